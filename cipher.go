@@ -0,0 +1,92 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/noiseutil"
+)
+
+const (
+	CipherAES        = "aes"
+	CipherChaChaPoly = "chachapoly"
+)
+
+// knownCiphers is every cipher we are able to use for a tunnel
+var knownCiphers = []string{CipherAES, CipherChaChaPoly}
+
+// NewCiphersFromConfig reads our cipher preference list. `cipher` may be a single cipher or a list, the first entry is
+// used for the noise handshake we send and is the cipher we would most like our tunnels to use.
+func NewCiphersFromConfig(c *config.C) ([]string, error) {
+	var ciphers []string
+	switch v := c.Get("cipher").(type) {
+	case nil:
+		ciphers = []string{CipherAES}
+	case string:
+		ciphers = []string{v}
+	default:
+		ciphers = c.GetStringSlice("cipher", nil)
+	}
+
+	if len(ciphers) == 0 {
+		return nil, fmt.Errorf("cipher must be a cipher name or a list of cipher names")
+	}
+
+	for i, name := range ciphers {
+		if !slices.Contains(knownCiphers, name) {
+			return nil, fmt.Errorf("unknown cipher: %v", name)
+		}
+
+		if slices.Contains(ciphers[:i], name) {
+			return nil, fmt.Errorf("cipher %v is listed more than once", name)
+		}
+	}
+
+	return ciphers, nil
+}
+
+// negotiateCipher picks the cipher a tunnel will use. The initiators preference wins, the first cipher it advertised
+// that we also accept is chosen. An empty string is returned if there is no cipher in common.
+func negotiateCipher(ours, theirs []string) string {
+	for _, name := range theirs {
+		if slices.Contains(ours, name) {
+			return name
+		}
+	}
+	return ""
+}
+
+func cipherFunc(name string) noise.CipherFunc {
+	if name == CipherChaChaPoly {
+		return noise.CipherChaChaPoly
+	}
+	return noiseutil.CipherAESGCM
+}
+
+// cipherEndianness returns the byte order used to write the message counter into the nonce for a cipher
+func cipherEndianness(name string) endianness {
+	if name == CipherChaChaPoly {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+// transportSuite returns a cipher suite for building transport keys with the named cipher. Only the cipher is ever used
+// from this suite, the dh and hash functions are never called.
+func transportSuite(name string) noise.CipherSuite {
+	return noise.NewCipherSuite(noise.DH25519, cipherFunc(name), noise.HashSHA256)
+}
+
+// transportKeys moves the keys noise arrived at over to the negotiated cipher. The noise handshake may have used a
+// different cipher than the tunnel will, every cipher we support uses the same 32 byte keys.
+func transportKeys(name string, states ...*noise.CipherState) []*noise.CipherState {
+	suite := transportSuite(name)
+	out := make([]*noise.CipherState, len(states))
+	for i, cs := range states {
+		out[i] = noise.UnsafeNewCipherState(suite, cs.UnsafeKey(), 0)
+	}
+	return out
+}
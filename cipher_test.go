@@ -0,0 +1,85 @@
+package nebula
+
+import (
+	"testing"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewCiphersFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	ciphers, err := NewCiphersFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"aes"}, ciphers)
+
+	c.Settings["cipher"] = "chachapoly"
+	ciphers, err = NewCiphersFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"chachapoly"}, ciphers)
+
+	c.Settings["cipher"] = []interface{}{"chachapoly", "aes"}
+	ciphers, err = NewCiphersFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"chachapoly", "aes"}, ciphers)
+
+	c.Settings["cipher"] = "des"
+	_, err = NewCiphersFromConfig(c)
+	assert.EqualError(t, err, "unknown cipher: des")
+
+	c.Settings["cipher"] = []interface{}{"aes", "aes"}
+	_, err = NewCiphersFromConfig(c)
+	assert.EqualError(t, err, "cipher aes is listed more than once")
+
+	c.Settings["cipher"] = []interface{}{}
+	_, err = NewCiphersFromConfig(c)
+	assert.EqualError(t, err, "cipher must be a cipher name or a list of cipher names")
+}
+
+func TestNegotiateCipher(t *testing.T) {
+	// The initiators preference wins
+	assert.Equal(t, "chachapoly", negotiateCipher([]string{"aes", "chachapoly"}, []string{"chachapoly", "aes"}))
+	assert.Equal(t, "aes", negotiateCipher([]string{"chachapoly", "aes"}, []string{"aes", "chachapoly"}))
+
+	// Ciphers we do not accept are skipped
+	assert.Equal(t, "aes", negotiateCipher([]string{"aes"}, []string{"chachapoly", "aes"}))
+
+	// Nothing in common
+	assert.Equal(t, "", negotiateCipher([]string{"aes"}, []string{"chachapoly"}))
+	assert.Equal(t, "", negotiateCipher([]string{"aes"}, []string{"unknown"}))
+}
+
+func TestTransportKeys(t *testing.T) {
+	k := [32]byte{1}
+	orig := noise.UnsafeNewCipherState(noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256), k, 0)
+
+	for _, name := range knownCiphers {
+		keys := transportKeys(name, orig)
+		require.Len(t, keys, 1)
+		assert.Equal(t, k, keys[0].UnsafeKey())
+
+		// The key is kept but the cipher changes
+		eKey := NewNebulaCipherState(keys[0], name)
+		dKey := NewNebulaCipherState(transportKeys(name, orig)[0], name)
+		nb := make([]byte, 12)
+		ct, err := eKey.EncryptDanger(nil, []byte("ad"), []byte("hi"), 5, nb)
+		require.NoError(t, err)
+		pt, err := dKey.DecryptDanger(nil, []byte("ad"), ct, 5, nb)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("hi"), pt)
+	}
+
+	// Different ciphers can not read each others traffic even with the same key
+	nb := make([]byte, 12)
+	aes := NewNebulaCipherState(transportKeys(CipherAES, orig)[0], CipherAES)
+	chacha := NewNebulaCipherState(transportKeys(CipherChaChaPoly, orig)[0], CipherChaChaPoly)
+	ct, err := aes.EncryptDanger(nil, nil, []byte("hi"), 5, nb)
+	require.NoError(t, err)
+	_, err = chacha.DecryptDanger(nil, nil, ct, 5, nb)
+	assert.Error(t, err)
+}
@@ -42,14 +42,16 @@ type connectionManager struct {
 	intf                    *Interface
 	pendingDeletion         map[uint32]struct{}
 	punchy                  *Punchy
+	rekey                   *Rekey
 	checkInterval           time.Duration
 	pendingDeletionInterval time.Duration
 	metricsTxPunchy         metrics.Counter
+	metricsDirectUpgrade    metrics.Counter
 
 	l *logrus.Logger
 }
 
-func newConnectionManager(ctx context.Context, l *logrus.Logger, intf *Interface, checkInterval, pendingDeletionInterval time.Duration, punchy *Punchy) *connectionManager {
+func newConnectionManager(ctx context.Context, l *logrus.Logger, intf *Interface, checkInterval, pendingDeletionInterval time.Duration, punchy *Punchy, rekey *Rekey) *connectionManager {
 	var max time.Duration
 	if checkInterval < pendingDeletionInterval {
 		max = pendingDeletionInterval
@@ -71,7 +73,9 @@ func newConnectionManager(ctx context.Context, l *logrus.Logger, intf *Interface
 		checkInterval:           checkInterval,
 		pendingDeletionInterval: pendingDeletionInterval,
 		punchy:                  punchy,
+		rekey:                   rekey,
 		metricsTxPunchy:         metrics.GetOrRegisterCounter("messages.tx.punchy", nil),
+		metricsDirectUpgrade:    metrics.GetOrRegisterCounter("relay.upgrade.attempts", nil),
 		l:                       l,
 	}
 
@@ -179,11 +183,24 @@ func (n *connectionManager) Run(ctx context.Context) {
 func (n *connectionManager) doTrafficCheck(localIndex uint32, p, nb, out []byte, now time.Time) {
 	decision, hostinfo, primary := n.makeTrafficDecision(localIndex, now)
 
+	// Move our relayed tunnels off of a relay that is going away or is no longer healthy
+	if hostinfo != nil && hostinfo.relayState.hasTerminalRelays() {
+		n.checkRelayFailover(hostinfo, decision)
+	}
+
+	if decision == tryRehandshake || decision == sendTestPacket {
+		// This is the primary tunnel and it is in use, if it is relayed see if we can go direct
+		n.tryDirectPath(hostinfo, nb, out, now)
+	}
+
 	switch decision {
 	case deleteTunnel:
 		if n.hostMap.DeleteHostInfo(hostinfo) {
 			// Only clearing the lighthouse cache if this is the last hostinfo for this vpn ip in the hostmap
 			n.intf.lightHouse.DeleteVpnIp(hostinfo.vpnIp)
+			if n.intf.routeLearner != nil {
+				n.intf.routeLearner.gatewayFailed(hostinfo.vpnIp)
+			}
 		}
 
 	case closeTunnel:
@@ -197,7 +214,7 @@ func (n *connectionManager) doTrafficCheck(localIndex uint32, p, nb, out []byte,
 		n.migrateRelayUsed(hostinfo, primary)
 
 	case tryRehandshake:
-		n.tryRehandshake(hostinfo)
+		n.tryRehandshake(hostinfo, now)
 
 	case sendTestPacket:
 		n.intf.SendMessageToHostInfo(header.Test, header.TestRequest, hostinfo, p, nb, out)
@@ -239,7 +256,7 @@ func (n *connectionManager) migrateRelayUsed(oldhostinfo, newhostinfo *HostInfo)
 				relayTo = existing.PeerIp
 			case ForwardingType:
 				relayFrom = existing.PeerIp
-				relayTo = newhostinfo.vpnIp
+				relayTo = existing.forwardFrom(newhostinfo.vpnIp)
 			default:
 				// should never happen
 			}
@@ -253,7 +270,7 @@ func (n *connectionManager) migrateRelayUsed(oldhostinfo, newhostinfo *HostInfo)
 			n.relayUsedLock.RUnlock()
 			// The relay doesn't exist at all; create some relay state and send the request.
 			var err error
-			index, err = AddRelay(n.l, newhostinfo, n.hostMap, r.PeerIp, nil, r.Type, Requested)
+			index, err = addChainedRelay(n.l, newhostinfo, n.hostMap, r.PeerIp, r.ViaIp, r.FromIp, nil, r.Type, Requested)
 			if err != nil {
 				n.l.WithError(err).Error("failed to migrate relay to new hostinfo")
 				continue
@@ -264,7 +281,7 @@ func (n *connectionManager) migrateRelayUsed(oldhostinfo, newhostinfo *HostInfo)
 				relayTo = r.PeerIp
 			case ForwardingType:
 				relayFrom = r.PeerIp
-				relayTo = newhostinfo.vpnIp
+				relayTo = r.forwardFrom(newhostinfo.vpnIp)
 			default:
 				// should never happen
 			}
@@ -280,6 +297,12 @@ func (n *connectionManager) migrateRelayUsed(oldhostinfo, newhostinfo *HostInfo)
 			InitiatorRelayIndex: index,
 			RelayFromIp:         binary.BigEndian.Uint32(relayFromB[:]),
 			RelayToIp:           binary.BigEndian.Uint32(relayToB[:]),
+			HopLimit:            uint32(n.intf.relayManager.GetMaxHops()),
+		}
+		if r.Type == ForwardingType && relayTo != newhostinfo.vpnIp {
+			// newhostinfo is the next relay in a chain, we are the relay before it
+			myVpnIpB := n.intf.myVpnNet.Addr().As4()
+			req.RelayPath = []uint32{binary.BigEndian.Uint32(myVpnIpB[:])}
 		}
 		msg, err := req.Marshal()
 		if err != nil {
@@ -297,6 +320,90 @@ func (n *connectionManager) migrateRelayUsed(oldhostinfo, newhostinfo *HostInfo)
 	}
 }
 
+// checkRelayFailover moves the relayed tunnels using relayHostInfo when it is going away. A degraded relay has its
+// tunnels moved once, they are left alone until it has been healthy again so they don't bounce between relays.
+func (n *connectionManager) checkRelayFailover(relayHostInfo *HostInfo, decision trafficDecision) {
+	if decision == deleteTunnel || decision == closeTunnel {
+		n.failoverRelays(relayHostInfo)
+		return
+	}
+
+	if !n.intf.relayManager.health.IsDegraded(relayHostInfo.vpnIp) {
+		relayHostInfo.relaysMoved = false
+		return
+	}
+
+	if !relayHostInfo.relaysMoved {
+		relayHostInfo.relaysMoved = n.failoverRelays(relayHostInfo)
+	}
+}
+
+// failoverRelays migrates the relays we are using through relayHostInfo to the healthiest alternative relay, it
+// returns false if there was no relay to move to yet
+func (n *connectionManager) failoverRelays(relayHostInfo *HostInfo) bool {
+	rm := n.intf.relayManager
+	if rm.GetAmRelay() {
+		// Relays don't use other relays
+		return false
+	}
+
+	relayFor := relayHostInfo.relayState.CopyAllRelayFor()
+	skip := map[netip.Addr]struct{}{
+		relayHostInfo.vpnIp:    {},
+		n.intf.myVpnNet.Addr(): {},
+	}
+	for _, r := range relayFor {
+		skip[r.PeerIp] = struct{}{}
+	}
+
+	// Consider our own relays and any relay the peers we reach through this relay told the lighthouse about
+	var candidates []netip.Addr
+	add := func(vpnIp netip.Addr) {
+		if _, ok := skip[vpnIp]; ok {
+			return
+		}
+		skip[vpnIp] = struct{}{}
+		candidates = append(candidates, vpnIp)
+	}
+
+	for _, r := range relayFor {
+		if r.Type != TerminalType {
+			continue
+		}
+
+		peer := n.hostMap.QueryVpnIp(r.PeerIp)
+		if peer != nil && peer.remotes != nil {
+			for _, vpnIp := range peer.remotes.CopyRelays() {
+				add(vpnIp)
+			}
+		}
+	}
+
+	for _, vpnIp := range n.intf.lightHouse.GetRelaysForMe() {
+		add(vpnIp)
+	}
+
+	for _, vpnIp := range rm.health.Rank(candidates) {
+		if rm.health.IsDegraded(vpnIp) {
+			continue
+		}
+
+		newRelayHostInfo := n.hostMap.QueryVpnIp(vpnIp)
+		if newRelayHostInfo == nil || !newRelayHostInfo.remote.IsValid() {
+			// Get a tunnel up so this relay can be considered on a later check
+			n.intf.Handshake(vpnIp)
+			continue
+		}
+
+		relayHostInfo.logger(n.l).WithField("newRelay", vpnIp).
+			Info("Moving relayed tunnels to a healthier relay")
+		n.migrateRelayUsed(relayHostInfo, newRelayHostInfo)
+		return true
+	}
+
+	return false
+}
+
 func (n *connectionManager) makeTrafficDecision(localIndex uint32, now time.Time) (trafficDecision, *HostInfo, *HostInfo) {
 	n.hostMap.RLock()
 	defer n.hostMap.RUnlock()
@@ -472,14 +579,51 @@ func (n *connectionManager) sendPunch(hostinfo *HostInfo) {
 	}
 }
 
-func (n *connectionManager) tryRehandshake(hostinfo *HostInfo) {
+// tryDirectPath attempts to move a relayed tunnel to a direct path. The lighthouse is queried for fresh addresses,
+// which also asks the remote to punch towards us, and a test packet is sent to every address we know of.
+// The first address to answer becomes the remote in handleHostRoaming, without a new handshake.
+func (n *connectionManager) tryDirectPath(hostinfo *HostInfo, nb, out []byte, now time.Time) {
+	interval := n.punchy.GetRelayedUpgradeInterval()
+	if interval <= 0 || hostinfo.remote.IsValid() || hostinfo.remotes == nil || hostinfo.ConnectionState == nil {
+		return
+	}
+
+	if now.UnixNano() < hostinfo.nextDirectProbe.Load() {
+		return
+	}
+	hostinfo.nextDirectProbe.Store(now.Add(interval).UnixNano())
+
+	if n.l.Level >= logrus.DebugLevel {
+		hostinfo.logger(n.l).Debug("Trying to find a direct path for relayed tunnel")
+	}
+
+	n.metricsDirectUpgrade.Inc(1)
+	if n.intf.lightHouse != nil {
+		n.intf.lightHouse.QueryServer(hostinfo.vpnIp)
+	}
+
+	hostinfo.remotes.ForEach(n.hostMap.GetPreferredRanges(), func(addr netip.AddrPort, preferred bool) {
+		if n.punchy.GetPunch() {
+			n.metricsTxPunchy.Inc(1)
+			n.intf.outside.WriteTo([]byte{1}, addr)
+		}
+		n.intf.sendTo(header.Test, header.TestRequest, hostinfo.ConnectionState, hostinfo, addr, []byte(""), nb, out)
+	})
+}
+
+func (n *connectionManager) tryRehandshake(hostinfo *HostInfo, now time.Time) {
+	reason := "local certificate is not current"
 	certState := n.intf.pki.GetCertState()
 	if bytes.Equal(hostinfo.ConnectionState.myCert.Signature(), certState.Certificate.Signature()) {
-		return
+		// Our certificate is current, make sure the session keys have not been used for too long
+		reason = n.rekey.reason(hostinfo.ConnectionState, now)
+		if reason == "" {
+			return
+		}
 	}
 
 	n.l.WithField("vpnIp", hostinfo.vpnIp).
-		WithField("reason", "local certificate is not current").
+		WithField("reason", reason).
 		Info("Re-handshaking with remote")
 
 	n.intf.handshakeManager.StartHandshake(hostinfo.vpnIp, nil)
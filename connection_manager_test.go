@@ -14,6 +14,7 @@ import (
 	"github.com/slackhq/nebula/test"
 	"github.com/slackhq/nebula/udp"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func newTestLighthouse() *LightHouse {
@@ -67,7 +68,7 @@ func Test_NewConnectionManagerTest(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	punchy := NewPunchyFromConfig(l, config.NewC(l))
-	nc := newConnectionManager(ctx, l, ifce, 5, 10, punchy)
+	nc := newConnectionManager(ctx, l, ifce, 5, 10, punchy, NewRekeyFromConfig(l, config.NewC(l)))
 	p := []byte("")
 	nb := make([]byte, 12, 12)
 	out := make([]byte, mtu)
@@ -150,7 +151,7 @@ func Test_NewConnectionManagerTest2(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	punchy := NewPunchyFromConfig(l, config.NewC(l))
-	nc := newConnectionManager(ctx, l, ifce, 5, 10, punchy)
+	nc := newConnectionManager(ctx, l, ifce, 5, 10, punchy, NewRekeyFromConfig(l, config.NewC(l)))
 	p := []byte("")
 	nb := make([]byte, 12, 12)
 	out := make([]byte, mtu)
@@ -269,7 +270,7 @@ func Test_NewConnectionManagerTest_DisconnectInvalid(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	punchy := NewPunchyFromConfig(l, config.NewC(l))
-	nc := newConnectionManager(ctx, l, ifce, 5, 10, punchy)
+	nc := newConnectionManager(ctx, l, ifce, 5, 10, punchy, NewRekeyFromConfig(l, config.NewC(l)))
 	ifce.connectionManager = nc
 
 	hostinfo := &HostInfo{
@@ -297,6 +298,58 @@ func Test_NewConnectionManagerTest_DisconnectInvalid(t *testing.T) {
 	assert.True(t, invalid)
 }
 
+func Test_NewConnectionManagerTest_TryDirectPath(t *testing.T) {
+	l := test.NewLogger()
+	vpncidr := netip.MustParsePrefix("172.1.1.1/24")
+	vpnIp := netip.MustParseAddr("172.1.1.2")
+	preferredRanges := []netip.Prefix{netip.MustParsePrefix("10.1.1.1/24")}
+
+	hostMap := newHostMap(l, vpncidr)
+	hostMap.preferredRanges.Store(&preferredRanges)
+	lh := newTestLighthouse()
+	ifce := &Interface{
+		hostMap:    hostMap,
+		inside:     &test.NoopTun{},
+		outside:    &udp.NoopConn{},
+		lightHouse: lh,
+		l:          l,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	punchy := NewPunchyFromConfig(l, config.NewC(l))
+	nc := newConnectionManager(ctx, l, ifce, 5, 10, punchy, NewRekeyFromConfig(l, config.NewC(l)))
+	nb := make([]byte, 12, 12)
+	out := make([]byte, mtu)
+
+	// A relayed tunnel has no remote
+	hostinfo := &HostInfo{
+		vpnIp:           vpnIp,
+		localIndexId:    1099,
+		remoteIndexId:   9901,
+		remotes:         NewRemoteList(nil),
+		ConnectionState: &ConnectionState{myCert: &dummyCert{}, H: &noise.HandshakeState{}},
+	}
+
+	now := time.Now()
+	nc.tryDirectPath(hostinfo, nb, out, now)
+	assert.Len(t, lh.queryChan, 1)
+	assert.Equal(t, vpnIp, <-lh.queryChan)
+
+	// Nothing should happen again until the interval has passed
+	nc.tryDirectPath(hostinfo, nb, out, now.Add(punchy.GetRelayedUpgradeInterval()-time.Second))
+	assert.Len(t, lh.queryChan, 0)
+
+	nc.tryDirectPath(hostinfo, nb, out, now.Add(punchy.GetRelayedUpgradeInterval()))
+	assert.Len(t, lh.queryChan, 1)
+	<-lh.queryChan
+
+	// Direct tunnels are left alone
+	hostinfo.remote = netip.MustParseAddrPort("10.1.1.2:4242")
+	nc.tryDirectPath(hostinfo, nb, out, now.Add(time.Hour))
+	assert.Len(t, lh.queryChan, 0)
+}
+
 type dummyCert struct {
 	version        cert.Version
 	curve          cert.Curve
@@ -407,3 +460,82 @@ func (d *dummyCert) MarshalJSON() ([]byte, error) {
 func (d *dummyCert) Copy() cert.Certificate {
 	return d
 }
+
+func Test_NewConnectionManagerTest_RelayFailover(t *testing.T) {
+	l := test.NewLogger()
+	vpncidr := netip.MustParsePrefix("172.1.1.1/24")
+	peer := netip.MustParseAddr("172.1.1.2")
+	relay1 := netip.MustParseAddr("172.1.1.3")
+	relay2 := netip.MustParseAddr("172.1.1.4")
+	relay3 := netip.MustParseAddr("172.1.1.5")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hostMap := newHostMap(l, vpncidr)
+	rm, err := NewRelayManager(ctx, l, hostMap, config.NewC(l))
+	require.NoError(t, err)
+	lh := newTestLighthouse()
+	lh.relaysForMe.Store(&[]netip.Addr{relay2, relay3})
+	ifce := &Interface{
+		hostMap:      hostMap,
+		inside:       &test.NoopTun{},
+		outside:      &udp.NoopConn{},
+		lightHouse:   lh,
+		relayManager: rm,
+		myVpnNet:     vpncidr,
+		l:            l,
+	}
+	nc := newConnectionManager(ctx, l, ifce, 5, 10, NewPunchyFromConfig(l, config.NewC(l)), NewRekeyFromConfig(l, config.NewC(l)))
+
+	addRelay := func(vpnIp netip.Addr, localIndex uint32) *HostInfo {
+		hostinfo := &HostInfo{
+			vpnIp:           vpnIp,
+			localIndexId:    localIndex,
+			remote:          netip.MustParseAddrPort("10.1.1.1:4242"),
+			ConnectionState: &ConnectionState{},
+			relayState: RelayState{
+				relays:        map[netip.Addr]struct{}{},
+				relayForByIp:  map[netip.Addr]*Relay{},
+				relayForByIdx: map[uint32]*Relay{},
+			},
+		}
+		hostMap.unlockedAddHostInfo(hostinfo, ifce)
+		return hostinfo
+	}
+	r1 := addRelay(relay1, 1)
+	r2 := addRelay(relay2, 2)
+	r3 := addRelay(relay3, 3)
+	r1.relayState.InsertRelay(peer, 100, &Relay{Type: TerminalType, State: Established, LocalIndex: 100, PeerIp: peer})
+	nc.RelayUsed(100)
+
+	degrade := func(relays ...*HostInfo) {
+		for range relayMinProbes + 1 {
+			rm.health.probe(time.Now(), relays, func(*HostInfo, []byte) {})
+		}
+	}
+
+	// A healthy relay is left alone
+	nc.checkRelayFailover(r1, doNothing)
+	assert.Empty(t, r2.relayState.CopyAllRelayFor())
+
+	// The tunnels move off of a degraded relay once
+	degrade(r1)
+	nc.checkRelayFailover(r1, doNothing)
+	assert.True(t, r1.relaysMoved)
+	_, ok := r2.relayState.QueryRelayForByIp(peer)
+	assert.True(t, ok)
+
+	// They stay put even if the relay they moved to looks worse later
+	degrade(r1, r2)
+	nc.checkRelayFailover(r1, doNothing)
+	assert.Empty(t, r3.relayState.CopyAllRelayFor())
+
+	// A relay that recovers and degrades again gets its tunnels moved again
+	rm.health = newRelayHealth(l)
+	nc.checkRelayFailover(r1, doNothing)
+	assert.False(t, r1.relaysMoved)
+	degrade(r1, r2)
+	nc.checkRelayFailover(r1, doNothing)
+	_, ok = r3.relayState.QueryRelayForByIp(peer)
+	assert.True(t, ok)
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/flynn/noise"
 	"github.com/sirupsen/logrus"
@@ -22,8 +23,17 @@ type ConnectionState struct {
 	peerCert       *cert.CachedCertificate
 	initiator      bool
 	messageCounter atomic.Uint64
-	window         *Bits
-	writeLock      sync.Mutex
+	// bytesSent counts the bytes we have encrypted with eKey, used by rekey.max_bytes
+	bytesSent atomic.Uint64
+	window    *Bits
+	writeLock sync.Mutex
+	created   time.Time
+	// cipher is used for the noise handshake until the tunnel cipher has been negotiated
+	cipher string
+	// postQuantum is true if an ML-KEM shared secret was mixed into our keys
+	postQuantum bool
+	// multiport is set when both ends agreed to spread packets across their multiport listeners
+	multiport *multiportPeer
 }
 
 func NewConnectionState(l *logrus.Logger, cipher string, certState *CertState, initiator bool, pattern noise.HandshakePattern, psk []byte, pskStage int) *ConnectionState {
@@ -42,12 +52,7 @@ func NewConnectionState(l *logrus.Logger, cipher string, certState *CertState, i
 		return nil
 	}
 
-	var cs noise.CipherSuite
-	if cipher == "chachapoly" {
-		cs = noise.NewCipherSuite(dhFunc, noise.CipherChaChaPoly, noise.HashSHA256)
-	} else {
-		cs = noise.NewCipherSuite(dhFunc, noiseutil.CipherAESGCM, noise.HashSHA256)
-	}
+	cs := noise.NewCipherSuite(dhFunc, cipherFunc(cipher), noise.HashSHA256)
 
 	static := noise.DHKey{Private: certState.PrivateKey, Public: certState.PublicKey}
 
@@ -75,6 +80,8 @@ func NewConnectionState(l *logrus.Logger, cipher string, certState *CertState, i
 		initiator: initiator,
 		window:    b,
 		myCert:    certState.Certificate,
+		created:   time.Now(),
+		cipher:    cipher,
 	}
 	// always start the counter from 2, as packet 1 and packet 2 are handshake packets.
 	ci.messageCounter.Add(2)
@@ -85,7 +92,9 @@ func NewConnectionState(l *logrus.Logger, cipher string, certState *CertState, i
 func (cs *ConnectionState) MarshalJSON() ([]byte, error) {
 	return json.Marshal(m{
 		"certificate":     cs.peerCert,
+		"cipher":          cs.cipher,
 		"initiator":       cs.initiator,
 		"message_counter": cs.messageCounter.Load(),
+		"post_quantum":    cs.postQuantum,
 	})
 }
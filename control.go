@@ -46,6 +46,8 @@ type ControlHostInfo struct {
 	CurrentRemote          netip.AddrPort   `json:"currentRemote"`
 	CurrentRelaysToMe      []netip.Addr     `json:"currentRelaysToMe"`
 	CurrentRelaysThroughMe []netip.Addr     `json:"currentRelaysThroughMe"`
+	PostQuantum            bool             `json:"postQuantum"`
+	Cipher                 string           `json:"cipher"`
 }
 
 // Start actually runs nebula, this is a nonblocking call. To block use Control.ShutdownBlock()
@@ -287,6 +289,8 @@ func copyHostInfo(h *HostInfo, preferredRanges []netip.Prefix) ControlHostInfo {
 
 	if h.ConnectionState != nil {
 		chi.MessageCounter = h.ConnectionState.messageCounter.Load()
+		chi.PostQuantum = h.ConnectionState.postQuantum
+		chi.Cipher = h.ConnectionState.cipher
 	}
 
 	if c := h.GetCert(); c != nil {
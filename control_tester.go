@@ -20,7 +20,7 @@ import (
 func (c *Control) WaitForType(msgType header.MessageType, subType header.MessageSubType, pipeTo *Control) {
 	h := &header.H{}
 	for {
-		p := c.f.outside.(*udp.TesterConn).Get(true)
+		p := udp.Unwrap(c.f.outside).(*udp.TesterConn).Get(true)
 		if err := h.Parse(p.Data); err != nil {
 			panic(err)
 		}
@@ -36,7 +36,7 @@ func (c *Control) WaitForType(msgType header.MessageType, subType header.Message
 func (c *Control) WaitForTypeByIndex(toIndex uint32, msgType header.MessageType, subType header.MessageSubType, pipeTo *Control) {
 	h := &header.H{}
 	for {
-		p := c.f.outside.(*udp.TesterConn).Get(true)
+		p := udp.Unwrap(c.f.outside).(*udp.TesterConn).Get(true)
 		if err := h.Parse(p.Data); err != nil {
 			panic(err)
 		}
@@ -82,11 +82,11 @@ func (c *Control) GetFromTun(block bool) []byte {
 
 // GetFromUDP will pull a udp packet off the udp side of nebula
 func (c *Control) GetFromUDP(block bool) *udp.Packet {
-	return c.f.outside.(*udp.TesterConn).Get(block)
+	return udp.Unwrap(c.f.outside).(*udp.TesterConn).Get(block)
 }
 
 func (c *Control) GetUDPTxChan() <-chan *udp.Packet {
-	return c.f.outside.(*udp.TesterConn).TxPackets
+	return udp.Unwrap(c.f.outside).(*udp.TesterConn).TxPackets
 }
 
 func (c *Control) GetTunTxChan() <-chan []byte {
@@ -95,7 +95,7 @@ func (c *Control) GetTunTxChan() <-chan []byte {
 
 // InjectUDPPacket will inject a packet into the udp side of nebula
 func (c *Control) InjectUDPPacket(p *udp.Packet) {
-	c.f.outside.(*udp.TesterConn).Send(p)
+	udp.Unwrap(c.f.outside).(*udp.TesterConn).Send(p)
 }
 
 // InjectTunUDPPacket puts a udp packet on the tun interface. Using UDP here because it's a simpler protocol
@@ -131,12 +131,35 @@ func (c *Control) InjectTunUDPPacket(toIp netip.Addr, toPort uint16, fromPort ui
 	c.f.inside.(*overlay.TestTun).Send(buffer.Bytes())
 }
 
+// InjectTunFrame puts an ethernet frame on the device, it is only understood in tap mode
+func (c *Control) InjectTunFrame(frame []byte) {
+	c.f.inside.(*overlay.TestTun).Send(frame)
+}
+
 func (c *Control) GetVpnIp() netip.Addr {
 	return c.f.myVpnNet.Addr()
 }
 
 func (c *Control) GetUDPAddr() netip.AddrPort {
-	return c.f.outside.(*udp.TesterConn).Addr
+	return udp.Unwrap(c.f.outside).(*udp.TesterConn).Addr
+}
+
+// GetTCPAddr returns the address the tcp transport accepts streams on, it is invalid if there is none
+func (c *Control) GetTCPAddr() netip.AddrPort {
+	if c.f.tcp == nil {
+		return netip.AddrPort{}
+	}
+	addr, _ := c.f.tcp.LocalAddr()
+	return addr
+}
+
+// GetWebSocketAddr returns the address the websocket transport accepts streams on, it is invalid if there is none
+func (c *Control) GetWebSocketAddr() netip.AddrPort {
+	if c.f.websocket == nil {
+		return netip.AddrPort{}
+	}
+	addr, _ := c.f.websocket.LocalAddr()
+	return addr
 }
 
 func (c *Control) KillPendingTunnel(vpnIp netip.Addr) bool {
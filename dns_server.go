@@ -7,6 +7,8 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
@@ -15,27 +17,89 @@ import (
 
 // This whole thing should be rewritten to use context
 
-var dnsR *dnsRecords
 var dnsServer *dns.Server
 var dnsAddr string
 
+const (
+	defaultDnsQueryTimeout = 500 * time.Millisecond
+
+	// dnsLighthouseQueryRate is how many names a second, and in a burst, we ask the lighthouses about
+	dnsLighthouseQueryRate = 10
+)
+
 type dnsRecords struct {
 	sync.RWMutex
 	dnsMap  map[string]string
 	hostMap *HostMap
+
+	// lh is used to ask the lighthouses about names we have not seen a certificate for yet
+	lh           *LightHouse
+	pending      map[string]chan struct{}
+	queryTimeout atomic.Int64
+	// expires holds when a name a lighthouse told us about is asked about again, names we saw a certificate for are
+	// not in here and never expire
+	expires map[string]time.Time
+	// unknown holds when a name no lighthouse knew about may be asked about again
+	unknown map[string]time.Time
+	// queries limits the names we ask the lighthouses about across all names
+	queries *tokenBucket
+	// myName is the name in our certificate, its domain is the default lighthouse.dns.suffix
+	myName string
+	// suffix is the domain a name must be in for the lighthouses to be asked about it, empty allows only bare names
+	suffix atomic.Pointer[string]
 }
 
 func newDnsRecords(hostMap *HostMap) *dnsRecords {
 	return &dnsRecords{
 		dnsMap:  make(map[string]string),
 		hostMap: hostMap,
+		pending: make(map[string]chan struct{}),
+		expires: make(map[string]time.Time),
+		unknown: make(map[string]time.Time),
+		queries: newTokenBucket(dnsLighthouseQueryRate, dnsLighthouseQueryRate, time.Now()),
+	}
+}
+
+func newDnsRecordsFromConfig(c *config.C, hostMap *HostMap, lh *LightHouse, myName string) *dnsRecords {
+	d := newDnsRecords(hostMap)
+	d.lh = lh
+	d.myName = myName
+	d.reload(c)
+	c.RegisterReloadCallback(d.reload)
+	return d
+}
+
+func (d *dnsRecords) reload(c *config.C) {
+	d.queryTimeout.Store(int64(c.GetDuration("lighthouse.dns.query_timeout", defaultDnsQueryTimeout)))
+
+	suffix := c.GetString("lighthouse.dns.suffix", "")
+	if suffix == "" {
+		if _, domain, ok := strings.Cut(d.myName, "."); ok {
+			suffix = domain
+		}
+	}
+	suffix = strings.Trim(strings.ToLower(suffix), ".")
+	d.suffix.Store(&suffix)
+}
+
+// inSuffix returns true if host is a name the lighthouses may be asked about
+func (d *dnsRecords) inSuffix(host string) bool {
+	name := strings.TrimSuffix(host, ".")
+	suffix := *d.suffix.Load()
+	if suffix == "" {
+		return name != "" && !strings.Contains(name, ".")
 	}
+	return strings.HasSuffix(name, "."+suffix)
 }
 
 func (d *dnsRecords) Query(data string) string {
 	d.RLock()
 	defer d.RUnlock()
-	if r, ok := d.dnsMap[strings.ToLower(data)]; ok {
+	data = strings.ToLower(data)
+	if e, ok := d.expires[data]; ok && !time.Now().Before(e) {
+		return ""
+	}
+	if r, ok := d.dnsMap[data]; ok {
 		return r
 	}
 	return ""
@@ -67,15 +131,125 @@ func (d *dnsRecords) QueryCert(data string) string {
 func (d *dnsRecords) Add(host, data string) {
 	d.Lock()
 	defer d.Unlock()
-	d.dnsMap[strings.ToLower(host)] = data
+	host = strings.ToLower(host)
+	d.dnsMap[host] = data
+	delete(d.expires, host)
+}
+
+// QueryLighthouses asks the lighthouses for a name we have no local record of and waits up to
+// lighthouse.dns.query_timeout for an answer. Concurrent lookups for the same name share a single query. Only names
+// within lighthouse.dns.suffix are asked about, names no lighthouse knew are not asked about again for a
+// lighthouse.interval and at most dnsLighthouseQueryRate names a second are asked about in total.
+func (d *dnsRecords) QueryLighthouses(host string) string {
+	timeout := time.Duration(d.queryTimeout.Load())
+	if d.lh == nil || d.lh.amLighthouse || timeout <= 0 {
+		return ""
+	}
+
+	host = strings.ToLower(host)
+	if !d.inSuffix(host) {
+		return ""
+	}
+
+	now := time.Now()
+	d.Lock()
+	if e, ok := d.unknown[host]; ok && now.Before(e) {
+		d.Unlock()
+		return ""
+	}
+
+	ch, ok := d.pending[host]
+	if !ok {
+		if !d.queries.allow(now, 1) {
+			d.Unlock()
+			return ""
+		}
+		ch = make(chan struct{})
+		d.pending[host] = ch
+	}
+	d.Unlock()
+
+	if !ok {
+		d.lh.QueryName(host)
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case <-ch:
+	case <-t.C:
+		// Allow the next lookup to ask again
+		d.Lock()
+		if d.pending[host] == ch {
+			delete(d.pending, host)
+		}
+		d.Unlock()
+	}
+
+	return d.Query(host)
+}
+
+// resolved records the answer a lighthouse gave us for host, an invalid addr means the lighthouse did not know it.
+// Anyone waiting on the name is released either way. The answer is kept for one lighthouse.interval, the lighthouse may
+// have learned about a new certificate for the name by then, a name no lighthouse knew is not asked about for as long.
+// Expired answers are dropped here as well.
+func (d *dnsRecords) resolved(host string, addr netip.Addr) {
+	host = strings.ToLower(host)
+	now := time.Now()
+	d.Lock()
+	defer d.Unlock()
+
+	for h, e := range d.expires {
+		if !now.Before(e) {
+			delete(d.dnsMap, h)
+			delete(d.expires, h)
+		}
+	}
+	for h, e := range d.unknown {
+		if !now.Before(e) {
+			delete(d.unknown, h)
+		}
+	}
+
+	_, known := d.dnsMap[host]
+	_, learned := d.expires[host]
+	if addr.IsValid() {
+		delete(d.unknown, host)
+		if !known || learned {
+			d.dnsMap[host] = addr.String()
+			d.expires[host] = now.Add(d.answerTTL())
+		}
+	} else if !known || learned {
+		delete(d.dnsMap, host)
+		delete(d.expires, host)
+		d.unknown[host] = now.Add(d.answerTTL())
+	}
+
+	if ch, ok := d.pending[host]; ok {
+		close(ch)
+		delete(d.pending, host)
+	}
 }
 
-func parseQuery(l *logrus.Logger, m *dns.Msg, w dns.ResponseWriter) {
+// answerTTL is how long an answer from the lighthouses is used, lighthouse.interval or its default when updates are off
+func (d *dnsRecords) answerTTL() time.Duration {
+	interval := d.lh.GetUpdateInterval()
+	if interval <= 0 {
+		interval = 10
+	}
+	return time.Duration(interval) * time.Second
+}
+
+func (d *dnsRecords) parseQuery(l *logrus.Logger, m *dns.Msg, w dns.ResponseWriter) {
 	for _, q := range m.Question {
 		switch q.Qtype {
 		case dns.TypeA:
 			l.Debugf("Query for A %s", q.Name)
-			ip := dnsR.Query(q.Name)
+			ip := d.Query(q.Name)
+			if ip == "" {
+				ip = d.QueryLighthouses(q.Name)
+			}
 			if ip != "" {
 				rr, err := dns.NewRR(fmt.Sprintf("%s A %s", q.Name, ip))
 				if err == nil {
@@ -90,12 +264,12 @@ func parseQuery(l *logrus.Logger, m *dns.Msg, w dns.ResponseWriter) {
 			}
 
 			// We don't answer these queries from non nebula nodes or localhost
-			//l.Debugf("Does %s contain %s", b, dnsR.hostMap.vpnCIDR)
-			if !dnsR.hostMap.vpnCIDR.Contains(b) && a != "127.0.0.1" {
+			//l.Debugf("Does %s contain %s", b, d.hostMap.vpnCIDR)
+			if !d.hostMap.vpnCIDR.Contains(b) && a != "127.0.0.1" {
 				return
 			}
 			l.Debugf("Query for TXT %s", q.Name)
-			ip := dnsR.QueryCert(q.Name)
+			ip := d.QueryCert(q.Name)
 			if ip != "" {
 				rr, err := dns.NewRR(fmt.Sprintf("%s TXT %s", q.Name, ip))
 				if err == nil {
@@ -110,25 +284,23 @@ func parseQuery(l *logrus.Logger, m *dns.Msg, w dns.ResponseWriter) {
 	}
 }
 
-func handleDnsRequest(l *logrus.Logger, w dns.ResponseWriter, r *dns.Msg) {
+func (d *dnsRecords) handleDnsRequest(l *logrus.Logger, w dns.ResponseWriter, r *dns.Msg) {
 	m := new(dns.Msg)
 	m.SetReply(r)
 	m.Compress = false
 
 	switch r.Opcode {
 	case dns.OpcodeQuery:
-		parseQuery(l, m, w)
+		d.parseQuery(l, m, w)
 	}
 
 	w.WriteMsg(m)
 }
 
-func dnsMain(l *logrus.Logger, hostMap *HostMap, c *config.C) func() {
-	dnsR = newDnsRecords(hostMap)
-
+func dnsMain(l *logrus.Logger, d *dnsRecords, c *config.C) func() {
 	// attach request handler func
 	dns.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
-		handleDnsRequest(l, w, r)
+		d.handleDnsRequest(l, w, r)
 	})
 
 	c.RegisterReloadCallback(func(c *config.C) {
@@ -1,10 +1,15 @@
 package nebula
 
 import (
+	"context"
+	"net/netip"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -56,3 +61,128 @@ func Test_getDnsServerAddr(t *testing.T) {
 	}
 	assert.Equal(t, "[::]:1", getDnsServerAddr(c))
 }
+
+func TestDnsRecords_QueryLighthouses(t *testing.T) {
+	l := test.NewLogger()
+	myVpnNet := netip.MustParsePrefix("10.128.0.1/24")
+
+	lc := config.NewC(l)
+	lc.Settings["lighthouse"] = map[interface{}]interface{}{"am_lighthouse": true}
+	lc.Settings["listen"] = map[interface{}]interface{}{"port": 4242}
+	lighthouse, err := NewLightHouseFromConfig(context.Background(), l, lc, myVpnNet, nil, nil)
+	assert.NoError(t, err)
+	lighthouse.dnsRecords = newDnsRecordsFromConfig(lc, &HostMap{}, lighthouse, "lighthouse.host")
+	lighthouse.dnsRecords.Add("known.host.", "10.128.0.5")
+
+	cc := config.NewC(l)
+	cc.Settings["lighthouse"] = map[interface{}]interface{}{"hosts": []interface{}{"10.128.0.1"}}
+	cc.Settings["static_host_map"] = map[interface{}]interface{}{"10.128.0.1": []interface{}{"1.1.1.1:4242"}}
+	cc.Settings["listen"] = map[interface{}]interface{}{"port": 4242}
+	client, err := NewLightHouseFromConfig(context.Background(), l, cc, netip.MustParsePrefix("10.128.0.2/24"), nil, nil)
+	assert.NoError(t, err)
+	d := newDnsRecordsFromConfig(cc, &HostMap{}, client, "client.host")
+	client.dnsRecords = d
+
+	w := &testDnsLoopWriter{
+		client:     client.NewRequestHandler(),
+		lighthouse: lighthouse.NewRequestHandler(),
+		clientIp:   netip.MustParseAddr("10.128.0.2"),
+	}
+	client.ifce = w
+
+	// The lighthouse knows this name, the answer should be cached
+	assert.Equal(t, "10.128.0.5", d.QueryLighthouses("Known.Host."))
+	assert.Equal(t, 1, w.queries)
+	assert.Equal(t, "10.128.0.5", d.Query("known.host."))
+	assert.Empty(t, d.pending)
+
+	// An unknown name should return nothing without waiting out the timeout, it is not asked about again for a while
+	assert.Equal(t, "", d.QueryLighthouses("unknown.host."))
+	assert.Equal(t, 2, w.queries)
+	assert.Empty(t, d.pending)
+	assert.Equal(t, "", d.QueryLighthouses("unknown.host."))
+	assert.Equal(t, 2, w.queries)
+
+	// Names outside of our own domain are never asked about
+	assert.Equal(t, "", d.QueryLighthouses("known.host.example.com."))
+	assert.Equal(t, "", d.QueryLighthouses("host."))
+	assert.Equal(t, 2, w.queries)
+
+	// Lighthouses don't query themselves
+	assert.Equal(t, "", lighthouse.dnsRecords.QueryLighthouses("unknown.host."))
+	assert.Equal(t, 2, w.queries)
+
+	// Answers are kept for one lighthouse interval, after that the lighthouses are asked again
+	assert.WithinDuration(t, time.Now().Add(10*time.Second), d.expires["known.host."], time.Second)
+	d.expires["known.host."] = time.Now().Add(-time.Second)
+	assert.Equal(t, "", d.Query("known.host."))
+	assert.Equal(t, "10.128.0.5", d.QueryLighthouses("known.host."))
+	assert.Equal(t, 3, w.queries)
+
+	// A name the lighthouse forgot about is dropped
+	lighthouse.dnsRecords.Lock()
+	delete(lighthouse.dnsRecords.dnsMap, "known.host.")
+	lighthouse.dnsRecords.Unlock()
+	d.expires["known.host."] = time.Now().Add(-time.Second)
+	assert.Equal(t, "", d.QueryLighthouses("known.host."))
+	assert.NotContains(t, d.dnsMap, "known.host.")
+	assert.Empty(t, d.expires)
+	assert.Contains(t, d.unknown, "known.host.")
+
+	// Names we saw a certificate for never expire and are not replaced by lighthouse answers
+	d.Add("local.host.", "10.128.0.6")
+	lighthouse.dnsRecords.Add("local.host.", "10.128.0.7")
+	d.resolved("local.host.", netip.MustParseAddr("10.128.0.7"))
+	assert.Equal(t, "10.128.0.6", d.Query("local.host."))
+	assert.Empty(t, d.expires)
+
+	// Only so many names are asked about, however many different ones there are
+	queries := w.queries
+	d.queries = newTokenBucket(1, 2, time.Now())
+	for _, name := range []string{"a.host.", "b.host.", "c.host.", "d.host."} {
+		d.QueryLighthouses(name)
+	}
+	assert.Equal(t, queries+2, w.queries)
+}
+
+func TestDnsRecords_inSuffix(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	d := newDnsRecordsFromConfig(c, &HostMap{}, nil, "laptop.corp.nebula")
+	assert.True(t, d.inSuffix("desktop.corp.nebula."))
+	assert.True(t, d.inSuffix("a.b.corp.nebula."))
+	assert.False(t, d.inSuffix("corp.nebula."))
+	assert.False(t, d.inSuffix("example.com."))
+	assert.False(t, d.inSuffix("desktop."))
+
+	// A bare name only asks about other bare names
+	d = newDnsRecordsFromConfig(c, &HostMap{}, nil, "laptop")
+	assert.True(t, d.inSuffix("desktop."))
+	assert.False(t, d.inSuffix("desktop.corp.nebula."))
+
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"dns": map[interface{}]interface{}{"suffix": ".Example.Com."}}
+	d.reload(c)
+	assert.True(t, d.inSuffix("desktop.example.com."))
+	assert.False(t, d.inSuffix("desktop."))
+}
+
+// testDnsLoopWriter hands lighthouse messages from the client straight to the lighthouse and back
+type testDnsLoopWriter struct {
+	testEncWriter
+	client     *LightHouseHandler
+	lighthouse *LightHouseHandler
+	clientIp   netip.Addr
+	queries    int
+}
+
+func (tw *testDnsLoopWriter) SendMessageToVpnIp(t header.MessageType, st header.MessageSubType, vpnIp netip.Addr, p, _, _ []byte) {
+	tw.queries++
+	reply := &testEncWriter{}
+	tw.lighthouse.HandleRequest(netip.AddrPort{}, tw.clientIp, p, reply)
+
+	b, err := reply.lastReply.msg.Marshal()
+	if err != nil {
+		panic(err)
+	}
+	tw.client.HandleRequest(netip.AddrPort{}, vpnIp, b, tw)
+}
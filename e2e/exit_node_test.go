@@ -0,0 +1,89 @@
+//go:build e2e_testing
+// +build e2e_testing
+
+package e2e
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/slackhq/nebula/e2e/router"
+	"github.com/stretchr/testify/assert"
+)
+
+func udpPacket(srcIp, dstIp netip.Addr, data []byte) []byte {
+	ip := layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    srcIp.AsSlice(),
+		DstIP:    dstIp.AsSlice(),
+	}
+	udp := layers.UDP{SrcPort: 80, DstPort: 80}
+	if err := udp.SetNetworkLayerForChecksum(&ip); err != nil {
+		panic(err)
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	opt := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	if err := gopacket.SerializeLayers(buffer, opt, &ip, &udp, gopacket.Payload(data)); err != nil {
+		panic(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestExitNode(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+
+	exitVpnIpNet := netip.MustParsePrefix("10.128.0.1/24")
+	_, _, exitKey, exitCrt := NewTestCert(ca, caKey, "exit   ", time.Now(), time.Now().Add(5*time.Minute),
+		[]netip.Prefix{exitVpnIpNet}, []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")}, nil)
+	exitControl, _, exitUdpAddr, _ := newSimpleServer(ca, caKey, "exit   ", exitVpnIpNet.String(), m{
+		"pki": m{"cert": string(exitCrt), "key": string(exitKey)},
+		"tun": m{"exit_node": m{"serve": true}},
+	})
+	otherControl, otherVpnIpNet, otherUdpAddr, _ := newSimpleServer(ca, caKey, "other  ", "10.128.0.3/24", nil)
+	myControl, myVpnIpNet, _, _ := newSimpleServer(ca, caKey, "me     ", "10.128.0.2/24", m{
+		"tun":    m{"exit_node": m{"via": exitVpnIpNet.Addr().String()}},
+		"listen": m{"so_mark": 1},
+	})
+
+	myControl.InjectLightHouseAddr(exitVpnIpNet.Addr(), exitUdpAddr)
+	myControl.InjectLightHouseAddr(otherVpnIpNet.Addr(), otherUdpAddr)
+
+	r := router.NewR(t, myControl, exitControl, otherControl)
+	defer r.RenderFlow()
+
+	myControl.Start()
+	exitControl.Start()
+	otherControl.Start()
+
+	internet := netip.MustParseAddr("8.8.8.8")
+
+	r.Log("Internet traffic goes through the exit node")
+	myControl.InjectTunUDPPacket(internet, 80, 80, []byte("Hi internet"))
+	assertUdpPacket(t, []byte("Hi internet"), r.RouteForAllUntilTxTun(exitControl), myVpnIpNet.Addr(), internet, 80, 80)
+
+	r.Log("The internet answers through the exit node")
+	exitControl.InjectTunFrame(udpPacket(internet, myVpnIpNet.Addr(), []byte("Hi me")))
+	assertUdpPacket(t, []byte("Hi me"), r.RouteForAllUntilTxTun(myControl), internet, myVpnIpNet.Addr(), 80, 80)
+
+	r.Log("Vpn traffic still goes straight to the host")
+	myControl.InjectTunUDPPacket(otherVpnIpNet.Addr(), 80, 80, []byte("Hi other"))
+	assertUdpPacket(t, []byte("Hi other"), r.RouteForAllUntilTxTun(otherControl), myVpnIpNet.Addr(), otherVpnIpNet.Addr(), 80, 80)
+
+	r.Log("Only the exit node may answer for the internet")
+	otherControl.InjectTunFrame(udpPacket(internet, myVpnIpNet.Addr(), []byte("Spoofed")))
+	otherControl.InjectTunUDPPacket(myVpnIpNet.Addr(), 80, 80, []byte("Hi from other"))
+	assertUdpPacket(t, []byte("Hi from other"), r.RouteForAllUntilTxTun(myControl), otherVpnIpNet.Addr(), myVpnIpNet.Addr(), 80, 80)
+
+	assert.Nil(t, myControl.GetFromTun(false))
+	r.RenderHostmaps("Final hostmaps", myControl, exitControl, otherControl)
+
+	myControl.Stop()
+	exitControl.Stop()
+	otherControl.Stop()
+}
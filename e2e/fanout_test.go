@@ -0,0 +1,84 @@
+//go:build e2e_testing
+// +build e2e_testing
+
+package e2e
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/e2e/router"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newFanoutServer is newGroupServer with fanout to the mdns group enabled
+func newFanoutServer(caCrt cert.Certificate, caKey []byte, name string, sVpnIpNet string, groups []string) (*nebula.Control, netip.Prefix, netip.AddrPort) {
+	control, vpnIpNet, udpAddr, _ := newGroupServer(caCrt, caKey, name, sVpnIpNet, groups, m{
+		"tun": m{"fanout": m{"enabled": true, "groups": []string{"mdns"}, "rate": 2}},
+	})
+	return control, vpnIpNet, udpAddr
+}
+
+func TestFanout(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	myControl, myVpnIpNet, _ := newFanoutServer(ca, caKey, "me     ", "10.128.0.1/24", []string{"mdns"})
+	theirControl, theirVpnIpNet, theirUdpAddr := newFanoutServer(ca, caKey, "them   ", "10.128.0.2/24", []string{"mdns"})
+	otherControl, otherVpnIpNet, otherUdpAddr := newFanoutServer(ca, caKey, "other  ", "10.128.0.3/24", []string{})
+
+	myControl.InjectLightHouseAddr(theirVpnIpNet.Addr(), theirUdpAddr)
+	myControl.InjectLightHouseAddr(otherVpnIpNet.Addr(), otherUdpAddr)
+
+	r := router.NewR(t, myControl, theirControl, otherControl)
+	defer r.RenderFlow()
+
+	myControl.Start()
+	theirControl.Start()
+	otherControl.Start()
+
+	r.Log("Stand up tunnels to them and other")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.Addr(), 80, 80, []byte("Hi them"))
+	r.RouteForAllUntilTxTun(theirControl)
+	myControl.InjectTunUDPPacket(otherVpnIpNet.Addr(), 80, 80, []byte("Hi other"))
+	r.RouteForAllUntilTxTun(otherControl)
+
+	r.Log("Multicast and broadcast packets only go to them, other is not in the group")
+	mdns := netip.MustParseAddr("224.0.0.251")
+	broadcast := netip.MustParseAddr("10.128.0.255")
+	myControl.InjectTunUDPPacket(mdns, 5353, 5353, []byte("Multicast from me"))
+	myControl.InjectTunUDPPacket(broadcast, 137, 137, []byte("Broadcast from me"))
+
+	r.Log("The rate limit only allows two copies a second, the next one is dropped")
+	myControl.InjectTunUDPPacket(mdns, 5353, 5353, []byte("Limited"))
+	myControl.InjectTunUDPPacket(theirVpnIpNet.Addr(), 80, 80, []byte("Unicast from me"))
+
+	expected := []struct {
+		data string
+		to   netip.Addr
+		port uint16
+	}{
+		{"Multicast from me", mdns, 5353},
+		{"Broadcast from me", broadcast, 137},
+		{"Unicast from me", theirVpnIpNet.Addr(), 80},
+	}
+	for _, e := range expected {
+		p := myControl.GetFromUDP(true)
+		require.Equal(t, theirUdpAddr, p.To)
+		r.InjectUDPPacket(myControl, theirControl, p)
+		assertUdpPacket(t, []byte(e.data), theirControl.GetFromTun(true), myVpnIpNet.Addr(), e.to, e.port, e.port)
+	}
+
+	r.Log("Their multicast reaches me")
+	theirControl.InjectTunUDPPacket(mdns, 5353, 5353, []byte("Multicast from them"))
+	assertUdpPacket(t, []byte("Multicast from them"), r.RouteForAllUntilTxTun(myControl), theirVpnIpNet.Addr(), mdns, 5353, 5353)
+
+	assert.Nil(t, otherControl.GetFromTun(false))
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl, otherControl)
+
+	myControl.Stop()
+	theirControl.Stop()
+	otherControl.Stop()
+}
@@ -94,6 +94,332 @@ func TestGoodHandshake(t *testing.T) {
 	//TODO: assert hostmaps
 }
 
+func TestPskHandshake(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	myControl, myVpnIpNet, _, _ := newSimpleServer(ca, caKey, "me  ", "10.128.0.1/24", m{"pki": m{"psk": []string{"old network key"}}})
+	// They have rotated in a new key but still accept the old one
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", "10.128.0.2/24", m{"pki": m{"psk": []string{"new network key", "old network key"}}})
+	// Evil has a valid certificate but not the key
+	evilControl, _, _, _ := newSimpleServer(ca, caKey, "evil", "10.128.0.3/24", m{"pki": m{"psk": []string{"wrong network key"}}})
+
+	myControl.InjectLightHouseAddr(theirVpnIpNet.Addr(), theirUdpAddr)
+	evilControl.InjectLightHouseAddr(theirVpnIpNet.Addr(), theirUdpAddr)
+
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+
+	myControl.Start()
+	theirControl.Start()
+	evilControl.Start()
+
+	t.Log("Have them consume a stage 0 packet from evil, it should be dropped")
+	evilControl.InjectTunUDPPacket(theirVpnIpNet.Addr(), 80, 80, []byte("Hi from evil"))
+	theirControl.InjectUDPPacket(evilControl.GetFromUDP(true))
+
+	t.Log("Stand up a tunnel between me and them using the old key")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.Addr(), 80, 80, []byte("Hi from me"))
+	p := r.RouteForAllUntilTxTun(theirControl)
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIpNet.Addr(), theirVpnIpNet.Addr(), 80, 80)
+	assertTunnel(t, myVpnIpNet.Addr(), theirVpnIpNet.Addr(), myControl, theirControl, r)
+
+	t.Log("Make sure evil never got a tunnel")
+	assert.Nil(t, theirControl.GetHostInfoByVpnIp(netip.MustParseAddr("10.128.0.3"), false), "Their main hostmap should not contain evil")
+	assert.Empty(t, evilControl.ListHostmapHosts(false), "Evil should not have any tunnels")
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl)
+	myControl.Stop()
+	theirControl.Stop()
+	evilControl.Stop()
+}
+
+func TestHandshakeCookie(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me   ", "10.128.0.1/24", nil)
+	// They will only handle 1 handshake a second before asking for cookies
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them ", "10.128.0.2/24", m{"handshakes": m{"cookie_threshold": 1}})
+	otherControl, _, otherUdpAddr, _ := newSimpleServer(ca, caKey, "other", "10.128.0.3/24", nil)
+
+	myControl.InjectLightHouseAddr(theirVpnIpNet.Addr(), theirUdpAddr)
+	otherControl.InjectLightHouseAddr(theirVpnIpNet.Addr(), theirUdpAddr)
+
+	myControl.Start()
+	theirControl.Start()
+	otherControl.Start()
+
+	t.Log("Use up their handshake budget with a handshake from other")
+	otherControl.InjectTunUDPPacket(theirVpnIpNet.Addr(), 80, 80, []byte("Hi from other"))
+	theirControl.InjectUDPPacket(otherControl.GetFromUDP(true))
+	p := theirControl.GetFromUDP(true)
+	assert.Equal(t, otherUdpAddr, p.To)
+
+	t.Log("Have them consume my stage 0 packet, they should ask for a cookie")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.Addr(), 80, 80, []byte("Hi from me"))
+	theirControl.InjectUDPPacket(myControl.GetFromUDP(true))
+	p = theirControl.GetFromUDP(true)
+	assert.Equal(t, myUdpAddr, p.To)
+	h := &header.H{}
+	assert.NoError(t, h.Parse(p.Data))
+	assert.Equal(t, header.Handshake, h.Type)
+	assert.Equal(t, header.HandshakeCookie, h.Subtype)
+	assert.Nil(t, theirControl.GetHostInfoByVpnIp(myVpnIpNet.Addr(), false), "They should not have a tunnel before seeing the cookie")
+
+	t.Log("Give me the cookie and finish the handshake")
+	myControl.InjectUDPPacket(p)
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+	p2 := r.RouteForAllUntilTxTun(theirControl)
+	assertUdpPacket(t, []byte("Hi from me"), p2, myVpnIpNet.Addr(), theirVpnIpNet.Addr(), 80, 80)
+	assertTunnel(t, myVpnIpNet.Addr(), theirVpnIpNet.Addr(), myControl, theirControl, r)
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl)
+	myControl.Stop()
+	theirControl.Stop()
+	otherControl.Stop()
+}
+
+func TestPostQuantumHandshake(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	myControl, myVpnIpNet, _, _ := newSimpleServer(ca, caKey, "me   ", "10.128.0.1/24", m{"handshakes": m{"post_quantum": "prefer"}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them ", "10.128.0.2/24", m{"handshakes": m{"post_quantum": "require"}})
+	classicControl, classicVpnIpNet, _, _ := newSimpleServer(ca, caKey, "old  ", "10.128.0.3/24", nil)
+
+	myControl.InjectLightHouseAddr(theirVpnIpNet.Addr(), theirUdpAddr)
+	classicControl.InjectLightHouseAddr(theirVpnIpNet.Addr(), theirUdpAddr)
+
+	myControl.Start()
+	theirControl.Start()
+	classicControl.Start()
+
+	t.Log("Have them consume a classic stage 0 packet, it should be refused")
+	classicControl.InjectTunUDPPacket(theirVpnIpNet.Addr(), 80, 80, []byte("Hi from old"))
+	p := classicControl.GetFromUDP(true)
+	h := &header.H{}
+	assert.NoError(t, h.Parse(p.Data))
+	assert.Equal(t, header.HandshakeIXPSK0, h.Subtype)
+	theirControl.InjectUDPPacket(p)
+
+	t.Log("Stand up a hybrid tunnel between me and them")
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+	myControl.InjectTunUDPPacket(theirVpnIpNet.Addr(), 80, 80, []byte("Hi from me"))
+	p2 := r.RouteForAllUntilTxTun(theirControl)
+	assertUdpPacket(t, []byte("Hi from me"), p2, myVpnIpNet.Addr(), theirVpnIpNet.Addr(), 80, 80)
+	assertTunnel(t, myVpnIpNet.Addr(), theirVpnIpNet.Addr(), myControl, theirControl, r)
+
+	assert.True(t, myControl.GetHostInfoByVpnIp(theirVpnIpNet.Addr(), false).PostQuantum)
+	assert.True(t, theirControl.GetHostInfoByVpnIp(myVpnIpNet.Addr(), false).PostQuantum)
+	assert.Nil(t, theirControl.GetHostInfoByVpnIp(classicVpnIpNet.Addr(), false), "They should not accept a classic handshake")
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl)
+	myControl.Stop()
+	theirControl.Stop()
+	classicControl.Stop()
+}
+
+func TestPostQuantumFallback(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	myControl, myVpnIpNet, _, _ := newSimpleServer(ca, caKey, "me  ", "10.128.0.1/24", m{"handshakes": m{"post_quantum": "prefer"}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", "10.128.0.2/24", nil)
+
+	myControl.InjectLightHouseAddr(theirVpnIpNet.Addr(), theirUdpAddr)
+
+	myControl.Start()
+	theirControl.Start()
+
+	t.Log("Drop my hybrid handshakes, like a host that does not understand them, until I fall back")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.Addr(), 80, 80, []byte("Hi from me"))
+	h := &header.H{}
+	hybrid := 0
+	for {
+		p := myControl.GetFromUDP(true)
+		assert.NoError(t, h.Parse(p.Data))
+		assert.Equal(t, header.Handshake, h.Type)
+		if h.Subtype == header.HandshakeIXPSK0Hybrid {
+			hybrid++
+			continue
+		}
+
+		assert.Equal(t, header.HandshakeIXPSK0, h.Subtype)
+		theirControl.InjectUDPPacket(p)
+		break
+	}
+	assert.NotZero(t, hybrid)
+
+	t.Log("Finish the classic handshake")
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+	p := r.RouteForAllUntilTxTun(theirControl)
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIpNet.Addr(), theirVpnIpNet.Addr(), 80, 80)
+	assertTunnel(t, myVpnIpNet.Addr(), theirVpnIpNet.Addr(), myControl, theirControl, r)
+
+	assert.False(t, myControl.GetHostInfoByVpnIp(theirVpnIpNet.Addr(), false).PostQuantum)
+	assert.False(t, theirControl.GetHostInfoByVpnIp(myVpnIpNet.Addr(), false).PostQuantum)
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl)
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func TestCipherNegotiation(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	myControl, myVpnIpNet, _, _ := newSimpleServer(ca, caKey, "me  ", "10.128.0.1/24", m{"cipher": []string{"chachapoly", "aes"}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", "10.128.0.2/24", m{"cipher": []string{"aes", "chachapoly"}})
+
+	myControl.InjectLightHouseAddr(theirVpnIpNet.Addr(), theirUdpAddr)
+
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+
+	myControl.Start()
+	theirControl.Start()
+
+	t.Log("Send a packet, the handshake uses my preferred cipher which is not their first choice")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.Addr(), 80, 80, []byte("Hi from me"))
+	p := r.RouteForAllUntilTxTun(theirControl)
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIpNet.Addr(), theirVpnIpNet.Addr(), 80, 80)
+	assertTunnel(t, myVpnIpNet.Addr(), theirVpnIpNet.Addr(), myControl, theirControl, r)
+
+	t.Log("Both sides use the initiators preferred cipher")
+	assert.Equal(t, "chachapoly", myControl.GetHostInfoByVpnIp(theirVpnIpNet.Addr(), false).Cipher)
+	assert.Equal(t, "chachapoly", theirControl.GetHostInfoByVpnIp(myVpnIpNet.Addr(), false).Cipher)
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl)
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func TestTCPFallback(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	tcpListen := func(tls bool) m {
+		return m{"enabled": true, "host": "127.0.0.1", "port": 0, "tls": tls}
+	}
+
+	lhControl, lhVpnIpNet, _, _ := newSimpleServer(ca, caKey, "lh  ", "10.128.0.1/24", m{
+		"lighthouse": m{"am_lighthouse": true},
+		"listen":     m{"transports": m{"tcp": tcpListen(true)}},
+	})
+
+	// Everyone only knows how to reach the lighthouse over tcp
+	lhTcpAddr := lhControl.GetTCPAddr()
+	clientConfig := func(tcp m) m {
+		return m{
+			"static_host_map": m{lhVpnIpNet.Addr().String(): []string{"tcp://" + lhTcpAddr.String()}},
+			"lighthouse":      m{"hosts": []string{lhVpnIpNet.Addr().String()}},
+			"listen":          m{"transports": m{"tcp": tcp}},
+			"handshakes":      m{"tcp_fallback_after": 1},
+		}
+	}
+
+	// I can only dial out in plain tcp, they accept streams and dial out wrapped in tls
+	myControl, myVpnIpNet, _, _ := newSimpleServer(ca, caKey, "me  ", "10.128.0.2/24", clientConfig(m{"enabled": true}))
+	theirControl, theirVpnIpNet, _, _ := newSimpleServer(ca, caKey, "them", "10.128.0.3/24", clientConfig(tcpListen(true)))
+
+	t.Log("Drop every udp packet, like a network that blocks udp")
+	for _, c := range []*nebula.Control{lhControl, myControl, theirControl} {
+		go func(c *nebula.Control) {
+			for range c.GetUDPTxChan() {
+			}
+		}(c)
+	}
+
+	lhControl.Start()
+	theirControl.Start()
+	myControl.Start()
+	done := deadline(t, 20)
+
+	t.Log("Wait for them to report their tcp endpoint to the lighthouse")
+	for {
+		cm := lhControl.QueryLighthouse(theirVpnIpNet.Addr())
+		if cm != nil {
+			if c := (*cm)[theirVpnIpNet.Addr().String()]; c != nil && slices.Contains(c.TCP, theirControl.GetTCPAddr()) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Log("Send a packet, the lighthouse tells me their tcp endpoint and the handshake falls back to it")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.Addr(), 80, 80, []byte("Hi from me"))
+	assertUdpPacket(t, []byte("Hi from me"), theirControl.GetFromTun(true), myVpnIpNet.Addr(), theirVpnIpNet.Addr(), 80, 80)
+
+	theirControl.InjectTunUDPPacket(myVpnIpNet.Addr(), 80, 80, []byte("Hi from them"))
+	assertUdpPacket(t, []byte("Hi from them"), myControl.GetFromTun(true), theirVpnIpNet.Addr(), myVpnIpNet.Addr(), 80, 80)
+	done()
+
+	assert.Equal(t, theirControl.GetTCPAddr(), myControl.GetHostInfoByVpnIp(theirVpnIpNet.Addr(), false).CurrentRemote)
+
+	lhControl.Stop()
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func TestWebSocketTransport(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	wsListen := m{"enabled": true, "host": "127.0.0.1", "port": 0, "dial_tls": false}
+
+	lhControl, lhVpnIpNet, _, _ := newSimpleServer(ca, caKey, "lh  ", "10.128.0.1/24", m{
+		"lighthouse": m{"am_lighthouse": true},
+		"listen":     m{"transports": m{"websocket": wsListen}},
+	})
+
+	// Everyone only knows how to reach the lighthouse over websocket
+	lhWsAddr := lhControl.GetWebSocketAddr()
+	clientConfig := func(ws m) m {
+		return m{
+			"static_host_map": m{lhVpnIpNet.Addr().String(): []string{"ws://" + lhWsAddr.String()}},
+			"lighthouse":      m{"hosts": []string{lhVpnIpNet.Addr().String()}},
+			"listen":          m{"transports": m{"websocket": ws}},
+			"handshakes":      m{"tcp_fallback_after": 1},
+		}
+	}
+
+	// I can only dial out, they listen on loopback like they would behind a reverse proxy and advertise it
+	myControl, myVpnIpNet, _, _ := newSimpleServer(ca, caKey, "me  ", "10.128.0.2/24", clientConfig(m{"enabled": true, "dial_tls": false}))
+	theirWs := m{"advertise_addrs": []string{"127.0.0.1:0"}}
+	for k, v := range wsListen {
+		theirWs[k] = v
+	}
+	theirControl, theirVpnIpNet, _, _ := newSimpleServer(ca, caKey, "them", "10.128.0.3/24", clientConfig(theirWs))
+
+	t.Log("Drop every udp packet, like a network that only lets http out")
+	for _, c := range []*nebula.Control{lhControl, myControl, theirControl} {
+		go func(c *nebula.Control) {
+			for range c.GetUDPTxChan() {
+			}
+		}(c)
+	}
+
+	lhControl.Start()
+	theirControl.Start()
+	myControl.Start()
+	done := deadline(t, 20)
+
+	t.Log("Wait for them to report their websocket endpoint to the lighthouse")
+	for {
+		cm := lhControl.QueryLighthouse(theirVpnIpNet.Addr())
+		if cm != nil {
+			if c := (*cm)[theirVpnIpNet.Addr().String()]; c != nil && slices.Contains(c.WebSocket, theirControl.GetWebSocketAddr()) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Log("Send a packet, the lighthouse tells me their websocket endpoint and the handshake falls back to it")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.Addr(), 80, 80, []byte("Hi from me"))
+	assertUdpPacket(t, []byte("Hi from me"), theirControl.GetFromTun(true), myVpnIpNet.Addr(), theirVpnIpNet.Addr(), 80, 80)
+
+	theirControl.InjectTunUDPPacket(myVpnIpNet.Addr(), 80, 80, []byte("Hi from them"))
+	assertUdpPacket(t, []byte("Hi from them"), myControl.GetFromTun(true), theirVpnIpNet.Addr(), myVpnIpNet.Addr(), 80, 80)
+	done()
+
+	assert.Equal(t, theirControl.GetWebSocketAddr(), myControl.GetHostInfoByVpnIp(theirVpnIpNet.Addr(), false).CurrentRemote)
+
+	lhControl.Stop()
+	myControl.Stop()
+	theirControl.Stop()
+}
+
 func TestWrongResponderHandshake(t *testing.T) {
 	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
 
@@ -467,6 +793,145 @@ func TestRelays(t *testing.T) {
 	//TODO: assert we actually used the relay even though it should be impossible for a tunnel to have occurred without it
 }
 
+func TestRelaysRejectedByGroup(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	myControl, myVpnIpNet, _, _ := newSimpleServer(ca, caKey, "me     ", "10.128.0.1/24", m{"relay": m{"use_relays": true}})
+	relayControl, relayVpnIpNet, relayUdpAddr, _ := newSimpleServer(ca, caKey, "relay  ", "10.128.0.128/24", m{"relay": m{"am_relay": true, "limits": m{"groups": []string{"relay-users"}}}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them   ", "10.128.0.2/24", m{"relay": m{"use_relays": true}})
+
+	// Teach my how to get to the relay and that their can be reached via the relay
+	myControl.InjectLightHouseAddr(relayVpnIpNet.Addr(), relayUdpAddr)
+	myControl.InjectRelays(theirVpnIpNet.Addr(), []netip.Addr{relayVpnIpNet.Addr()})
+	relayControl.InjectLightHouseAddr(theirVpnIpNet.Addr(), theirUdpAddr)
+
+	// Build a router so we don't have to reason who gets which packet
+	r := router.NewR(t, myControl, relayControl, theirControl)
+	defer r.RenderFlow()
+
+	// Start the servers
+	myControl.Start()
+	relayControl.Start()
+	theirControl.Start()
+
+	t.Log("Trigger a handshake from me to them via the relay")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.Addr(), 80, 80, []byte("Hi from me"))
+
+	r.Log("Wait for the relay to reject the request, my cert has no groups")
+	r.RouteForAllUntilAfterMsgTypeTo(myControl, header.Control, 0)
+
+	r.Log("Assert the relay did not relay for me")
+	relayHostInfo := relayControl.GetHostInfoByVpnIp(myVpnIpNet.Addr(), false)
+	assert.NotNil(t, relayHostInfo)
+	assert.Empty(t, relayHostInfo.CurrentRelaysThroughMe)
+	assert.Nil(t, relayControl.GetHostInfoByVpnIp(theirVpnIpNet.Addr(), true), "The relay should not be handshaking with them")
+	assert.Nil(t, relayControl.GetHostInfoByVpnIp(theirVpnIpNet.Addr(), false), "The relay should not have a tunnel with them")
+	r.RenderHostmaps("Final hostmaps", myControl, relayControl, theirControl)
+
+	myControl.Stop()
+	relayControl.Stop()
+	theirControl.Stop()
+}
+
+func TestRelayChain(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	relay1Control, relay1VpnIpNet, relay1UdpAddr, _ := newSimpleServer(ca, caKey, "relay1 ", "10.128.0.128/24", m{"relay": m{"am_relay": true, "max_hops": 2}})
+	relay2Control, relay2VpnIpNet, relay2UdpAddr, _ := newSimpleServer(ca, caKey, "relay2 ", "10.128.0.129/24", m{"relay": m{"am_relay": true, "max_hops": 2, "chain_from": []string{relay1VpnIpNet.Addr().String()}}})
+	myControl, myVpnIpNet, _, _ := newSimpleServer(ca, caKey, "me     ", "10.128.0.1/24", m{"relay": m{"use_relays": true, "max_hops": 2, "relays": []string{relay1VpnIpNet.Addr().String()}}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them   ", "10.128.0.2/24", m{"relay": m{"use_relays": true}})
+
+	// I can only reach relay1, they can only be reached through relay2, and only the relays can reach each other
+	myControl.InjectLightHouseAddr(relay1VpnIpNet.Addr(), relay1UdpAddr)
+	myControl.InjectRelays(theirVpnIpNet.Addr(), []netip.Addr{relay2VpnIpNet.Addr()})
+	relay1Control.InjectLightHouseAddr(relay2VpnIpNet.Addr(), relay2UdpAddr)
+	relay1Control.InjectRelays(theirVpnIpNet.Addr(), []netip.Addr{relay2VpnIpNet.Addr()})
+	relay2Control.InjectLightHouseAddr(theirVpnIpNet.Addr(), theirUdpAddr)
+
+	// Build a router so we don't have to reason who gets which packet
+	r := router.NewR(t, myControl, relay1Control, relay2Control, theirControl)
+	defer r.RenderFlow()
+
+	// Start the servers
+	myControl.Start()
+	relay1Control.Start()
+	relay2Control.Start()
+	theirControl.Start()
+
+	t.Log("Trigger a handshake from me to them through both relays")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.Addr(), 80, 80, []byte("Hi from me"))
+
+	p := r.RouteForAllUntilTxTun(theirControl)
+	r.Log("Assert the tunnel works")
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIpNet.Addr(), theirVpnIpNet.Addr(), 80, 80)
+
+	theirControl.InjectTunUDPPacket(myVpnIpNet.Addr(), 80, 80, []byte("Hi from them"))
+	p = r.RouteForAllUntilTxTun(myControl)
+	assertUdpPacket(t, []byte("Hi from them"), p, theirVpnIpNet.Addr(), myVpnIpNet.Addr(), 80, 80)
+
+	r.Log("Assert the chain went through both relays")
+	assert.Nil(t, relay1Control.GetHostInfoByVpnIp(theirVpnIpNet.Addr(), false), "relay1 should not have a tunnel with them")
+	assert.Contains(t, relay1Control.GetHostInfoByVpnIp(myVpnIpNet.Addr(), false).CurrentRelaysThroughMe, theirVpnIpNet.Addr())
+	assert.Contains(t, relay1Control.GetHostInfoByVpnIp(relay2VpnIpNet.Addr(), false).CurrentRelaysThroughMe, myVpnIpNet.Addr())
+	assert.Contains(t, relay2Control.GetHostInfoByVpnIp(relay1VpnIpNet.Addr(), false).CurrentRelaysThroughMe, theirVpnIpNet.Addr())
+	assert.Contains(t, relay2Control.GetHostInfoByVpnIp(theirVpnIpNet.Addr(), false).CurrentRelaysThroughMe, myVpnIpNet.Addr())
+	assert.Equal(t, []netip.Addr{relay1VpnIpNet.Addr()}, myControl.GetHostInfoByVpnIp(theirVpnIpNet.Addr(), false).CurrentRelaysToMe)
+	assert.Equal(t, []netip.Addr{relay2VpnIpNet.Addr()}, theirControl.GetHostInfoByVpnIp(myVpnIpNet.Addr(), false).CurrentRelaysToMe)
+	r.RenderHostmaps("Final hostmaps", myControl, relay1Control, relay2Control, theirControl)
+
+	myControl.Stop()
+	relay1Control.Stop()
+	relay2Control.Stop()
+	theirControl.Stop()
+}
+
+func TestRelayChainRejectedByGroup(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	relay1Control, relay1VpnIpNet, relay1UdpAddr, _ := newGroupServer(ca, caKey, "relay1 ", "10.128.0.128/24", []string{"relay-users"}, m{"relay": m{"am_relay": true, "max_hops": 2}})
+	relay2Control, relay2VpnIpNet, relay2UdpAddr, _ := newSimpleServer(ca, caKey, "relay2 ", "10.128.0.129/24", m{"relay": m{
+		"am_relay":   true,
+		"max_hops":   2,
+		"chain_from": []string{relay1VpnIpNet.Addr().String()},
+		"limits":     m{"groups": []string{"relay-users"}},
+	}})
+	myControl, myVpnIpNet, _, _ := newSimpleServer(ca, caKey, "me     ", "10.128.0.1/24", m{"relay": m{"use_relays": true, "max_hops": 2, "relays": []string{relay1VpnIpNet.Addr().String()}}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them   ", "10.128.0.2/24", m{"relay": m{"use_relays": true}})
+
+	// Only relay1 is in the group relay2 allows, my cert has no groups and I try to get through relay2 by way of relay1
+	myControl.InjectLightHouseAddr(relay1VpnIpNet.Addr(), relay1UdpAddr)
+	myControl.InjectRelays(theirVpnIpNet.Addr(), []netip.Addr{relay2VpnIpNet.Addr()})
+	relay1Control.InjectLightHouseAddr(relay2VpnIpNet.Addr(), relay2UdpAddr)
+	relay1Control.InjectRelays(theirVpnIpNet.Addr(), []netip.Addr{relay2VpnIpNet.Addr()})
+	relay2Control.InjectLightHouseAddr(theirVpnIpNet.Addr(), theirUdpAddr)
+
+	// Build a router so we don't have to reason who gets which packet
+	r := router.NewR(t, myControl, relay1Control, relay2Control, theirControl)
+	defer r.RenderFlow()
+
+	// Start the servers
+	myControl.Start()
+	relay1Control.Start()
+	relay2Control.Start()
+	theirControl.Start()
+
+	t.Log("Trigger a handshake from me to them through both relays")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.Addr(), 80, 80, []byte("Hi from me"))
+
+	r.Log("Wait for relay1 to pass my request on and relay2 to reject it")
+	r.RouteForAllUntilAfterMsgTypeTo(relay2Control, header.Control, 0)
+	r.RouteForAllUntilAfterMsgTypeTo(relay1Control, header.Control, 0)
+
+	r.Log("Assert relay2 did not relay for me")
+	assert.NotNil(t, relay1Control.GetHostInfoByVpnIp(myVpnIpNet.Addr(), false))
+	assert.Empty(t, relay2Control.GetHostInfoByVpnIp(relay1VpnIpNet.Addr(), false).CurrentRelaysThroughMe)
+	assert.Nil(t, relay2Control.GetHostInfoByVpnIp(theirVpnIpNet.Addr(), true), "relay2 should not be handshaking with them")
+	assert.Nil(t, relay2Control.GetHostInfoByVpnIp(theirVpnIpNet.Addr(), false), "relay2 should not have a tunnel with them")
+	r.RenderHostmaps("Final hostmaps", myControl, relay1Control, relay2Control, theirControl)
+
+	myControl.Stop()
+	relay1Control.Stop()
+	relay2Control.Stop()
+	theirControl.Stop()
+}
+
 func TestStage1RaceRelays(t *testing.T) {
 	//NOTE: this is a race between me and relay resulting in a full tunnel from me to them via relay
 	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
@@ -907,6 +1372,65 @@ func TestRehandshaking(t *testing.T) {
 	theirControl.Stop()
 }
 
+func TestRekeying(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	myControl, myVpnIpNet, myUdpAddr, myConfig := newSimpleServer(ca, caKey, "me  ", "10.128.0.2/24", m{"rekey": m{"max_messages": 10}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", "10.128.0.1/24", nil)
+
+	// Put their info in our lighthouse and vice versa
+	myControl.InjectLightHouseAddr(theirVpnIpNet.Addr(), theirUdpAddr)
+	theirControl.InjectLightHouseAddr(myVpnIpNet.Addr(), myUdpAddr)
+
+	// Build a router so we don't have to reason who gets which packet
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+
+	// Start the servers
+	myControl.Start()
+	theirControl.Start()
+
+	t.Log("Stand up a tunnel between me and them")
+	assertTunnel(t, myVpnIpNet.Addr(), theirVpnIpNet.Addr(), myControl, theirControl, r)
+	firstIndex := myControl.GetHostInfoByVpnIp(theirVpnIpNet.Addr(), false).LocalIndex
+
+	r.RenderHostmaps("Starting hostmaps", myControl, theirControl)
+
+	r.Log("Send traffic until I rekey")
+	for myControl.GetHostInfoByVpnIp(theirVpnIpNet.Addr(), false).LocalIndex == firstIndex {
+		assertTunnel(t, myVpnIpNet.Addr(), theirVpnIpNet.Addr(), myControl, theirControl, r)
+		time.Sleep(time.Second)
+	}
+
+	r.Log("Disable rekeying so the new tunnel sticks around")
+	myConfig.Settings["rekey"] = m{"max_messages": 0}
+	rc, err := yaml.Marshal(myConfig.Settings)
+	assert.NoError(t, err)
+	myConfig.ReloadConfigString(string(rc))
+
+	r.Log("Spin until there is only 1 tunnel")
+	for len(myControl.GetHostmap().Indexes)+len(theirControl.GetHostmap().Indexes) > 2 {
+		assertTunnel(t, myVpnIpNet.Addr(), theirVpnIpNet.Addr(), myControl, theirControl, r)
+		t.Log("Connection manager hasn't ticked yet")
+		time.Sleep(time.Second)
+	}
+
+	assertTunnel(t, myVpnIpNet.Addr(), theirVpnIpNet.Addr(), myControl, theirControl, r)
+
+	// Both sides agree on the new tunnel
+	myHostInfo := myControl.GetHostInfoByVpnIp(theirVpnIpNet.Addr(), false)
+	theirHostInfo := theirControl.GetHostInfoByVpnIp(myVpnIpNet.Addr(), false)
+	assert.NotEqual(t, firstIndex, myHostInfo.LocalIndex)
+	assert.Equal(t, myHostInfo.LocalIndex, theirHostInfo.RemoteIndex)
+	assert.Equal(t, myHostInfo.RemoteIndex, theirHostInfo.LocalIndex)
+	assert.Len(t, myControl.ListHostmapIndexes(false), 1)
+	assert.Len(t, theirControl.ListHostmapIndexes(false), 1)
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl)
+
+	myControl.Stop()
+	theirControl.Stop()
+}
+
 func TestRehandshakingLoser(t *testing.T) {
 	// The purpose of this test is that the race loser renews their certificate and rehandshakes. The final tunnel
 	// Should be the one with the new certificate
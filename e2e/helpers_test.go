@@ -114,6 +114,21 @@ func newSimpleServer(caCrt cert.Certificate, caKey []byte, name string, sVpnIpNe
 
 type doneCb func()
 
+// newGroupServer is newSimpleServer with a certificate in groups
+func newGroupServer(caCrt cert.Certificate, caKey []byte, name string, sVpnIpNet string, groups []string, overrides m) (*nebula.Control, netip.Prefix, netip.AddrPort, *config.C) {
+	vpnIpNet, err := netip.ParsePrefix(sVpnIpNet)
+	if err != nil {
+		panic(err)
+	}
+
+	_, _, key, crt := NewTestCert(caCrt, caKey, name, time.Now(), time.Now().Add(5*time.Minute), []netip.Prefix{vpnIpNet}, nil, groups)
+	if overrides == nil {
+		overrides = m{}
+	}
+	overrides["pki"] = m{"cert": string(crt), "key": string(key)}
+	return newSimpleServer(caCrt, caKey, name, sVpnIpNet, overrides)
+}
+
 func deadline(t *testing.T, seconds time.Duration) doneCb {
 	timeout := time.After(seconds * time.Second)
 	done := make(chan bool)
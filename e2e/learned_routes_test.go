@@ -0,0 +1,120 @@
+//go:build e2e_testing
+// +build e2e_testing
+
+package e2e
+
+import (
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula"
+	"github.com/slackhq/nebula/e2e/router"
+	"github.com/slackhq/nebula/header"
+)
+
+func TestLearnedUnsafeRoutes(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	lan := netip.MustParsePrefix("192.168.1.0/24")
+	lanHost := netip.MustParseAddr("192.168.1.1")
+
+	lhControl, lhVpnIpNet, lhUdpAddr, _ := newSimpleServer(ca, caKey, "lh     ", "10.128.0.1/24", m{
+		"lighthouse": m{"am_lighthouse": true, "interval": 1},
+	})
+	nodeConfig := func(overrides m) m {
+		overrides["static_host_map"] = m{lhVpnIpNet.Addr().String(): []string{lhUdpAddr.String()}}
+		overrides["handshakes"] = m{"try_interval": "100ms", "retries": 3}
+		lighthouse, _ := overrides["lighthouse"].(m)
+		if lighthouse == nil {
+			lighthouse = m{}
+		}
+		lighthouse["hosts"] = []string{lhVpnIpNet.Addr().String()}
+		lighthouse["interval"] = 1
+		overrides["lighthouse"] = lighthouse
+		return overrides
+	}
+	gateway := func(name, sVpnIpNet string, priority int) *nebula.Control {
+		vpnIpNet := netip.MustParsePrefix(sVpnIpNet)
+		_, _, key, crt := NewTestCert(ca, caKey, name, time.Now(), time.Now().Add(5*time.Minute),
+			[]netip.Prefix{vpnIpNet}, []netip.Prefix{lan}, nil)
+		control, _, _, _ := newSimpleServer(ca, caKey, name, sVpnIpNet, nodeConfig(m{
+			"pki":        m{"cert": string(crt), "key": string(key)},
+			"lighthouse": m{"advertise_unsafe_routes": m{"enabled": true, "priority": priority}},
+		}))
+		return control
+	}
+
+	primaryControl := gateway("primary", "10.128.0.2/24", 200)
+	backupControl := gateway("backup ", "10.128.0.3/24", 100)
+	myControl, myVpnIpNet, _, _ := newSimpleServer(ca, caKey, "me     ", "10.128.0.4/24", nodeConfig(m{
+		"tun": m{"learn_unsafe_routes": m{"enabled": true}},
+	}))
+
+	controls := []*nebula.Control{lhControl, primaryControl, backupControl, myControl}
+	r := router.NewR(t, controls...)
+	defer r.RenderFlow()
+
+	// Route every packet as it is sent, everything to or from the primary is lost while it is down. Hole punches are
+	// not nebula packets and are dropped too.
+	var primaryDown atomic.Bool
+	byAddr := map[netip.AddrPort]*nebula.Control{}
+	for _, c := range controls {
+		byAddr[c.GetUDPAddr()] = c
+	}
+	for _, c := range controls {
+		go func(c *nebula.Control) {
+			for p := range c.GetUDPTxChan() {
+				receiver := byAddr[p.To]
+				if receiver == nil || len(p.Data) < header.Len || primaryDown.Load() && (c == primaryControl || receiver == primaryControl) {
+					continue
+				}
+				r.InjectUDPPacket(c, receiver, p)
+			}
+		}(c)
+	}
+
+	for _, c := range controls {
+		c.Start()
+	}
+	done := deadline(t, 60)
+
+	// sendUntil keeps sending packets for the lan host until one comes out of the expected gateway
+	sendUntil := func(expected *nebula.Control) {
+		tick := time.NewTicker(250 * time.Millisecond)
+		defer tick.Stop()
+		for {
+			select {
+			case p := <-primaryControl.GetTunTxChan():
+				if expected == primaryControl {
+					assertUdpPacket(t, []byte("Hi lan"), p, myVpnIpNet.Addr(), lanHost, 80, 80)
+					return
+				}
+			case p := <-backupControl.GetTunTxChan():
+				if expected == backupControl {
+					assertUdpPacket(t, []byte("Hi lan"), p, myVpnIpNet.Addr(), lanHost, 80, 80)
+					return
+				}
+			case <-tick.C:
+				myControl.InjectTunUDPPacket(lanHost, 80, 80, []byte("Hi lan"))
+			}
+		}
+	}
+
+	r.Log("The lighthouse tells me about both gateways, the lan is reached through the higher priority one")
+	sendUntil(primaryControl)
+
+	r.Log("The primary goes away, its tunnel dies and the lan is reached through the backup")
+	primaryDown.Store(true)
+	sendUntil(backupControl)
+
+	r.Log("The primary comes back and takes the lan over again")
+	primaryDown.Store(false)
+	sendUntil(primaryControl)
+	done()
+
+	r.RenderHostmaps("Final hostmaps", controls...)
+	for _, c := range controls {
+		c.Stop()
+	}
+}
@@ -711,6 +711,11 @@ func (r *R) getControl(fromAddr, toAddr netip.AddrPort, p *udp.Packet) *nebula.C
 }
 
 func (r *R) formatUdpPacket(p *packet) string {
+	if len(p.packet.Data) > 0 && p.packet.Data[0]>>4 != 4 {
+		// Not an ipv4 packet, devices in tap mode hand over ethernet frames
+		return r.formatFrame(p)
+	}
+
 	packet := gopacket.NewPacket(p.packet.Data, layers.LayerTypeIPv4, gopacket.Lazy)
 	v4 := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
 	if v4 == nil {
@@ -738,3 +743,39 @@ func (r *R) formatUdpPacket(p *packet) string {
 		string(data.Payload()),
 	)
 }
+
+func (r *R) formatFrame(p *packet) string {
+	packet := gopacket.NewPacket(p.packet.Data, layers.LayerTypeEthernet, gopacket.Lazy)
+	eth, _ := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if eth == nil {
+		panic("not an ethernet frame")
+	}
+
+	var srcIp []byte
+	if v4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok {
+		srcIp = v4.SrcIP
+	} else if arp, ok := packet.Layer(layers.LayerTypeARP).(*layers.ARP); ok {
+		srcIp = arp.SourceProtAddress
+	}
+
+	from := "unknown"
+	srcAddr, _ := netip.AddrFromSlice(srcIp)
+	if c, ok := r.vpnControls[srcAddr]; ok {
+		from = c.GetUDPAddr().String()
+	}
+
+	var data []byte
+	if app := packet.ApplicationLayer(); app != nil {
+		data = app.Payload()
+	}
+
+	return fmt.Sprintf(
+		"    %s-->>%s: %v<br/>src mac: %v<br/>dest mac: %v<br/>data: \"%v\"\n",
+		strings.Replace(from, ":", "-", 1),
+		strings.Replace(p.to.GetUDPAddr().String(), ":", "-", 1),
+		eth.EthernetType,
+		eth.SrcMAC,
+		eth.DstMAC,
+		string(data),
+	)
+}
@@ -0,0 +1,85 @@
+//go:build e2e_testing
+// +build e2e_testing
+
+package e2e
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/e2e/router"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnat(t *testing.T) {
+	// A host behind the gateway is played by an address of this host, the gateway's stack drops loopback packets
+	var lan netip.Addr
+	addrs, err := net.InterfaceAddrs()
+	require.NoError(t, err)
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok {
+			addr, _ := netip.AddrFromSlice(n.IP)
+			if addr = addr.Unmap(); addr.Is4() && !addr.IsLoopback() {
+				lan = addr
+				break
+			}
+		}
+	}
+	if !lan.IsValid() {
+		t.Skip("no non loopback ipv4 address to test with")
+	}
+
+	server, err := net.ListenUDP("udp4", net.UDPAddrFromAddrPort(netip.AddrPortFrom(lan, 0)))
+	require.NoError(t, err)
+	defer server.Close()
+	serverPort := server.LocalAddr().(*net.UDPAddr).AddrPort().Port()
+
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+
+	gatewayVpnIpNet := netip.MustParsePrefix("10.128.0.1/24")
+	_, _, gatewayKey, gatewayCrt := NewTestCert(ca, caKey, "gateway", time.Now(), time.Now().Add(5*time.Minute),
+		[]netip.Prefix{gatewayVpnIpNet}, []netip.Prefix{netip.PrefixFrom(lan, 32)}, nil)
+	gatewayControl, _, gatewayUdpAddr, _ := newSimpleServer(ca, caKey, "gateway", gatewayVpnIpNet.String(), m{
+		"pki": m{"cert": string(gatewayCrt), "key": string(gatewayKey)},
+		"tun": m{"snat": m{"enabled": true}},
+	})
+	myControl, myVpnIpNet, _, _ := newSimpleServer(ca, caKey, "me     ", "10.128.0.2/24", m{
+		"tun": m{"unsafe_routes": []m{{"route": netip.PrefixFrom(lan, 32).String(), "via": gatewayVpnIpNet.Addr().String()}}},
+	})
+
+	myControl.InjectLightHouseAddr(gatewayVpnIpNet.Addr(), gatewayUdpAddr)
+
+	r := router.NewR(t, myControl, gatewayControl)
+	defer r.RenderFlow()
+
+	myControl.Start()
+	gatewayControl.Start()
+
+	// The lan host answers whoever reached it
+	received := make(chan netip.AddrPort, 1)
+	go func() {
+		b := make([]byte, 64)
+		n, from, err := server.ReadFromUDPAddrPort(b)
+		if err != nil {
+			return
+		}
+		received <- from
+		server.WriteToUDPAddrPort(append([]byte("Hi "), b[:n]...), from)
+	}()
+
+	r.Log("A udp packet for the lan reaches it from the gateway and the reply comes back through the vpn")
+	myControl.InjectTunUDPPacket(lan, serverPort, 80, []byte("me"))
+	assertUdpPacket(t, []byte("Hi me"), r.RouteForAllUntilTxTun(myControl), lan, myVpnIpNet.Addr(), serverPort, 80)
+
+	from := <-received
+	assert.NotEqual(t, myVpnIpNet.Addr(), from.Addr().Unmap())
+	assert.Nil(t, gatewayControl.GetFromTun(false))
+
+	r.RenderHostmaps("Final hostmaps", myControl, gatewayControl)
+
+	myControl.Stop()
+	gatewayControl.Stop()
+}
@@ -0,0 +1,134 @@
+//go:build e2e_testing
+// +build e2e_testing
+
+package e2e
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/slackhq/nebula"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/e2e/router"
+	"github.com/slackhq/nebula/header"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTapServer is newGroupServer in tap mode
+func newTapServer(caCrt cert.Certificate, caKey []byte, name string, sVpnIpNet string, groups []string, tap m) (*nebula.Control, netip.Prefix, netip.AddrPort) {
+	tap["group"] = "l2"
+	control, vpnIpNet, udpAddr, _ := newGroupServer(caCrt, caKey, name, sVpnIpNet, groups, m{
+		"tun": m{"mode": "tap", "tap": tap},
+	})
+	return control, vpnIpNet, udpAddr
+}
+
+func arpFrame(src, dst net.HardwareAddr, srcIp, dstIp netip.Addr) []byte {
+	eth := layers.Ethernet{SrcMAC: src, DstMAC: dst, EthernetType: layers.EthernetTypeARP}
+	arp := layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   src,
+		SourceProtAddress: srcIp.AsSlice(),
+		DstHwAddress:      make([]byte, 6),
+		DstProtAddress:    dstIp.AsSlice(),
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{}, &eth, &arp); err != nil {
+		panic(err)
+	}
+	return buffer.Bytes()
+}
+
+func udpFrame(src, dst net.HardwareAddr, srcIp, dstIp netip.Addr, data []byte) []byte {
+	eth := layers.Ethernet{SrcMAC: src, DstMAC: dst, EthernetType: layers.EthernetTypeIPv4}
+	ip := layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    srcIp.AsSlice(),
+		DstIP:    dstIp.AsSlice(),
+	}
+	udp := layers.UDP{SrcPort: 90, DstPort: 80}
+	if err := udp.SetNetworkLayerForChecksum(&ip); err != nil {
+		panic(err)
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	opt := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	if err := gopacket.SerializeLayers(buffer, opt, &eth, &ip, &udp, gopacket.Payload(data)); err != nil {
+		panic(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestTapBridging(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	theirControl, theirVpnIpNet, theirUdpAddr := newTapServer(ca, caKey, "them   ", "10.128.0.2/24", []string{"l2"}, m{})
+	otherControl, otherVpnIpNet, otherUdpAddr := newTapServer(ca, caKey, "other  ", "10.128.0.3/24", []string{"l3"}, m{})
+	myControl, myVpnIpNet, _ := newTapServer(ca, caKey, "me     ", "10.128.0.1/24", []string{"l2"}, m{
+		"peers": []string{theirVpnIpNet.Addr().String(), otherVpnIpNet.Addr().String()},
+	})
+
+	myMac := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	theirMac := net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+	broadcast := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+	myControl.InjectLightHouseAddr(theirVpnIpNet.Addr(), theirUdpAddr)
+	myControl.InjectLightHouseAddr(otherVpnIpNet.Addr(), otherUdpAddr)
+
+	r := router.NewR(t, myControl, theirControl, otherControl)
+	defer r.RenderFlow()
+
+	myControl.Start()
+	theirControl.Start()
+	otherControl.Start()
+
+	r.Log("Flooding a frame starts tunnels to the configured peers")
+	myControl.InjectTunFrame(arpFrame(myMac, broadcast, myVpnIpNet.Addr(), theirVpnIpNet.Addr()))
+	r.RouteForAllUntilAfterMsgTypeTo(myControl, header.Handshake, header.HandshakeIXPSK0)
+	r.RouteForAllUntilAfterMsgTypeTo(myControl, header.Handshake, header.HandshakeIXPSK0)
+	require.Eventually(t, func() bool {
+		return myControl.GetHostInfoByVpnIp(theirVpnIpNet.Addr(), false) != nil &&
+			myControl.GetHostInfoByVpnIp(otherVpnIpNet.Addr(), false) != nil
+	}, time.Second, 10*time.Millisecond)
+
+	r.Log("A broadcast from them reaches me")
+	frame := arpFrame(theirMac, broadcast, theirVpnIpNet.Addr(), myVpnIpNet.Addr())
+	theirControl.InjectTunFrame(frame)
+	assert.Equal(t, frame, r.RouteForAllUntilTxTun(myControl))
+
+	r.Log("My broadcast and a unicast to their learned mac only go to them, other is not in the group")
+	broadcastFrame := arpFrame(myMac, broadcast, myVpnIpNet.Addr(), theirVpnIpNet.Addr())
+	unicastFrame := udpFrame(myMac, theirMac, myVpnIpNet.Addr(), theirVpnIpNet.Addr(), []byte("Hi from me"))
+	myControl.InjectTunFrame(broadcastFrame)
+	myControl.InjectTunFrame(unicastFrame)
+	for _, expected := range [][]byte{broadcastFrame, unicastFrame} {
+		p := myControl.GetFromUDP(true)
+		require.Equal(t, theirUdpAddr, p.To)
+		r.InjectUDPPacket(myControl, theirControl, p)
+		assert.Equal(t, expected, theirControl.GetFromTun(true))
+	}
+
+	r.Log("The firewall still applies to the ip packet in a frame, they can not spoof an address")
+	theirControl.InjectTunFrame(udpFrame(theirMac, myMac, netip.MustParseAddr("10.128.0.99"), myVpnIpNet.Addr(), []byte("Spoofed")))
+	frame = udpFrame(theirMac, myMac, theirVpnIpNet.Addr(), myVpnIpNet.Addr(), []byte("Hi from them"))
+	theirControl.InjectTunFrame(frame)
+	assert.Equal(t, frame, r.RouteForAllUntilTxTun(myControl))
+
+	assert.Nil(t, otherControl.GetFromTun(false))
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl, otherControl)
+
+	myControl.Stop()
+	theirControl.Stop()
+	otherControl.Stop()
+}
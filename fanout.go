@@ -0,0 +1,152 @@
+package nebula
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/udp"
+)
+
+// defaultFanoutRate is how many copies of multicast and broadcast packets we send per second unless configured
+const defaultFanoutRate = 1000
+
+var limitedBroadcastAddr = netip.AddrFrom4([4]byte{255, 255, 255, 255})
+
+// fanout holds the settings for sending multicast and broadcast packets from the tun device to every established
+// tunnel. Every copy is checked by the firewall on its own and the copies sent per second are capped so a single
+// chatty service can not flood the whole network.
+type fanout struct {
+	// groups is the set of certificate groups a host needs one of to be sent copies, nil sends to everyone
+	groups map[string]struct{}
+	// rate is the copies sent per second, 0 is unlimited
+	rate   float64
+	bucket *tokenBucket
+
+	metricSent    metrics.Counter
+	metricLimited metrics.Counter
+}
+
+// newFanoutFromConfig returns nil if fanout is not enabled
+func newFanoutFromConfig(c *config.C) (*fanout, error) {
+	if !c.GetBool("tun.fanout.enabled", false) {
+		return nil, nil
+	}
+
+	rate := c.GetInt("tun.fanout.rate", defaultFanoutRate)
+	if rate < 0 {
+		return nil, fmt.Errorf("tun.fanout.rate must not be negative: %v", rate)
+	}
+
+	fo := &fanout{
+		rate:          float64(rate),
+		metricSent:    metrics.GetOrRegisterCounter("fanout.sent", nil),
+		metricLimited: metrics.GetOrRegisterCounter("fanout.rate_limited", nil),
+	}
+
+	if rate > 0 {
+		fo.bucket = newTokenBucket(fo.rate, fo.rate, time.Now())
+	}
+
+	if groups := c.GetStringSlice("tun.fanout.groups", nil); len(groups) > 0 {
+		fo.groups = make(map[string]struct{}, len(groups))
+		for _, g := range groups {
+			fo.groups[g] = struct{}{}
+		}
+	}
+
+	return fo, nil
+}
+
+// allowCert returns true if the certificate has a group that is sent copies
+func (fo *fanout) allowCert(c *cert.CachedCertificate) bool {
+	if fo.groups == nil {
+		return true
+	}
+
+	if c == nil {
+		return false
+	}
+
+	for g := range fo.groups {
+		if _, ok := c.InvertedGroups[g]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// allow returns true if one more copy is within the rate limit
+func (fo *fanout) allow(now time.Time) bool {
+	if fo.bucket == nil || fo.bucket.allow(now, 1) {
+		return true
+	}
+	fo.metricLimited.Inc(1)
+	return false
+}
+
+// isFanoutAddr is true for destinations that are not a single host, multicast groups and broadcast addresses
+func (f *Interface) isFanoutAddr(ip netip.Addr) bool {
+	return ip.IsMulticast() || ip == f.myBroadcastAddr || ip == limitedBroadcastAddr
+}
+
+// reloadFanout swaps in new fanout settings, the initial settings are handed to NewInterface so errors stop startup
+func (f *Interface) reloadFanout(c *config.C) {
+	if !c.HasChanged("tun.fanout") {
+		return
+	}
+
+	fo, err := newFanoutFromConfig(c)
+	if err != nil {
+		f.l.WithError(err).Error("Failed to reload tun.fanout, keeping the previous settings")
+		return
+	}
+
+	f.fanout.Store(fo)
+	if fo == nil {
+		f.l.Info("tun.fanout has been disabled")
+	} else {
+		f.l.WithField("rate", fo.rate).WithField("groups", fo.groups).Info("tun.fanout has changed")
+	}
+}
+
+// fanoutInsidePacket sends a copy of a multicast or broadcast packet read from the tun device to every established
+// tunnel the firewall and rate limit let it through to
+func (f *Interface) fanoutInsidePacket(fo *fanout, packet []byte, fwPacket *firewall.Packet, nb, out []byte, q int, localCache firewall.ConntrackCache, batch *udp.Batch) {
+	var hostinfos []*HostInfo
+	f.hostMap.ForEachVpnIp(func(hostinfo *HostInfo) {
+		hostinfos = append(hostinfos, hostinfo)
+	})
+
+	now := time.Now()
+	for _, hostinfo := range hostinfos {
+		if !fo.allowCert(hostinfo.GetCert()) {
+			continue
+		}
+
+		dropReason := f.firewall.DropFanout(*fwPacket, false, hostinfo, f.pki.GetCAPool(), localCache)
+		if dropReason != nil {
+			if f.l.Level >= logrus.DebugLevel {
+				hostinfo.logger(f.l).
+					WithField("fwPacket", fwPacket).
+					WithField("reason", dropReason).
+					Debugln("dropping outbound fanout packet")
+			}
+			continue
+		}
+
+		if !fo.allow(now) {
+			// Every tunnel after this one would be over the limit too
+			return
+		}
+
+		fo.metricSent.Inc(1)
+		f.sendNoMetricsBatch(header.Message, 0, hostinfo.ConnectionState, hostinfo, netip.AddrPort{}, packet, nb, out, q, batch)
+	}
+}
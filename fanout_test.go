@@ -0,0 +1,72 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewFanoutFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	fo, err := newFanoutFromConfig(c)
+	require.NoError(t, err)
+	assert.Nil(t, fo)
+
+	c.Settings["tun"] = map[interface{}]interface{}{"fanout": map[interface{}]interface{}{"enabled": true}}
+	fo, err = newFanoutFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, float64(defaultFanoutRate), fo.rate)
+	assert.Nil(t, fo.groups)
+	assert.True(t, fo.allowCert(nil))
+
+	c.Settings["tun"] = map[interface{}]interface{}{"fanout": map[interface{}]interface{}{"enabled": true, "rate": -1}}
+	_, err = newFanoutFromConfig(c)
+	assert.EqualError(t, err, "tun.fanout.rate must not be negative: -1")
+
+	c.Settings["tun"] = map[interface{}]interface{}{"fanout": map[interface{}]interface{}{
+		"enabled": true,
+		"rate":    0,
+		"groups":  []interface{}{"mdns", "cluster"},
+	}}
+	fo, err = newFanoutFromConfig(c)
+	require.NoError(t, err)
+	assert.Nil(t, fo.bucket)
+	assert.False(t, fo.allowCert(nil))
+	assert.False(t, fo.allowCert(&cert.CachedCertificate{InvertedGroups: map[string]struct{}{"other": {}}}))
+	assert.True(t, fo.allowCert(&cert.CachedCertificate{InvertedGroups: map[string]struct{}{"cluster": {}}}))
+}
+
+func TestFanout_allow(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["tun"] = map[interface{}]interface{}{"fanout": map[interface{}]interface{}{"enabled": true, "rate": 10}}
+	fo, err := newFanoutFromConfig(c)
+	require.NoError(t, err)
+
+	// A full second worth of copies can go out at once, then they trickle out at the rate
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		assert.True(t, fo.allow(now))
+	}
+	assert.False(t, fo.allow(now))
+	assert.False(t, fo.allow(now.Add(50*time.Millisecond)))
+	assert.True(t, fo.allow(now.Add(100*time.Millisecond)))
+}
+
+func TestInterface_isFanoutAddr(t *testing.T) {
+	f := &Interface{myBroadcastAddr: netip.MustParseAddr("10.128.0.255")}
+	assert.True(t, f.isFanoutAddr(netip.MustParseAddr("224.0.0.251")))
+	assert.True(t, f.isFanoutAddr(netip.MustParseAddr("239.255.255.250")))
+	assert.True(t, f.isFanoutAddr(netip.MustParseAddr("10.128.0.255")))
+	assert.True(t, f.isFanoutAddr(netip.MustParseAddr("255.255.255.255")))
+	assert.False(t, f.isFanoutAddr(netip.MustParseAddr("10.128.0.2")))
+	assert.False(t, f.isFanoutAddr(netip.MustParseAddr("10.129.0.255")))
+}
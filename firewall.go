@@ -418,33 +418,47 @@ var ErrNoMatchingRule = errors.New("no matching rule in firewall table")
 // Drop returns an error if the packet should be dropped, explaining why. It
 // returns nil if the packet should not be dropped.
 func (f *Firewall) Drop(fp firewall.Packet, incoming bool, h *HostInfo, caPool *cert.CAPool, localCache firewall.ConntrackCache) error {
+	return f.drop(fp, incoming, false, h, caPool, localCache)
+}
+
+// DropFanout is Drop for a broadcast or multicast packet, its destination is not an address of either host so only
+// the source is checked against the certificates
+func (f *Firewall) DropFanout(fp firewall.Packet, incoming bool, h *HostInfo, caPool *cert.CAPool, localCache firewall.ConntrackCache) error {
+	return f.drop(fp, incoming, true, h, caPool, localCache)
+}
+
+func (f *Firewall) drop(fp firewall.Packet, incoming, fanout bool, h *HostInfo, caPool *cert.CAPool, localCache firewall.ConntrackCache) error {
 	// Check if we spoke to this tuple, if we did then allow this packet
 	if f.inConns(fp, h, caPool, localCache) {
 		return nil
 	}
 
-	// Make sure remote address matches nebula certificate
-	if remoteCidr := h.remoteCidr; remoteCidr != nil {
-		//TODO: this would be better if we had a least specific match lookup, could waste time here, need to benchmark since the algo is different
-		_, ok := remoteCidr.Lookup(fp.RemoteIP)
-		if !ok {
-			f.metrics(incoming).droppedRemoteIP.Inc(1)
-			return ErrInvalidRemoteIP
-		}
-	} else {
-		// Simple case: Certificate has one IP and no subnets
-		if fp.RemoteIP != h.vpnIp {
-			f.metrics(incoming).droppedRemoteIP.Inc(1)
-			return ErrInvalidRemoteIP
+	// Make sure remote address matches nebula certificate, an outgoing fanout packet is addressed to a group instead
+	if !fanout || incoming {
+		if remoteCidr := h.remoteCidr; remoteCidr != nil {
+			//TODO: this would be better if we had a least specific match lookup, could waste time here, need to benchmark since the algo is different
+			_, ok := remoteCidr.Lookup(fp.RemoteIP)
+			if !ok {
+				f.metrics(incoming).droppedRemoteIP.Inc(1)
+				return ErrInvalidRemoteIP
+			}
+		} else {
+			// Simple case: Certificate has one IP and no subnets
+			if fp.RemoteIP != h.vpnIp {
+				f.metrics(incoming).droppedRemoteIP.Inc(1)
+				return ErrInvalidRemoteIP
+			}
 		}
 	}
 
-	// Make sure we are supposed to be handling this local ip address
+	// Make sure we are supposed to be handling this local ip address, an incoming fanout packet is addressed to a group
 	//TODO: this would be better if we had a least specific match lookup, could waste time here, need to benchmark since the algo is different
-	_, ok := f.localIps.Lookup(fp.LocalIP)
-	if !ok {
-		f.metrics(incoming).droppedLocalIP.Inc(1)
-		return ErrInvalidLocalIP
+	if !fanout || !incoming {
+		_, ok := f.localIps.Lookup(fp.LocalIP)
+		if !ok {
+			f.metrics(incoming).droppedLocalIP.Inc(1)
+			return ErrInvalidLocalIP
+		}
 	}
 
 	table := f.OutRules
@@ -563,6 +577,17 @@ func (f *Firewall) inConns(fp firewall.Packet, h *HostInfo, caPool *cert.CAPool,
 	return true
 }
 
+// tracked returns true if fp has a conntrack entry that has not expired at now. Entries are neither purged nor checked
+// against a newer rule set here, the next packet of the flow takes care of that.
+func (f *Firewall) tracked(fp firewall.Packet, now time.Time) bool {
+	conntrack := f.Conntrack
+	conntrack.Lock()
+	defer conntrack.Unlock()
+
+	c, ok := conntrack.Conns[fp]
+	return ok && c.Expires.After(now)
+}
+
 func (f *Firewall) addConn(fp firewall.Packet, incoming bool) {
 	var timeout time.Duration
 	c := &conn{}
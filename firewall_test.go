@@ -302,6 +302,83 @@ func BenchmarkFirewallTable_match(b *testing.B) {
 	})
 }
 
+func TestFirewall_DropFanout(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	c := dummyCert{
+		name:     "host1",
+		networks: []netip.Prefix{netip.MustParsePrefix("1.2.3.4/24")},
+		groups:   []string{"default-group"},
+		issuer:   "signer-shasum",
+	}
+	h := HostInfo{
+		ConnectionState: &ConnectionState{
+			peerCert: &cert.CachedCertificate{
+				Certificate:    &c,
+				InvertedGroups: map[string]struct{}{"default-group": {}},
+			},
+		},
+		vpnIp: netip.MustParseAddr("1.2.3.4"),
+	}
+	h.CreateRemoteCIDR(&c)
+
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"any"}, "", netip.Prefix{}, netip.Prefix{}, "", ""))
+	assert.Nil(t, fw.AddRule(false, firewall.ProtoAny, 0, 0, []string{"any"}, "", netip.Prefix{}, netip.Prefix{}, "", ""))
+	cp := cert.NewCAPool()
+
+	// Outbound to a group, only our own address has to be ours
+	out := firewall.Packet{
+		LocalIP:    netip.MustParseAddr("1.2.3.4"),
+		RemoteIP:   netip.MustParseAddr("224.0.0.251"),
+		LocalPort:  5353,
+		RemotePort: 5353,
+		Protocol:   firewall.ProtoUDP,
+	}
+	assert.Equal(t, ErrInvalidRemoteIP, fw.Drop(out, false, &h, cp, nil))
+	assert.NoError(t, fw.DropFanout(out, false, &h, cp, nil))
+	out.LocalIP = netip.MustParseAddr("9.9.9.9")
+	assert.Equal(t, ErrInvalidLocalIP, fw.DropFanout(out, false, &h, cp, nil))
+
+	// Inbound to a group, the sender still has to be who their certificate says
+	in := firewall.Packet{
+		LocalIP:    netip.MustParseAddr("255.255.255.255"),
+		RemoteIP:   netip.MustParseAddr("1.2.3.4"),
+		LocalPort:  137,
+		RemotePort: 137,
+		Protocol:   firewall.ProtoUDP,
+	}
+	assert.Equal(t, ErrInvalidLocalIP, fw.Drop(in, true, &h, cp, nil))
+	assert.NoError(t, fw.DropFanout(in, true, &h, cp, nil))
+	in.RemoteIP = netip.MustParseAddr("9.9.9.9")
+	assert.Equal(t, ErrInvalidRemoteIP, fw.DropFanout(in, true, &h, cp, nil))
+}
+
+func TestFirewall_tracked(t *testing.T) {
+	l := test.NewLogger()
+	c := dummyCert{networks: []netip.Prefix{netip.MustParsePrefix("1.2.3.4/24")}}
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+
+	fp := firewall.Packet{
+		LocalIP:    netip.MustParseAddr("1.2.3.4"),
+		RemoteIP:   netip.MustParseAddr("1.2.3.5"),
+		LocalPort:  53,
+		RemotePort: 1000,
+		Protocol:   firewall.ProtoUDP,
+	}
+
+	now := time.Now()
+	assert.False(t, fw.tracked(fp, now))
+
+	fw.addConn(fp, true)
+	assert.True(t, fw.tracked(fp, now))
+
+	// The udp timeout is a minute
+	assert.False(t, fw.tracked(fp, now.Add(2*time.Minute)))
+}
+
 func TestFirewall_Drop2(t *testing.T) {
 	l := test.NewLogger()
 	ob := &bytes.Buffer{}
@@ -0,0 +1,133 @@
+package nebula
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// handshakeCookieRotation is how often the cookie secret changes, a cookie is valid for up to twice this long
+	handshakeCookieRotation = 2 * time.Minute
+
+	// handshakeSourceIdleTimeout is how long an unused per source ip rate limiter is kept around
+	handshakeSourceIdleTimeout = time.Minute
+)
+
+// handshakeGuard protects the responder side of a handshake from floods. Every source ip is rate limited and once
+// more than cookieThreshold handshakes a second arrive a source must echo back a cookie, proving it owns the address,
+// before we verify its certificate or do any DH work.
+type handshakeGuard struct {
+	// load is drained by every incoming handshake, cookies are required while it is empty. nil never requires cookies
+	load *tokenBucket
+	// perIpRate is the number of handshakes a second allowed from a single ip, 0 is unlimited
+	perIpRate float64
+
+	sync.Mutex
+	secrets   [2][]byte
+	rotated   time.Time
+	sources   map[netip.Addr]*tokenBucket
+	lastPrune time.Time
+}
+
+func newHandshakeGuard(cookieThreshold, perIpRate int, now time.Time) *handshakeGuard {
+	g := &handshakeGuard{
+		perIpRate: float64(perIpRate),
+		sources:   map[netip.Addr]*tokenBucket{},
+	}
+
+	if cookieThreshold > 0 {
+		g.load = newTokenBucket(float64(cookieThreshold), float64(cookieThreshold), now)
+	}
+
+	return g
+}
+
+// allowSource returns true if addr has not sent too many handshakes recently
+func (g *handshakeGuard) allowSource(addr netip.Addr, now time.Time) bool {
+	if g.perIpRate <= 0 {
+		return true
+	}
+
+	g.Lock()
+	b, ok := g.sources[addr]
+	if !ok {
+		if now.Sub(g.lastPrune) > handshakeSourceIdleTimeout {
+			for k, v := range g.sources {
+				if now.Sub(v.idleSince()) > handshakeSourceIdleTimeout {
+					delete(g.sources, k)
+				}
+			}
+			g.lastPrune = now
+		}
+
+		b = newTokenBucket(g.perIpRate, max(g.perIpRate, 1), now)
+		g.sources[addr] = b
+	}
+	g.Unlock()
+
+	return b.allow(now, 1)
+}
+
+// underLoad records an incoming handshake and returns true if cookies should be required
+func (g *handshakeGuard) underLoad(now time.Time) bool {
+	if g.load == nil {
+		return false
+	}
+	return !g.load.allow(now, 1)
+}
+
+// cookie returns the cookie addr must send back in its next handshake
+func (g *handshakeGuard) cookie(addr netip.AddrPort, now time.Time) uint64 {
+	g.Lock()
+	defer g.Unlock()
+	g.rotate(now)
+	return cookieFor(g.secrets[0], addr)
+}
+
+// validCookie returns true if cookie was handed out to addr recently
+func (g *handshakeGuard) validCookie(addr netip.AddrPort, cookie uint64, now time.Time) bool {
+	if cookie == 0 {
+		return false
+	}
+
+	g.Lock()
+	defer g.Unlock()
+	g.rotate(now)
+	for _, s := range g.secrets {
+		if s != nil && cookieFor(s, addr) == cookie {
+			return true
+		}
+	}
+	return false
+}
+
+// rotate replaces the cookie secret if it is too old, the previous secret is kept so recent cookies remain valid.
+// The lock must be held.
+func (g *handshakeGuard) rotate(now time.Time) {
+	if g.secrets[0] != nil && now.Sub(g.rotated) < handshakeCookieRotation {
+		return
+	}
+
+	s := make([]byte, 32)
+	if _, err := rand.Read(s); err != nil {
+		// Keep using the current secret and try again next time. If there is no secret yet no cookie will validate.
+		return
+	}
+
+	g.secrets[1] = g.secrets[0]
+	g.secrets[0] = s
+	g.rotated = now
+}
+
+func cookieFor(secret []byte, addr netip.AddrPort) uint64 {
+	mac := hmac.New(sha256.New, secret)
+	b := addr.Addr().As16()
+	mac.Write(b[:])
+	mac.Write(binary.BigEndian.AppendUint16(nil, addr.Port()))
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
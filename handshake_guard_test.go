@@ -0,0 +1,69 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandshakeGuard_allowSource(t *testing.T) {
+	now := time.Now()
+	a := netip.MustParseAddr("1.1.1.1")
+	b := netip.MustParseAddr("2.2.2.2")
+
+	// Unlimited by default
+	g := newHandshakeGuard(0, 0, now)
+	for i := 0; i < 100; i++ {
+		assert.True(t, g.allowSource(a, now))
+	}
+
+	g = newHandshakeGuard(0, 2, now)
+	assert.True(t, g.allowSource(a, now))
+	assert.True(t, g.allowSource(a, now))
+	assert.False(t, g.allowSource(a, now))
+
+	// Other sources have their own budget
+	assert.True(t, g.allowSource(b, now))
+
+	// The budget refills over time
+	assert.True(t, g.allowSource(a, now.Add(500*time.Millisecond)))
+	assert.False(t, g.allowSource(a, now.Add(500*time.Millisecond)))
+
+	// Idle sources are forgotten
+	g.allowSource(netip.MustParseAddr("3.3.3.3"), now.Add(2*handshakeSourceIdleTimeout))
+	assert.Len(t, g.sources, 1)
+}
+
+func TestHandshakeGuard_cookies(t *testing.T) {
+	now := time.Now()
+	a := netip.MustParseAddrPort("1.1.1.1:4242")
+	b := netip.MustParseAddrPort("1.1.1.1:4243")
+
+	// Cookies are never required without a threshold
+	g := newHandshakeGuard(0, 0, now)
+	for i := 0; i < 100; i++ {
+		assert.False(t, g.underLoad(now))
+	}
+
+	g = newHandshakeGuard(2, 0, now)
+	assert.False(t, g.underLoad(now))
+	assert.False(t, g.underLoad(now))
+	assert.True(t, g.underLoad(now))
+	assert.False(t, g.underLoad(now.Add(time.Second)))
+
+	c := g.cookie(a, now)
+	assert.True(t, g.validCookie(a, c, now))
+	assert.False(t, g.validCookie(b, c, now), "cookies are bound to the address they were sent to")
+	assert.False(t, g.validCookie(a, 0, now))
+	assert.False(t, g.validCookie(a, c+1, now))
+
+	// Cookies survive a single rotation
+	now = now.Add(handshakeCookieRotation)
+	assert.True(t, g.validCookie(a, c, now))
+	assert.NotEqual(t, c, g.cookie(a, now))
+
+	now = now.Add(handshakeCookieRotation)
+	assert.False(t, g.validCookie(a, c, now))
+}
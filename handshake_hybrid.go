@@ -0,0 +1,73 @@
+package nebula
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/flynn/noise"
+	"golang.org/x/crypto/hkdf"
+)
+
+// handshakeHybridFallbackAfter is the number of attempts a preferred hybrid handshake is sent before we assume the
+// remote does not support it and fall back to a classic handshake
+const handshakeHybridFallbackAfter = 4
+
+// hybridInfo is mixed into the key derivation so hybrid session keys can not be confused with any other key material
+const hybridInfo = "NEBULA HYBRID MLKEM768"
+
+type PostQuantumMode int
+
+const (
+	// PostQuantumNone sends classic handshakes, hybrid handshakes from others are still answered
+	PostQuantumNone PostQuantumMode = iota
+	// PostQuantumPrefer sends hybrid handshakes and falls back to classic if the remote does not answer
+	PostQuantumPrefer
+	// PostQuantumRequire only sends and accepts hybrid handshakes
+	PostQuantumRequire
+)
+
+func (m PostQuantumMode) String() string {
+	switch m {
+	case PostQuantumNone:
+		return "none"
+	case PostQuantumPrefer:
+		return "prefer"
+	case PostQuantumRequire:
+		return "require"
+	}
+	return "unknown"
+}
+
+func NewPostQuantumMode(s string) (PostQuantumMode, error) {
+	switch strings.ToLower(s) {
+	case "none":
+		return PostQuantumNone, nil
+	case "prefer":
+		return PostQuantumPrefer, nil
+	case "require":
+		return PostQuantumRequire, nil
+	}
+	return PostQuantumNone, fmt.Errorf("unknown post quantum mode: %v", s)
+}
+
+// mixHybridSecret derives new session keys from the keys noise arrived at and the ML-KEM shared secret. An attacker has
+// to break both the DH exchange and ML-KEM to recover the session keys. hash is the noise handshake hash, which binds
+// the new keys to the full handshake transcript including the ML-KEM key and ciphertext.
+func mixHybridSecret(suite noise.CipherSuite, hash, secret []byte, states ...*noise.CipherState) ([]*noise.CipherState, error) {
+	out := make([]*noise.CipherState, len(states))
+	for i, cs := range states {
+		k := cs.UnsafeKey()
+
+		var nk [32]byte
+		r := hkdf.New(sha256.New, append(k[:], secret...), hash, []byte(hybridInfo))
+		if _, err := io.ReadFull(r, nk[:]); err != nil {
+			return nil, err
+		}
+
+		out[i] = noise.UnsafeNewCipherState(suite, nk, 0)
+	}
+
+	return out, nil
+}
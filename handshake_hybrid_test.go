@@ -0,0 +1,59 @@
+package nebula
+
+import (
+	"crypto/mlkem"
+	"testing"
+
+	"github.com/flynn/noise"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPostQuantumMode(t *testing.T) {
+	for _, mode := range []PostQuantumMode{PostQuantumNone, PostQuantumPrefer, PostQuantumRequire} {
+		m, err := NewPostQuantumMode(mode.String())
+		require.NoError(t, err)
+		assert.Equal(t, mode, m)
+	}
+
+	_, err := NewPostQuantumMode("sometimes")
+	assert.EqualError(t, err, "unknown post quantum mode: sometimes")
+}
+
+func TestMixHybridSecret(t *testing.T) {
+	suite := noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
+	hash := []byte("handshake hash")
+
+	dk, err := mlkem.GenerateKey768()
+	require.NoError(t, err)
+	mySecret, ct := dk.EncapsulationKey().Encapsulate()
+	theirSecret, err := dk.Decapsulate(ct)
+	require.NoError(t, err)
+
+	k := [32]byte{1}
+	orig := noise.UnsafeNewCipherState(suite, k, 0)
+
+	mine, err := mixHybridSecret(suite, hash, mySecret, orig)
+	require.NoError(t, err)
+	theirs, err := mixHybridSecret(suite, hash, theirSecret, noise.UnsafeNewCipherState(suite, k, 0))
+	require.NoError(t, err)
+
+	// Both sides arrive at the same new key
+	assert.Equal(t, mine[0].UnsafeKey(), theirs[0].UnsafeKey())
+	assert.NotEqual(t, k, mine[0].UnsafeKey())
+
+	ct1, err := mine[0].Encrypt(nil, nil, []byte("hi"))
+	require.NoError(t, err)
+	pt, err := theirs[0].Decrypt(nil, nil, ct1)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hi"), pt)
+
+	// A different secret or transcript changes the key
+	other, err := mixHybridSecret(suite, hash, make([]byte, 32), orig)
+	require.NoError(t, err)
+	assert.NotEqual(t, mine[0].UnsafeKey(), other[0].UnsafeKey())
+
+	other, err = mixHybridSecret(suite, []byte("other hash"), mySecret, orig)
+	require.NoError(t, err)
+	assert.NotEqual(t, mine[0].UnsafeKey(), other[0].UnsafeKey())
+}
@@ -1,7 +1,10 @@
 package nebula
 
 import (
+	"crypto/mlkem"
+	"errors"
 	"net/netip"
+	"slices"
 	"time"
 
 	"github.com/flynn/noise"
@@ -11,6 +14,8 @@ import (
 
 // NOISE IX Handshakes
 
+var errHandshakeCipher = errors.New("handshake cipher is not accepted")
+
 // This function constructs a handshake packet, but does not actually send it
 // Sending is done by the handshake manager
 func ixHandshakeStage0(f *Interface, hh *HandshakeHostInfo) bool {
@@ -21,14 +26,39 @@ func ixHandshakeStage0(f *Interface, hh *HandshakeHostInfo) bool {
 		return false
 	}
 
+	hh.hybrid = f.handshakeManager.config.postQuantum != PostQuantumNone
+	return ixHandshakeStage0Build(f, hh)
+}
+
+// ixHandshakeStage0Build creates a fresh noise state and handshake packet for an index that has already been allocated,
+// including any cookie the responder has asked for
+func ixHandshakeStage0Build(f *Interface, hh *HandshakeHostInfo) bool {
 	certState := f.pki.GetCertState()
-	ci := NewConnectionState(f.l, f.cipher, certState, true, noise.HandshakeIX, []byte{}, 0)
+	ci := NewConnectionState(f.l, f.ciphers[0], certState, true, noise.HandshakeIX, f.pki.GetPsk().Primary(), 0)
 	hh.hostinfo.ConnectionState = ci
 
 	hsProto := &NebulaHandshakeDetails{
-		InitiatorIndex: hh.hostinfo.localIndexId,
-		Time:           uint64(time.Now().UnixNano()),
-		Cert:           certState.RawCertificateNoKey,
+		InitiatorIndex:     hh.hostinfo.localIndexId,
+		Time:               uint64(time.Now().UnixNano()),
+		Cert:               certState.RawCertificateNoKey,
+		Cookie:             hh.cookie,
+		Ciphers:            f.ciphers,
+		InitiatorMultiPort: f.multiPort.details(),
+	}
+
+	subtype := header.HandshakeIXPSK0
+	hh.kemKey = nil
+	if hh.hybrid {
+		kemKey, err := mlkem.GenerateKey768()
+		if err != nil {
+			f.l.WithError(err).WithField("vpnIp", hh.hostinfo.vpnIp).
+				WithField("handshake", m{"stage": 0, "style": "ix_psk0"}).Error("Failed to generate ML-KEM key")
+			return false
+		}
+
+		hh.kemKey = kemKey
+		hsProto.KemKey = kemKey.EncapsulationKey().Bytes()
+		subtype = header.HandshakeIXPSK0Hybrid
 	}
 
 	hsBytes := []byte{}
@@ -36,7 +66,7 @@ func ixHandshakeStage0(f *Interface, hh *HandshakeHostInfo) bool {
 	hs := &NebulaHandshake{
 		Details: hsProto,
 	}
-	hsBytes, err = hs.Marshal()
+	hsBytes, err := hs.Marshal()
 
 	if err != nil {
 		f.l.WithError(err).WithField("vpnIp", hh.hostinfo.vpnIp).
@@ -44,7 +74,7 @@ func ixHandshakeStage0(f *Interface, hh *HandshakeHostInfo) bool {
 		return false
 	}
 
-	h := header.Encode(make([]byte, header.Len), header.Version, header.Handshake, header.HandshakeIXPSK0, 0, 1)
+	h := header.Encode(make([]byte, header.Len), header.Version, header.Handshake, subtype, 0, 1)
 
 	msg, _, _, err := ci.H.WriteMessage(h, hsBytes)
 	if err != nil {
@@ -64,17 +94,33 @@ func ixHandshakeStage0(f *Interface, hh *HandshakeHostInfo) bool {
 
 func ixHandshakeStage1(f *Interface, addr netip.AddrPort, via *ViaSender, packet []byte, h *header.H) {
 	certState := f.pki.GetCertState()
-	ci := NewConnectionState(f.l, f.cipher, certState, false, noise.HandshakeIX, []byte{}, 0)
-	// Mark packet 1 as seen so it doesn't show up as missed
-	ci.window.Update(f.l, 1)
+	psk := f.pki.GetPsk()
 
-	msg, _, _, err := ci.H.ReadMessage(nil, packet[header.Len:])
+	ci, msg, err := ixHandshakeStage1Read(f, certState, psk, packet[header.Len:])
 	if err != nil {
+		if err == errHandshakeCipher {
+			f.l.WithField("udpAddr", addr).
+				WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+				Info("Refusing handshake, the initiator used a cipher we do not accept")
+			return
+		}
+
+		if psk.Mode() != PskNone {
+			f.metricHandshakePskFailed.Inc(1)
+			f.l.WithError(err).WithField("udpAddr", addr).
+				WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+				Debug("Failed to call noise.ReadMessage with any accepted pki.psk")
+			return
+		}
+
 		f.l.WithError(err).WithField("udpAddr", addr).
 			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Error("Failed to call noise.ReadMessage")
 		return
 	}
 
+	// Mark packet 1 as seen so it doesn't show up as missed
+	ci.window.Update(f.l, 1)
+
 	hs := &NebulaHandshake{}
 	err = hs.Unmarshal(msg)
 	/*
@@ -86,6 +132,49 @@ func ixHandshakeStage1(f *Interface, addr netip.AddrPort, via *ViaSender, packet
 		return
 	}
 
+	// Initiators that do not advertise any ciphers expect the tunnel to use the handshake cipher
+	if len(hs.Details.Ciphers) > 0 {
+		ci.cipher = negotiateCipher(f.ciphers, hs.Details.Ciphers)
+		if ci.cipher == "" {
+			f.l.WithField("udpAddr", addr).WithField("ciphers", hs.Details.Ciphers).
+				WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+				Info("Refusing handshake, no cipher in common with the initiator")
+			return
+		}
+	}
+
+	ci.multiport = negotiateMultiPort(f.multiPort, hs.Details.InitiatorMultiPort)
+	if ci.multiport != nil {
+		ci.window = multiportWindow(f.l)
+	}
+
+	var kemKey *mlkem.EncapsulationKey768
+	if h.Subtype == header.HandshakeIXPSK0Hybrid {
+		kemKey, err = mlkem.NewEncapsulationKey768(hs.Details.KemKey)
+		if err != nil {
+			f.l.WithError(err).WithField("udpAddr", addr).
+				WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Error("Invalid ML-KEM key in hybrid handshake")
+			return
+		}
+
+	} else if f.handshakeManager.config.postQuantum == PostQuantumRequire {
+		f.l.WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+			Info("Refusing classic handshake, handshakes.post_quantum is require")
+		return
+	}
+
+	// Certificate verification and the DH work to respond are expensive, when we are busy make sure the sender owns
+	// the address before doing either
+	if addr.IsValid() {
+		now := time.Now()
+		hm := f.handshakeManager
+		if hm.guard.underLoad(now) && !hm.guard.validCookie(addr, hs.Details.Cookie, now) {
+			hm.sendCookie(addr, hs.Details.InitiatorIndex, now)
+			return
+		}
+	}
+
 	remoteCert, err := RecombineCertAndValidate(ci.H, hs.Details.Cert, f.pki.GetCAPool())
 	if err != nil {
 		e := f.l.WithError(err).WithField("udpAddr", addr).
@@ -169,6 +258,16 @@ func ixHandshakeStage1(f *Interface, addr netip.AddrPort, via *ViaSender, packet
 	// Update the time in case their clock is way off from ours
 	hs.Details.Time = uint64(time.Now().UnixNano())
 
+	hs.Details.Ciphers = nil
+	hs.Details.Cipher = ci.cipher
+	hs.Details.ResponderMultiPort = f.multiPort.details()
+
+	var kemSecret []byte
+	hs.Details.KemKey = nil
+	if kemKey != nil {
+		kemSecret, hs.Details.KemCiphertext = kemKey.Encapsulate()
+	}
+
 	hsBytes, err := hs.Marshal()
 	if err != nil {
 		f.l.WithError(err).WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
@@ -179,7 +278,7 @@ func ixHandshakeStage1(f *Interface, addr netip.AddrPort, via *ViaSender, packet
 		return
 	}
 
-	nh := header.Encode(make([]byte, header.Len), header.Version, header.Handshake, header.HandshakeIXPSK0, hs.Details.InitiatorIndex, 2)
+	nh := header.Encode(make([]byte, header.Len), header.Version, header.Handshake, h.Subtype, hs.Details.InitiatorIndex, 2)
 	msg, dKey, eKey, err := ci.H.WriteMessage(nh, hsBytes)
 	if err != nil {
 		f.l.WithError(err).WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
@@ -197,6 +296,24 @@ func ixHandshakeStage1(f *Interface, addr netip.AddrPort, via *ViaSender, packet
 		return
 	}
 
+	if kemSecret != nil {
+		keys, err := mixHybridSecret(transportSuite(ci.cipher), ci.H.ChannelBinding(), kemSecret, dKey, eKey)
+		if err != nil {
+			f.l.WithError(err).WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
+				WithField("certName", certName).
+				WithField("fingerprint", fingerprint).
+				WithField("issuer", issuer).
+				WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Error("Failed to mix ML-KEM secret into keys")
+			return
+		}
+		dKey, eKey = keys[0], keys[1]
+		ci.postQuantum = true
+
+	} else {
+		keys := transportKeys(ci.cipher, dKey, eKey)
+		dKey, eKey = keys[0], keys[1]
+	}
+
 	hostinfo.HandshakePacket[0] = make([]byte, len(packet[header.Len:]))
 	copy(hostinfo.HandshakePacket[0], packet[header.Len:])
 
@@ -210,8 +327,8 @@ func ixHandshakeStage1(f *Interface, addr netip.AddrPort, via *ViaSender, packet
 	ci.window.Update(f.l, 2)
 
 	ci.peerCert = remoteCert
-	ci.dKey = NewNebulaCipherState(dKey)
-	ci.eKey = NewNebulaCipherState(eKey)
+	ci.dKey = NewNebulaCipherState(dKey, ci.cipher)
+	ci.eKey = NewNebulaCipherState(eKey, ci.cipher)
 
 	hostinfo.remotes = f.lightHouse.QueryCache(vpnIp)
 	hostinfo.SetRemote(addr)
@@ -332,12 +449,42 @@ func ixHandshakeStage1(f *Interface, addr netip.AddrPort, via *ViaSender, packet
 	}
 
 	f.connectionManager.AddTrafficWatch(hostinfo.localIndexId)
+	f.sprayCompleted(vpnIp, addr)
 
 	hostinfo.remotes.ResetBlockedRemotes()
 
 	return
 }
 
+// ixHandshakeStage1Read tries each cipher we accept with each accepted pre-shared key until one reads the initiators
+// handshake packet. The psk is mixed in before the initiators static key is encrypted so a handshake without a valid
+// psk fails here before we spend any time on the certificate.
+func ixHandshakeStage1Read(f *Interface, certState *CertState, psk *Psk, packet []byte) (*ConnectionState, []byte, error) {
+	var err error
+	for _, cipher := range f.ciphers {
+		for _, key := range psk.Accepted() {
+			ci := NewConnectionState(f.l, cipher, certState, false, noise.HandshakeIX, key, 0)
+			var msg []byte
+			msg, _, _, err = ci.H.ReadMessage(nil, packet)
+			if err != nil {
+				continue
+			}
+
+			// Nothing in the first packet is authenticated without a psk so any cipher will read it, make sure we have
+			// the handshake cipher the initiator advertised before we respond with it
+			hs := &NebulaHandshake{}
+			if hs.Unmarshal(msg) == nil && hs.Details != nil && len(hs.Details.Ciphers) > 0 && hs.Details.Ciphers[0] != cipher {
+				err = errHandshakeCipher
+				break
+			}
+
+			return ci, msg, nil
+		}
+	}
+
+	return nil, nil, err
+}
+
 func ixHandshakeStage2(f *Interface, addr netip.AddrPort, via *ViaSender, hh *HandshakeHostInfo, packet []byte, h *header.H) bool {
 	if hh == nil {
 		// Nothing here to tear down, got a bogus stage 2 packet
@@ -386,6 +533,55 @@ func ixHandshakeStage2(f *Interface, addr netip.AddrPort, via *ViaSender, hh *Ha
 		return true
 	}
 
+	// Responders that do not know about cipher negotiation use the handshake cipher for the tunnel
+	if hs.Details.Cipher != "" {
+		if !slices.Contains(f.ciphers, hs.Details.Cipher) {
+			f.l.WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).WithField("cipher", hs.Details.Cipher).
+				WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).Error("Responder chose a cipher we do not accept")
+			return true
+		}
+		ci.cipher = hs.Details.Cipher
+	}
+
+	ci.multiport = negotiateMultiPort(f.multiPort, hs.Details.ResponderMultiPort)
+	if ci.multiport != nil {
+		ci.window = multiportWindow(f.l)
+	}
+
+	if hh.kemKey != nil {
+		// We sent a hybrid handshake, the response must be one too
+		if h.Subtype != header.HandshakeIXPSK0Hybrid {
+			f.l.WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
+				WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).Error("Expected a hybrid handshake response")
+			return true
+		}
+
+		kemSecret, err := hh.kemKey.Decapsulate(hs.Details.KemCiphertext)
+		if err != nil {
+			f.l.WithError(err).WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
+				WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).Error("Invalid ML-KEM ciphertext in hybrid handshake")
+			return true
+		}
+
+		keys, err := mixHybridSecret(transportSuite(ci.cipher), ci.H.ChannelBinding(), kemSecret, eKey, dKey)
+		if err != nil {
+			f.l.WithError(err).WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
+				WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).Error("Failed to mix ML-KEM secret into keys")
+			return true
+		}
+		eKey, dKey = keys[0], keys[1]
+		ci.postQuantum = true
+
+	} else if h.Subtype == header.HandshakeIXPSK0Hybrid {
+		f.l.WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).Error("Unexpected hybrid handshake response")
+		return true
+
+	} else {
+		keys := transportKeys(ci.cipher, eKey, dKey)
+		eKey, dKey = keys[0], keys[1]
+	}
+
 	remoteCert, err := RecombineCertAndValidate(ci.H, hs.Details.Cert, f.pki.GetCAPool())
 	if err != nil {
 		e := f.l.WithError(err).WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
@@ -423,8 +619,8 @@ func ixHandshakeStage2(f *Interface, addr netip.AddrPort, via *ViaSender, hh *Ha
 
 	// Store their cert and our symmetric keys
 	ci.peerCert = remoteCert
-	ci.dKey = NewNebulaCipherState(dKey)
-	ci.eKey = NewNebulaCipherState(eKey)
+	ci.dKey = NewNebulaCipherState(dKey, ci.cipher)
+	ci.eKey = NewNebulaCipherState(eKey, ci.cipher)
 
 	// Make sure the current udpAddr being used is set for responding
 	if addr.IsValid() {
@@ -490,6 +686,7 @@ func ixHandshakeStage2(f *Interface, addr netip.AddrPort, via *ViaSender, hh *Ha
 	// Complete our handshake and update metrics, this will replace any existing tunnels for this vpnIp
 	f.handshakeManager.Complete(hostinfo, f)
 	f.connectionManager.AddTrafficWatch(hostinfo.localIndexId)
+	f.sprayCompleted(vpnIp, addr)
 
 	if f.l.Level >= logrus.DebugLevel {
 		hostinfo.logger(f.l).Debugf("Sending %d stored packets", len(hh.packetStore))
@@ -509,3 +706,11 @@ func ixHandshakeStage2(f *Interface, addr netip.AddrPort, via *ViaSender, hh *Ha
 
 	return false
 }
+
+// sprayCompleted tells punchy a direct tunnel to vpnIp is up, relayed and stream tunnels are no success for a spray
+func (f *Interface) sprayCompleted(vpnIp netip.Addr, addr netip.AddrPort) {
+	if f.lightHouse.punchy == nil || !addr.IsValid() || f.lightHouse.hasStream(addr) {
+		return
+	}
+	f.lightHouse.punchy.sprayCompleted(vpnIp)
+}
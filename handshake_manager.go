@@ -3,6 +3,7 @@ package nebula
 import (
 	"bytes"
 	"context"
+	"crypto/mlkem"
 	"crypto/rand"
 	"encoding/binary"
 	"errors"
@@ -18,18 +19,28 @@ import (
 )
 
 const (
-	DefaultHandshakeTryInterval   = time.Millisecond * 100
-	DefaultHandshakeRetries       = 10
-	DefaultHandshakeTriggerBuffer = 64
-	DefaultUseRelays              = true
+	DefaultHandshakeTryInterval     = time.Millisecond * 100
+	DefaultHandshakeRetries         = 10
+	DefaultHandshakeTriggerBuffer   = 64
+	DefaultHandshakeCookieThreshold = 0
+	DefaultUseRelays                = true
+
+	// DefaultHandshakeTCPFallbackAfter is the number of handshake attempts over udp before tcp endpoints are tried too
+	DefaultHandshakeTCPFallbackAfter = 5
+
+	// handshakeRelayFanoutAfter is the number of attempts we send a handshake through only the best established
+	// relay before sending it through every established relay
+	handshakeRelayFanoutAfter = 2
 )
 
 var (
 	defaultHandshakeConfig = HandshakeConfig{
-		tryInterval:   DefaultHandshakeTryInterval,
-		retries:       DefaultHandshakeRetries,
-		triggerBuffer: DefaultHandshakeTriggerBuffer,
-		useRelays:     DefaultUseRelays,
+		tryInterval:      DefaultHandshakeTryInterval,
+		retries:          DefaultHandshakeRetries,
+		triggerBuffer:    DefaultHandshakeTriggerBuffer,
+		useRelays:        DefaultUseRelays,
+		cookieThreshold:  DefaultHandshakeCookieThreshold,
+		tcpFallbackAfter: DefaultHandshakeTCPFallbackAfter,
 	}
 )
 
@@ -39,6 +50,15 @@ type HandshakeConfig struct {
 	triggerBuffer int
 	useRelays     bool
 
+	// cookieThreshold is the number of incoming handshakes a second before we require cookies, 0 never requires them
+	cookieThreshold int
+	// perIpRate is the number of incoming handshakes a second allowed from a single ip, 0 is unlimited
+	perIpRate int
+	// postQuantum controls whether we send and accept hybrid ML-KEM handshakes
+	postQuantum PostQuantumMode
+	// tcpFallbackAfter is the number of attempts before handshakes are also sent to tcp endpoints
+	tcpFallbackAfter int64
+
 	messageMetrics *MessageMetrics
 }
 
@@ -57,6 +77,10 @@ type HandshakeManager struct {
 	messageMetrics         *MessageMetrics
 	metricInitiated        metrics.Counter
 	metricTimedOut         metrics.Counter
+	metricCookiesSent      metrics.Counter
+	metricCookiesReceived  metrics.Counter
+	metricRateLimited      metrics.Counter
+	guard                  *handshakeGuard
 	f                      *Interface
 	l                      *logrus.Logger
 
@@ -71,7 +95,13 @@ type HandshakeHostInfo struct {
 	ready       bool             // Is the handshake ready
 	counter     int64            // How many attempts have we made so far
 	lastRemotes []netip.AddrPort // Remotes that we sent to during the previous attempt
+	tcpRemotes  []netip.AddrPort // Tcp endpoints that we sent to during the previous attempt
+	wsRemotes   []netip.AddrPort // Websocket endpoints that we sent to during the previous attempt
 	packetStore []*cachedPacket  // A set of packets to be transmitted once the handshake completes
+	cookie      uint64           // A cookie a busy responder asked us to include in our handshake
+	hybrid      bool             // Is the handshake packet a hybrid ML-KEM handshake
+
+	kemKey *mlkem.DecapsulationKey768 // The ML-KEM key sent in a hybrid handshake packet
 
 	hostinfo *HostInfo
 }
@@ -114,6 +144,10 @@ func NewHandshakeManager(l *logrus.Logger, mainHostMap *HostMap, lightHouse *Lig
 		messageMetrics:         config.messageMetrics,
 		metricInitiated:        metrics.GetOrRegisterCounter("handshake_manager.initiated", nil),
 		metricTimedOut:         metrics.GetOrRegisterCounter("handshake_manager.timed_out", nil),
+		metricCookiesSent:      metrics.GetOrRegisterCounter("handshake_manager.cookies.sent", nil),
+		metricCookiesReceived:  metrics.GetOrRegisterCounter("handshake_manager.cookies.received", nil),
+		metricRateLimited:      metrics.GetOrRegisterCounter("handshake_manager.rate_limited", nil),
+		guard:                  newHandshakeGuard(config.cookieThreshold, config.perIpRate, time.Now()),
 		l:                      l,
 	}
 }
@@ -144,9 +178,17 @@ func (hm *HandshakeManager) HandleIncoming(addr netip.AddrPort, via *ViaSender,
 	}
 
 	switch h.Subtype {
-	case header.HandshakeIXPSK0:
+	case header.HandshakeIXPSK0, header.HandshakeIXPSK0Hybrid:
 		switch h.MessageCounter {
 		case 1:
+			// Relayed handshakes arrive over an authenticated tunnel, only limit those that come directly from an address
+			if addr.IsValid() && !hm.guard.allowSource(addr.Addr(), time.Now()) {
+				hm.metricRateLimited.Inc(1)
+				if hm.l.Level >= logrus.DebugLevel {
+					hm.l.WithField("udpAddr", addr).Debug("Dropping handshake, too many from this address")
+				}
+				return
+			}
 			ixHandshakeStage1(hm.f, addr, via, packet, h)
 
 		case 2:
@@ -156,6 +198,70 @@ func (hm *HandshakeManager) HandleIncoming(addr netip.AddrPort, via *ViaSender,
 				hm.DeleteHostInfo(newHostinfo.hostinfo)
 			}
 		}
+
+	case header.HandshakeCookie:
+		hm.handleCookie(addr, via, packet, h)
+	}
+}
+
+// handleCookie is called when a busy responder asks us to prove we own our address. The first handshake
+// packet is rebuilt with the cookie and immediately sent back to the responder.
+func (hm *HandshakeManager) handleCookie(addr netip.AddrPort, via *ViaSender, packet []byte, h *header.H) {
+	if !addr.IsValid() || len(packet) < header.Len+8 {
+		return
+	}
+
+	hh := hm.queryIndex(h.RemoteIndex)
+	if hh == nil {
+		return
+	}
+
+	hh.Lock()
+	defer hh.Unlock()
+
+	if !hh.ready || !(slices.Contains(hh.lastRemotes, addr) || slices.Contains(hh.tcpRemotes, addr) || slices.Contains(hh.wsRemotes, addr)) {
+		// We are not waiting on a handshake from this address
+		return
+	}
+
+	hm.metricCookiesReceived.Inc(1)
+	hh.cookie = binary.BigEndian.Uint64(packet[header.Len:])
+	if !ixHandshakeStage0Build(hm.f, hh) {
+		return
+	}
+
+	hostinfo := hh.hostinfo
+	hm.messageMetrics.Tx(header.Handshake, header.MessageSubType(hostinfo.HandshakePacket[0][1]), 1)
+	err := hm.outside.WriteTo(hostinfo.HandshakePacket[0], addr)
+	if err != nil {
+		hostinfo.logger(hm.l).WithField("udpAddr", addr).
+			WithField("initiatorIndex", hostinfo.localIndexId).
+			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+			WithError(err).Error("Failed to send handshake message with cookie")
+		return
+	}
+
+	hostinfo.logger(hm.l).WithField("udpAddr", addr).
+		WithField("initiatorIndex", hostinfo.localIndexId).
+		WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+		Info("Handshake message sent with cookie")
+}
+
+// sendCookie asks the initiator at addr to repeat its handshake with a cookie proving it can receive at addr
+func (hm *HandshakeManager) sendCookie(addr netip.AddrPort, initiatorIndex uint32, now time.Time) {
+	b := header.Encode(make([]byte, header.Len, header.Len+8), header.Version, header.Handshake, header.HandshakeCookie, initiatorIndex, 1)
+	b = binary.BigEndian.AppendUint64(b, hm.guard.cookie(addr, now))
+
+	hm.metricCookiesSent.Inc(1)
+	hm.messageMetrics.Tx(header.Handshake, header.HandshakeCookie, 1)
+	err := hm.outside.WriteTo(b, addr)
+	if err != nil {
+		hm.l.WithField("udpAddr", addr).WithError(err).Error("Failed to send handshake cookie")
+		return
+	}
+
+	if hm.l.Level >= logrus.DebugLevel {
+		hm.l.WithField("udpAddr", addr).WithField("initiatorIndex", initiatorIndex).Debug("Busy, sent handshake cookie")
 	}
 }
 
@@ -189,6 +295,9 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 			Info("Handshake timed out")
 		hm.metricTimedOut.Inc(1)
 		hm.DeleteHostInfo(hostinfo)
+		if hm.f != nil && hm.f.routeLearner != nil {
+			hm.f.routeLearner.gatewayFailed(vpnIp)
+		}
 		return
 	}
 
@@ -201,6 +310,18 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 			hm.OutboundHandshakeTimer.Add(vpnIp, hm.config.tryInterval*time.Duration(hh.counter))
 			return
 		}
+
+	} else if hh.hybrid && hm.config.postQuantum == PostQuantumPrefer && hh.counter == handshakeHybridFallbackAfter {
+		// The remote may not understand hybrid handshakes, try a classic one instead
+		hh.hybrid = false
+		if !ixHandshakeStage0Build(hm.f, hh) {
+			hm.OutboundHandshakeTimer.Add(vpnIp, hm.config.tryInterval*time.Duration(hh.counter))
+			return
+		}
+
+		hostinfo.logger(hm.l).WithField("initiatorIndex", hostinfo.localIndexId).
+			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+			Info("No answer to hybrid handshake, falling back to a classic handshake")
 	}
 
 	// Get a remotes object if we don't already have one.
@@ -263,10 +384,31 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 			Debug("Handshake message sent")
 	}
 
+	// Networks that block udp may still let tcp or http through, give udp a head start unless there is nothing else to try
+	if hh.counter >= hm.config.tcpFallbackAfter || len(remotes) == 0 {
+		if hm.f.tcp != nil {
+			hh.tcpRemotes = hm.sendStreamHandshake(hh, hm.f.tcp, hostinfo.remotes.CopyTCPAddrs(), hh.tcpRemotes)
+		}
+		if hm.f.websocket != nil {
+			hh.wsRemotes = hm.sendStreamHandshake(hh, hm.f.websocket.TCPConn, hostinfo.remotes.CopyWebSocketAddrs(), hh.wsRemotes)
+		}
+	}
+
 	if hm.config.useRelays && len(hostinfo.remotes.relays) > 0 {
-		hostinfo.logger(hm.l).WithField("relays", hostinfo.remotes.relays).Info("Attempt to relay through hosts")
-		// Send a RelayRequest to all known Relay IP's
-		for _, relay := range hostinfo.remotes.relays {
+		relays := hm.f.relayManager.health.Rank(hostinfo.remotes.relays)
+		maxHops := hm.f.relayManager.GetMaxHops()
+		if maxHops > 1 {
+			// Our own relays may be able to reach their relays, try them after the relays they advertised
+			for _, relay := range hm.f.relayManager.health.Rank(hm.lightHouse.GetRelaysForMe()) {
+				if !slices.Contains(relays, relay) {
+					relays = append(relays, relay)
+				}
+			}
+		}
+		hostinfo.logger(hm.l).WithField("relays", relays).Info("Attempt to relay through hosts")
+		sentViaRelay := false
+		// Send a RelayRequest to all known Relay IP's, best first
+		for _, relay := range relays {
 			// Don't relay to myself, and don't relay through the host I'm trying to connect to
 			if relay == vpnIp || relay == hm.lightHouse.myVpnNet.Addr() {
 				continue
@@ -281,8 +423,13 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 			if existingRelay, ok := relayHostInfo.relayState.QueryRelayForByIp(vpnIp); ok {
 				switch existingRelay.State {
 				case Established:
+					if sentViaRelay && hh.counter <= handshakeRelayFanoutAfter {
+						// Give the best relay a chance before sending through all of them
+						continue
+					}
 					hostinfo.logger(hm.l).WithField("relay", relay.String()).Info("Send handshake via relay")
 					hm.f.SendVia(relayHostInfo, existingRelay, hostinfo.HandshakePacket[0], make([]byte, 12), make([]byte, mtu), false)
+					sentViaRelay = true
 				case Requested:
 					hostinfo.logger(hm.l).WithField("relay", relay.String()).Info("Re-send CreateRelay request")
 
@@ -296,6 +443,7 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 						InitiatorRelayIndex: existingRelay.LocalIndex,
 						RelayFromIp:         binary.BigEndian.Uint32(myVpnIpB[:]),
 						RelayToIp:           binary.BigEndian.Uint32(theirVpnIpB[:]),
+						HopLimit:            uint32(maxHops),
 					}
 					msg, err := m.Marshal()
 					if err != nil {
@@ -336,6 +484,7 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 						InitiatorRelayIndex: idx,
 						RelayFromIp:         binary.BigEndian.Uint32(myVpnIpB[:]),
 						RelayToIp:           binary.BigEndian.Uint32(theirVpnIpB[:]),
+						HopLimit:            uint32(maxHops),
 					}
 					msg, err := m.Marshal()
 					if err != nil {
@@ -362,6 +511,39 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 	}
 }
 
+// sendStreamHandshake sends the handshake to the endpoints of the remote on a stream transport and returns them as the
+// new set of previous remotes. Udp has had its chance by now and may be blocked by the network we are on, or theirs.
+func (hm *HandshakeManager) sendStreamHandshake(hh *HandshakeHostInfo, conn *udp.TCPConn, remotes, lastRemotes []netip.AddrPort) []netip.AddrPort {
+	hostinfo := hh.hostinfo
+	remotesHaveChanged := !slices.Equal(remotes, lastRemotes)
+
+	var sentTo []netip.AddrPort
+	for _, addr := range remotes {
+		hm.messageMetrics.Tx(header.Handshake, header.MessageSubType(hostinfo.HandshakePacket[0][1]), 1)
+		err := conn.WriteTo(hostinfo.HandshakePacket[0], addr)
+		if err != nil {
+			hostinfo.logger(hm.l).WithField("tcpAddr", addr).
+				WithField("transport", conn.Kind()).
+				WithField("initiatorIndex", hostinfo.localIndexId).
+				WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+				WithError(err).Error("Failed to send handshake message over a stream")
+
+		} else {
+			sentTo = append(sentTo, addr)
+		}
+	}
+
+	if len(sentTo) > 0 && remotesHaveChanged {
+		hostinfo.logger(hm.l).WithField("tcpAddrs", sentTo).
+			WithField("transport", conn.Kind()).
+			WithField("initiatorIndex", hostinfo.localIndexId).
+			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+			Info("Handshake message sent over a stream")
+	}
+
+	return remotes
+}
+
 // GetOrHandshake will try to find a hostinfo with a fully formed tunnel or start a new handshake if one is not present
 // The 2nd argument will be true if the hostinfo is ready to transmit traffic
 func (hm *HandshakeManager) GetOrHandshake(vpnIp netip.Addr, cacheCb func(*HandshakeHostInfo)) (*HostInfo, bool) {
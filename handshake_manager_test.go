@@ -9,6 +9,7 @@ import (
 	"github.com/slackhq/nebula/test"
 	"github.com/slackhq/nebula/udp"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_NewHandshakeManagerVpnIp(t *testing.T) {
@@ -31,8 +32,11 @@ func Test_NewHandshakeManagerVpnIp(t *testing.T) {
 	}
 
 	blah := NewHandshakeManager(l, mainHM, lh, &udp.NoopConn{}, defaultHandshakeConfig)
-	blah.f = &Interface{handshakeManager: blah, pki: &PKI{}, l: l}
+	blah.f = &Interface{handshakeManager: blah, pki: &PKI{}, ciphers: []string{CipherAES}, l: l}
 	blah.f.pki.cs.Store(cs)
+	psk, err := NewPsk(PskNone, nil)
+	require.NoError(t, err)
+	blah.f.pki.psk.Store(psk)
 
 	now := time.Now()
 	blah.NextOutboundHandshakeTimerTick(now)
@@ -52,6 +52,8 @@ var typeMap = map[MessageType]string{
 const (
 	MessageNone  MessageSubType = 0
 	MessageRelay MessageSubType = 1
+	// MessageEthernet carries a whole ethernet frame between tap devices
+	MessageEthernet MessageSubType = 2
 )
 
 const (
@@ -62,6 +64,9 @@ const (
 const (
 	HandshakeIXPSK0 MessageSubType = 0
 	HandshakeXXPSK0 MessageSubType = 1
+	HandshakeCookie MessageSubType = 2
+	// HandshakeIXPSK0Hybrid is HandshakeIXPSK0 with an ML-KEM-768 shared secret mixed into the session keys
+	HandshakeIXPSK0Hybrid MessageSubType = 3
 )
 
 var ErrHeaderTooShort = errors.New("header is too short")
@@ -75,15 +80,18 @@ var subTypeNoneMap = map[MessageSubType]string{0: "none"}
 
 var subTypeMap = map[MessageType]*map[MessageSubType]string{
 	Message: {
-		MessageNone:  "none",
-		MessageRelay: "relay",
+		MessageNone:     "none",
+		MessageRelay:    "relay",
+		MessageEthernet: "ethernet",
 	},
 	RecvError:   &subTypeNoneMap,
 	LightHouse:  &subTypeNoneMap,
 	Test:        &subTypeTestMap,
 	CloseTunnel: &subTypeNoneMap,
 	Handshake: {
-		HandshakeIXPSK0: "ix_psk0",
+		HandshakeIXPSK0:       "ix_psk0",
+		HandshakeCookie:       "cookie",
+		HandshakeIXPSK0Hybrid: "ix_psk0_hybrid",
 	},
 	Control: &subTypeNoneMap,
 }
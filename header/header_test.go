@@ -87,15 +87,18 @@ func TestTypeMap(t *testing.T) {
 
 	assert.Equal(t, map[MessageType]*map[MessageSubType]string{
 		Message: {
-			MessageNone:  "none",
-			MessageRelay: "relay",
+			MessageNone:     "none",
+			MessageRelay:    "relay",
+			MessageEthernet: "ethernet",
 		},
 		RecvError:   &subTypeNoneMap,
 		LightHouse:  &subTypeNoneMap,
 		Test:        &subTypeTestMap,
 		CloseTunnel: &subTypeNoneMap,
 		Handshake: {
-			HandshakeIXPSK0: "ix_psk0",
+			HandshakeIXPSK0:       "ix_psk0",
+			HandshakeCookie:       "cookie",
+			HandshakeIXPSK0Hybrid: "ix_psk0_hybrid",
 		},
 		Control: &subTypeNoneMap,
 	}, subTypeMap)
@@ -49,6 +49,28 @@ type Relay struct {
 	LocalIndex  uint32
 	RemoteIndex uint32
 	PeerIp      netip.Addr
+
+	// ViaIp is set on a forwarding relay in a chain when packets must be sent to another relay to reach PeerIp
+	ViaIp netip.Addr
+	// FromIp is set on a forwarding relay in a chain when the host it belongs to is a relay for FromIp
+	FromIp netip.Addr
+}
+
+// forwardTo returns the vpn ip of the host packets arriving on this forwarding relay are sent to
+func (r *Relay) forwardTo() netip.Addr {
+	if r.ViaIp.IsValid() {
+		return r.ViaIp
+	}
+	return r.PeerIp
+}
+
+// forwardFrom returns the vpn ip of the peer at the far end of this forwarding relay, relayHostIp is the host
+// the relay belongs to
+func (r *Relay) forwardFrom(relayHostIp netip.Addr) netip.Addr {
+	if r.FromIp.IsValid() {
+		return r.FromIp
+	}
+	return relayHostIp
 }
 
 type HostMap struct {
@@ -71,12 +93,31 @@ type RelayState struct {
 	relays        map[netip.Addr]struct{} // Set of VpnIp's of Hosts to use as relays to access this peer
 	relayForByIp  map[netip.Addr]*Relay   // Maps VpnIps of peers for which this HostInfo is a relay to some Relay info
 	relayForByIdx map[uint32]*Relay       // Maps a local index to some Relay info
+
+	// ranked is relays best first as of the relay health generation rankedGen, nil once relays changed
+	ranked    []netip.Addr
+	rankedGen uint64
 }
 
 func (rs *RelayState) DeleteRelay(ip netip.Addr) {
 	rs.Lock()
 	defer rs.Unlock()
 	delete(rs.relays, ip)
+	rs.ranked = nil
+}
+
+// RemoveRelay removes the relay identified by our local index
+func (rs *RelayState) RemoveRelay(localIdx uint32) {
+	rs.Lock()
+	defer rs.Unlock()
+	r, ok := rs.relayForByIdx[localIdx]
+	if !ok {
+		return
+	}
+	delete(rs.relayForByIdx, localIdx)
+	if rs.relayForByIp[r.PeerIp] == r {
+		delete(rs.relayForByIp, r.PeerIp)
+	}
 }
 
 func (rs *RelayState) CopyAllRelayFor() []*Relay {
@@ -100,6 +141,7 @@ func (rs *RelayState) InsertRelayTo(ip netip.Addr) {
 	rs.Lock()
 	defer rs.Unlock()
 	rs.relays[ip] = struct{}{}
+	rs.ranked = nil
 }
 
 func (rs *RelayState) CopyRelayIps() []netip.Addr {
@@ -112,6 +154,30 @@ func (rs *RelayState) CopyRelayIps() []netip.Addr {
 	return ret
 }
 
+// RankedRelayIps returns the relays to this peer best first, the order is only worked out again once a relay is added
+// or removed or the health of the relays changed. The returned slice must not be modified.
+func (rs *RelayState) RankedRelayIps(rh *relayHealth) []netip.Addr {
+	gen := rh.Generation()
+	rs.RLock()
+	if rs.ranked != nil && rs.rankedGen == gen {
+		defer rs.RUnlock()
+		return rs.ranked
+	}
+	rs.RUnlock()
+
+	rs.Lock()
+	defer rs.Unlock()
+	if rs.ranked == nil || rs.rankedGen != gen {
+		relays := make([]netip.Addr, 0, len(rs.relays))
+		for ip := range rs.relays {
+			relays = append(relays, ip)
+		}
+		rs.ranked = rh.Rank(relays)
+		rs.rankedGen = gen
+	}
+	return rs.ranked
+}
+
 func (rs *RelayState) CopyRelayForIps() []netip.Addr {
 	rs.RLock()
 	defer rs.RUnlock()
@@ -176,6 +242,18 @@ func (rs *RelayState) QueryRelayForByIdx(idx uint32) (*Relay, bool) {
 	return r, ok
 }
 
+// hasTerminalRelays returns true if we are an endpoint of any relay through this host
+func (rs *RelayState) hasTerminalRelays() bool {
+	rs.RLock()
+	defer rs.RUnlock()
+	for _, r := range rs.relayForByIdx {
+		if r.Type == TerminalType {
+			return true
+		}
+	}
+	return false
+}
+
 func (rs *RelayState) InsertRelay(ip netip.Addr, idx uint32, r *Relay) {
 	rs.Lock()
 	defer rs.Unlock()
@@ -203,6 +281,13 @@ type HostInfo struct {
 	// This is used to limit lighthouse re-queries in chatty clients
 	nextLHQuery atomic.Int64
 
+	// nextDirectProbe is the earliest we can try to move this tunnel off of a relay and onto a direct path.
+	nextDirectProbe atomic.Int64
+
+	// relaysMoved is set once the relayed tunnels using this relay were moved off of it for being degraded, it is
+	// cleared when the relay is healthy again. Only the connection manager uses it.
+	relaysMoved bool
+
 	// lastRebindCount is the other side of Interface.rebindCount, if these values don't match then we need to ask LH
 	// for a punch from the remote end of this tunnel. The goal being to prime their conntrack for our traffic just like
 	// with a handshake
@@ -216,6 +301,9 @@ type HostInfo struct {
 	lastRoam       time.Time
 	lastRoamRemote netip.AddrPort
 
+	// pmtu tracks the path mtu discovered for this tunnel
+	pmtu pathMTUState
+
 	// Used to track other hostinfos for this vpn ip since only 1 can be primary
 	// Synchronised via hostmap lock and not the hostinfo lock.
 	next, prev *HostInfo
@@ -290,19 +378,34 @@ func (hm *HostMap) reload(c *config.C, initial bool) {
 	}
 }
 
-// EmitStats reports host, index, and relay counts to the stats collection system
+// EmitStats reports host, index, relay, direct vs relayed and per cipher tunnel counts to the stats collection system
 func (hm *HostMap) EmitStats() {
 	hm.RLock()
 	hostLen := len(hm.Hosts)
 	indexLen := len(hm.Indexes)
 	remoteIndexLen := len(hm.RemoteIndexes)
 	relaysLen := len(hm.Relays)
+	directLen := 0
+	cipherLens := make(map[string]int64, len(knownCiphers))
+	for _, hostinfo := range hm.Hosts {
+		if hostinfo.remote.IsValid() {
+			directLen++
+		}
+		if hostinfo.ConnectionState != nil {
+			cipherLens[hostinfo.ConnectionState.cipher]++
+		}
+	}
 	hm.RUnlock()
 
 	metrics.GetOrRegisterGauge("hostmap.main.hosts", nil).Update(int64(hostLen))
 	metrics.GetOrRegisterGauge("hostmap.main.indexes", nil).Update(int64(indexLen))
 	metrics.GetOrRegisterGauge("hostmap.main.remoteIndexes", nil).Update(int64(remoteIndexLen))
 	metrics.GetOrRegisterGauge("hostmap.main.relayIndexes", nil).Update(int64(relaysLen))
+	metrics.GetOrRegisterGauge("hostmap.main.tunnels.direct", nil).Update(int64(directLen))
+	metrics.GetOrRegisterGauge("hostmap.main.tunnels.relayed", nil).Update(int64(hostLen - directLen))
+	for _, name := range knownCiphers {
+		metrics.GetOrRegisterGauge("hostmap.main.tunnels.cipher."+name, nil).Update(cipherLens[name])
+	}
 }
 
 func (hm *HostMap) RemoveRelay(localIdx uint32) {
@@ -489,9 +592,9 @@ func (hm *HostMap) queryVpnIp(vpnIp netip.Addr, promoteIfce *Interface) *HostInf
 // unlockedAddHostInfo assumes you have a write-lock and will add a hostinfo object to the hostmap Indexes and RemoteIndexes maps.
 // If an entry exists for the Hosts table (vpnIp -> hostinfo) then the provided hostinfo will be made primary
 func (hm *HostMap) unlockedAddHostInfo(hostinfo *HostInfo, f *Interface) {
-	if f.serveDns {
+	if f.dnsRecords != nil {
 		remoteCert := hostinfo.ConnectionState.peerCert
-		dnsR.Add(remoteCert.Certificate.Name()+".", remoteCert.Certificate.Networks()[0].Addr().String())
+		f.dnsRecords.Add(remoteCert.Certificate.Name()+".", remoteCert.Certificate.Networks()[0].Addr().String())
 	}
 
 	existing := hm.Hosts[hostinfo.vpnIp]
@@ -8,9 +8,12 @@ import (
 	"github.com/slackhq/nebula/header"
 	"github.com/slackhq/nebula/iputil"
 	"github.com/slackhq/nebula/noiseutil"
+	"github.com/slackhq/nebula/udp"
 )
 
-func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *firewall.Packet, nb, out []byte, q int, localCache firewall.ConntrackCache) {
+// consumeInsidePacket sends a packet read from the tun device, direct udp writes are added to batch and left for the
+// caller to flush
+func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *firewall.Packet, nb, out []byte, q int, localCache firewall.ConntrackCache, batch *udp.Batch) {
 	err := newPacket(packet, false, fwPacket)
 	if err != nil {
 		if f.l.Level >= logrus.DebugLevel {
@@ -45,6 +48,11 @@ func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *firewall.Packet
 		return
 	}
 
+	if fo := f.fanout.Load(); fo != nil && f.isFanoutAddr(fwPacket.RemoteIP) {
+		f.fanoutInsidePacket(fo, packet, fwPacket, nb, out, q, localCache, batch)
+		return
+	}
+
 	hostinfo, ready := f.getOrHandshake(fwPacket.RemoteIP, func(hh *HandshakeHostInfo) {
 		hh.cachePacket(f.l, header.Message, 0, packet, f.sendMessageNow, f.cachedPacketMetrics)
 	})
@@ -65,7 +73,10 @@ func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *firewall.Packet
 
 	dropReason := f.firewall.Drop(*fwPacket, false, hostinfo, f.pki.GetCAPool(), localCache)
 	if dropReason == nil {
-		f.sendNoMetrics(header.Message, 0, hostinfo.ConnectionState, hostinfo, netip.AddrPort{}, packet, nb, out, q)
+		if !f.enforcePathMTU(hostinfo, packet, out, q) {
+			return
+		}
+		f.sendNoMetricsBatch(header.Message, 0, hostinfo.ConnectionState, hostinfo, netip.AddrPort{}, packet, nb, out, q, batch)
 
 	} else {
 		f.rejectInside(packet, out, q)
@@ -249,6 +260,7 @@ func (f *Interface) SendVia(via *HostInfo,
 		via.logger(f.l).WithError(err).Info("Failed to EncryptDanger in sendVia")
 		return
 	}
+	via.ConnectionState.bytesSent.Add(uint64(len(out)))
 	err = f.writers[0].WriteTo(out, via.remote)
 	if err != nil {
 		via.logger(f.l).WithError(err).Info("Failed to WriteTo in sendVia")
@@ -257,6 +269,12 @@ func (f *Interface) SendVia(via *HostInfo,
 }
 
 func (f *Interface) sendNoMetrics(t header.MessageType, st header.MessageSubType, ci *ConnectionState, hostinfo *HostInfo, remote netip.AddrPort, p, nb, out []byte, q int) {
+	f.sendNoMetricsBatch(t, st, ci, hostinfo, remote, p, nb, out, q, nil)
+}
+
+// sendNoMetricsBatch is sendNoMetrics that adds the packet to batch instead of writing it when it goes straight to the
+// remote from our own queue. Only the routine that owns batch may pass it.
+func (f *Interface) sendNoMetricsBatch(t header.MessageType, st header.MessageSubType, ci *ConnectionState, hostinfo *HostInfo, remote netip.AddrPort, p, nb, out []byte, q int, batch *udp.Batch) {
 	if ci.eKey == nil {
 		//TODO: log warning
 		return
@@ -308,6 +326,7 @@ func (f *Interface) sendNoMetrics(t header.MessageType, st header.MessageSubType
 			Error("Failed to encrypt outgoing packet")
 		return
 	}
+	ci.bytesSent.Add(uint64(len(out)))
 
 	if remote.IsValid() {
 		err = f.writers[q].WriteTo(out, remote)
@@ -316,14 +335,19 @@ func (f *Interface) sendNoMetrics(t header.MessageType, st header.MessageSubType
 				WithField("udpAddr", remote).Error("Failed to write outgoing packet")
 		}
 	} else if hostinfo.remote.IsValid() {
-		err = f.writers[q].WriteTo(out, hostinfo.remote)
+		conn, dst := f.multiportRoute(t, ci, hostinfo.remote, c, q)
+		if batch != nil && conn == f.writers[q] {
+			err = batch.WriteTo(out, dst)
+		} else {
+			err = conn.WriteTo(out, dst)
+		}
 		if err != nil {
 			hostinfo.logger(f.l).WithError(err).
-				WithField("udpAddr", remote).Error("Failed to write outgoing packet")
+				WithField("udpAddr", dst).Error("Failed to write outgoing packet")
 		}
 	} else {
-		// Try to send via a relay
-		for _, relayIP := range hostinfo.relayState.CopyRelayIps() {
+		// Try to send via a relay, best first
+		for _, relayIP := range hostinfo.relayState.RankedRelayIps(f.relayManager.health) {
 			relayHostInfo, relay, err := f.hostMap.QueryVpnIpRelayFor(hostinfo.vpnIp, relayIP)
 			if err != nil {
 				hostinfo.relayState.DeleteRelay(relayIP)
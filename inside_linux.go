@@ -0,0 +1,44 @@
+//go:build linux
+// +build linux
+
+package nebula
+
+import (
+	"io"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// insideReadable returns a check for another packet waiting to be read from reader, the inside routine writes out its
+// udp batch once there is none. nil means we can not tell and the batch is written after every packet.
+func insideReadable(reader io.ReadWriteCloser) func() bool {
+	// Segments of a superpacket the reader already pulled from the kernel
+	buffered, _ := reader.(interface{ Buffered() int })
+
+	fd := -1
+	if sc, ok := reader.(syscall.Conn); ok {
+		if rc, err := sc.SyscallConn(); err == nil {
+			if err := rc.Control(func(f uintptr) { fd = int(f) }); err != nil {
+				fd = -1
+			}
+		}
+	}
+
+	if fd < 0 {
+		if buffered == nil {
+			return nil
+		}
+		return func() bool { return buffered.Buffered() > 0 }
+	}
+
+	return func() bool {
+		if buffered != nil && buffered.Buffered() > 0 {
+			return true
+		}
+
+		fds := [1]unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds[:], 0)
+		return err == nil && n > 0
+	}
+}
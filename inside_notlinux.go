@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package nebula
+
+import "io"
+
+// insideReadable can not tell if reader has another packet waiting outside of linux, only linux batches udp writes
+func insideReadable(_ io.ReadWriteCloser) func() bool {
+	return nil
+}
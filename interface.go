@@ -19,19 +19,23 @@ import (
 	"github.com/slackhq/nebula/firewall"
 	"github.com/slackhq/nebula/header"
 	"github.com/slackhq/nebula/overlay"
+	"github.com/slackhq/nebula/portmap"
 	"github.com/slackhq/nebula/udp"
 )
 
 const mtu = 9001
 
+// defaultWriteBatchLatency is how long an inside routine holds encrypted packets back at most, see listen.write_batch_latency
+const defaultWriteBatchLatency = 100 * time.Microsecond
+
 type InterfaceConfig struct {
 	HostMap                 *HostMap
 	Outside                 udp.Conn
 	Inside                  overlay.Device
 	pki                     *PKI
-	Cipher                  string
+	Ciphers                 []string
 	Firewall                *Firewall
-	ServeDns                bool
+	dnsRecords              *dnsRecords
 	HandshakeManager        *HandshakeManager
 	lightHouse              *LightHouse
 	checkInterval           time.Duration
@@ -43,10 +47,22 @@ type InterfaceConfig struct {
 	version                 string
 	relayManager            *relayManager
 	punchy                  *Punchy
+	rekey                   *Rekey
+	multiPort               *MultiPort
+	tcp                     *udp.TCPConn
+	websocket               *udp.WebSocketConn
+	pmtu                    *PathMTU
+	portMap                 *portmap.Mapper
+	tap                     *tapSwitch
+	fanout                  *fanout
+	snat                    *snat
+	routeLearner            *routeLearner
 
 	tryPromoteEvery uint32
 	reQueryEvery    uint32
 	reQueryWait     time.Duration
+	// writeBatchLatency is the longest an encrypted packet waits in an inside routine for more to write with it
+	writeBatchLatency time.Duration
 
 	ConntrackCacheTimeout time.Duration
 	l                     *logrus.Logger
@@ -57,11 +73,11 @@ type Interface struct {
 	outside            udp.Conn
 	inside             overlay.Device
 	pki                *PKI
-	cipher             string
+	ciphers            []string
 	firewall           *Firewall
 	connectionManager  *connectionManager
 	handshakeManager   *HandshakeManager
-	serveDns           bool
+	dnsRecords         *dnsRecords
 	createTime         time.Time
 	lightHouse         *LightHouse
 	myBroadcastAddr    netip.Addr
@@ -84,13 +100,33 @@ type Interface struct {
 	version     string
 
 	conntrackCacheTimeout time.Duration
+	writeBatchLatency     time.Duration
 
+	// writers and readers hold a udp socket and a tun queue for every routine, with tun.snat there is one more queue
+	// after them for the userspace nat. It shares the udp socket of the first routine.
 	writers []udp.Conn
-	readers []io.ReadWriteCloser
-
-	metricHandshakes    metrics.Histogram
-	messageMetrics      *MessageMetrics
-	cachedPacketMetrics *cachedPacketMetrics
+	// multiPort is nil unless tunnels may spread packets across extra listeners
+	multiPort *MultiPort
+	// tcp and websocket are nil unless tunnels may fall back to streams when udp does not get through
+	tcp       *udp.TCPConn
+	websocket *udp.WebSocketConn
+	pmtu      *PathMTU
+	// portMap is nil unless we ask the gateway in front of us for a public port, the mapping is removed on Close
+	portMap *portmap.Mapper
+	// fanout is nil unless multicast and broadcast packets from the tun device are sent to every tunnel
+	fanout atomic.Pointer[fanout]
+	// tap is nil unless the device carries ethernet frames
+	tap *tapSwitch
+	// snat is nil unless packets for unsafe networks go through the userspace nat instead of the tun device
+	snat *snat
+	// routeLearner is nil unless unsafe routes are learned from the lighthouses, it is told when a gateway fails
+	routeLearner *routeLearner
+	readers      []io.ReadWriteCloser
+
+	metricHandshakes         metrics.Histogram
+	metricHandshakePskFailed metrics.Counter
+	messageMetrics           *MessageMetrics
+	cachedPacketMetrics      *cachedPacketMetrics
 
 	l *logrus.Logger
 }
@@ -163,9 +199,9 @@ func NewInterface(ctx context.Context, c *InterfaceConfig) (*Interface, error) {
 		hostMap:            c.HostMap,
 		outside:            c.Outside,
 		inside:             c.Inside,
-		cipher:             c.Cipher,
+		ciphers:            c.Ciphers,
 		firewall:           c.Firewall,
-		serveDns:           c.ServeDns,
+		dnsRecords:         c.dnsRecords,
 		handshakeManager:   c.HandshakeManager,
 		createTime:         time.Now(),
 		lightHouse:         c.lightHouse,
@@ -174,14 +210,24 @@ func NewInterface(ctx context.Context, c *InterfaceConfig) (*Interface, error) {
 		routines:           c.routines,
 		version:            c.version,
 		writers:            make([]udp.Conn, c.routines),
+		multiPort:          c.multiPort,
+		tcp:                c.tcp,
+		websocket:          c.websocket,
+		pmtu:               c.pmtu,
+		tap:                c.tap,
+		snat:               c.snat,
+		routeLearner:       c.routeLearner,
+		portMap:            c.portMap,
 		readers:            make([]io.ReadWriteCloser, c.routines),
 		myVpnNet:           certificate.Networks()[0],
 		relayManager:       c.relayManager,
 
 		conntrackCacheTimeout: c.ConntrackCacheTimeout,
+		writeBatchLatency:     c.writeBatchLatency,
 
-		metricHandshakes: metrics.GetOrRegisterHistogram("handshakes", nil, metrics.NewExpDecaySample(1028, 0.015)),
-		messageMetrics:   c.MessageMetrics,
+		metricHandshakes:         metrics.GetOrRegisterHistogram("handshakes", nil, metrics.NewExpDecaySample(1028, 0.015)),
+		metricHandshakePskFailed: metrics.GetOrRegisterCounter("handshakes.psk_failed", nil),
+		messageMetrics:           c.MessageMetrics,
 		cachedPacketMetrics: &cachedPacketMetrics{
 			sent:    metrics.GetOrRegisterCounter("hostinfo.cached_packets.sent", nil),
 			dropped: metrics.GetOrRegisterCounter("hostinfo.cached_packets.dropped", nil),
@@ -198,11 +244,17 @@ func NewInterface(ctx context.Context, c *InterfaceConfig) (*Interface, error) {
 		ifce.myBroadcastAddr = netip.AddrFrom4(addr)
 	}
 
+	if c.snat != nil {
+		// The userspace nat sends from a queue of its own, what would be written back to the tun device is for its stack
+		ifce.readers = append(ifce.readers, snatReplies{c.snat})
+	}
+
+	ifce.fanout.Store(c.fanout)
 	ifce.tryPromoteEvery.Store(c.tryPromoteEvery)
 	ifce.reQueryEvery.Store(c.reQueryEvery)
 	ifce.reQueryWait.Store(int64(c.reQueryWait))
 
-	ifce.connectionManager = newConnectionManager(ctx, c.l, ifce, c.checkInterval, c.pendingDeletionInterval, c.punchy)
+	ifce.connectionManager = newConnectionManager(ctx, c.l, ifce, c.checkInterval, c.pendingDeletionInterval, c.punchy, c.rekey)
 
 	return ifce, nil
 }
@@ -249,6 +301,22 @@ func (f *Interface) run() {
 		go f.listenOut(i)
 	}
 
+	// Launch a reader for each extra multiport listener, they share the first routine for anything they send back
+	if f.multiPort != nil {
+		for _, conn := range f.multiPort.conns {
+			go f.listenOutConn(conn, 0)
+		}
+	}
+
+	// Every stream of a transport is funneled through a single reader which also shares the first routine
+	if f.tcp != nil {
+		go f.listenOutConn(f.tcp, 0)
+	}
+
+	if f.websocket != nil {
+		go f.listenOutConn(f.websocket, 0)
+	}
+
 	// Launch n queues to read packets from tun dev
 	for i := 0; i < f.routines; i++ {
 		go f.listenIn(f.readers[i], i)
@@ -256,8 +324,6 @@ func (f *Interface) run() {
 }
 
 func (f *Interface) listenOut(i int) {
-	runtime.LockOSThread()
-
 	var li udp.Conn
 	// TODO clean this up with a coherent interface for each outside connection
 	if i > 0 {
@@ -266,9 +332,33 @@ func (f *Interface) listenOut(i int) {
 		li = f.outside
 	}
 
+	f.listenOutConn(li, i)
+}
+
+func (f *Interface) listenOutConn(li udp.Conn, i int) {
+	runtime.LockOSThread()
+
 	lhh := f.lightHouse.NewRequestHandler()
 	conntrackCache := firewall.NewConntrackCacheTicker(f.conntrackCacheTimeout)
-	li.ListenOut(readOutsidePackets(f), lhHandleRequest(lhh, f), conntrackCache, i)
+
+	// Decrypted tcp segments of a flow are glued back together into one tun write until the conn runs dry
+	tunBatch := overlay.NewCoalescer(f.readers[i])
+	flush := func() {
+		if err := tunBatch.Flush(); err != nil {
+			f.l.WithError(err).Error("Failed to write to tun")
+		}
+	}
+
+	r := readOutsidePackets(f, tunBatch)
+	if bl, ok := udp.Unwrap(li).(udp.BatchListener); ok {
+		bl.ListenOutBatch(r, flush, lhHandleRequest(lhh, f), conntrackCache, i)
+		return
+	}
+
+	li.ListenOut(func(addr netip.AddrPort, out []byte, packet []byte, h *header.H, fwPacket *firewall.Packet, lhf udp.LightHouseHandlerFunc, nb []byte, q int, localCache firewall.ConntrackCache) {
+		r(addr, out, packet, h, fwPacket, lhf, nb, q, localCache)
+		flush()
+	}, lhHandleRequest(lhh, f), conntrackCache, i)
 }
 
 func (f *Interface) listenIn(reader io.ReadWriteCloser, i int) {
@@ -281,6 +371,11 @@ func (f *Interface) listenIn(reader io.ReadWriteCloser, i int) {
 
 	conntrackCache := firewall.NewConntrackCacheTicker(f.conntrackCacheTimeout)
 
+	// Encrypted packets are written together once the tun device runs dry or the oldest has waited long enough, packets
+	// for the same remote are glued into one segmented write
+	batch := udp.NewBatch(f.writers[i], f.writeBatchLatency)
+	readable := insideReadable(reader)
+
 	for {
 		n, err := reader.Read(packet)
 		if err != nil {
@@ -293,7 +388,17 @@ func (f *Interface) listenIn(reader io.ReadWriteCloser, i int) {
 			os.Exit(2)
 		}
 
-		f.consumeInsidePacket(packet[:n], fwPacket, nb, out, i, conntrackCache.Get(f.l))
+		if f.tap != nil {
+			f.consumeInsideFrame(packet[:n], fwPacket, nb, out, i, conntrackCache.Get(f.l), batch)
+		} else {
+			f.consumeInsidePacket(packet[:n], fwPacket, nb, out, i, conntrackCache.Get(f.l), batch)
+		}
+
+		if batch.Len() > 0 && (readable == nil || batch.Due() || !readable()) {
+			if err := batch.Flush(); err != nil {
+				f.l.WithError(err).Error("Failed to write outgoing packets")
+			}
+		}
 	}
 }
 
@@ -302,10 +407,17 @@ func (f *Interface) RegisterConfigChangeCallbacks(c *config.C) {
 	c.RegisterReloadCallback(f.reloadSendRecvError)
 	c.RegisterReloadCallback(f.reloadDisconnectInvalid)
 	c.RegisterReloadCallback(f.reloadMisc)
+	c.RegisterReloadCallback(f.reloadFanout)
 
-	for _, udpConn := range f.writers {
+	for _, udpConn := range f.writers[:f.routines] {
 		c.RegisterReloadCallback(udpConn.ReloadConfig)
 	}
+
+	if f.multiPort != nil {
+		for _, udpConn := range f.multiPort.conns {
+			c.RegisterReloadCallback(udpConn.ReloadConfig)
+		}
+	}
 }
 
 func (f *Interface) reloadDisconnectInvalid(c *config.C) {
@@ -405,7 +517,7 @@ func (f *Interface) emitStats(ctx context.Context, i time.Duration) {
 	ticker := time.NewTicker(i)
 	defer ticker.Stop()
 
-	udpStats := udp.NewUDPStatsEmitter(f.writers)
+	udpStats := udp.NewUDPStatsEmitter(f.writers[:f.routines])
 
 	certExpirationGauge := metrics.GetOrRegisterGauge("certificate.ttl_seconds", nil)
 
@@ -425,13 +537,31 @@ func (f *Interface) emitStats(ctx context.Context, i time.Duration) {
 func (f *Interface) Close() error {
 	f.closed.Store(true)
 
-	for _, u := range f.writers {
+	if f.portMap != nil {
+		if err := f.portMap.Close(); err != nil {
+			f.l.WithError(err).Error("Error while removing the port mapping")
+		}
+	}
+
+	for _, u := range f.writers[:f.routines] {
 		err := u.Close()
 		if err != nil {
 			f.l.WithError(err).Error("Error while closing udp socket")
 		}
 	}
 
+	if f.multiPort != nil {
+		f.multiPort.Close()
+	}
+
+	if f.tcp != nil {
+		f.tcp.Close()
+	}
+
+	if f.websocket != nil {
+		f.websocket.Close()
+	}
+
 	// Release the tun device
 	return f.inside.Close()
 }
@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 //TODO: IPV6-WORK can probably delete this
@@ -14,6 +15,12 @@ const (
 	// - 8 byte icmpv4 header
 	// - 68 byte body (60 byte max orig ipv4 header + 8 byte orig icmpv4 header)
 	MaxRejectPacketSize = ipv4.HeaderLen + 8 + 60 + 8
+
+	// MaxPacketTooBigSize is the largest packet too big message, icmpv6 errors are kept within the ipv6 minimum mtu
+	MaxPacketTooBigSize = ipv6MinMTU
+
+	ipv6HeaderLen = 40
+	ipv6MinMTU    = 1280
 )
 
 func CreateRejectPacket(packet []byte, out []byte) []byte {
@@ -201,6 +208,189 @@ func CreateICMPEchoResponse(packet, out []byte) []byte {
 	return out
 }
 
+// CreatePacketTooBig builds an icmp fragmentation needed (ipv4) or icmpv6 packet too big (ipv6) reply to packet, telling
+// the sender to keep its packets within mtu. Nil is returned when the sender did not ask us not to fragment or packet is
+// not something we can answer.
+func CreatePacketTooBig(packet []byte, mtu int, out []byte) []byte {
+	if len(packet) < 1 {
+		return nil
+	}
+
+	switch int(packet[0] >> 4) {
+	case ipv4.Version:
+		return ipv4CreatePacketTooBig(packet, mtu, out)
+	case ipv6.Version:
+		return ipv6CreatePacketTooBig(packet, mtu, out)
+	}
+	return nil
+}
+
+func ipv4CreatePacketTooBig(packet []byte, mtu int, out []byte) []byte {
+	if len(packet) < ipv4.HeaderLen {
+		return nil
+	}
+
+	// Only packets with the don't fragment flag set get an answer, and never a later fragment
+	flagsfrags := binary.BigEndian.Uint16(packet[6:8])
+	if flagsfrags&0x4000 == 0 || flagsfrags&0x1fff != 0 {
+		return nil
+	}
+
+	out = ipv4CreateRejectICMPPacket(packet, out)
+	if out == nil {
+		return nil
+	}
+
+	// Turn the port unreachable into fragmentation needed with the next hop mtu set
+	icmpOut := out[ipv4.HeaderLen:]
+	icmpOut[1] = 4 // code (Fragmentation needed and DF set)
+	icmpOut[2] = 0 // checksum
+	icmpOut[3] = 0 //  .
+	binary.BigEndian.PutUint16(icmpOut[6:], uint16(mtu))
+	binary.BigEndian.PutUint16(icmpOut[2:], tcpipChecksum(icmpOut, 0))
+
+	return out
+}
+
+func ipv6CreatePacketTooBig(packet []byte, mtu int, out []byte) []byte {
+	if len(packet) < ipv6HeaderLen {
+		return nil
+	}
+
+	// The mtu of an ipv6 link is never below the minimum mtu
+	if mtu < ipv6MinMTU {
+		mtu = ipv6MinMTU
+	}
+
+	// As much of the original packet as fits without exceeding the minimum mtu
+	bodyLen := len(packet)
+	if bodyLen > MaxPacketTooBigSize-ipv6HeaderLen-8 {
+		bodyLen = MaxPacketTooBigSize - ipv6HeaderLen - 8
+	}
+
+	outLen := ipv6HeaderLen + 8 + bodyLen
+	if outLen > cap(out) {
+		return nil
+	}
+
+	out = out[:outLen]
+
+	ipHdr := out[0:ipv6HeaderLen]
+	ipHdr[0] = ipv6.Version << 4                                        // version, traffic class
+	ipHdr[1] = 0                                                        // traffic class, flow label
+	ipHdr[2] = 0                                                        // flow label
+	ipHdr[3] = 0                                                        //  .
+	binary.BigEndian.PutUint16(ipHdr[4:], uint16(outLen-ipv6HeaderLen)) // payload length
+	ipHdr[6] = 58                                                       // next header (icmpv6)
+	ipHdr[7] = 64                                                       // hop limit
+
+	// Swap dest / src IPs
+	copy(ipHdr[8:24], packet[24:40])
+	copy(ipHdr[24:40], packet[8:24])
+
+	// ICMPv6 Packet Too Big
+	icmpOut := out[ipv6HeaderLen:]
+	icmpOut[0] = 2 // type (Packet too big)
+	icmpOut[1] = 0 // code
+	icmpOut[2] = 0 // checksum
+	icmpOut[3] = 0 //  .
+	binary.BigEndian.PutUint32(icmpOut[4:], uint32(mtu))
+
+	copy(icmpOut[8:], packet[:bodyLen])
+
+	// Calculate checksum
+	csum := ipv6PseudoheaderChecksum(ipHdr[8:24], ipHdr[24:40], 58, uint32(len(icmpOut)))
+	binary.BigEndian.PutUint16(icmpOut[2:], tcpipChecksum(icmpOut, csum))
+
+	return out
+}
+
+// ClampTCPMSS lowers the maximum segment size option of a tcp syn so that full sized segments fit within mtu. The tcp
+// checksum is fixed up to match. Returns true if packet was changed.
+func ClampTCPMSS(packet []byte, mtu int) bool {
+	if len(packet) < 1 {
+		return false
+	}
+
+	var tcp []byte
+	var maxMSS int
+	switch int(packet[0] >> 4) {
+	case ipv4.Version:
+		if len(packet) < ipv4.HeaderLen || packet[9] != 6 {
+			return false
+		}
+
+		// Only the first fragment carries the tcp header
+		if binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 {
+			return false
+		}
+
+		ihl := int(packet[0]&0x0f) << 2
+		if ihl < ipv4.HeaderLen || len(packet) < ihl {
+			return false
+		}
+		tcp = packet[ihl:]
+		maxMSS = mtu - ipv4.HeaderLen - 20
+
+	case ipv6.Version:
+		// Extension headers are not walked, a tcp syn carrying them is left alone
+		if len(packet) < ipv6HeaderLen || packet[6] != 6 {
+			return false
+		}
+		tcp = packet[ipv6HeaderLen:]
+		maxMSS = mtu - ipv6HeaderLen - 20
+
+	default:
+		return false
+	}
+
+	if maxMSS <= 0 || len(tcp) < 20 || tcp[13]&0b00000010 == 0 {
+		// Not a syn
+		return false
+	}
+
+	dataOffset := int(tcp[12]>>4) << 2
+	if dataOffset < 20 || len(tcp) < dataOffset {
+		return false
+	}
+
+	options := tcp[20:dataOffset]
+	for i := 0; i < len(options); {
+		switch options[i] {
+		case 0: // end of options
+			return false
+		case 1: // no-op
+			i++
+			continue
+		}
+
+		if i+1 >= len(options) || options[i+1] < 2 || i+int(options[i+1]) > len(options) {
+			return false
+		}
+
+		if options[i] == 2 && options[i+1] == 4 {
+			mss := binary.BigEndian.Uint16(options[i+2:])
+			if int(mss) <= maxMSS {
+				return false
+			}
+
+			binary.BigEndian.PutUint16(options[i+2:], uint16(maxMSS))
+
+			// Incremental checksum update from rfc1624, HC' = ~(~HC + ~m + m')
+			csum := uint32(^binary.BigEndian.Uint16(tcp[16:])) + uint32(^mss) + uint32(maxMSS)
+			for csum > 0xffff {
+				csum = (csum >> 16) + (csum & 0xffff)
+			}
+			binary.BigEndian.PutUint16(tcp[16:], ^uint16(csum))
+			return true
+		}
+
+		i += int(options[i+1])
+	}
+
+	return false
+}
+
 // calculates the TCP/IP checksum defined in rfc1071. The passed-in
 // csum is any initial checksum data that's already been computed.
 //
@@ -238,3 +428,14 @@ func ipv4PseudoheaderChecksum(src, dst []byte, proto, length uint32) (csum uint3
 	csum += length >> 16
 	return csum
 }
+
+func ipv6PseudoheaderChecksum(src, dst []byte, proto, length uint32) (csum uint32) {
+	for i := 0; i < 16; i += 2 {
+		csum += uint32(src[i])<<8 + uint32(src[i+1])
+		csum += uint32(dst[i])<<8 + uint32(dst[i+1])
+	}
+	csum += proto
+	csum += length & 0xffff
+	csum += length >> 16
+	return csum
+}
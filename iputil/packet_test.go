@@ -1,6 +1,7 @@
 package iputil
 
 import (
+	"encoding/binary"
 	"net"
 	"testing"
 
@@ -71,3 +72,123 @@ func Test_CreateRejectPacket(t *testing.T) {
 	assert.NotNil(t, rejectPacket)
 	assert.Len(t, rejectPacket, expectedLen)
 }
+
+func Test_CreatePacketTooBig(t *testing.T) {
+	h := ipv4.Header{
+		Len:      20,
+		TotalLen: 1400,
+		Src:      net.IPv4(10, 0, 0, 1),
+		Dst:      net.IPv4(10, 0, 0, 2),
+		Protocol: 6, // TCP
+		Flags:    ipv4.DontFragment,
+	}
+
+	b, err := h.Marshal()
+	if err != nil {
+		t.Fatalf("h.Marhshal: %v", err)
+	}
+	b = append(b, make([]byte, 1380)...)
+
+	out := make([]byte, MaxPacketTooBigSize)
+	p := CreatePacketTooBig(b, 1300, out)
+	assert.Len(t, p, ipv4.HeaderLen+8+h.Len+8)
+	assert.Equal(t, net.IP(b[16:20]), net.IP(p[12:16]), "comes from the original destination")
+	assert.Equal(t, net.IP(b[12:16]), net.IP(p[16:20]), "goes to the original source")
+	assert.Equal(t, []byte{3, 4}, p[20:22], "fragmentation needed")
+	assert.Equal(t, uint16(1300), binary.BigEndian.Uint16(p[26:28]))
+	assert.Zero(t, tcpipChecksum(p[:ipv4.HeaderLen], 0))
+	assert.Zero(t, tcpipChecksum(p[ipv4.HeaderLen:], 0))
+	assert.Equal(t, b[:h.Len+8], p[28:])
+
+	// Senders that allow fragmentation do not get an answer
+	h.Flags = 0
+	b2, err := h.Marshal()
+	if err != nil {
+		t.Fatalf("h.Marhshal: %v", err)
+	}
+	assert.Nil(t, CreatePacketTooBig(append(b2, make([]byte, 1380)...), 1300, out))
+
+	// IPv6
+	b = make([]byte, 1400)
+	b[0] = 6 << 4
+	binary.BigEndian.PutUint16(b[4:], 1400-ipv6HeaderLen)
+	b[6] = 17 // UDP
+	copy(b[8:24], net.ParseIP("fd00::1"))
+	copy(b[24:40], net.ParseIP("fd00::2"))
+	for i := ipv6HeaderLen; i < len(b); i++ {
+		b[i] = byte(i)
+	}
+
+	p = CreatePacketTooBig(b, 1300, out)
+	assert.Len(t, p, MaxPacketTooBigSize, "capped at the ipv6 minimum mtu")
+	assert.Equal(t, b[24:40], p[8:24])
+	assert.Equal(t, b[8:24], p[24:40])
+	assert.Equal(t, byte(58), p[6])
+	assert.Equal(t, uint16(MaxPacketTooBigSize-ipv6HeaderLen), binary.BigEndian.Uint16(p[4:6]))
+	assert.Equal(t, []byte{2, 0}, p[40:42], "packet too big")
+	assert.Equal(t, uint32(1300), binary.BigEndian.Uint32(p[44:48]))
+	csum := ipv6PseudoheaderChecksum(p[8:24], p[24:40], 58, uint32(len(p)-ipv6HeaderLen))
+	assert.Zero(t, tcpipChecksum(p[ipv6HeaderLen:], csum))
+	assert.Equal(t, b[:len(p)-48], p[48:])
+
+	// The mtu is never reported below the ipv6 minimum
+	p = CreatePacketTooBig(b, 1000, out)
+	assert.Equal(t, uint32(1280), binary.BigEndian.Uint32(p[44:48]))
+
+	// Nonsense
+	assert.Nil(t, CreatePacketTooBig(nil, 1300, out))
+	assert.Nil(t, CreatePacketTooBig([]byte{0x45, 0}, 1300, out))
+	assert.Nil(t, CreatePacketTooBig([]byte{0x60, 0}, 1300, out))
+}
+
+func Test_ClampTCPMSS(t *testing.T) {
+	h := ipv4.Header{
+		Len:      20,
+		TotalLen: 20 + 24,
+		Src:      net.IPv4(10, 0, 0, 1),
+		Dst:      net.IPv4(10, 0, 0, 2),
+		Protocol: 6, // TCP
+	}
+
+	b, err := h.Marshal()
+	if err != nil {
+		t.Fatalf("h.Marhshal: %v", err)
+	}
+
+	tcp := make([]byte, 24)
+	binary.BigEndian.PutUint16(tcp[0:], 1234)
+	binary.BigEndian.PutUint16(tcp[2:], 80)
+	tcp[12] = 6 << 4        // data offset
+	tcp[13] = 0b00000010    // SYN
+	tcp[20], tcp[21] = 2, 4 // MSS
+	binary.BigEndian.PutUint16(tcp[22:], 1460)
+	binary.BigEndian.PutUint16(tcp[16:], tcpipChecksum(tcp, ipv4PseudoheaderChecksum(b[12:16], b[16:20], 6, 24)))
+	b = append(b, tcp...)
+
+	syn := make([]byte, len(b))
+	copy(syn, b)
+
+	// Already small enough
+	assert.False(t, ClampTCPMSS(b, 1500))
+	assert.Equal(t, syn, b)
+
+	assert.True(t, ClampTCPMSS(b, 1300))
+	assert.Equal(t, uint16(1260), binary.BigEndian.Uint16(b[42:44]))
+	assert.Zero(t, tcpipChecksum(b[20:], ipv4PseudoheaderChecksum(b[12:16], b[16:20], 6, 24)))
+
+	// Only syns are touched
+	copy(b, syn)
+	b[33] = 0b00010000 // ACK
+	assert.False(t, ClampTCPMSS(b, 1300))
+
+	// Options are walked past no-ops
+	copy(b, syn)
+	b[40], b[41], b[42], b[43] = 1, 2, 4, 0x05
+	assert.False(t, ClampTCPMSS(b[:43], 1300), "truncated option")
+
+	// Not tcp
+	copy(b, syn)
+	b[9] = 17
+	assert.False(t, ClampTCPMSS(b, 1300))
+	assert.False(t, ClampTCPMSS(nil, 1300))
+}
@@ -7,7 +7,10 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
+	"net/url"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -17,6 +20,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/portmap"
 	"github.com/slackhq/nebula/udp"
 	"github.com/slackhq/nebula/util"
 )
@@ -57,13 +61,33 @@ type LightHouse struct {
 	staticList  atomic.Pointer[map[netip.Addr]struct{}]
 	lighthouses atomic.Pointer[map[netip.Addr]struct{}]
 
-	interval     atomic.Int64
-	updateCancel context.CancelFunc
-	ifce         EncWriter
-	nebulaPort   uint32 // 32 bits because protobuf does not have a uint16
+	interval      atomic.Int64
+	updateCancel  context.CancelFunc
+	updateStarted atomic.Bool
+	ifce          EncWriter
+	nebulaPort    uint32 // 32 bits because protobuf does not have a uint16
 
 	advertiseAddrs atomic.Pointer[[]netip.AddrPort]
 
+	// tcp is nil unless the tcp transport is enabled, tcpAdvertiseAddrs are extra tcp endpoints to report
+	tcp               *udp.TCPConn
+	tcpAdvertiseAddrs atomic.Pointer[[]netip.AddrPort]
+
+	// websocket is nil unless the websocket transport is enabled, websocketAdvertiseAddrs are extra websocket endpoints
+	// to report and websocketEndpoints are how to dial the websocket entries in the static host map
+	websocket               *udp.WebSocketConn
+	websocketAdvertiseAddrs atomic.Pointer[[]netip.AddrPort]
+	websocketEndpoints      atomic.Pointer[map[netip.AddrPort]udp.StreamEndpoint]
+
+	// proxy is nil unless udp goes through the relay of a socks5 proxy, our local addresses are useless to others then
+	proxy *udp.Socks5Conn
+
+	// portMap is nil unless we ask the gateway in front of us for a public port, its address is reported when it has one
+	portMap *portmap.Mapper
+
+	// nat classifies the NAT in front of us from the HostWhoamiReply of every lighthouse, with punchy.nat_detection
+	nat *natDetector
+
 	// IP's of relays that can be used by peers to access me
 	relaysForMe atomic.Pointer[[]netip.Addr]
 
@@ -71,6 +95,19 @@ type LightHouse struct {
 
 	calculatedRemotes atomic.Pointer[bart.Table[[]*calculatedRemote]] // Maps VpnIp to []*calculatedRemote
 
+	// dnsRecords holds the certificate names we know about, lighthouses answer name queries from it
+	// and other nodes record the answers in it. nil when neither is needed.
+	dnsRecords *dnsRecords
+
+	// advertisedRoutes are the unsafe networks we carry traffic for as a gateway, sent with every update
+	advertisedRoutes []*UnsafeRoute
+	// unsafeRoutes holds the unsafe networks each gateway advertised when we are a lighthouse, they are checked
+	// against the gateway certificate from hostMap
+	unsafeRoutes map[netip.Addr][]*UnsafeRoute
+	hostMap      *HostMap
+	// routeLearner takes the unsafe routes lighthouses answer with, nil unless tun.learn_unsafe_routes is enabled
+	routeLearner *routeLearner
+
 	metrics           *MessageMetrics
 	metricHolepunchTx metrics.Counter
 	l                 *logrus.Logger
@@ -99,9 +136,11 @@ func NewLightHouseFromConfig(ctx context.Context, l *logrus.Logger, c *config.C,
 		amLighthouse: amLighthouse,
 		myVpnNet:     myVpnNet,
 		addrMap:      make(map[netip.Addr]*RemoteList),
+		unsafeRoutes: make(map[netip.Addr][]*UnsafeRoute),
 		nebulaPort:   nebulaPort,
 		punchConn:    pc,
 		punchy:       p,
+		nat:          newNatDetector(),
 		queryChan:    make(chan netip.Addr, c.GetUint32("handshakes.query_buffer", 64)),
 		l:            l,
 	}
@@ -171,47 +210,42 @@ func (lh *LightHouse) GetUpdateInterval() int64 {
 
 func (lh *LightHouse) reload(c *config.C, initial bool) error {
 	if initial || c.HasChanged("lighthouse.advertise_addrs") {
-		rawAdvAddrs := c.GetStringSlice("lighthouse.advertise_addrs", []string{})
-		advAddrs := make([]netip.AddrPort, 0)
+		advAddrs, err := lh.parseAdvertiseAddrs(c, "lighthouse.advertise_addrs", uint16(lh.nebulaPort))
+		if err != nil {
+			return err
+		}
 
-		for i, rawAddr := range rawAdvAddrs {
-			host, sport, err := net.SplitHostPort(rawAddr)
-			if err != nil {
-				return util.NewContextualError("Unable to parse lighthouse.advertise_addrs entry", m{"addr": rawAddr, "entry": i + 1}, err)
-			}
+		lh.advertiseAddrs.Store(&advAddrs)
 
-			ips, err := net.DefaultResolver.LookupNetIP(context.Background(), "ip", host)
-			if err != nil {
-				return util.NewContextualError("Unable to lookup lighthouse.advertise_addrs entry", m{"addr": rawAddr, "entry": i + 1}, err)
-			}
-			if len(ips) == 0 {
-				return util.NewContextualError("Unable to lookup lighthouse.advertise_addrs entry", m{"addr": rawAddr, "entry": i + 1}, nil)
-			}
+		if !initial {
+			lh.l.Info("lighthouse.advertise_addrs has changed")
+		}
+	}
 
-			port, err := strconv.Atoi(sport)
-			if err != nil {
-				return util.NewContextualError("Unable to parse port in lighthouse.advertise_addrs entry", m{"addr": rawAddr, "entry": i + 1}, err)
-			}
+	if initial || c.HasChanged("listen.transports.tcp.advertise_addrs") {
+		// A port of 0 is filled in with the port we accept tcp streams on when the update is sent
+		advAddrs, err := lh.parseAdvertiseAddrs(c, "listen.transports.tcp.advertise_addrs", 0)
+		if err != nil {
+			return err
+		}
 
-			if port == 0 {
-				port = int(lh.nebulaPort)
-			}
+		lh.tcpAdvertiseAddrs.Store(&advAddrs)
 
-			//TODO: we could technically insert all returned ips instead of just the first one if a dns lookup was used
-			ip := ips[0].Unmap()
-			if lh.myVpnNet.Contains(ip) {
-				lh.l.WithField("addr", rawAddr).WithField("entry", i+1).
-					Warn("Ignoring lighthouse.advertise_addrs report because it is within the nebula network range")
-				continue
-			}
+		if !initial {
+			lh.l.Info("listen.transports.tcp.advertise_addrs has changed")
+		}
+	}
 
-			advAddrs = append(advAddrs, netip.AddrPortFrom(ip, uint16(port)))
+	if initial || c.HasChanged("listen.transports.websocket.advertise_addrs") {
+		advAddrs, err := lh.parseAdvertiseAddrs(c, "listen.transports.websocket.advertise_addrs", 0)
+		if err != nil {
+			return err
 		}
 
-		lh.advertiseAddrs.Store(&advAddrs)
+		lh.websocketAdvertiseAddrs.Store(&advAddrs)
 
 		if !initial {
-			lh.l.Info("lighthouse.advertise_addrs has changed")
+			lh.l.Info("listen.transports.websocket.advertise_addrs has changed")
 		}
 	}
 
@@ -348,6 +382,48 @@ func (lh *LightHouse) reload(c *config.C, initial bool) error {
 	return nil
 }
 
+// parseAdvertiseAddrs resolves the ip:port entries under key, entries with a port of 0 get defaultPort
+func (lh *LightHouse) parseAdvertiseAddrs(c *config.C, key string, defaultPort uint16) ([]netip.AddrPort, error) {
+	rawAdvAddrs := c.GetStringSlice(key, []string{})
+	advAddrs := make([]netip.AddrPort, 0)
+
+	for i, rawAddr := range rawAdvAddrs {
+		host, sport, err := net.SplitHostPort(rawAddr)
+		if err != nil {
+			return nil, util.NewContextualError("Unable to parse "+key+" entry", m{"addr": rawAddr, "entry": i + 1}, err)
+		}
+
+		ips, err := net.DefaultResolver.LookupNetIP(context.Background(), "ip", host)
+		if err != nil {
+			return nil, util.NewContextualError("Unable to lookup "+key+" entry", m{"addr": rawAddr, "entry": i + 1}, err)
+		}
+		if len(ips) == 0 {
+			return nil, util.NewContextualError("Unable to lookup "+key+" entry", m{"addr": rawAddr, "entry": i + 1}, nil)
+		}
+
+		port, err := strconv.Atoi(sport)
+		if err != nil {
+			return nil, util.NewContextualError("Unable to parse port in "+key+" entry", m{"addr": rawAddr, "entry": i + 1}, err)
+		}
+
+		if port == 0 {
+			port = int(defaultPort)
+		}
+
+		//TODO: we could technically insert all returned ips instead of just the first one if a dns lookup was used
+		ip := ips[0].Unmap()
+		if lh.myVpnNet.Contains(ip) {
+			lh.l.WithField("addr", rawAddr).WithField("entry", i+1).
+				Warnf("Ignoring %s report because it is within the nebula network range", key)
+			continue
+		}
+
+		advAddrs = append(advAddrs, netip.AddrPortFrom(ip, uint16(port)))
+	}
+
+	return advAddrs, nil
+}
+
 func (lh *LightHouse) parseLighthouses(c *config.C, lhMap map[netip.Addr]struct{}) error {
 	lhs := c.GetStringSlice("lighthouse.hosts", []string{})
 	if lh.amLighthouse && len(lhs) != 0 {
@@ -422,6 +498,7 @@ func (lh *LightHouse) loadStaticMap(c *config.C, staticList map[netip.Addr]struc
 	}
 
 	shm := c.GetMap("static_host_map", map[interface{}]interface{}{})
+	wsEndpoints := map[netip.AddrPort]udp.StreamEndpoint{}
 	i := 0
 
 	for k, v := range shm {
@@ -443,16 +520,27 @@ func (lh *LightHouse) loadStaticMap(c *config.C, staticList map[netip.Addr]struc
 			remoteAddrs = append(remoteAddrs, fmt.Sprintf("%v", v))
 		}
 
-		err = lh.addStaticRemotes(i, d, network, lookupTimeout, vpnIp, remoteAddrs, staticList)
+		err = lh.addStaticRemotes(i, d, network, lookupTimeout, vpnIp, remoteAddrs, staticList, wsEndpoints)
 		if err != nil {
 			return err
 		}
 		i++
 	}
 
+	lh.websocketEndpoints.Store(&wsEndpoints)
 	return nil
 }
 
+// webSocketEndpoint returns how to dial addr if it came from a websocket entry in the static host map
+func (lh *LightHouse) webSocketEndpoint(addr netip.AddrPort) (udp.StreamEndpoint, bool) {
+	eps := lh.websocketEndpoints.Load()
+	if eps == nil {
+		return udp.StreamEndpoint{}, false
+	}
+	ep, ok := (*eps)[addr]
+	return ep, ok
+}
+
 func (lh *LightHouse) Query(ip netip.Addr) *RemoteList {
 	if !lh.IsLighthouseIP(ip) {
 		lh.QueryServer(ip)
@@ -517,6 +605,11 @@ func (lh *LightHouse) queryAndPrepMessage(vpnIp netip.Addr, f func(*cache) (int,
 }
 
 func (lh *LightHouse) DeleteVpnIp(vpnIp netip.Addr) {
+	// A gateway we lost the tunnel to can not carry traffic for its unsafe networks, static or not
+	lh.Lock()
+	delete(lh.unsafeRoutes, vpnIp)
+	lh.Unlock()
+
 	// First we check the static mapping
 	// and do nothing if it is there
 	if _, ok := lh.GetStaticHostList()[vpnIp]; ok {
@@ -537,7 +630,9 @@ func (lh *LightHouse) DeleteVpnIp(vpnIp netip.Addr) {
 // We are the owner because we don't want a lighthouse server to advertise for static hosts it was configured with
 // And we don't want a lighthouse query reply to interfere with our learned cache if we are a client
 // NOTE: this function should not interact with any hot path objects, like lh.staticList, the caller should handle it
-func (lh *LightHouse) addStaticRemotes(i int, d time.Duration, network string, timeout time.Duration, vpnIp netip.Addr, toAddrs []string, staticList map[netip.Addr]struct{}) error {
+func (lh *LightHouse) addStaticRemotes(i int, d time.Duration, network string, timeout time.Duration, vpnIp netip.Addr, toAddrs []string, staticList map[netip.Addr]struct{}, wsEndpoints map[netip.AddrPort]udp.StreamEndpoint) error {
+	toAddrs, tcpAddrs, wsAddrs := lh.resolveStaticStreamRemotes(network, timeout, vpnIp, toAddrs, wsEndpoints)
+
 	lh.Lock()
 	am := lh.unlockedGetRemoteList(vpnIp)
 	am.Lock()
@@ -568,12 +663,86 @@ func (lh *LightHouse) addStaticRemotes(i int, d time.Duration, network string, t
 			am.unlockedPrependV6(lh.myVpnNet.Addr(), NewIp6AndPortFromNetIP(addrPort.Addr(), addrPort.Port()))
 		}
 	}
+	am.unlockedSetTCP(lh.myVpnNet.Addr(), vpnIp, tcpAddrs, lh.shouldAdd)
+	am.unlockedSetWebSocket(lh.myVpnNet.Addr(), vpnIp, wsAddrs, lh.shouldAdd)
 
 	// Mark it as static in the caller provided map
 	staticList[vpnIp] = struct{}{}
 	return nil
 }
 
+// resolveStaticStreamRemotes pulls the tcp://host:port, ws://host[:port][/path] and wss://host[:port][/path] entries out
+// of a static_host_map entry. How to dial each websocket address is recorded in wsEndpoints. Unlike udp entries, a
+// hostname is only looked up once when the static map is loaded.
+func (lh *LightHouse) resolveStaticStreamRemotes(network string, timeout time.Duration, vpnIp netip.Addr, toAddrs []string, wsEndpoints map[netip.AddrPort]udp.StreamEndpoint) ([]string, []netip.AddrPort, []netip.AddrPort) {
+	var udpAddrs []string
+	var tcpAddrs, wsAddrs []netip.AddrPort
+	for _, to := range toAddrs {
+		var addrs []netip.AddrPort
+		var err error
+
+		switch {
+		case strings.HasPrefix(to, "tcp://"):
+			var host, port string
+			host, port, err = net.SplitHostPort(strings.TrimPrefix(to, "tcp://"))
+			if err == nil {
+				addrs, err = lh.lookupStaticStreamRemote(network, timeout, host, port)
+			}
+			tcpAddrs = append(tcpAddrs, addrs...)
+
+		case strings.HasPrefix(to, "ws://"), strings.HasPrefix(to, "wss://"):
+			var u *url.URL
+			u, err = url.Parse(to)
+			if err == nil {
+				ep := udp.StreamEndpoint{Host: u.Hostname(), Path: u.Path, TLS: u.Scheme == "wss"}
+				port := u.Port()
+				if port == "" {
+					port = "80"
+					if ep.TLS {
+						port = "443"
+					}
+				}
+
+				addrs, err = lh.lookupStaticStreamRemote(network, timeout, ep.Host, port)
+				for _, addr := range addrs {
+					wsEndpoints[addr] = ep
+				}
+			}
+			wsAddrs = append(wsAddrs, addrs...)
+
+		default:
+			udpAddrs = append(udpAddrs, to)
+		}
+
+		if err != nil {
+			lh.l.WithField("vpnIp", vpnIp).WithField("entry", to).WithError(err).
+				Error("Unable to resolve static_host_map stream entry")
+		}
+	}
+
+	return udpAddrs, tcpAddrs, wsAddrs
+}
+
+func (lh *LightHouse) lookupStaticStreamRemote(network string, timeout time.Duration, host, sPort string) ([]netip.AddrPort, error) {
+	port, err := strconv.Atoi(sPort)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(lh.ctx, timeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, network, host)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]netip.AddrPort, len(ips))
+	for i, ip := range ips {
+		addrs[i] = netip.AddrPortFrom(ip.Unmap(), uint16(port))
+	}
+	return addrs, nil
+}
+
 // addCalculatedRemotes adds any calculated remotes based on the
 // lighthouse.calculated_remotes configuration. It returns true if any
 // calculated remotes were added
@@ -758,9 +927,62 @@ func (lh *LightHouse) innerQueryServer(ip netip.Addr, nb, out []byte) {
 	}
 }
 
+// QueryName asks all lighthouses for the vpn ip of the host whose certificate name is name.
+// Answers are recorded in lh.dnsRecords as they arrive.
+func (lh *LightHouse) QueryName(name string) {
+	if lh.amLighthouse {
+		return
+	}
+
+	query, err := (&NebulaMeta{
+		Type:    NebulaMeta_HostNameQuery,
+		Details: &NebulaMetaDetails{Name: name},
+	}).Marshal()
+	if err != nil {
+		lh.l.WithError(err).WithField("name", name).Error("Failed to marshal lighthouse name query payload")
+		return
+	}
+
+	lighthouses := lh.GetLighthouses()
+	lh.metricTx(NebulaMeta_HostNameQuery, int64(len(lighthouses)))
+	nb := make([]byte, 12, 12)
+	out := make([]byte, mtu)
+
+	for n := range lighthouses {
+		lh.ifce.SendMessageToVpnIp(header.LightHouse, 0, n, query, nb, out)
+	}
+}
+
+// queryUnsafeRoutes asks all lighthouses for the unsafe networks gateways advertised to them.
+// Answers are handed to lh.routeLearner as they arrive.
+func (lh *LightHouse) queryUnsafeRoutes() {
+	query, err := (&NebulaMeta{
+		Type:    NebulaMeta_HostRoutesQuery,
+		Details: &NebulaMetaDetails{},
+	}).Marshal()
+	if err != nil {
+		lh.l.WithError(err).Error("Failed to marshal lighthouse routes query payload")
+		return
+	}
+
+	lighthouses := lh.GetLighthouses()
+	lh.metricTx(NebulaMeta_HostRoutesQuery, int64(len(lighthouses)))
+	nb := make([]byte, 12, 12)
+	out := make([]byte, mtu)
+
+	for n := range lighthouses {
+		lh.ifce.SendMessageToVpnIp(header.LightHouse, 0, n, query, nb, out)
+	}
+}
+
 func (lh *LightHouse) StartUpdateWorker() {
+	if lh.amLighthouse {
+		return
+	}
+	lh.updateStarted.Store(true)
+
 	interval := lh.GetUpdateInterval()
-	if lh.amLighthouse || interval == 0 {
+	if interval == 0 {
 		return
 	}
 
@@ -784,32 +1006,27 @@ func (lh *LightHouse) StartUpdateWorker() {
 	}()
 }
 
-func (lh *LightHouse) SendUpdate() {
-	var v4 []*Ip4AndPort
-	var v6 []*Ip6AndPort
-
-	for _, e := range lh.GetAdvertiseAddrs() {
-		if e.Addr().Is4() {
-			v4 = append(v4, NewIp4AndPortFromNetIP(e.Addr(), e.Port()))
-		} else {
-			v6 = append(v6, NewIp6AndPortFromNetIP(e.Addr(), e.Port()))
-		}
+// TriggerUpdate sends an update to the lighthouses now instead of at the next interval, like when our port mapping
+// changes. Nothing is sent before the update worker starts, the first update will include the change.
+func (lh *LightHouse) TriggerUpdate() {
+	if lh.updateStarted.Load() {
+		go lh.SendUpdate()
 	}
+}
 
-	lal := lh.GetLocalAllowList()
-	for _, e := range localIps(lh.l, lal) {
-		if lh.myVpnNet.Contains(e) {
-			continue
-		}
-
+func (lh *LightHouse) SendUpdate() {
+	var local []netip.Addr
+	for _, e := range localIps(lh.l, lh.GetLocalAllowList()) {
 		// Only add IPs that aren't my VPN/tun IP
-		if e.Is4() {
-			v4 = append(v4, NewIp4AndPortFromNetIP(e, uint16(lh.nebulaPort)))
-		} else {
-			v6 = append(v6, NewIp6AndPortFromNetIP(e, uint16(lh.nebulaPort)))
+		if !lh.myVpnNet.Contains(e) {
+			local = append(local, e)
 		}
 	}
 
+	v4, v6 := splitAddrPorts(lh.udpEndpoints(local))
+	tcp4, tcp6 := splitAddrPorts(lh.tcpEndpoints(local))
+	ws4, ws6 := splitAddrPorts(lh.webSocketEndpoints(local))
+
 	var relays []uint32
 	for _, r := range lh.GetRelaysForMe() {
 		//TODO: IPV6-WORK both relays and vpnip need ipv6 support
@@ -823,10 +1040,16 @@ func (lh *LightHouse) SendUpdate() {
 	m := &NebulaMeta{
 		Type: NebulaMeta_HostUpdateNotification,
 		Details: &NebulaMetaDetails{
-			VpnIp:       binary.BigEndian.Uint32(b[:]),
-			Ip4AndPorts: v4,
-			Ip6AndPorts: v6,
-			RelayVpnIp:  relays,
+			VpnIp:                binary.BigEndian.Uint32(b[:]),
+			Ip4AndPorts:          v4,
+			Ip6AndPorts:          v6,
+			RelayVpnIp:           relays,
+			TcpIp4AndPorts:       tcp4,
+			TcpIp6AndPorts:       tcp6,
+			WebSocketIp4AndPorts: ws4,
+			WebSocketIp6AndPorts: ws6,
+			NatType:              uint32(lh.natType()),
+			UnsafeRoutes:         lh.advertisedRoutes,
 		},
 	}
 
@@ -844,6 +1067,120 @@ func (lh *LightHouse) SendUpdate() {
 	for vpnIp := range lighthouses {
 		lh.ifce.SendMessageToVpnIp(header.LightHouse, 0, vpnIp, mm, nb, out)
 	}
+
+	if lh.punchy != nil && lh.punchy.GetNatDetection() {
+		lh.sendWhoami(lighthouses, nb, out)
+	}
+}
+
+// sendWhoami asks every lighthouse where it sees us, the answers classify the NAT in front of us
+func (lh *LightHouse) sendWhoami(lighthouses map[netip.Addr]struct{}, nb, out []byte) {
+	lh.nat.retain(lighthouses)
+
+	//TODO: IPV6-WORK
+	b := lh.myVpnNet.Addr().As4()
+	m := &NebulaMeta{
+		Type:    NebulaMeta_HostWhoami,
+		Details: &NebulaMetaDetails{VpnIp: binary.BigEndian.Uint32(b[:])},
+	}
+
+	mm, err := m.Marshal()
+	if err != nil {
+		lh.l.WithError(err).Error("Error while marshaling for lighthouse whoami")
+		return
+	}
+
+	lh.metricTx(NebulaMeta_HostWhoami, int64(len(lighthouses)))
+	for vpnIp := range lighthouses {
+		lh.ifce.SendMessageToVpnIp(header.LightHouse, 0, vpnIp, mm, nb, out)
+	}
+}
+
+// natType is what we tell lighthouses about the NAT in front of us, nothing is claimed without punchy.nat_detection
+func (lh *LightHouse) natType() NatType {
+	if lh.punchy == nil || !lh.punchy.GetNatDetection() {
+		return NatTypeUnknown
+	}
+	return lh.nat.get()
+}
+
+// udpEndpoints are the udp endpoints we report to lighthouses, lighthouse.advertise_addrs, the public address of our
+// port mapping and listen.port on every local ip. Through a socks5 proxy nobody can reach our local ips, the lighthouse
+// learns the public address of the proxy from our packets and we report the relay in case it is reachable by hosts on
+// the same network as the proxy.
+func (lh *LightHouse) udpEndpoints(local []netip.Addr) []netip.AddrPort {
+	endpoints := append([]netip.AddrPort{}, lh.GetAdvertiseAddrs()...)
+	if lh.portMap != nil {
+		if mapped := lh.portMap.Addr(); mapped.IsValid() && !slices.Contains(endpoints, mapped) {
+			endpoints = append(endpoints, mapped)
+		}
+	}
+
+	if lh.proxy != nil {
+		relay := lh.proxy.RelayAddr()
+		if !relay.Addr().IsLoopback() && !relay.Addr().IsUnspecified() && lh.GetLocalAllowList().Allow(relay.Addr()) {
+			endpoints = append(endpoints, relay)
+		}
+		return endpoints
+	}
+
+	for _, ip := range local {
+		endpoints = append(endpoints, netip.AddrPortFrom(ip, uint16(lh.nebulaPort)))
+	}
+	return endpoints
+}
+
+// tcpEndpoints are the tcp endpoints we report to lighthouses, listen.transports.tcp.advertise_addrs and the address we
+// accept streams on
+func (lh *LightHouse) tcpEndpoints(local []netip.Addr) []netip.AddrPort {
+	if lh.tcp == nil {
+		return nil
+	}
+
+	listen, _ := lh.tcp.LocalAddr()
+	return lh.streamEndpoints(listen, true, *lh.tcpAdvertiseAddrs.Load(), local)
+}
+
+// webSocketEndpoints are the websocket endpoints we report to lighthouses, like tcpEndpoints. A listener behind a
+// reverse proxy should bind to a loopback address and advertise the address of the proxy instead.
+func (lh *LightHouse) webSocketEndpoints(local []netip.Addr) []netip.AddrPort {
+	if lh.websocket == nil {
+		return nil
+	}
+
+	listen, _ := lh.websocket.LocalAddr()
+	return lh.streamEndpoints(listen, !listen.Addr().IsLoopback(), *lh.websocketAdvertiseAddrs.Load(), local)
+}
+
+// streamEndpoints are the advertised addresses and, if reportListen is set, the address a stream transport listens on.
+// Advertised addresses with a port of 0 get the listen port. Like the udp port, an unspecified listen address is
+// reported on every local ip.
+func (lh *LightHouse) streamEndpoints(listen netip.AddrPort, reportListen bool, advertise []netip.AddrPort, local []netip.Addr) []netip.AddrPort {
+	var endpoints []netip.AddrPort
+	for _, e := range advertise {
+		if e.Port() == 0 {
+			if !listen.IsValid() {
+				continue
+			}
+			e = netip.AddrPortFrom(e.Addr(), listen.Port())
+		}
+		endpoints = append(endpoints, e)
+	}
+
+	if !listen.IsValid() || !reportListen {
+		// We only dial out, or someone else is listening for us
+		return endpoints
+	}
+
+	if listen.Addr().IsUnspecified() {
+		for _, ip := range local {
+			endpoints = append(endpoints, netip.AddrPortFrom(ip, listen.Port()))
+		}
+	} else if !lh.myVpnNet.Contains(listen.Addr()) {
+		endpoints = append(endpoints, listen)
+	}
+
+	return endpoints
 }
 
 type LightHouseHandler struct {
@@ -886,9 +1223,12 @@ func (lhh *LightHouseHandler) resetMeta() *NebulaMeta {
 	lhh.meta.Reset()
 
 	// Keep the array memory around
-	details.Ip4AndPorts = details.Ip4AndPorts[:0]
-	details.Ip6AndPorts = details.Ip6AndPorts[:0]
-	details.RelayVpnIp = details.RelayVpnIp[:0]
+	*details = NebulaMetaDetails{
+		Ip4AndPorts:  details.Ip4AndPorts[:0],
+		Ip6AndPorts:  details.Ip6AndPorts[:0],
+		RelayVpnIp:   details.RelayVpnIp[:0],
+		UnsafeRoutes: details.UnsafeRoutes[:0],
+	}
 	lhh.meta.Details = details
 
 	return lhh.meta
@@ -935,6 +1275,24 @@ func (lhh *LightHouseHandler) HandleRequest(rAddr netip.AddrPort, vpnIp netip.Ad
 
 	case NebulaMeta_HostUpdateNotificationAck:
 		// noop
+
+	case NebulaMeta_HostNameQuery:
+		lhh.handleHostNameQuery(n, vpnIp, w)
+
+	case NebulaMeta_HostNameQueryReply:
+		lhh.handleHostNameQueryReply(n, vpnIp)
+
+	case NebulaMeta_HostRoutesQuery:
+		lhh.handleHostRoutesQuery(vpnIp, w)
+
+	case NebulaMeta_HostRoutesQueryReply:
+		lhh.handleHostRoutesQueryReply(n, vpnIp)
+
+	case NebulaMeta_HostWhoami:
+		lhh.handleHostWhoami(vpnIp, rAddr, w)
+
+	case NebulaMeta_HostWhoamiReply:
+		lhh.handleHostWhoamiReply(n, vpnIp)
 	}
 }
 
@@ -1009,8 +1367,11 @@ func (lhh *LightHouseHandler) handleHostQuery(n *NebulaMeta, vpnIp netip.Addr, a
 
 func (lhh *LightHouseHandler) coalesceAnswers(c *cache, n *NebulaMeta) {
 	if c.v4 != nil {
-		if c.v4.learned != nil {
+		if c.v4.learned != nil && !lhh.lh.hasStream(AddrPortFromIp4AndPort(c.v4.learned)) {
 			n.Details.Ip4AndPorts = append(n.Details.Ip4AndPorts, c.v4.learned)
+			if c.natType == NatTypeSymmetric {
+				n.Details.ObservedIp4AndPorts = append(n.Details.ObservedIp4AndPorts, c.v4.learned)
+			}
 		}
 		if c.v4.reported != nil && len(c.v4.reported) > 0 {
 			n.Details.Ip4AndPorts = append(n.Details.Ip4AndPorts, c.v4.reported...)
@@ -1018,8 +1379,11 @@ func (lhh *LightHouseHandler) coalesceAnswers(c *cache, n *NebulaMeta) {
 	}
 
 	if c.v6 != nil {
-		if c.v6.learned != nil {
+		if c.v6.learned != nil && !lhh.lh.hasStream(AddrPortFromIp6AndPort(c.v6.learned)) {
 			n.Details.Ip6AndPorts = append(n.Details.Ip6AndPorts, c.v6.learned)
+			if c.natType == NatTypeSymmetric {
+				n.Details.ObservedIp6AndPorts = append(n.Details.ObservedIp6AndPorts, c.v6.learned)
+			}
 		}
 		if c.v6.reported != nil && len(c.v6.reported) > 0 {
 			n.Details.Ip6AndPorts = append(n.Details.Ip6AndPorts, c.v6.reported...)
@@ -1036,6 +1400,60 @@ func (lhh *LightHouseHandler) coalesceAnswers(c *cache, n *NebulaMeta) {
 		}
 		n.Details.RelayVpnIp = append(n.Details.RelayVpnIp, relays...)
 	}
+
+	if c.tcp != nil {
+		v4, v6 := splitAddrPorts(c.tcp.reported)
+		n.Details.TcpIp4AndPorts = append(n.Details.TcpIp4AndPorts, v4...)
+		n.Details.TcpIp6AndPorts = append(n.Details.TcpIp6AndPorts, v6...)
+	}
+
+	if c.websocket != nil {
+		v4, v6 := splitAddrPorts(c.websocket.reported)
+		n.Details.WebSocketIp4AndPorts = append(n.Details.WebSocketIp4AndPorts, v4...)
+		n.Details.WebSocketIp6AndPorts = append(n.Details.WebSocketIp6AndPorts, v6...)
+	}
+
+	n.Details.NatType = uint32(c.natType)
+}
+
+// hasStream reports if addr belongs to a stream a host dialed us on, the port is one nobody else can reach
+func (lh *LightHouse) hasStream(addr netip.AddrPort) bool {
+	return lh.tcp.Has(addr) || (lh.websocket != nil && lh.websocket.Has(addr))
+}
+
+// splitAddrPorts converts addrs into the ipv4 and ipv6 lists of a lighthouse message
+func splitAddrPorts(addrs []netip.AddrPort) ([]*Ip4AndPort, []*Ip6AndPort) {
+	var v4 []*Ip4AndPort
+	var v6 []*Ip6AndPort
+	for _, a := range addrs {
+		if a.Addr().Is4() {
+			v4 = append(v4, NewIp4AndPortFromNetIP(a.Addr(), a.Port()))
+		} else {
+			v6 = append(v6, NewIp6AndPortFromNetIP(a.Addr(), a.Port()))
+		}
+	}
+	return v4, v6
+}
+
+// tcpAddrsFromDetails collects the tcp endpoints in a lighthouse message
+func tcpAddrsFromDetails(d *NebulaMetaDetails) []netip.AddrPort {
+	return joinAddrPorts(d.TcpIp4AndPorts, d.TcpIp6AndPorts)
+}
+
+// webSocketAddrsFromDetails collects the websocket endpoints in a lighthouse message
+func webSocketAddrsFromDetails(d *NebulaMetaDetails) []netip.AddrPort {
+	return joinAddrPorts(d.WebSocketIp4AndPorts, d.WebSocketIp6AndPorts)
+}
+
+func joinAddrPorts(v4 []*Ip4AndPort, v6 []*Ip6AndPort) []netip.AddrPort {
+	addrs := make([]netip.AddrPort, 0, len(v4)+len(v6))
+	for _, v := range v4 {
+		addrs = append(addrs, AddrPortFromIp4AndPort(v))
+	}
+	for _, v := range v6 {
+		addrs = append(addrs, AddrPortFromIp6AndPort(v))
+	}
+	return addrs
 }
 
 func (lhh *LightHouseHandler) handleHostQueryReply(n *NebulaMeta, vpnIp netip.Addr) {
@@ -1063,6 +1481,8 @@ func (lhh *LightHouseHandler) handleHostQueryReply(n *NebulaMeta, vpnIp netip.Ad
 		relays[i] = netip.AddrFrom4(b)
 	}
 	am.unlockedSetRelay(vpnIp, certVpnIp, relays)
+	am.unlockedSetTCP(vpnIp, certVpnIp, tcpAddrsFromDetails(n.Details), lhh.lh.shouldAdd)
+	am.unlockedSetWebSocket(vpnIp, certVpnIp, webSocketAddrsFromDetails(n.Details), lhh.lh.shouldAdd)
 	am.Unlock()
 
 	// Non-blocking attempt to trigger, skip if it would block
@@ -1070,6 +1490,9 @@ func (lhh *LightHouseHandler) handleHostQueryReply(n *NebulaMeta, vpnIp netip.Ad
 	case lhh.lh.handshakeTrigger <- certVpnIp:
 	default:
 	}
+
+	// Our handshake goes out now, the guesses open our NAT for whichever port the peer answers from
+	lhh.lh.spray(certVpnIp, n.Details, 0)
 }
 
 func (lhh *LightHouseHandler) handleHostUpdateNotification(n *NebulaMeta, vpnIp netip.Addr, w EncWriter) {
@@ -1107,8 +1530,13 @@ func (lhh *LightHouseHandler) handleHostUpdateNotification(n *NebulaMeta, vpnIp
 		relays[i] = netip.AddrFrom4(b)
 	}
 	am.unlockedSetRelay(vpnIp, detailsVpnIp, relays)
+	am.unlockedSetTCP(vpnIp, detailsVpnIp, tcpAddrsFromDetails(n.Details), lhh.lh.shouldAdd)
+	am.unlockedSetWebSocket(vpnIp, detailsVpnIp, webSocketAddrsFromDetails(n.Details), lhh.lh.shouldAdd)
+	am.unlockedSetNatType(vpnIp, NatType(n.Details.NatType))
 	am.Unlock()
 
+	lhh.lh.setUnsafeRoutes(vpnIp, n.Details.UnsafeRoutes)
+
 	n = lhh.resetMeta()
 	n.Type = NebulaMeta_HostUpdateNotificationAck
 
@@ -1160,14 +1588,16 @@ func (lhh *LightHouseHandler) handleHostPunchNotification(n *NebulaMeta, vpnIp n
 		punch(AddrPortFromIp6AndPort(a))
 	}
 
+	//TODO: IPV6-WORK
+	b := [4]byte{}
+	binary.BigEndian.PutUint32(b[:], n.Details.VpnIp)
+	queryVpnIp := netip.AddrFrom4(b)
+	lhh.lh.spray(queryVpnIp, n.Details, lhh.lh.punchy.GetDelay())
+
 	// This sends a nebula test packet to the host trying to contact us. In the case
 	// of a double nat or other difficult scenario, this may help establish
 	// a tunnel.
 	if lhh.lh.punchy.GetRespond() {
-		//TODO: IPV6-WORK
-		b := [4]byte{}
-		binary.BigEndian.PutUint32(b[:], n.Details.VpnIp)
-		queryVpnIp := netip.AddrFrom4(b)
 		go func() {
 			time.Sleep(lhh.lh.punchy.GetRespondDelay())
 			if lhh.l.Level >= logrus.DebugLevel {
@@ -1180,3 +1610,231 @@ func (lhh *LightHouseHandler) handleHostPunchNotification(n *NebulaMeta, vpnIp n
 		}()
 	}
 }
+
+func (lhh *LightHouseHandler) handleHostNameQuery(n *NebulaMeta, vpnIp netip.Addr, w EncWriter) {
+	// Exit if we don't answer queries
+	if !lhh.lh.amLighthouse || lhh.lh.dnsRecords == nil {
+		if lhh.l.Level >= logrus.DebugLevel {
+			lhh.l.Debugln("I don't answer name queries, but received from: ", vpnIp)
+		}
+		return
+	}
+
+	name := n.Details.Name
+	var answer uint32
+	//TODO: IPV6-WORK
+	if addr, err := netip.ParseAddr(lhh.lh.dnsRecords.Query(name)); err == nil && addr.Is4() {
+		b := addr.As4()
+		answer = binary.BigEndian.Uint32(b[:])
+	}
+
+	// Always answer so the querying host does not have to wait out its timeout for names we don't know
+	n = lhh.resetMeta()
+	n.Type = NebulaMeta_HostNameQueryReply
+	n.Details.Name = name
+	n.Details.VpnIp = answer
+	ln, err := n.MarshalTo(lhh.pb)
+	if err != nil {
+		lhh.l.WithError(err).WithField("vpnIp", vpnIp).Error("Failed to marshal lighthouse name query reply")
+		return
+	}
+
+	lhh.lh.metricTx(NebulaMeta_HostNameQueryReply, 1)
+	w.SendMessageToVpnIp(header.LightHouse, 0, vpnIp, lhh.pb[:ln], lhh.nb, lhh.out[:0])
+}
+
+func (lhh *LightHouseHandler) handleHostNameQueryReply(n *NebulaMeta, vpnIp netip.Addr) {
+	if !lhh.lh.IsLighthouseIP(vpnIp) || lhh.lh.dnsRecords == nil {
+		return
+	}
+
+	var addr netip.Addr
+	if n.Details.VpnIp != 0 {
+		//TODO: IPV6-WORK
+		b := [4]byte{}
+		binary.BigEndian.PutUint32(b[:], n.Details.VpnIp)
+		addr = netip.AddrFrom4(b)
+	}
+
+	lhh.lh.dnsRecords.resolved(n.Details.Name, addr)
+}
+
+// setUnsafeRoutes records the unsafe networks a gateway advertised, any outside of its certificate are ignored
+func (lh *LightHouse) setUnsafeRoutes(vpnIp netip.Addr, routes []*UnsafeRoute) {
+	var valid []*UnsafeRoute
+	if len(routes) > 0 {
+		var unsafeNetworks []netip.Prefix
+		if hostinfo := lh.hostMap.QueryVpnIp(vpnIp); hostinfo != nil && hostinfo.GetCert() != nil {
+			unsafeNetworks = hostinfo.GetCert().Certificate.UnsafeNetworks()
+		}
+
+		//TODO: IPV6-WORK
+		b := vpnIp.As4()
+		via := binary.BigEndian.Uint32(b[:])
+		for _, r := range routes {
+			cidr, ok := unsafeRouteCidr(r)
+			if !ok || !networksCover(unsafeNetworks, cidr) {
+				if lh.l.Level >= logrus.DebugLevel {
+					lh.l.WithField("vpnIp", vpnIp).WithField("route", r).
+						Debugln("Host advertised an unsafe route outside of its certificate")
+				}
+				continue
+			}
+
+			valid = append(valid, &UnsafeRoute{Ip: r.Ip, Bits: r.Bits, Priority: r.Priority, Via: via})
+		}
+	}
+
+	lh.Lock()
+	if len(valid) == 0 {
+		delete(lh.unsafeRoutes, vpnIp)
+	} else {
+		lh.unsafeRoutes[vpnIp] = valid
+	}
+	lh.Unlock()
+}
+
+func (lhh *LightHouseHandler) handleHostRoutesQuery(vpnIp netip.Addr, w EncWriter) {
+	// Exit if we don't answer queries
+	if !lhh.lh.amLighthouse {
+		if lhh.l.Level >= logrus.DebugLevel {
+			lhh.l.Debugln("I don't answer routes queries, but received from: ", vpnIp)
+		}
+		return
+	}
+
+	n := lhh.resetMeta()
+	n.Type = NebulaMeta_HostRoutesQueryReply
+
+	var routes []*UnsafeRoute
+	lhh.lh.RLock()
+	for _, r := range lhh.lh.unsafeRoutes {
+		routes = append(routes, r...)
+	}
+	lhh.lh.RUnlock()
+
+	// A lighthouse can be a gateway too
+	//TODO: IPV6-WORK
+	b := lhh.lh.myVpnNet.Addr().As4()
+	for _, r := range lhh.lh.advertisedRoutes {
+		routes = append(routes, &UnsafeRoute{Ip: r.Ip, Bits: r.Bits, Priority: r.Priority, Via: binary.BigEndian.Uint32(b[:])})
+	}
+
+	// The details length prefix can grow by a couple of bytes once the routes are in
+	n.Details.UnsafeRoutes = fitUnsafeRoutes(routes, maxUnsafeRoutesReplySize-n.Size()-2)
+	if len(n.Details.UnsafeRoutes) < len(routes) {
+		lhh.l.WithField("vpnIp", vpnIp).WithField("routes", len(routes)).
+			Warnf("Too many unsafe routes for a lighthouse answer, only sending %v", len(n.Details.UnsafeRoutes))
+	}
+
+	ln, err := n.MarshalTo(lhh.pb)
+	if err != nil {
+		lhh.l.WithError(err).WithField("vpnIp", vpnIp).Error("Failed to marshal lighthouse routes query reply")
+		return
+	}
+
+	lhh.lh.metricTx(NebulaMeta_HostRoutesQueryReply, 1)
+	w.SendMessageToVpnIp(header.LightHouse, 0, vpnIp, lhh.pb[:ln], lhh.nb, lhh.out[:0])
+}
+
+func (lhh *LightHouseHandler) handleHostRoutesQueryReply(n *NebulaMeta, vpnIp netip.Addr) {
+	if !lhh.lh.IsLighthouseIP(vpnIp) || lhh.lh.routeLearner == nil {
+		return
+	}
+
+	lhh.lh.routeLearner.answer(vpnIp, n.Details.UnsafeRoutes, time.Now())
+}
+
+// spray punches guesses at the ports the NAT in front of a symmetric peer will use to reach us, one normal punch at the
+// port the lighthouse saw is useless as the peer shows up from a new port. Only the public addresses the lighthouse saw
+// the peer at itself are guessed at, the peer can report any address and would otherwise aim the spray at a third
+// party. Every peer gets one spray until a direct tunnel completes or the attempt times out and every target address
+// is limited to one spray per sprayResultTimeout no matter how many peers claim it.
+func (lh *LightHouse) spray(vpnPeer netip.Addr, d *NebulaMetaDetails, delay time.Duration) {
+	if NatType(d.NatType) != NatTypeSymmetric || lh.punchy == nil || !lh.punchy.GetSpray() {
+		return
+	}
+
+	var targets []netip.AddrPort
+	for _, a := range joinAddrPorts(d.ObservedIp4AndPorts, d.ObservedIp6AndPorts) {
+		ip := a.Addr().Unmap()
+		if !ip.IsGlobalUnicast() || ip.IsPrivate() || lh.hasStream(a) || slices.Contains(targets, a) {
+			continue
+		}
+		targets = append(targets, a)
+	}
+
+	targets = lh.punchy.startSpray(vpnPeer, targets, time.Now())
+	if len(targets) == 0 {
+		return
+	}
+
+	if lh.l.Level >= logrus.DebugLevel {
+		lh.l.WithField("vpnIp", vpnPeer).WithField("remotes", targets).Debug("Spraying punches at a symmetric NAT")
+	}
+
+	go func() {
+		time.Sleep(delay)
+		empty := []byte{0}
+		for _, target := range targets {
+			for _, addr := range lh.punchy.sprayAddrs(target) {
+				lh.punchy.metricSprayPackets.Inc(1)
+				lh.punchConn.WriteTo(empty, addr)
+			}
+		}
+	}()
+}
+
+func (lhh *LightHouseHandler) handleHostWhoami(vpnIp netip.Addr, rAddr netip.AddrPort, w EncWriter) {
+	if !lhh.lh.amLighthouse {
+		if lhh.l.Level >= logrus.DebugLevel {
+			lhh.l.Debugln("I am not a lighthouse, do not answer whoami: ", vpnIp)
+		}
+		return
+	}
+
+	// A relayed host or one on a stream tells us nothing about its udp port
+	if !rAddr.IsValid() || lhh.lh.hasStream(rAddr) {
+		return
+	}
+
+	n := lhh.resetMeta()
+	n.Type = NebulaMeta_HostWhoamiReply
+	//TODO: IPV6-WORK
+	b := vpnIp.As4()
+	n.Details.VpnIp = binary.BigEndian.Uint32(b[:])
+	if rAddr.Addr().Unmap().Is4() {
+		n.Details.Ip4AndPorts = append(n.Details.Ip4AndPorts, NewIp4AndPortFromNetIP(rAddr.Addr().Unmap(), rAddr.Port()))
+	} else {
+		n.Details.Ip6AndPorts = append(n.Details.Ip6AndPorts, NewIp6AndPortFromNetIP(rAddr.Addr(), rAddr.Port()))
+	}
+
+	ln, err := n.MarshalTo(lhh.pb)
+	if err != nil {
+		lhh.l.WithError(err).WithField("vpnIp", vpnIp).Error("Failed to marshal lighthouse whoami reply")
+		return
+	}
+
+	lhh.lh.metricTx(NebulaMeta_HostWhoamiReply, 1)
+	w.SendMessageToVpnIp(header.LightHouse, 0, vpnIp, lhh.pb[:ln], lhh.nb, lhh.out[:0])
+}
+
+func (lhh *LightHouseHandler) handleHostWhoamiReply(n *NebulaMeta, vpnIp netip.Addr) {
+	if !lhh.lh.IsLighthouseIP(vpnIp) {
+		return
+	}
+
+	addrs := joinAddrPorts(n.Details.Ip4AndPorts, n.Details.Ip6AndPorts)
+	if len(addrs) != 1 {
+		return
+	}
+
+	natType, changed := lhh.lh.nat.observe(vpnIp, addrs[0])
+	if !changed {
+		return
+	}
+
+	lhh.l.WithField("natType", natType).Info("NAT type changed")
+	// The lighthouses pass it on to hosts that want to reach us
+	lhh.lh.TriggerUpdate()
+}
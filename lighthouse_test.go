@@ -6,11 +6,14 @@ import (
 	"fmt"
 	"net/netip"
 	"testing"
+	"time"
 
 	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/header"
 	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"gopkg.in/yaml.v2"
 )
 
@@ -67,6 +70,59 @@ func Test_lhStaticMapping(t *testing.T) {
 	assert.EqualError(t, err, "lighthouse 10.128.0.3 does not have a static_host_map entry")
 }
 
+func Test_lhStaticMappingTCP(t *testing.T) {
+	l := test.NewLogger()
+	myVpnNet := netip.MustParsePrefix("10.128.0.1/16")
+	lh1 := "10.128.0.2"
+
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"hosts": []interface{}{lh1}}
+	c.Settings["static_host_map"] = map[interface{}]interface{}{lh1: []interface{}{"1.1.1.1:4242", "tcp://1.1.1.1:443", "tcp://3.3.3.3:8443"}}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, myVpnNet, nil, nil)
+	assert.Nil(t, err)
+
+	rl := lh.Query(netip.MustParseAddr(lh1))
+	assert.Equal(t, []netip.AddrPort{netip.MustParseAddrPort("1.1.1.1:4242")}, rl.CopyAddrs(nil))
+	assert.Equal(t, []netip.AddrPort{netip.MustParseAddrPort("1.1.1.1:443"), netip.MustParseAddrPort("3.3.3.3:8443")}, rl.CopyTCPAddrs())
+
+	// A reload replaces the tcp entries instead of piling them up
+	c.Settings["static_host_map"] = map[interface{}]interface{}{lh1: []interface{}{"1.1.1.1:4242", "tcp://2.2.2.2:443"}}
+	assert.NoError(t, lh.reload(c, true))
+	assert.Equal(t, []netip.AddrPort{netip.MustParseAddrPort("2.2.2.2:443")}, rl.CopyTCPAddrs())
+}
+
+func Test_lhStaticMappingWebSocket(t *testing.T) {
+	l := test.NewLogger()
+	myVpnNet := netip.MustParsePrefix("10.128.0.1/16")
+	lh1 := "10.128.0.2"
+
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"hosts": []interface{}{lh1}}
+	c.Settings["static_host_map"] = map[interface{}]interface{}{lh1: []interface{}{"1.1.1.1:4242", "wss://1.1.1.1", "ws://3.3.3.3:8080/tunnel"}}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, myVpnNet, nil, nil)
+	assert.Nil(t, err)
+
+	rl := lh.Query(netip.MustParseAddr(lh1))
+	assert.Equal(t, []netip.AddrPort{netip.MustParseAddrPort("1.1.1.1:4242")}, rl.CopyAddrs(nil))
+	assert.Empty(t, rl.CopyTCPAddrs())
+	assert.Equal(t, []netip.AddrPort{netip.MustParseAddrPort("1.1.1.1:443"), netip.MustParseAddrPort("3.3.3.3:8080")}, rl.CopyWebSocketAddrs())
+
+	ep, ok := lh.webSocketEndpoint(netip.MustParseAddrPort("1.1.1.1:443"))
+	assert.True(t, ok)
+	assert.Equal(t, udp.StreamEndpoint{Host: "1.1.1.1", TLS: true}, ep)
+
+	ep, ok = lh.webSocketEndpoint(netip.MustParseAddrPort("3.3.3.3:8080"))
+	assert.True(t, ok)
+	assert.Equal(t, udp.StreamEndpoint{Host: "3.3.3.3", Path: "/tunnel"}, ep)
+
+	// A reload forgets endpoints that are gone
+	c.Settings["static_host_map"] = map[interface{}]interface{}{lh1: []interface{}{"1.1.1.1:4242"}}
+	assert.NoError(t, lh.reload(c, true))
+	assert.Empty(t, rl.CopyWebSocketAddrs())
+	_, ok = lh.webSocketEndpoint(netip.MustParseAddrPort("1.1.1.1:443"))
+	assert.False(t, ok)
+}
+
 func TestReloadLighthouseInterval(t *testing.T) {
 	l := test.NewLogger()
 	myVpnNet := netip.MustParsePrefix("10.128.0.1/16")
@@ -268,6 +324,236 @@ func TestLighthouse_Memory(t *testing.T) {
 	assertIp4InArray(t, r.msg.Details.Ip4AndPorts, good)
 }
 
+func TestLighthouse_TCP(t *testing.T) {
+	l := test.NewLogger()
+	myUdpAddr0 := netip.MustParseAddrPort("10.0.0.2:4242")
+	myVpnIp := netip.MustParseAddr("10.128.0.2")
+	theirUdpAddr0 := netip.MustParseAddrPort("10.0.0.3:4242")
+	theirVpnIp := netip.MustParseAddr("10.128.0.3")
+
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"am_lighthouse": true}
+	c.Settings["listen"] = map[interface{}]interface{}{"port": 4242}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, netip.MustParsePrefix("10.128.0.1/24"), nil, nil)
+	assert.NoError(t, err)
+	lhh := lh.NewRequestHandler()
+
+	// Tcp endpoints in an update are handed out next to the udp addresses
+	tcp4 := netip.MustParseAddrPort("1.1.1.1:443")
+	tcp6 := netip.MustParseAddrPort("[1::1]:443")
+	bip := myVpnIp.As4()
+	req := &NebulaMeta{
+		Type: NebulaMeta_HostUpdateNotification,
+		Details: &NebulaMetaDetails{
+			VpnIp:          binary.BigEndian.Uint32(bip[:]),
+			Ip4AndPorts:    []*Ip4AndPort{NewIp4AndPortFromNetIP(myUdpAddr0.Addr(), myUdpAddr0.Port())},
+			TcpIp4AndPorts: []*Ip4AndPort{NewIp4AndPortFromNetIP(tcp4.Addr(), tcp4.Port())},
+			TcpIp6AndPorts: []*Ip6AndPort{NewIp6AndPortFromNetIP(tcp6.Addr(), tcp6.Port())},
+		},
+	}
+	b, err := req.Marshal()
+	assert.NoError(t, err)
+	lhh.HandleRequest(myUdpAddr0, myVpnIp, b, &testEncWriter{})
+
+	r := newLHHostRequest(theirUdpAddr0, theirVpnIp, myVpnIp, lhh)
+	assertIp4InArray(t, r.msg.Details.Ip4AndPorts, myUdpAddr0)
+	assert.Equal(t, []netip.AddrPort{tcp4, tcp6}, tcpAddrsFromDetails(r.msg.Details))
+
+	// A host that stops reporting tcp endpoints loses them
+	newLHHostUpdate(myUdpAddr0, myVpnIp, []netip.AddrPort{myUdpAddr0}, lhh)
+	r = newLHHostRequest(theirUdpAddr0, theirVpnIp, myVpnIp, lhh)
+	assert.Empty(t, tcpAddrsFromDetails(r.msg.Details))
+}
+
+func TestLighthouse_natType(t *testing.T) {
+	l := test.NewLogger()
+	myUdpAddr0 := netip.MustParseAddrPort("1.1.1.1:4242")
+	myVpnIp := netip.MustParseAddr("10.128.0.2")
+	theirUdpAddr0 := netip.MustParseAddrPort("2.2.2.2:4242")
+	theirVpnIp := netip.MustParseAddr("10.128.0.3")
+
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"am_lighthouse": true}
+	c.Settings["listen"] = map[interface{}]interface{}{"port": 4242}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, netip.MustParsePrefix("10.128.0.1/24"), nil, nil)
+	require.NoError(t, err)
+	lhh := lh.NewRequestHandler()
+
+	// A whoami is answered with the address it came from
+	bip := myVpnIp.As4()
+	req := &NebulaMeta{Type: NebulaMeta_HostWhoami, Details: &NebulaMetaDetails{VpnIp: binary.BigEndian.Uint32(bip[:])}}
+	b, err := req.Marshal()
+	require.NoError(t, err)
+	w := &testEncWriter{}
+	lhh.HandleRequest(myUdpAddr0, myVpnIp, b, w)
+	assert.Equal(t, NebulaMeta_HostWhoamiReply, w.lastReply.msg.Type)
+	assert.Equal(t, myVpnIp, w.lastReply.vpnIp)
+	assertIp4InArray(t, w.lastReply.msg.Details.Ip4AndPorts, myUdpAddr0)
+
+	// The nat type a host reports is handed to everyone looking for it
+	req = &NebulaMeta{
+		Type: NebulaMeta_HostUpdateNotification,
+		Details: &NebulaMetaDetails{
+			VpnIp:       binary.BigEndian.Uint32(bip[:]),
+			Ip4AndPorts: []*Ip4AndPort{NewIp4AndPortFromNetIP(netip.MustParseAddr("3.3.3.3"), 4242)},
+			NatType:     uint32(NatTypeSymmetric),
+		},
+	}
+	b, err = req.Marshal()
+	require.NoError(t, err)
+	lhh.HandleRequest(myUdpAddr0, myVpnIp, b, &testEncWriter{})
+	// Our tunnel with the host learns the address it came from
+	lh.addrMap[myVpnIp].LearnRemote(myVpnIp, myUdpAddr0)
+
+	r := newLHHostRequest(theirUdpAddr0, theirVpnIp, myVpnIp, lhh)
+	assertIp4InArray(t, r.msg.Details.Ip4AndPorts, myUdpAddr0, netip.MustParseAddrPort("3.3.3.3:4242"))
+	assert.Equal(t, NatTypeSymmetric, NatType(r.msg.Details.NatType))
+
+	// Only the address we saw the symmetric host at ourselves is worth spraying at, the reported one may be anyone's
+	assertIp4InArray(t, r.msg.Details.ObservedIp4AndPorts, myUdpAddr0)
+
+	// A host that has not classified its nat yet is unknown
+	newLHHostUpdate(theirUdpAddr0, theirVpnIp, []netip.AddrPort{theirUdpAddr0}, lhh)
+	r = newLHHostRequest(myUdpAddr0, myVpnIp, theirVpnIp, lhh)
+	assert.Equal(t, NatTypeUnknown, NatType(r.msg.Details.NatType))
+	assert.Empty(t, r.msg.Details.ObservedIp4AndPorts)
+}
+
+func TestLighthouse_whoamiReply(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["listen"] = map[interface{}]interface{}{"port": 4242}
+	c.Settings["punchy"] = map[interface{}]interface{}{"nat_detection": true}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, netip.MustParsePrefix("10.128.0.2/24"), nil, NewPunchyFromConfig(l, c))
+	require.NoError(t, err)
+	lhh := lh.NewRequestHandler()
+
+	lh1 := netip.MustParseAddr("10.128.0.1")
+	lh2 := netip.MustParseAddr("10.128.0.3")
+	lh.lighthouses.Store(&map[netip.Addr]struct{}{lh1: {}, lh2: {}})
+
+	reply := func(from netip.Addr, addr netip.AddrPort) {
+		b, err := (&NebulaMeta{
+			Type:    NebulaMeta_HostWhoamiReply,
+			Details: &NebulaMetaDetails{Ip4AndPorts: []*Ip4AndPort{NewIp4AndPortFromNetIP(addr.Addr(), addr.Port())}},
+		}).Marshal()
+		require.NoError(t, err)
+		lhh.HandleRequest(netip.AddrPort{}, from, b, &testEncWriter{})
+	}
+
+	// One lighthouse can not tell anything, other hosts do not get a say
+	reply(lh1, netip.MustParseAddrPort("1.1.1.1:4242"))
+	reply(netip.MustParseAddr("10.128.0.4"), netip.MustParseAddrPort("1.1.1.1:5000"))
+	assert.Equal(t, NatTypeUnknown, lh.natType())
+
+	reply(lh2, netip.MustParseAddrPort("1.1.1.1:4242"))
+	assert.Equal(t, NatTypeEndpointIndependent, lh.natType())
+
+	reply(lh2, netip.MustParseAddrPort("1.1.1.1:4300"))
+	assert.Equal(t, NatTypeSymmetric, lh.natType())
+
+	// A lighthouse we drop is forgotten the next time we ask
+	lh.nat.retain(map[netip.Addr]struct{}{lh1: {}})
+	assert.Equal(t, NatTypeSymmetric, lh.natType(), "classification waits for the next reply")
+	reply(lh1, netip.MustParseAddrPort("1.1.1.1:4242"))
+	assert.Equal(t, NatTypeUnknown, lh.natType())
+
+	// Without nat_detection nothing is claimed
+	lh.punchy.natDetection.Store(false)
+	assert.Equal(t, NatTypeUnknown, lh.natType())
+}
+
+func TestLighthouse_udpEndpoints(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["listen"] = map[interface{}]interface{}{"port": 4242}
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"advertise_addrs": []interface{}{"1.1.1.1:4242"}}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, netip.MustParsePrefix("10.128.0.1/24"), nil, nil)
+	require.NoError(t, err)
+
+	local := []netip.Addr{netip.MustParseAddr("192.168.0.2")}
+	assert.Equal(t, []netip.AddrPort{
+		netip.MustParseAddrPort("1.1.1.1:4242"),
+		netip.MustParseAddrPort("192.168.0.2:4242"),
+	}, lh.udpEndpoints(local))
+
+	// Through a proxy our local ips are unreachable, and so is a relay on loopback
+	proxy := listenSocks5ProxyTest(t, true)
+	lh.proxy, err = udp.NewSocks5Conn(l, &udp.Socks5Dialer{Server: proxy.addr.String(), Username: "user", Password: "pass"}, netip.MustParseAddrPort("127.0.0.1:0"), time.Second)
+	require.NoError(t, err)
+	defer lh.proxy.Close()
+	assert.Equal(t, []netip.AddrPort{netip.MustParseAddrPort("1.1.1.1:4242")}, lh.udpEndpoints(local))
+}
+
+func TestLighthouse_tcpEndpoints(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["listen"] = map[interface{}]interface{}{
+		"port": 4242,
+		"transports": map[interface{}]interface{}{
+			"tcp": map[interface{}]interface{}{
+				"advertise_addrs": []interface{}{"1.1.1.1:0", "2.2.2.2:443", "10.128.0.5:443"},
+			},
+		},
+	}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, netip.MustParsePrefix("10.128.0.1/24"), nil, nil)
+	assert.NoError(t, err)
+
+	local := []netip.Addr{netip.MustParseAddr("192.168.0.2")}
+	assert.Empty(t, lh.tcpEndpoints(local), "the tcp transport is disabled")
+
+	// We only dial out, there is no port to fill in
+	lh.tcp, err = udp.NewTCPConn(l, udp.TCPConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, []netip.AddrPort{netip.MustParseAddrPort("2.2.2.2:443")}, lh.tcpEndpoints(local))
+	lh.tcp.Close()
+
+	lh.tcp, err = udp.NewTCPConn(l, udp.TCPConfig{Listen: netip.MustParseAddrPort("127.0.0.1:0")})
+	assert.NoError(t, err)
+	defer lh.tcp.Close()
+	listen, _ := lh.tcp.LocalAddr()
+	assert.Equal(t, []netip.AddrPort{
+		netip.AddrPortFrom(netip.MustParseAddr("1.1.1.1"), listen.Port()),
+		netip.MustParseAddrPort("2.2.2.2:443"),
+		listen,
+	}, lh.tcpEndpoints(local))
+
+	// An unspecified listen address is reported on every local ip
+	lh.tcp.Close()
+	lh.tcp, err = udp.NewTCPConn(l, udp.TCPConfig{Listen: netip.MustParseAddrPort("0.0.0.0:0")})
+	assert.NoError(t, err)
+	listen, _ = lh.tcp.LocalAddr()
+	assert.Equal(t, netip.AddrPortFrom(local[0], listen.Port()), lh.tcpEndpoints(local)[2])
+}
+
+func TestLighthouse_webSocketEndpoints(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["listen"] = map[interface{}]interface{}{
+		"port": 4242,
+		"transports": map[interface{}]interface{}{
+			"websocket": map[interface{}]interface{}{
+				"advertise_addrs": []interface{}{"1.1.1.1:0", "2.2.2.2:443"},
+			},
+		},
+	}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, netip.MustParsePrefix("10.128.0.1/24"), nil, nil)
+	assert.NoError(t, err)
+
+	local := []netip.Addr{netip.MustParseAddr("192.168.0.2")}
+	assert.Empty(t, lh.webSocketEndpoints(local), "the websocket transport is disabled")
+
+	// A loopback listener is behind a reverse proxy, only the advertised addresses are reported
+	lh.websocket, err = udp.NewWebSocketConn(l, udp.WebSocketConfig{Listen: netip.MustParseAddrPort("127.0.0.1:0")})
+	assert.NoError(t, err)
+	defer lh.websocket.Close()
+	listen, _ := lh.websocket.LocalAddr()
+	assert.Equal(t, []netip.AddrPort{
+		netip.AddrPortFrom(netip.MustParseAddr("1.1.1.1"), listen.Port()),
+		netip.MustParseAddrPort("2.2.2.2:443"),
+	}, lh.webSocketEndpoints(local))
+}
+
 func TestLighthouse_reload(t *testing.T) {
 	l := test.NewLogger()
 	c := config.NewC(l)
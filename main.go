@@ -2,15 +2,17 @@ package nebula
 
 import (
 	"context"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 	"net/netip"
+	"slices"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/overlay"
+	"github.com/slackhq/nebula/portmap"
 	"github.com/slackhq/nebula/sshd"
 	"github.com/slackhq/nebula/udp"
 	"github.com/slackhq/nebula/util"
@@ -70,6 +72,10 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 
 	tunCidr := certificate.Networks()[0]
 
+	if overlay.ServesExitNode(c) && !slices.Contains(certificate.UnsafeNetworks(), netip.PrefixFrom(netip.IPv4Unspecified(), 0)) {
+		return nil, util.NewContextualError("tun.exit_node.serve requires 0.0.0.0/0 in the certificate unsafe networks", nil, nil)
+	}
+
 	ssh, err := sshd.NewSSHServer(l.WithField("subsystem", "sshd"))
 	if err != nil {
 		return nil, util.ContextualizeIfNeeded("Error while creating SSH server", err)
@@ -147,6 +153,12 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 	// set up our UDP listener
 	udpConns := make([]udp.Conn, routines)
 	port := c.GetInt("listen.port", 0)
+	var multiPort *MultiPort
+	var tcpConn *udp.TCPConn
+	var wsConn *udp.WebSocketConn
+	var socksConn *udp.Socks5Conn
+	// streamsOnly is set when udp has to go through a proxy that will not relay it
+	streamsOnly := false
 
 	if !configTest {
 		rawListenHost := c.GetString("listen.host", "0.0.0.0")
@@ -166,7 +178,20 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 			listenHost = ips[0].Unmap()
 		}
 
-		for i := 0; i < routines; i++ {
+		socksConn, err = NewSocks5FromConfig(l, c, netip.AddrPortFrom(listenHost, uint16(port)))
+		if errors.Is(err, udp.ErrSocks5CommandNotSupported) {
+			l.Warn("The socks5 proxy in listen.proxy does not relay udp, handshakes will go straight to stream transports")
+			streamsOnly = true
+		} else if err != nil {
+			return nil, util.ContextualizeIfNeeded("Failed to open socks5 proxy", err)
+		}
+
+		// Every routine shares the one relay, remotes have to see all of our packets coming from the same address
+		for i := 0; socksConn != nil && i < routines; i++ {
+			udpConns[i] = socksConn
+		}
+
+		for i := 0; socksConn == nil && i < routines; i++ {
 			l.Infof("listening on %v", netip.AddrPortFrom(listenHost, uint16(port)))
 			udpServer, err := udp.NewListener(l, listenHost, port, routines > 1, c.GetInt("listen.batch", 64))
 			if err != nil {
@@ -185,6 +210,54 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 				port = int(uPort.Port())
 			}
 		}
+
+		if socksConn == nil {
+			multiPort, err = NewMultiPortFromConfig(l, c, listenHost, port, c.GetInt("listen.batch", 64))
+			if err != nil {
+				return nil, util.NewContextualError("Failed to open multiport udp listener", nil, err)
+			}
+		} else if c.GetInt("listen.multiport.ports", 0) > 1 {
+			l.Warn("listen.multiport.ports does not work through a socks5 proxy, multiport is disabled")
+		}
+
+		tcpConn, err = NewTCPFromConfig(l, c, listenHost)
+		if err != nil {
+			return nil, util.ContextualizeIfNeeded("Failed to open tcp transport", err)
+		}
+
+		wsConn, err = NewWebSocketFromConfig(l, c, listenHost)
+		if err != nil {
+			return nil, util.ContextualizeIfNeeded("Failed to open websocket transport", err)
+		}
+
+		if streamsOnly && tcpConn == nil && wsConn == nil {
+			// Nothing else gets out, dial the tcp endpoints of other hosts through the proxy
+			proxy, _ := socks5DialerFromConfig(c)
+			tcpConn, err = udp.NewTCPConn(l, udp.TCPConfig{
+				DialTimeout: c.GetDuration("listen.proxy.dial_timeout", defaultTCPDialTimeout),
+				Dialer:      proxy,
+				IdleTimeout: defaultTCPIdleTimeout,
+				Mark:        c.GetInt("listen.so_mark", 0),
+			})
+			if err != nil {
+				return nil, util.ContextualizeIfNeeded("Failed to open tcp transport", err)
+			}
+		}
+
+		var streams []*udp.TCPConn
+		if tcpConn != nil {
+			streams = append(streams, tcpConn)
+		}
+		if wsConn != nil {
+			streams = append(streams, wsConn.TCPConn)
+		}
+
+		if len(streams) > 0 {
+			// Anything written to an address with a stream goes over the stream instead of udp
+			for i := range udpConns {
+				udpConns[i] = &udp.FallbackConn{Conn: udpConns[i], Streams: streams}
+			}
+		}
 	}
 
 	hostMap := NewHostMapFromConfig(l, tunCidr, c)
@@ -193,6 +266,37 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 	if err != nil {
 		return nil, util.ContextualizeIfNeeded("Failed to initialize lighthouse handler", err)
 	}
+	lightHouse.tcp = tcpConn
+	lightHouse.websocket = wsConn
+	lightHouse.proxy = socksConn
+	lightHouse.hostMap = hostMap
+
+	lightHouse.advertisedRoutes, err = newAdvertisedRoutesFromConfig(c, certificate)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to load lighthouse.advertise_unsafe_routes config", nil, err)
+	}
+
+	routeLearner, err := newRouteLearnerFromConfig(l, c, hostMap, tun)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to load tun.learn_unsafe_routes config", nil, err)
+	}
+	lightHouse.routeLearner = routeLearner
+
+	var portMap *portmap.Mapper
+	if !configTest {
+		if socksConn == nil {
+			portMap, err = NewPortMapFromConfig(l, c, uint16(lightHouse.nebulaPort), func(netip.AddrPort) { lightHouse.TriggerUpdate() })
+			if err != nil {
+				return nil, util.ContextualizeIfNeeded("Failed to load port mapping config", err)
+			}
+			lightHouse.portMap = portMap
+		} else if c.GetBool("listen.port_mapping.enabled", false) {
+			l.Warn("listen.port_mapping does not work through a socks5 proxy, port mapping is disabled")
+		}
+	}
+	if wsConn != nil {
+		wsConn.SetEndpoints(lightHouse.webSocketEndpoint)
+	}
 
 	var messageMetrics *MessageMetrics
 	if c.GetBool("stats.message_metrics", false) {
@@ -203,25 +307,64 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 
 	useRelays := c.GetBool("relay.use_relays", DefaultUseRelays) && !c.GetBool("relay.am_relay", false)
 
+	postQuantum, err := NewPostQuantumMode(c.GetString("handshakes.post_quantum", "none"))
+	if err != nil {
+		return nil, util.NewContextualError("Failed to load handshakes.post_quantum", nil, err)
+	}
+
 	handshakeConfig := HandshakeConfig{
-		tryInterval:   c.GetDuration("handshakes.try_interval", DefaultHandshakeTryInterval),
-		retries:       int64(c.GetInt("handshakes.retries", DefaultHandshakeRetries)),
-		triggerBuffer: c.GetInt("handshakes.trigger_buffer", DefaultHandshakeTriggerBuffer),
-		useRelays:     useRelays,
+		tryInterval:      c.GetDuration("handshakes.try_interval", DefaultHandshakeTryInterval),
+		retries:          int64(c.GetInt("handshakes.retries", DefaultHandshakeRetries)),
+		triggerBuffer:    c.GetInt("handshakes.trigger_buffer", DefaultHandshakeTriggerBuffer),
+		useRelays:        useRelays,
+		cookieThreshold:  c.GetInt("handshakes.cookie_threshold", DefaultHandshakeCookieThreshold),
+		perIpRate:        c.GetInt("handshakes.per_ip_rate", 0),
+		postQuantum:      postQuantum,
+		tcpFallbackAfter: int64(c.GetInt("handshakes.tcp_fallback_after", DefaultHandshakeTCPFallbackAfter)),
 
 		messageMetrics: messageMetrics,
 	}
 
+	if streamsOnly {
+		handshakeConfig.tcpFallbackAfter = 0
+	}
+
 	handshakeManager := NewHandshakeManager(l, hostMap, lightHouse, udpConns[0], handshakeConfig)
 	lightHouse.handshakeTrigger = handshakeManager.trigger
 
-	serveDns := false
-	if c.GetBool("lighthouse.serve_dns", false) {
-		if c.GetBool("lighthouse.am_lighthouse", false) {
-			serveDns = true
-		} else {
-			l.Warn("DNS server refusing to run because this host is not a lighthouse.")
-		}
+	// Lighthouses always track certificate names so they can answer name queries from other nodes,
+	// any node serving DNS needs them to answer locally.
+	serveDns := c.GetBool("lighthouse.serve_dns", false)
+	var dnsR *dnsRecords
+	if serveDns || lightHouse.amLighthouse {
+		dnsR = newDnsRecordsFromConfig(c, hostMap, lightHouse, certificate.Name())
+		dnsR.Add(certificate.Name()+".", certificate.Networks()[0].Addr().String())
+		lightHouse.dnsRecords = dnsR
+	}
+
+	relayManager, err := NewRelayManager(ctx, l, hostMap, c)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to load relay config", nil, err)
+	}
+
+	ciphers, err := NewCiphersFromConfig(c)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to load cipher config", nil, err)
+	}
+
+	tap, err := NewTapSwitchFromConfig(l, c)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to load tap config", nil, err)
+	}
+
+	fo, err := newFanoutFromConfig(c)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to load tun.fanout config", nil, err)
+	}
+
+	sn, err := newSnatFromConfig(l, c, certificate)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to load tun.snat config", nil, err)
 	}
 
 	checkInterval := c.GetInt("timers.connection_alive_interval", 5)
@@ -232,9 +375,9 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		Inside:                  tun,
 		Outside:                 udpConns[0],
 		pki:                     pki,
-		Cipher:                  c.GetString("cipher", "aes"),
+		Ciphers:                 ciphers,
 		Firewall:                fw,
-		ServeDns:                serveDns,
+		dnsRecords:              dnsR,
 		HandshakeManager:        handshakeManager,
 		lightHouse:              lightHouse,
 		checkInterval:           time.Second * time.Duration(checkInterval),
@@ -242,27 +385,29 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		tryPromoteEvery:         c.GetUint32("counters.try_promote", defaultPromoteEvery),
 		reQueryEvery:            c.GetUint32("counters.requery_every_packets", defaultReQueryEvery),
 		reQueryWait:             c.GetDuration("timers.requery_wait_duration", defaultReQueryWait),
+		writeBatchLatency:       c.GetDuration("listen.write_batch_latency", defaultWriteBatchLatency),
 		DropLocalBroadcast:      c.GetBool("tun.drop_local_broadcast", false),
 		DropMulticast:           c.GetBool("tun.drop_multicast", false),
 		routines:                routines,
 		MessageMetrics:          messageMetrics,
 		version:                 buildVersion,
-		relayManager:            NewRelayManager(ctx, l, hostMap, c),
+		relayManager:            relayManager,
 		punchy:                  punchy,
+		rekey:                   NewRekeyFromConfig(l, c),
+		multiPort:               multiPort,
+		tcp:                     tcpConn,
+		websocket:               wsConn,
+		pmtu:                    NewPathMTUFromConfig(l, c),
+		portMap:                 portMap,
+		tap:                     tap,
+		fanout:                  fo,
+		snat:                    sn,
+		routeLearner:            routeLearner,
 
 		ConntrackCacheTimeout: conntrackCacheTimeout,
 		l:                     l,
 	}
 
-	switch ifConfig.Cipher {
-	case "aes":
-		noiseEndianness = binary.BigEndian
-	case "chachapoly":
-		noiseEndianness = binary.LittleEndian
-	default:
-		return nil, fmt.Errorf("unknown cipher: %v", ifConfig.Cipher)
-	}
-
 	var ifce *Interface
 	if !configTest {
 		ifce, err = NewInterface(ctx, ifConfig)
@@ -273,6 +418,9 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		// TODO: Better way to attach these, probably want a new interface in InterfaceConfig
 		// I don't want to make this initial commit too far-reaching though
 		ifce.writers = udpConns
+		if sn != nil {
+			ifce.writers = append(ifce.writers, udpConns[0])
+		}
 		lightHouse.ifce = ifce
 
 		ifce.RegisterConfigChangeCallbacks(c)
@@ -281,6 +429,17 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 
 		handshakeManager.f = ifce
 		go handshakeManager.Run(ctx)
+		go ifce.relayManager.health.Run(ctx, ifce)
+		go ifce.pmtu.Run(ctx, ifce)
+		if portMap != nil {
+			go portMap.Run(ctx)
+		}
+		if sn != nil {
+			go sn.Run(ctx, ifce)
+		}
+		if routeLearner != nil {
+			go routeLearner.Run(ctx, ifce)
+		}
 	}
 
 	// TODO - stats third-party modules start uncancellable goroutines. Update those libs to accept
@@ -301,9 +460,9 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 
 	// Start DNS server last to allow using the nebula IP as lighthouse.dns.host
 	var dnsStart func()
-	if lightHouse.amLighthouse && serveDns {
+	if serveDns {
 		l.Debugln("Starting dns server")
-		dnsStart = dnsMain(l, hostMap, c)
+		dnsStart = dnsMain(l, dnsR, c)
 	}
 
 	return &Control{
@@ -41,6 +41,9 @@ func newMessageMetrics() *MessageMetrics {
 		return [][]metrics.Counter{
 			{
 				metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.handshake_ixpsk0", t), nil),
+				metrics.NilCounter{},
+				metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.handshake_cookie", t), nil),
+				metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.handshake_ixpsk0_hybrid", t), nil),
 			},
 			nil,
 			{metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.recv_error", t), nil)},
@@ -85,6 +88,10 @@ func newLighthouseMetrics() *MessageMetrics {
 			NebulaMeta_HostUpdateNotification,
 			NebulaMeta_HostPunchNotification,
 			NebulaMeta_HostUpdateNotificationAck,
+			NebulaMeta_HostNameQuery,
+			NebulaMeta_HostNameQueryReply,
+			NebulaMeta_HostRoutesQuery,
+			NebulaMeta_HostRoutesQueryReply,
 		}
 		for _, i := range used {
 			h[i] = []metrics.Counter{metrics.GetOrRegisterCounter(fmt.Sprintf("lighthouse.%s.%s", t, i.String()), nil)}
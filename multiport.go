@@ -0,0 +1,140 @@
+package nebula
+
+import (
+	"net/netip"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/udp"
+)
+
+// MultiPortReplayWindow is the replay window used by tunnels that spread packets across ports. Every port pair can
+// take a different path through the underlay so packets arrive far more out of order than on a single flow.
+const MultiPortReplayWindow = 8 * ReplayWindow
+
+// maxMultiPorts bounds how many ports a remote can ask us to spread packets across
+const maxMultiPorts = 1024
+
+// MultiPort holds the extra udp listeners that tunnels spread their packets across. The listener on the base port is
+// the regular outside listener, conns holds the listeners on every port after it.
+type MultiPort struct {
+	basePort uint16
+	conns    []udp.Conn
+}
+
+// multiportPeer is what the remote end of a tunnel told us about its multiport listeners during the handshake
+type multiportPeer struct {
+	basePort   uint16
+	totalPorts uint16
+}
+
+// NewMultiPortFromConfig opens listen.multiport.ports - 1 listeners on the ports following the base port. Nil is
+// returned when multiport is disabled.
+func NewMultiPortFromConfig(l *logrus.Logger, c *config.C, host netip.Addr, basePort int, batch int) (*MultiPort, error) {
+	ports := c.GetInt("listen.multiport.ports", 0)
+	if ports <= 1 {
+		return nil, nil
+	}
+
+	if basePort == 0 {
+		l.Warn("listen.multiport.ports requires a static listen.port, multiport is disabled")
+		return nil, nil
+	}
+
+	if ports > maxMultiPorts || basePort+ports-1 > 65535 {
+		l.WithField("ports", ports).WithField("port", basePort).
+			Warn("listen.multiport.ports does not fit above listen.port, multiport is disabled")
+		return nil, nil
+	}
+
+	mp := &MultiPort{basePort: uint16(basePort)}
+	for i := 1; i < ports; i++ {
+		port := basePort + i
+		l.Infof("listening on %v", netip.AddrPortFrom(host, uint16(port)))
+		conn, err := udp.NewListener(l, host, port, false, batch)
+		if err != nil {
+			mp.Close()
+			return nil, err
+		}
+		conn.ReloadConfig(c)
+		mp.conns = append(mp.conns, conn)
+	}
+
+	return mp, nil
+}
+
+// TotalPorts is the number of ports including the base port
+func (mp *MultiPort) TotalPorts() int {
+	return len(mp.conns) + 1
+}
+
+func (mp *MultiPort) Close() error {
+	for _, conn := range mp.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// details is what we advertise in the handshake
+func (mp *MultiPort) details() *MultiPortDetails {
+	if mp == nil {
+		return nil
+	}
+	return &MultiPortDetails{BasePort: uint32(mp.basePort), TotalPorts: uint32(mp.TotalPorts())}
+}
+
+// negotiateMultiPort decides if a tunnel spreads its packets across ports. Both ends must have multiport listeners,
+// a remote that predates multiport never advertises any and keeps getting a single flow.
+func negotiateMultiPort(mp *MultiPort, theirs *MultiPortDetails) *multiportPeer {
+	if mp == nil || theirs == nil || theirs.TotalPorts <= 1 || theirs.TotalPorts > maxMultiPorts {
+		return nil
+	}
+
+	if theirs.BasePort == 0 || theirs.BasePort+theirs.TotalPorts-1 > 65535 {
+		return nil
+	}
+
+	return &multiportPeer{basePort: uint16(theirs.BasePort), totalPorts: uint16(theirs.TotalPorts)}
+}
+
+// owns reports if addr is one of the remotes multiport listeners behind the address we are talking to it on. Packets
+// from these are part of the tunnel and are not a roam.
+func (p *multiportPeer) owns(remote, addr netip.AddrPort) bool {
+	if p == nil || remote.Addr() != addr.Addr() || remote.Port() != p.basePort {
+		return false
+	}
+	return addr.Port() >= p.basePort && uint32(addr.Port()) < uint32(p.basePort)+uint32(p.totalPorts)
+}
+
+// multiportWindow is the replay window for a tunnel that negotiated multiport, with handshake packet 1 marked as seen
+// like a fresh connection state would have it
+func multiportWindow(l *logrus.Logger) *Bits {
+	b := NewBits(MultiPortReplayWindow)
+	b.Update(l, 0)
+	b.Update(l, 1)
+	return b
+}
+
+// multiportRoute picks the source listener and destination for the packet of type t with counter c. Every pair of our
+// ports and their ports is used in turn. Multiport is only used when the remote is reachable on its advertised base
+// port, a translated port means a nat sits in between and the other ports would not make it through. Lighthouse
+// messages always leave from the base port, every lighthouse has to see the same source port for whoami to classify
+// the nat in front of us and for the address it learns for us to be the one other hosts can reach.
+func (f *Interface) multiportRoute(t header.MessageType, ci *ConnectionState, remote netip.AddrPort, c uint64, q int) (udp.Conn, netip.AddrPort) {
+	peer := ci.multiport
+	if peer == nil || f.multiPort == nil || remote.Port() != peer.basePort || t == header.LightHouse {
+		return f.writers[q], remote
+	}
+
+	ours := uint64(f.multiPort.TotalPorts())
+	src := c % ours
+	dst := (c / ours) % uint64(peer.totalPorts)
+
+	conn := f.writers[q]
+	if src > 0 {
+		conn = f.multiPort.conns[src-1]
+	}
+
+	return conn, netip.AddrPortFrom(remote.Addr(), peer.basePort+uint16(dst))
+}
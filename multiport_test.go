@@ -0,0 +1,104 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+)
+
+type multiportTestConn struct {
+	udp.NoopConn
+	port uint16
+}
+
+func TestNegotiateMultiPort(t *testing.T) {
+	mp := &MultiPort{basePort: 4242, conns: make([]udp.Conn, 3)}
+	assert.Equal(t, &MultiPortDetails{BasePort: 4242, TotalPorts: 4}, mp.details())
+
+	// Both ends must use multiport
+	assert.Nil(t, negotiateMultiPort(nil, &MultiPortDetails{BasePort: 4242, TotalPorts: 4}))
+	assert.Nil(t, negotiateMultiPort(mp, nil))
+	assert.Nil(t, (*MultiPort)(nil).details())
+
+	// Nonsense from the remote is ignored
+	assert.Nil(t, negotiateMultiPort(mp, &MultiPortDetails{BasePort: 4242, TotalPorts: 1}))
+	assert.Nil(t, negotiateMultiPort(mp, &MultiPortDetails{BasePort: 0, TotalPorts: 4}))
+	assert.Nil(t, negotiateMultiPort(mp, &MultiPortDetails{BasePort: 65535, TotalPorts: 4}))
+	assert.Nil(t, negotiateMultiPort(mp, &MultiPortDetails{BasePort: 4242, TotalPorts: maxMultiPorts + 1}))
+
+	assert.Equal(t, &multiportPeer{basePort: 5000, totalPorts: 2}, negotiateMultiPort(mp, &MultiPortDetails{BasePort: 5000, TotalPorts: 2}))
+}
+
+func TestMultiportPeer_owns(t *testing.T) {
+	p := &multiportPeer{basePort: 4242, totalPorts: 3}
+	remote := netip.MustParseAddrPort("1.1.1.1:4242")
+
+	assert.True(t, p.owns(remote, netip.MustParseAddrPort("1.1.1.1:4243")))
+	assert.True(t, p.owns(remote, netip.MustParseAddrPort("1.1.1.1:4244")))
+	assert.False(t, p.owns(remote, netip.MustParseAddrPort("1.1.1.1:4245")))
+	assert.False(t, p.owns(remote, netip.MustParseAddrPort("1.1.1.1:4241")))
+	assert.False(t, p.owns(remote, netip.MustParseAddrPort("2.2.2.2:4243")), "a different ip is a roam")
+
+	// A translated port means the other ports are not reachable, so packets from them are not ours
+	assert.False(t, p.owns(netip.MustParseAddrPort("1.1.1.1:30000"), netip.MustParseAddrPort("1.1.1.1:4243")))
+	assert.False(t, (*multiportPeer)(nil).owns(remote, netip.MustParseAddrPort("1.1.1.1:4243")))
+}
+
+func TestInterface_multiportRoute(t *testing.T) {
+	base := &multiportTestConn{port: 4242}
+	f := &Interface{
+		writers:   []udp.Conn{base},
+		multiPort: &MultiPort{basePort: 4242, conns: []udp.Conn{&multiportTestConn{port: 4243}}},
+	}
+	remote := netip.MustParseAddrPort("1.1.1.1:5000")
+
+	// No multiport for this tunnel
+	conn, dst := f.multiportRoute(header.Message, &ConnectionState{}, remote, 7, 0)
+	assert.Equal(t, base, conn)
+	assert.Equal(t, remote, dst)
+
+	// Every pair of ports is used in turn
+	ci := &ConnectionState{multiport: &multiportPeer{basePort: 5000, totalPorts: 3}}
+	seen := map[[2]uint16]int{}
+	for c := uint64(0); c < 60; c++ {
+		conn, dst = f.multiportRoute(header.Message, ci, remote, c, 0)
+		assert.Equal(t, remote.Addr(), dst.Addr())
+		seen[[2]uint16{conn.(*multiportTestConn).port, dst.Port()}]++
+	}
+	assert.Len(t, seen, 6)
+	for _, n := range seen {
+		assert.Equal(t, 10, n)
+	}
+
+	// A translated remote port gets a single flow
+	translated := netip.MustParseAddrPort("1.1.1.1:30000")
+	for c := uint64(0); c < 6; c++ {
+		conn, dst = f.multiportRoute(header.Message, ci, translated, c, 0)
+		assert.Equal(t, base, conn)
+		assert.Equal(t, translated, dst)
+	}
+
+	// Lighthouse messages keep to the base ports, whoami answers from every lighthouse have to agree
+	for c := uint64(0); c < 6; c++ {
+		conn, dst = f.multiportRoute(header.LightHouse, ci, remote, c, 0)
+		assert.Equal(t, base, conn)
+		assert.Equal(t, remote, dst)
+	}
+}
+
+func TestMultiportWindow(t *testing.T) {
+	l := test.NewLogger()
+	b := multiportWindow(l)
+	assert.False(t, b.Check(l, 1), "handshake packet 1 is already seen")
+	assert.True(t, b.Check(l, 2))
+
+	// Packets held back on a slow path are still accepted well past the regular replay window
+	assert.True(t, b.Update(l, 2))
+	assert.True(t, b.Update(l, 4*ReplayWindow))
+	assert.True(t, b.Update(l, 3))
+	assert.False(t, b.Update(l, 3))
+}
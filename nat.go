@@ -0,0 +1,100 @@
+package nebula
+
+import (
+	"net/netip"
+	"sync"
+)
+
+// NatType is how the NAT in front of a host picks the public port for its udp socket, it travels in the NatType field
+// of lighthouse messages
+type NatType uint32
+
+const (
+	// NatTypeUnknown is used until enough lighthouses have told us where they see us, or when they disagree on our address
+	NatTypeUnknown NatType = iota
+	// NatTypeEndpointIndependent NATs use the same public port towards every destination, an ordinary punch works
+	NatTypeEndpointIndependent
+	// NatTypeSymmetric NATs use a new public port for every destination, the port others learn from a lighthouse is
+	// not the one they will see us at
+	NatTypeSymmetric
+)
+
+func (t NatType) String() string {
+	switch t {
+	case NatTypeEndpointIndependent:
+		return "endpoint-independent"
+	case NatTypeSymmetric:
+		return "symmetric"
+	default:
+		return "unknown"
+	}
+}
+
+// natDetector classifies our NAT from the addresses lighthouses see us at in their HostWhoamiReply
+type natDetector struct {
+	sync.Mutex
+	// observed is where each lighthouse saw our last HostWhoami come from
+	observed map[netip.Addr]netip.AddrPort
+	natType  NatType
+}
+
+func newNatDetector() *natDetector {
+	return &natDetector{observed: make(map[netip.Addr]netip.AddrPort)}
+}
+
+// observe records where a lighthouse saw us and returns the resulting classification, changed is true if it is not
+// the same as before
+func (d *natDetector) observe(lighthouse netip.Addr, addr netip.AddrPort) (NatType, bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.observed[lighthouse] = addr
+	addrs := make([]netip.AddrPort, 0, len(d.observed))
+	for _, v := range d.observed {
+		addrs = append(addrs, v)
+	}
+
+	old := d.natType
+	d.natType = classifyNat(addrs)
+	return d.natType, d.natType != old
+}
+
+// retain forgets what hosts that are no longer our lighthouses told us
+func (d *natDetector) retain(lighthouses map[netip.Addr]struct{}) {
+	d.Lock()
+	defer d.Unlock()
+	for k := range d.observed {
+		if _, ok := lighthouses[k]; !ok {
+			delete(d.observed, k)
+		}
+	}
+}
+
+func (d *natDetector) get() NatType {
+	d.Lock()
+	defer d.Unlock()
+	return d.natType
+}
+
+// classifyNat looks at the addresses different lighthouses saw us at. Only reflections with the same public ip say
+// anything about the NAT, a lighthouse on our own network or a second uplink sees us at a different ip entirely. If
+// any two of them disagree on the port the NAT picks a port per destination.
+func classifyNat(observed []netip.AddrPort) NatType {
+	ports := make(map[netip.Addr]uint16)
+	natType := NatTypeUnknown
+	for _, addr := range observed {
+		ip := addr.Addr().Unmap()
+		port, ok := ports[ip]
+		if !ok {
+			ports[ip] = addr.Port()
+			continue
+		}
+
+		if port != addr.Port() {
+			return NatTypeSymmetric
+		}
+		natType = NatTypeEndpointIndependent
+	}
+
+	return natType
+}
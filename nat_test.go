@@ -0,0 +1,34 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyNat(t *testing.T) {
+	tests := []struct {
+		name     string
+		observed []string
+		want     NatType
+	}{
+		{"nothing", nil, NatTypeUnknown},
+		{"one lighthouse", []string{"1.1.1.1:4242"}, NatTypeUnknown},
+		{"same port", []string{"1.1.1.1:4242", "1.1.1.1:4242", "[::ffff:1.1.1.1]:4242"}, NatTypeEndpointIndependent},
+		{"port per destination", []string{"1.1.1.1:4242", "1.1.1.1:4242", "1.1.1.1:30000"}, NatTypeSymmetric},
+		{"different ips", []string{"1.1.1.1:4242", "192.168.0.2:4242"}, NatTypeUnknown},
+		{"lan lighthouse", []string{"1.1.1.1:30000", "192.168.0.2:4242", "1.1.1.1:30000"}, NatTypeEndpointIndependent},
+		{"ipv6", []string{"[1::1]:4242", "[1::1]:4243"}, NatTypeSymmetric},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var observed []netip.AddrPort
+			for _, v := range tt.observed {
+				observed = append(observed, netip.MustParseAddrPort(v))
+			}
+			assert.Equal(t, tt.want, classifyNat(observed))
+		})
+	}
+}
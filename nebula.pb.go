@@ -36,6 +36,10 @@ const (
 	NebulaMeta_PathCheck                 NebulaMeta_MessageType = 8
 	NebulaMeta_PathCheckReply            NebulaMeta_MessageType = 9
 	NebulaMeta_HostUpdateNotificationAck NebulaMeta_MessageType = 10
+	NebulaMeta_HostNameQuery             NebulaMeta_MessageType = 11
+	NebulaMeta_HostNameQueryReply        NebulaMeta_MessageType = 12
+	NebulaMeta_HostRoutesQuery           NebulaMeta_MessageType = 13
+	NebulaMeta_HostRoutesQueryReply      NebulaMeta_MessageType = 14
 )
 
 var NebulaMeta_MessageType_name = map[int32]string{
@@ -50,6 +54,10 @@ var NebulaMeta_MessageType_name = map[int32]string{
 	8:  "PathCheck",
 	9:  "PathCheckReply",
 	10: "HostUpdateNotificationAck",
+	11: "HostNameQuery",
+	12: "HostNameQueryReply",
+	13: "HostRoutesQuery",
+	14: "HostRoutesQueryReply",
 }
 
 var NebulaMeta_MessageType_value = map[string]int32{
@@ -64,6 +72,10 @@ var NebulaMeta_MessageType_value = map[string]int32{
 	"PathCheck":                 8,
 	"PathCheckReply":            9,
 	"HostUpdateNotificationAck": 10,
+	"HostNameQuery":             11,
+	"HostNameQueryReply":        12,
+	"HostRoutesQuery":           13,
+	"HostRoutesQueryReply":      14,
 }
 
 func (x NebulaMeta_MessageType) String() string {
@@ -105,18 +117,21 @@ const (
 	NebulaControl_None                NebulaControl_MessageType = 0
 	NebulaControl_CreateRelayRequest  NebulaControl_MessageType = 1
 	NebulaControl_CreateRelayResponse NebulaControl_MessageType = 2
+	NebulaControl_CreateRelayRejected NebulaControl_MessageType = 3
 )
 
 var NebulaControl_MessageType_name = map[int32]string{
 	0: "None",
 	1: "CreateRelayRequest",
 	2: "CreateRelayResponse",
+	3: "CreateRelayRejected",
 }
 
 var NebulaControl_MessageType_value = map[string]int32{
 	"None":                0,
 	"CreateRelayRequest":  1,
 	"CreateRelayResponse": 2,
+	"CreateRelayRejected": 3,
 }
 
 func (x NebulaControl_MessageType) String() string {
@@ -124,7 +139,7 @@ func (x NebulaControl_MessageType) String() string {
 }
 
 func (NebulaControl_MessageType) EnumDescriptor() ([]byte, []int) {
-	return fileDescriptor_2d65afa7693df5ef, []int{7, 0}
+	return fileDescriptor_2d65afa7693df5ef, []int{8, 0}
 }
 
 type NebulaMeta struct {
@@ -180,11 +195,22 @@ func (m *NebulaMeta) GetDetails() *NebulaMetaDetails {
 }
 
 type NebulaMetaDetails struct {
-	VpnIp       uint32        `protobuf:"varint,1,opt,name=VpnIp,proto3" json:"VpnIp,omitempty"`
-	Ip4AndPorts []*Ip4AndPort `protobuf:"bytes,2,rep,name=Ip4AndPorts,proto3" json:"Ip4AndPorts,omitempty"`
-	Ip6AndPorts []*Ip6AndPort `protobuf:"bytes,4,rep,name=Ip6AndPorts,proto3" json:"Ip6AndPorts,omitempty"`
-	RelayVpnIp  []uint32      `protobuf:"varint,5,rep,packed,name=RelayVpnIp,proto3" json:"RelayVpnIp,omitempty"`
-	Counter     uint32        `protobuf:"varint,3,opt,name=counter,proto3" json:"counter,omitempty"`
+	VpnIp                uint32        `protobuf:"varint,1,opt,name=VpnIp,proto3" json:"VpnIp,omitempty"`
+	Ip4AndPorts          []*Ip4AndPort `protobuf:"bytes,2,rep,name=Ip4AndPorts,proto3" json:"Ip4AndPorts,omitempty"`
+	Ip6AndPorts          []*Ip6AndPort `protobuf:"bytes,4,rep,name=Ip6AndPorts,proto3" json:"Ip6AndPorts,omitempty"`
+	RelayVpnIp           []uint32      `protobuf:"varint,5,rep,packed,name=RelayVpnIp,proto3" json:"RelayVpnIp,omitempty"`
+	Counter              uint32        `protobuf:"varint,3,opt,name=counter,proto3" json:"counter,omitempty"`
+	Name                 string        `protobuf:"bytes,6,opt,name=Name,proto3" json:"Name,omitempty"`
+	TcpIp4AndPorts       []*Ip4AndPort `protobuf:"bytes,7,rep,name=TcpIp4AndPorts,proto3" json:"TcpIp4AndPorts,omitempty"`
+	TcpIp6AndPorts       []*Ip6AndPort `protobuf:"bytes,8,rep,name=TcpIp6AndPorts,proto3" json:"TcpIp6AndPorts,omitempty"`
+	WebSocketIp4AndPorts []*Ip4AndPort `protobuf:"bytes,9,rep,name=WebSocketIp4AndPorts,proto3" json:"WebSocketIp4AndPorts,omitempty"`
+	WebSocketIp6AndPorts []*Ip6AndPort `protobuf:"bytes,10,rep,name=WebSocketIp6AndPorts,proto3" json:"WebSocketIp6AndPorts,omitempty"`
+	NatType              uint32        `protobuf:"varint,11,opt,name=NatType,proto3" json:"NatType,omitempty"`
+	// Unsafe networks a gateway carries traffic for, Via is only set in answers from a lighthouse
+	UnsafeRoutes []*UnsafeRoute `protobuf:"bytes,12,rep,name=UnsafeRoutes,proto3" json:"UnsafeRoutes,omitempty"`
+	// Addresses the lighthouse saw the host at itself, only set in answers about a host behind a symmetric NAT
+	ObservedIp4AndPorts []*Ip4AndPort `protobuf:"bytes,13,rep,name=ObservedIp4AndPorts,proto3" json:"ObservedIp4AndPorts,omitempty"`
+	ObservedIp6AndPorts []*Ip6AndPort `protobuf:"bytes,14,rep,name=ObservedIp6AndPorts,proto3" json:"ObservedIp6AndPorts,omitempty"`
 }
 
 func (m *NebulaMetaDetails) Reset()         { *m = NebulaMetaDetails{} }
@@ -255,6 +281,69 @@ func (m *NebulaMetaDetails) GetCounter() uint32 {
 	return 0
 }
 
+func (m *NebulaMetaDetails) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *NebulaMetaDetails) GetTcpIp4AndPorts() []*Ip4AndPort {
+	if m != nil {
+		return m.TcpIp4AndPorts
+	}
+	return nil
+}
+
+func (m *NebulaMetaDetails) GetTcpIp6AndPorts() []*Ip6AndPort {
+	if m != nil {
+		return m.TcpIp6AndPorts
+	}
+	return nil
+}
+
+func (m *NebulaMetaDetails) GetWebSocketIp4AndPorts() []*Ip4AndPort {
+	if m != nil {
+		return m.WebSocketIp4AndPorts
+	}
+	return nil
+}
+
+func (m *NebulaMetaDetails) GetWebSocketIp6AndPorts() []*Ip6AndPort {
+	if m != nil {
+		return m.WebSocketIp6AndPorts
+	}
+	return nil
+}
+
+func (m *NebulaMetaDetails) GetNatType() uint32 {
+	if m != nil {
+		return m.NatType
+	}
+	return 0
+}
+
+func (m *NebulaMetaDetails) GetUnsafeRoutes() []*UnsafeRoute {
+	if m != nil {
+		return m.UnsafeRoutes
+	}
+	return nil
+}
+
+func (m *NebulaMetaDetails) GetObservedIp4AndPorts() []*Ip4AndPort {
+	if m != nil {
+		return m.ObservedIp4AndPorts
+	}
+	return nil
+}
+
+func (m *NebulaMetaDetails) GetObservedIp6AndPorts() []*Ip6AndPort {
+	if m != nil {
+		return m.ObservedIp6AndPorts
+	}
+	return nil
+}
+
 type Ip4AndPort struct {
 	Ip   uint32 `protobuf:"varint,1,opt,name=Ip,proto3" json:"Ip,omitempty"`
 	Port uint32 `protobuf:"varint,2,opt,name=Port,proto3" json:"Port,omitempty"`
@@ -477,6 +566,17 @@ type NebulaHandshakeDetails struct {
 	ResponderIndex uint32 `protobuf:"varint,3,opt,name=ResponderIndex,proto3" json:"ResponderIndex,omitempty"`
 	Cookie         uint64 `protobuf:"varint,4,opt,name=Cookie,proto3" json:"Cookie,omitempty"`
 	Time           uint64 `protobuf:"varint,5,opt,name=Time,proto3" json:"Time,omitempty"`
+	// Multiport listeners of each side, absent when the sender does not use multiport
+	InitiatorMultiPort *MultiPortDetails `protobuf:"bytes,6,opt,name=InitiatorMultiPort,proto3" json:"InitiatorMultiPort,omitempty"`
+	ResponderMultiPort *MultiPortDetails `protobuf:"bytes,7,opt,name=ResponderMultiPort,proto3" json:"ResponderMultiPort,omitempty"`
+	// ML-KEM-768 encapsulation key sent by the initiator of a hybrid handshake
+	KemKey []byte `protobuf:"bytes,8,opt,name=KemKey,proto3" json:"KemKey,omitempty"`
+	// ML-KEM-768 ciphertext sent back by the responder of a hybrid handshake
+	KemCiphertext []byte `protobuf:"bytes,9,opt,name=KemCiphertext,proto3" json:"KemCiphertext,omitempty"`
+	// Ciphers the initiator accepts for the tunnel in order of preference, the first is used for the handshake itself
+	Ciphers []string `protobuf:"bytes,10,rep,name=Ciphers,proto3" json:"Ciphers,omitempty"`
+	// Cipher the responder chose for the tunnel
+	Cipher string `protobuf:"bytes,11,opt,name=Cipher,proto3" json:"Cipher,omitempty"`
 }
 
 func (m *NebulaHandshakeDetails) Reset()         { *m = NebulaHandshakeDetails{} }
@@ -547,19 +647,120 @@ func (m *NebulaHandshakeDetails) GetTime() uint64 {
 	return 0
 }
 
+func (m *NebulaHandshakeDetails) GetInitiatorMultiPort() *MultiPortDetails {
+	if m != nil {
+		return m.InitiatorMultiPort
+	}
+	return nil
+}
+
+func (m *NebulaHandshakeDetails) GetResponderMultiPort() *MultiPortDetails {
+	if m != nil {
+		return m.ResponderMultiPort
+	}
+	return nil
+}
+
+func (m *NebulaHandshakeDetails) GetKemKey() []byte {
+	if m != nil {
+		return m.KemKey
+	}
+	return nil
+}
+
+func (m *NebulaHandshakeDetails) GetKemCiphertext() []byte {
+	if m != nil {
+		return m.KemCiphertext
+	}
+	return nil
+}
+
+func (m *NebulaHandshakeDetails) GetCiphers() []string {
+	if m != nil {
+		return m.Ciphers
+	}
+	return nil
+}
+
+func (m *NebulaHandshakeDetails) GetCipher() string {
+	if m != nil {
+		return m.Cipher
+	}
+	return ""
+}
+
+type MultiPortDetails struct {
+	// First udp port of a contiguous range the sender accepts tunnel traffic on and sends tunnel traffic from
+	BasePort   uint32 `protobuf:"varint,1,opt,name=BasePort,proto3" json:"BasePort,omitempty"`
+	TotalPorts uint32 `protobuf:"varint,2,opt,name=TotalPorts,proto3" json:"TotalPorts,omitempty"`
+}
+
+func (m *MultiPortDetails) Reset()         { *m = MultiPortDetails{} }
+func (m *MultiPortDetails) String() string { return proto.CompactTextString(m) }
+func (*MultiPortDetails) ProtoMessage()    {}
+func (*MultiPortDetails) Descriptor() ([]byte, []int) {
+	return fileDescriptor_2d65afa7693df5ef, []int{7}
+}
+func (m *MultiPortDetails) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *MultiPortDetails) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_MultiPortDetails.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *MultiPortDetails) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_MultiPortDetails.Merge(m, src)
+}
+func (m *MultiPortDetails) XXX_Size() int {
+	return m.Size()
+}
+func (m *MultiPortDetails) XXX_DiscardUnknown() {
+	xxx_messageInfo_MultiPortDetails.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_MultiPortDetails proto.InternalMessageInfo
+
+func (m *MultiPortDetails) GetBasePort() uint32 {
+	if m != nil {
+		return m.BasePort
+	}
+	return 0
+}
+
+func (m *MultiPortDetails) GetTotalPorts() uint32 {
+	if m != nil {
+		return m.TotalPorts
+	}
+	return 0
+}
+
 type NebulaControl struct {
 	Type                NebulaControl_MessageType `protobuf:"varint,1,opt,name=Type,proto3,enum=nebula.NebulaControl_MessageType" json:"Type,omitempty"`
 	InitiatorRelayIndex uint32                    `protobuf:"varint,2,opt,name=InitiatorRelayIndex,proto3" json:"InitiatorRelayIndex,omitempty"`
 	ResponderRelayIndex uint32                    `protobuf:"varint,3,opt,name=ResponderRelayIndex,proto3" json:"ResponderRelayIndex,omitempty"`
 	RelayToIp           uint32                    `protobuf:"varint,4,opt,name=RelayToIp,proto3" json:"RelayToIp,omitempty"`
 	RelayFromIp         uint32                    `protobuf:"varint,5,opt,name=RelayFromIp,proto3" json:"RelayFromIp,omitempty"`
+	// Reason is a human readable explanation for a CreateRelayRejected
+	Reason string `protobuf:"bytes,6,opt,name=Reason,proto3" json:"Reason,omitempty"`
+	// RelayPath holds the vpn ips of the relays a chained CreateRelayRequest has already passed through, in order
+	RelayPath []uint32 `protobuf:"varint,7,rep,packed,name=RelayPath,proto3" json:"RelayPath,omitempty"`
+	// HopLimit is the maximum number of relays the initiator allows between itself and RelayToIp
+	HopLimit uint32 `protobuf:"varint,8,opt,name=HopLimit,proto3" json:"HopLimit,omitempty"`
 }
 
 func (m *NebulaControl) Reset()         { *m = NebulaControl{} }
 func (m *NebulaControl) String() string { return proto.CompactTextString(m) }
 func (*NebulaControl) ProtoMessage()    {}
 func (*NebulaControl) Descriptor() ([]byte, []int) {
-	return fileDescriptor_2d65afa7693df5ef, []int{7}
+	return fileDescriptor_2d65afa7693df5ef, []int{8}
 }
 func (m *NebulaControl) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -623,6 +824,96 @@ func (m *NebulaControl) GetRelayFromIp() uint32 {
 	return 0
 }
 
+func (m *NebulaControl) GetReason() string {
+	if m != nil {
+		return m.Reason
+	}
+	return ""
+}
+
+func (m *NebulaControl) GetRelayPath() []uint32 {
+	if m != nil {
+		return m.RelayPath
+	}
+	return nil
+}
+
+func (m *NebulaControl) GetHopLimit() uint32 {
+	if m != nil {
+		return m.HopLimit
+	}
+	return 0
+}
+
+type UnsafeRoute struct {
+	Ip   uint32 `protobuf:"varint,1,opt,name=Ip,proto3" json:"Ip,omitempty"`
+	Bits uint32 `protobuf:"varint,2,opt,name=Bits,proto3" json:"Bits,omitempty"`
+	// Higher is preferred when several gateways advertise the same network
+	Priority uint32 `protobuf:"varint,3,opt,name=Priority,proto3" json:"Priority,omitempty"`
+	Via      uint32 `protobuf:"varint,4,opt,name=Via,proto3" json:"Via,omitempty"`
+}
+
+func (m *UnsafeRoute) Reset()         { *m = UnsafeRoute{} }
+func (m *UnsafeRoute) String() string { return proto.CompactTextString(m) }
+func (*UnsafeRoute) ProtoMessage()    {}
+func (*UnsafeRoute) Descriptor() ([]byte, []int) {
+	return fileDescriptor_2d65afa7693df5ef, []int{9}
+}
+func (m *UnsafeRoute) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *UnsafeRoute) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_UnsafeRoute.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *UnsafeRoute) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_UnsafeRoute.Merge(m, src)
+}
+func (m *UnsafeRoute) XXX_Size() int {
+	return m.Size()
+}
+func (m *UnsafeRoute) XXX_DiscardUnknown() {
+	xxx_messageInfo_UnsafeRoute.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_UnsafeRoute proto.InternalMessageInfo
+
+func (m *UnsafeRoute) GetIp() uint32 {
+	if m != nil {
+		return m.Ip
+	}
+	return 0
+}
+
+func (m *UnsafeRoute) GetBits() uint32 {
+	if m != nil {
+		return m.Bits
+	}
+	return 0
+}
+
+func (m *UnsafeRoute) GetPriority() uint32 {
+	if m != nil {
+		return m.Priority
+	}
+	return 0
+}
+
+func (m *UnsafeRoute) GetVia() uint32 {
+	if m != nil {
+		return m.Via
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterEnum("nebula.NebulaMeta_MessageType", NebulaMeta_MessageType_name, NebulaMeta_MessageType_value)
 	proto.RegisterEnum("nebula.NebulaPing_MessageType", NebulaPing_MessageType_name, NebulaPing_MessageType_value)
@@ -634,58 +925,81 @@ func init() {
 	proto.RegisterType((*NebulaPing)(nil), "nebula.NebulaPing")
 	proto.RegisterType((*NebulaHandshake)(nil), "nebula.NebulaHandshake")
 	proto.RegisterType((*NebulaHandshakeDetails)(nil), "nebula.NebulaHandshakeDetails")
+	proto.RegisterType((*MultiPortDetails)(nil), "nebula.MultiPortDetails")
 	proto.RegisterType((*NebulaControl)(nil), "nebula.NebulaControl")
+	proto.RegisterType((*UnsafeRoute)(nil), "nebula.UnsafeRoute")
 }
 
 func init() { proto.RegisterFile("nebula.proto", fileDescriptor_2d65afa7693df5ef) }
 
 var fileDescriptor_2d65afa7693df5ef = []byte{
-	// 707 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x54, 0x4d, 0x6f, 0xda, 0x4a,
-	0x14, 0xc5, 0xc6, 0x7c, 0x5d, 0x02, 0xf1, 0xbb, 0x79, 0x8f, 0x07, 0x4f, 0xaf, 0x16, 0xf5, 0xa2,
-	0x62, 0x45, 0x22, 0x92, 0x46, 0x5d, 0x36, 0xa5, 0xaa, 0x20, 0x4a, 0x22, 0x3a, 0x4a, 0x5b, 0xa9,
-	0x9b, 0x6a, 0x62, 0xa6, 0xc1, 0x02, 0x3c, 0x8e, 0x3d, 0x54, 0xe1, 0x5f, 0xf4, 0xc7, 0xe4, 0x47,
-	0x74, 0xd7, 0x2c, 0xbb, 0xac, 0x92, 0x65, 0x97, 0xfd, 0x03, 0xd5, 0x8c, 0xc1, 0x36, 0x84, 0x76,
-	0x37, 0xe7, 0xde, 0x73, 0x66, 0xce, 0x9c, 0xb9, 0x36, 0x6c, 0x79, 0xec, 0x62, 0x36, 0xa1, 0x6d,
-	0x3f, 0xe0, 0x82, 0x63, 0x3e, 0x42, 0xf6, 0x0f, 0x1d, 0xe0, 0x4c, 0x2d, 0x4f, 0x99, 0xa0, 0xd8,
-	0x01, 0xe3, 0x7c, 0xee, 0xb3, 0xba, 0xd6, 0xd4, 0x5a, 0xd5, 0x8e, 0xd5, 0x5e, 0x68, 0x12, 0x46,
-	0xfb, 0x94, 0x85, 0x21, 0xbd, 0x64, 0x92, 0x45, 0x14, 0x17, 0xf7, 0xa1, 0xf0, 0x92, 0x09, 0xea,
-	0x4e, 0xc2, 0xba, 0xde, 0xd4, 0x5a, 0xe5, 0x4e, 0xe3, 0xa1, 0x6c, 0x41, 0x20, 0x4b, 0xa6, 0xfd,
-	0x53, 0x83, 0x72, 0x6a, 0x2b, 0x2c, 0x82, 0x71, 0xc6, 0x3d, 0x66, 0x66, 0xb0, 0x02, 0xa5, 0x1e,
-	0x0f, 0xc5, 0xeb, 0x19, 0x0b, 0xe6, 0xa6, 0x86, 0x08, 0xd5, 0x18, 0x12, 0xe6, 0x4f, 0xe6, 0xa6,
-	0x8e, 0xff, 0x41, 0x4d, 0xd6, 0xde, 0xf8, 0x43, 0x2a, 0xd8, 0x19, 0x17, 0xee, 0x47, 0xd7, 0xa1,
-	0xc2, 0xe5, 0x9e, 0x99, 0xc5, 0x06, 0xfc, 0x23, 0x7b, 0xa7, 0xfc, 0x13, 0x1b, 0xae, 0xb4, 0x8c,
-	0x65, 0x6b, 0x30, 0xf3, 0x9c, 0xd1, 0x4a, 0x2b, 0x87, 0x55, 0x00, 0xd9, 0x7a, 0x37, 0xe2, 0x74,
-	0xea, 0x9a, 0x79, 0xdc, 0x81, 0xed, 0x04, 0x47, 0xc7, 0x16, 0xa4, 0xb3, 0x01, 0x15, 0xa3, 0xee,
-	0x88, 0x39, 0x63, 0xb3, 0x28, 0x9d, 0xc5, 0x30, 0xa2, 0x94, 0xf0, 0x11, 0x34, 0x36, 0x3b, 0x3b,
-	0x72, 0xc6, 0x26, 0xd8, 0x5f, 0x35, 0xf8, 0xeb, 0x41, 0x28, 0xf8, 0x37, 0xe4, 0xde, 0xfa, 0x5e,
-	0xdf, 0x57, 0xa9, 0x57, 0x48, 0x04, 0xf0, 0x00, 0xca, 0x7d, 0xff, 0xe0, 0xc8, 0x1b, 0x0e, 0x78,
-	0x20, 0x64, 0xb4, 0xd9, 0x56, 0xb9, 0x83, 0xcb, 0x68, 0x93, 0x16, 0x49, 0xd3, 0x22, 0xd5, 0x61,
-	0xac, 0x32, 0xd6, 0x55, 0x87, 0x29, 0x55, 0x4c, 0x43, 0x0b, 0x80, 0xb0, 0x09, 0x9d, 0x47, 0x36,
-	0x72, 0xcd, 0x6c, 0xab, 0x42, 0x52, 0x15, 0xac, 0x43, 0xc1, 0xe1, 0x33, 0x4f, 0xb0, 0xa0, 0x9e,
-	0x55, 0x1e, 0x97, 0xd0, 0xde, 0x03, 0x48, 0x8e, 0xc7, 0x2a, 0xe8, 0xf1, 0x35, 0xf4, 0xbe, 0x8f,
-	0x08, 0x86, 0xac, 0xab, 0xb9, 0xa8, 0x10, 0xb5, 0xb6, 0x9f, 0x4b, 0xc5, 0x61, 0x4a, 0xd1, 0x73,
-	0x95, 0xc2, 0x20, 0x7a, 0xcf, 0x95, 0xf8, 0x84, 0x2b, 0xbe, 0x41, 0xf4, 0x13, 0x1e, 0xef, 0x90,
-	0x4d, 0xed, 0x70, 0xbd, 0x1c, 0xd9, 0x81, 0xeb, 0x5d, 0xfe, 0x79, 0x64, 0x25, 0x63, 0xc3, 0xc8,
-	0x22, 0x18, 0xe7, 0xee, 0x94, 0x2d, 0xce, 0x51, 0x6b, 0xdb, 0x7e, 0x30, 0x90, 0x52, 0x6c, 0x66,
-	0xb0, 0x04, 0xb9, 0xe8, 0x79, 0x35, 0xfb, 0x03, 0x6c, 0x47, 0xfb, 0xf6, 0xa8, 0x37, 0x0c, 0x47,
-	0x74, 0xcc, 0xf0, 0x59, 0x32, 0xfd, 0x9a, 0x9a, 0xfe, 0x35, 0x07, 0x31, 0x73, 0xfd, 0x13, 0x90,
-	0x26, 0x7a, 0x53, 0xea, 0x28, 0x13, 0x5b, 0x44, 0xad, 0xed, 0x1b, 0x0d, 0x6a, 0x9b, 0x75, 0x92,
-	0xde, 0x65, 0x81, 0x50, 0xa7, 0x6c, 0x11, 0xb5, 0xc6, 0x27, 0x50, 0xed, 0x7b, 0xae, 0x70, 0xa9,
-	0xe0, 0x41, 0xdf, 0x1b, 0xb2, 0xeb, 0x45, 0xd2, 0x6b, 0x55, 0xc9, 0x23, 0x2c, 0xf4, 0xb9, 0x37,
-	0x64, 0x0b, 0x5e, 0x94, 0xe7, 0x5a, 0x15, 0x6b, 0x90, 0xef, 0x72, 0x3e, 0x76, 0x59, 0xdd, 0x50,
-	0xc9, 0x2c, 0x50, 0x9c, 0x57, 0x2e, 0xc9, 0xeb, 0xd8, 0x28, 0xe6, 0xcd, 0xc2, 0xb1, 0x51, 0x2c,
-	0x98, 0x45, 0xfb, 0x46, 0x87, 0x4a, 0x64, 0xbb, 0xcb, 0x3d, 0x11, 0xf0, 0x09, 0x3e, 0x5d, 0x79,
-	0x95, 0xc7, 0xab, 0x99, 0x2c, 0x48, 0x1b, 0x1e, 0x66, 0x0f, 0x76, 0x62, 0xeb, 0x6a, 0xfe, 0xd2,
-	0xb7, 0xda, 0xd4, 0x92, 0x8a, 0xf8, 0x12, 0x29, 0x45, 0x74, 0xbf, 0x4d, 0x2d, 0xfc, 0x1f, 0x4a,
-	0x0a, 0x9d, 0xf3, 0xbe, 0xaf, 0xee, 0x59, 0x21, 0x49, 0x01, 0x9b, 0x50, 0x56, 0xe0, 0x55, 0xc0,
-	0xa7, 0xea, 0x5b, 0x90, 0xfd, 0x74, 0xc9, 0xee, 0xfd, 0xee, 0xcf, 0x55, 0x03, 0xec, 0x06, 0x8c,
-	0x0a, 0xa6, 0xd8, 0x84, 0x5d, 0xcd, 0x58, 0x28, 0x4c, 0x0d, 0xff, 0x85, 0x9d, 0x95, 0xba, 0xb4,
-	0x14, 0x32, 0x53, 0x7f, 0xb1, 0xff, 0xe5, 0xce, 0xd2, 0x6e, 0xef, 0x2c, 0xed, 0xfb, 0x9d, 0xa5,
-	0x7d, 0xbe, 0xb7, 0x32, 0xb7, 0xf7, 0x56, 0xe6, 0xdb, 0xbd, 0x95, 0x79, 0xdf, 0xb8, 0x74, 0xc5,
-	0x68, 0x76, 0xd1, 0x76, 0xf8, 0x74, 0x37, 0x9c, 0x50, 0x67, 0x3c, 0xba, 0xda, 0x8d, 0x22, 0xbc,
-	0xc8, 0xab, 0x1f, 0xf8, 0xfe, 0xaf, 0x00, 0x00, 0x00, 0xff, 0xff, 0x17, 0x56, 0x28, 0x74, 0xd0,
-	0x05, 0x00, 0x00,
+	// 1044 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x56, 0xdd, 0x6e, 0xdb, 0x46,
+	0x13, 0x35, 0xf5, 0x67, 0x6b, 0x24, 0x2a, 0xcc, 0x38, 0x9f, 0x3f, 0x3a, 0x68, 0x05, 0x97, 0x28,
+	0x0a, 0x5f, 0x39, 0x81, 0x93, 0xa6, 0x45, 0xaf, 0x1a, 0x2b, 0x08, 0x24, 0xd8, 0x56, 0xd5, 0xad,
+	0x93, 0x00, 0xbd, 0x09, 0xd6, 0xd4, 0xc4, 0x62, 0x25, 0x71, 0x19, 0x72, 0x15, 0x58, 0x6f, 0xd1,
+	0x37, 0xe8, 0x0b, 0xf4, 0x35, 0x0a, 0x14, 0x05, 0x0a, 0xe4, 0xb2, 0x97, 0x85, 0xfd, 0x22, 0xc5,
+	0x2e, 0x7f, 0x25, 0x53, 0xed, 0xdd, 0x9e, 0x99, 0x33, 0xb3, 0xb3, 0x67, 0x67, 0x87, 0x84, 0xb6,
+	0x4f, 0x97, 0x8b, 0x19, 0x3f, 0x0a, 0x42, 0x21, 0x05, 0x36, 0x62, 0xe4, 0xfc, 0x56, 0x05, 0x18,
+	0xea, 0xe5, 0x39, 0x49, 0x8e, 0xc7, 0x50, 0xbb, 0x58, 0x06, 0x64, 0x1b, 0x07, 0xc6, 0x61, 0xe7,
+	0xb8, 0x7b, 0x94, 0xc4, 0xe4, 0x8c, 0xa3, 0x73, 0x8a, 0x22, 0x7e, 0x45, 0x8a, 0xc5, 0x34, 0x17,
+	0x9f, 0xc0, 0xf6, 0x0b, 0x92, 0xdc, 0x9b, 0x45, 0x76, 0xe5, 0xc0, 0x38, 0x6c, 0x1d, 0xef, 0xdf,
+	0x0d, 0x4b, 0x08, 0x2c, 0x65, 0x3a, 0x7f, 0x56, 0xa0, 0x55, 0x48, 0x85, 0x3b, 0x50, 0x1b, 0x0a,
+	0x9f, 0xac, 0x2d, 0x34, 0xa1, 0xd9, 0x17, 0x91, 0xfc, 0x7e, 0x41, 0xe1, 0xd2, 0x32, 0x10, 0xa1,
+	0x93, 0x41, 0x46, 0xc1, 0x6c, 0x69, 0x55, 0xf0, 0x21, 0xec, 0x29, 0xdb, 0xab, 0x60, 0xcc, 0x25,
+	0x0d, 0x85, 0xf4, 0xde, 0x79, 0x2e, 0x97, 0x9e, 0xf0, 0xad, 0x2a, 0xee, 0xc3, 0xff, 0x94, 0xef,
+	0x5c, 0x7c, 0xa0, 0xf1, 0x8a, 0xab, 0x96, 0xba, 0x46, 0x0b, 0xdf, 0x9d, 0xac, 0xb8, 0xea, 0xd8,
+	0x01, 0x50, 0xae, 0x37, 0x13, 0xc1, 0xe7, 0x9e, 0xd5, 0xc0, 0x5d, 0xb8, 0x97, 0xe3, 0x78, 0xdb,
+	0x6d, 0x55, 0xd9, 0x88, 0xcb, 0x49, 0x6f, 0x42, 0xee, 0xd4, 0xda, 0x51, 0x95, 0x65, 0x30, 0xa6,
+	0x34, 0xf1, 0x53, 0xd8, 0x2f, 0xaf, 0xec, 0xb9, 0x3b, 0xb5, 0x00, 0xef, 0x83, 0xa9, 0xdc, 0x43,
+	0x3e, 0xa7, 0xf8, 0x7c, 0x2d, 0xdc, 0x03, 0x5c, 0x31, 0xc5, 0x99, 0xda, 0x69, 0x05, 0x4c, 0x2c,
+	0x24, 0x45, 0x31, 0xd9, 0x44, 0x1b, 0x1e, 0xac, 0x19, 0x63, 0x7a, 0xc7, 0xf9, 0xa3, 0x0e, 0xf7,
+	0xef, 0xc8, 0x8d, 0x0f, 0xa0, 0xfe, 0x3a, 0xf0, 0x07, 0x81, 0xbe, 0x4f, 0x93, 0xc5, 0x00, 0x9f,
+	0x42, 0x6b, 0x10, 0x3c, 0x7d, 0xee, 0x8f, 0x47, 0x22, 0x94, 0xea, 0xd2, 0xaa, 0x87, 0xad, 0x63,
+	0x4c, 0x2f, 0x2d, 0x77, 0xb1, 0x22, 0x2d, 0x8e, 0x7a, 0x96, 0x45, 0xd5, 0xd6, 0xa3, 0x9e, 0x15,
+	0xa2, 0x32, 0x1a, 0x76, 0x01, 0x18, 0xcd, 0xf8, 0x32, 0x2e, 0xa3, 0x7e, 0x50, 0x3d, 0x34, 0x59,
+	0xc1, 0x82, 0x36, 0x6c, 0xbb, 0x62, 0xe1, 0x4b, 0x0a, 0xed, 0xaa, 0xae, 0x31, 0x85, 0x88, 0x50,
+	0x53, 0xa2, 0xd8, 0x8d, 0x03, 0xe3, 0xb0, 0xc9, 0xf4, 0x1a, 0xbf, 0x81, 0xce, 0x85, 0x1b, 0x14,
+	0x8b, 0xdf, 0xde, 0x58, 0xfc, 0x1a, 0x33, 0x8b, 0xcd, 0x8f, 0xb0, 0xb3, 0xf1, 0x08, 0x6b, 0x4c,
+	0x7c, 0x09, 0x0f, 0xde, 0xd0, 0xe5, 0x0f, 0xc2, 0x9d, 0x92, 0x2c, 0xee, 0xde, 0xdc, 0xb8, 0x7b,
+	0x29, 0x7f, 0x2d, 0x4f, 0x5e, 0x09, 0x6c, 0xac, 0xa4, 0x94, 0xaf, 0x54, 0x1b, 0x72, 0xa9, 0x5f,
+	0x6a, 0x2b, 0x56, 0x2d, 0x81, 0xf8, 0x15, 0xb4, 0x5f, 0xf9, 0x11, 0x7f, 0x47, 0x71, 0x8f, 0xd8,
+	0x6d, 0x9d, 0x79, 0x37, 0xcd, 0x5c, 0xf0, 0xb1, 0x15, 0x22, 0xbe, 0x80, 0xdd, 0xef, 0x2e, 0x23,
+	0x0a, 0x3f, 0xd0, 0xb8, 0x78, 0x42, 0x73, 0xe3, 0x09, 0xcb, 0xe8, 0xab, 0x59, 0xf2, 0xf3, 0x75,
+	0x36, 0x9e, 0xaf, 0x8c, 0xee, 0x3c, 0x06, 0xc8, 0x93, 0x62, 0x07, 0x2a, 0x59, 0x07, 0x57, 0x06,
+	0x81, 0x6a, 0x0c, 0x65, 0xd7, 0xc3, 0xc6, 0x64, 0x7a, 0xed, 0x7c, 0x0b, 0x90, 0x27, 0x50, 0x11,
+	0x7d, 0x4f, 0x47, 0xd4, 0x58, 0xa5, 0xef, 0x29, 0x7c, 0x26, 0x34, 0xbf, 0xc6, 0x2a, 0x67, 0x22,
+	0xcb, 0x50, 0x2d, 0x64, 0xb8, 0x4e, 0xe7, 0xe0, 0xc8, 0xf3, 0xaf, 0xfe, 0x7d, 0x0e, 0x2a, 0x46,
+	0xc9, 0x1c, 0x44, 0xa8, 0x5d, 0x78, 0x73, 0x4a, 0xf6, 0xd1, 0x6b, 0xc7, 0xb9, 0x33, 0xe5, 0x54,
+	0xb0, 0xb5, 0x85, 0x4d, 0xa8, 0xc7, 0x4f, 0xd7, 0x70, 0xde, 0xc2, 0xbd, 0x38, 0x6f, 0x9f, 0xfb,
+	0xe3, 0x68, 0xc2, 0xa7, 0x84, 0x5f, 0xe7, 0x23, 0xd5, 0xd0, 0x23, 0x75, 0xad, 0x82, 0x8c, 0xb9,
+	0x3e, 0x57, 0x55, 0x11, 0xfd, 0x39, 0x77, 0x75, 0x11, 0x6d, 0xa6, 0xd7, 0xce, 0xaf, 0x55, 0xd8,
+	0x2b, 0x8f, 0x53, 0xf4, 0x1e, 0x85, 0x52, 0xef, 0xd2, 0x66, 0x7a, 0x8d, 0x5f, 0x40, 0x67, 0xe0,
+	0x7b, 0xd2, 0xe3, 0x52, 0x84, 0x03, 0x7f, 0x4c, 0xd7, 0x89, 0xd2, 0x6b, 0x56, 0xc5, 0x63, 0x14,
+	0x05, 0xc2, 0x1f, 0x53, 0xc2, 0x8b, 0xf5, 0x5c, 0xb3, 0xe2, 0x1e, 0x34, 0x7a, 0x42, 0x4c, 0x3d,
+	0xb2, 0x6b, 0x5a, 0x99, 0x04, 0x65, 0x7a, 0xd5, 0x73, 0xbd, 0xb0, 0x0f, 0x98, 0xed, 0x72, 0xbe,
+	0x98, 0x49, 0x4f, 0xdf, 0x53, 0x43, 0x6b, 0x60, 0xa7, 0x1a, 0x64, 0x8e, 0xf4, 0xf4, 0x25, 0x31,
+	0x2a, 0x53, 0x56, 0x47, 0x9e, 0x69, 0xfb, 0xbf, 0x32, 0xdd, 0x8d, 0x51, 0xf5, 0x9f, 0xd2, 0xfc,
+	0x94, 0x96, 0xf6, 0x8e, 0x56, 0x29, 0x41, 0xf8, 0x39, 0x98, 0xa7, 0x34, 0xef, 0x79, 0xc1, 0x84,
+	0x42, 0x49, 0xd7, 0xd2, 0x6e, 0x6a, 0xf7, 0xaa, 0x51, 0x3d, 0xd5, 0x18, 0xc5, 0xaf, 0xbc, 0xc9,
+	0x52, 0xa8, 0x75, 0xd1, 0x4b, 0xfd, 0x86, 0x9b, 0x2c, 0x41, 0xce, 0x10, 0xac, 0xf5, 0xba, 0xf0,
+	0x21, 0xec, 0x9c, 0xf0, 0x88, 0x46, 0x22, 0xb9, 0x2b, 0x93, 0x65, 0x58, 0x8d, 0xd8, 0x0b, 0x21,
+	0xf9, 0x2c, 0x9d, 0xe6, 0xca, 0x5b, 0xb0, 0x38, 0xbf, 0x54, 0xc1, 0x8c, 0xaf, 0xbf, 0x27, 0x7c,
+	0x19, 0x8a, 0x19, 0x7e, 0xb9, 0xd2, 0xdd, 0x9f, 0xad, 0xf6, 0x56, 0x42, 0x2a, 0x69, 0xf0, 0xc7,
+	0xb0, 0x9b, 0x09, 0xad, 0x47, 0x78, 0xb1, 0x3b, 0xca, 0x5c, 0x2a, 0x22, 0x13, 0xb4, 0x10, 0x11,
+	0xf7, 0x49, 0x99, 0x0b, 0x3f, 0x81, 0xa6, 0x46, 0x17, 0x62, 0x10, 0xe8, 0x7e, 0x31, 0x59, 0x6e,
+	0xc0, 0x03, 0x68, 0x69, 0xf0, 0x32, 0x14, 0x73, 0xfd, 0x39, 0x51, 0xfe, 0xa2, 0x49, 0x89, 0xca,
+	0x88, 0x47, 0xc2, 0x4f, 0xbe, 0x1b, 0x09, 0xca, 0xf2, 0xaa, 0x2f, 0xb6, 0xfe, 0x68, 0x98, 0x2c,
+	0x37, 0x28, 0x79, 0xfb, 0x22, 0x38, 0xf3, 0xe6, 0x9e, 0xd4, 0x97, 0x6c, 0xb2, 0x0c, 0x3b, 0x7c,
+	0xd3, 0x8f, 0xca, 0x1e, 0x60, 0x2f, 0x24, 0x2e, 0x49, 0xe7, 0x61, 0xf4, 0x7e, 0x41, 0x91, 0xb4,
+	0x0c, 0xfc, 0x3f, 0xec, 0xae, 0xd8, 0xd5, 0x21, 0x23, 0xb2, 0x2a, 0x77, 0x1c, 0x3f, 0x91, 0x2b,
+	0x69, 0x6c, 0x55, 0x9d, 0xb7, 0xd0, 0x2a, 0xcc, 0xe2, 0xb2, 0x81, 0x77, 0xe2, 0x65, 0x57, 0xab,
+	0xd7, 0xaa, 0xe2, 0x51, 0xe8, 0x89, 0xd0, 0x93, 0xcb, 0x44, 0xce, 0x0c, 0xa3, 0x05, 0xd5, 0xd7,
+	0x1e, 0x4f, 0xd4, 0x53, 0xcb, 0x93, 0x27, 0xbf, 0xdf, 0x74, 0x8d, 0x8f, 0x37, 0x5d, 0xe3, 0xef,
+	0x9b, 0xae, 0xf1, 0xf3, 0x6d, 0x77, 0xeb, 0xe3, 0x6d, 0x77, 0xeb, 0xaf, 0xdb, 0xee, 0xd6, 0x8f,
+	0xfb, 0x57, 0x9e, 0x9c, 0x2c, 0x2e, 0x8f, 0x5c, 0x31, 0x7f, 0x14, 0xcd, 0xb8, 0x3b, 0x9d, 0xbc,
+	0x7f, 0x14, 0xb7, 0xc3, 0x65, 0x43, 0xff, 0x29, 0x3e, 0xf9, 0x67, 0x00, 0x40, 0xa4, 0xf9, 0x11,
+	0x39, 0x0a, 0x00, 0x00,
 }
 
 func (m *NebulaMeta) Marshal() (dAtA []byte, err error) {
@@ -748,6 +1062,116 @@ func (m *NebulaMetaDetails) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if len(m.ObservedIp6AndPorts) > 0 {
+		for iNdEx := len(m.ObservedIp6AndPorts) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.ObservedIp6AndPorts[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintNebula(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x72
+		}
+	}
+	if len(m.ObservedIp4AndPorts) > 0 {
+		for iNdEx := len(m.ObservedIp4AndPorts) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.ObservedIp4AndPorts[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintNebula(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x6a
+		}
+	}
+	if len(m.UnsafeRoutes) > 0 {
+		for iNdEx := len(m.UnsafeRoutes) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.UnsafeRoutes[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintNebula(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x62
+		}
+	}
+	if m.NatType != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.NatType))
+		i--
+		dAtA[i] = 0x58
+	}
+	if len(m.WebSocketIp6AndPorts) > 0 {
+		for iNdEx := len(m.WebSocketIp6AndPorts) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.WebSocketIp6AndPorts[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintNebula(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x52
+		}
+	}
+	if len(m.WebSocketIp4AndPorts) > 0 {
+		for iNdEx := len(m.WebSocketIp4AndPorts) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.WebSocketIp4AndPorts[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintNebula(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x4a
+		}
+	}
+	if len(m.TcpIp6AndPorts) > 0 {
+		for iNdEx := len(m.TcpIp6AndPorts) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.TcpIp6AndPorts[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintNebula(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x42
+		}
+	}
+	if len(m.TcpIp4AndPorts) > 0 {
+		for iNdEx := len(m.TcpIp4AndPorts) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.TcpIp4AndPorts[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintNebula(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x3a
+		}
+	}
+	if len(m.Name) > 0 {
+		i -= len(m.Name)
+		copy(dAtA[i:], m.Name)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.Name)))
+		i--
+		dAtA[i] = 0x32
+	}
 	if len(m.RelayVpnIp) > 0 {
 		dAtA3 := make([]byte, len(m.RelayVpnIp)*10)
 		var j2 int
@@ -973,36 +1397,123 @@ func (m *NebulaHandshakeDetails) MarshalToSizedBuffer(dAtA []byte) (int, error)
 	_ = i
 	var l int
 	_ = l
-	if m.Time != 0 {
-		i = encodeVarintNebula(dAtA, i, uint64(m.Time))
+	if len(m.Cipher) > 0 {
+		i -= len(m.Cipher)
+		copy(dAtA[i:], m.Cipher)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.Cipher)))
 		i--
-		dAtA[i] = 0x28
+		dAtA[i] = 0x5a
 	}
-	if m.Cookie != 0 {
-		i = encodeVarintNebula(dAtA, i, uint64(m.Cookie))
-		i--
-		dAtA[i] = 0x20
+	if len(m.Ciphers) > 0 {
+		for iNdEx := len(m.Ciphers) - 1; iNdEx >= 0; iNdEx-- {
+			i -= len(m.Ciphers[iNdEx])
+			copy(dAtA[i:], m.Ciphers[iNdEx])
+			i = encodeVarintNebula(dAtA, i, uint64(len(m.Ciphers[iNdEx])))
+			i--
+			dAtA[i] = 0x52
+		}
 	}
-	if m.ResponderIndex != 0 {
-		i = encodeVarintNebula(dAtA, i, uint64(m.ResponderIndex))
+	if len(m.KemCiphertext) > 0 {
+		i -= len(m.KemCiphertext)
+		copy(dAtA[i:], m.KemCiphertext)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.KemCiphertext)))
 		i--
-		dAtA[i] = 0x18
+		dAtA[i] = 0x4a
 	}
-	if m.InitiatorIndex != 0 {
-		i = encodeVarintNebula(dAtA, i, uint64(m.InitiatorIndex))
+	if len(m.KemKey) > 0 {
+		i -= len(m.KemKey)
+		copy(dAtA[i:], m.KemKey)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.KemKey)))
 		i--
-		dAtA[i] = 0x10
+		dAtA[i] = 0x42
 	}
-	if len(m.Cert) > 0 {
-		i -= len(m.Cert)
-		copy(dAtA[i:], m.Cert)
-		i = encodeVarintNebula(dAtA, i, uint64(len(m.Cert)))
+	if m.ResponderMultiPort != nil {
+		{
+			size, err := m.ResponderMultiPort.MarshalToSizedBuffer(dAtA[:i])
+			if err != nil {
+				return 0, err
+			}
+			i -= size
+			i = encodeVarintNebula(dAtA, i, uint64(size))
+		}
+		i--
+		dAtA[i] = 0x3a
+	}
+	if m.InitiatorMultiPort != nil {
+		{
+			size, err := m.InitiatorMultiPort.MarshalToSizedBuffer(dAtA[:i])
+			if err != nil {
+				return 0, err
+			}
+			i -= size
+			i = encodeVarintNebula(dAtA, i, uint64(size))
+		}
+		i--
+		dAtA[i] = 0x32
+	}
+	if m.Time != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.Time))
+		i--
+		dAtA[i] = 0x28
+	}
+	if m.Cookie != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.Cookie))
+		i--
+		dAtA[i] = 0x20
+	}
+	if m.ResponderIndex != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.ResponderIndex))
+		i--
+		dAtA[i] = 0x18
+	}
+	if m.InitiatorIndex != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.InitiatorIndex))
+		i--
+		dAtA[i] = 0x10
+	}
+	if len(m.Cert) > 0 {
+		i -= len(m.Cert)
+		copy(dAtA[i:], m.Cert)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.Cert)))
 		i--
 		dAtA[i] = 0xa
 	}
 	return len(dAtA) - i, nil
 }
 
+func (m *MultiPortDetails) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *MultiPortDetails) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *MultiPortDetails) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if m.TotalPorts != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.TotalPorts))
+		i--
+		dAtA[i] = 0x10
+	}
+	if m.BasePort != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.BasePort))
+		i--
+		dAtA[i] = 0x8
+	}
+	return len(dAtA) - i, nil
+}
+
 func (m *NebulaControl) Marshal() (dAtA []byte, err error) {
 	size := m.Size()
 	dAtA = make([]byte, size)
@@ -1023,6 +1534,36 @@ func (m *NebulaControl) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if m.HopLimit != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.HopLimit))
+		i--
+		dAtA[i] = 0x40
+	}
+	if len(m.RelayPath) > 0 {
+		dAtA8 := make([]byte, len(m.RelayPath)*10)
+		var j7 int
+		for _, num := range m.RelayPath {
+			for num >= 1<<7 {
+				dAtA8[j7] = uint8(uint64(num)&0x7f | 0x80)
+				num >>= 7
+				j7++
+			}
+			dAtA8[j7] = uint8(num)
+			j7++
+		}
+		i -= j7
+		copy(dAtA[i:], dAtA8[:j7])
+		i = encodeVarintNebula(dAtA, i, uint64(j7))
+		i--
+		dAtA[i] = 0x3a
+	}
+	if len(m.Reason) > 0 {
+		i -= len(m.Reason)
+		copy(dAtA[i:], m.Reason)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.Reason)))
+		i--
+		dAtA[i] = 0x32
+	}
 	if m.RelayFromIp != 0 {
 		i = encodeVarintNebula(dAtA, i, uint64(m.RelayFromIp))
 		i--
@@ -1051,6 +1592,49 @@ func (m *NebulaControl) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	return len(dAtA) - i, nil
 }
 
+func (m *UnsafeRoute) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *UnsafeRoute) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *UnsafeRoute) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if m.Via != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.Via))
+		i--
+		dAtA[i] = 0x20
+	}
+	if m.Priority != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.Priority))
+		i--
+		dAtA[i] = 0x18
+	}
+	if m.Bits != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.Bits))
+		i--
+		dAtA[i] = 0x10
+	}
+	if m.Ip != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.Ip))
+		i--
+		dAtA[i] = 0x8
+	}
+	return len(dAtA) - i, nil
+}
+
 func encodeVarintNebula(dAtA []byte, offset int, v uint64) int {
 	offset -= sovNebula(v)
 	base := offset
@@ -1109,6 +1693,55 @@ func (m *NebulaMetaDetails) Size() (n int) {
 		}
 		n += 1 + sovNebula(uint64(l)) + l
 	}
+	l = len(m.Name)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	if len(m.TcpIp4AndPorts) > 0 {
+		for _, e := range m.TcpIp4AndPorts {
+			l = e.Size()
+			n += 1 + l + sovNebula(uint64(l))
+		}
+	}
+	if len(m.TcpIp6AndPorts) > 0 {
+		for _, e := range m.TcpIp6AndPorts {
+			l = e.Size()
+			n += 1 + l + sovNebula(uint64(l))
+		}
+	}
+	if len(m.WebSocketIp4AndPorts) > 0 {
+		for _, e := range m.WebSocketIp4AndPorts {
+			l = e.Size()
+			n += 1 + l + sovNebula(uint64(l))
+		}
+	}
+	if len(m.WebSocketIp6AndPorts) > 0 {
+		for _, e := range m.WebSocketIp6AndPorts {
+			l = e.Size()
+			n += 1 + l + sovNebula(uint64(l))
+		}
+	}
+	if m.NatType != 0 {
+		n += 1 + sovNebula(uint64(m.NatType))
+	}
+	if len(m.UnsafeRoutes) > 0 {
+		for _, e := range m.UnsafeRoutes {
+			l = e.Size()
+			n += 1 + l + sovNebula(uint64(l))
+		}
+	}
+	if len(m.ObservedIp4AndPorts) > 0 {
+		for _, e := range m.ObservedIp4AndPorts {
+			l = e.Size()
+			n += 1 + l + sovNebula(uint64(l))
+		}
+	}
+	if len(m.ObservedIp6AndPorts) > 0 {
+		for _, e := range m.ObservedIp6AndPorts {
+			l = e.Size()
+			n += 1 + l + sovNebula(uint64(l))
+		}
+	}
 	return n
 }
 
@@ -1199,6 +1832,47 @@ func (m *NebulaHandshakeDetails) Size() (n int) {
 	if m.Time != 0 {
 		n += 1 + sovNebula(uint64(m.Time))
 	}
+	if m.InitiatorMultiPort != nil {
+		l = m.InitiatorMultiPort.Size()
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	if m.ResponderMultiPort != nil {
+		l = m.ResponderMultiPort.Size()
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	l = len(m.KemKey)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	l = len(m.KemCiphertext)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	if len(m.Ciphers) > 0 {
+		for _, s := range m.Ciphers {
+			l = len(s)
+			n += 1 + l + sovNebula(uint64(l))
+		}
+	}
+	l = len(m.Cipher)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	return n
+}
+
+func (m *MultiPortDetails) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	if m.BasePort != 0 {
+		n += 1 + sovNebula(uint64(m.BasePort))
+	}
+	if m.TotalPorts != 0 {
+		n += 1 + sovNebula(uint64(m.TotalPorts))
+	}
 	return n
 }
 
@@ -1223,6 +1897,41 @@ func (m *NebulaControl) Size() (n int) {
 	if m.RelayFromIp != 0 {
 		n += 1 + sovNebula(uint64(m.RelayFromIp))
 	}
+	l = len(m.Reason)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	if len(m.RelayPath) > 0 {
+		l = 0
+		for _, e := range m.RelayPath {
+			l += sovNebula(uint64(e))
+		}
+		n += 1 + sovNebula(uint64(l)) + l
+	}
+	if m.HopLimit != 0 {
+		n += 1 + sovNebula(uint64(m.HopLimit))
+	}
+	return n
+}
+
+func (m *UnsafeRoute) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	if m.Ip != 0 {
+		n += 1 + sovNebula(uint64(m.Ip))
+	}
+	if m.Bits != 0 {
+		n += 1 + sovNebula(uint64(m.Bits))
+	}
+	if m.Priority != 0 {
+		n += 1 + sovNebula(uint64(m.Priority))
+	}
+	if m.Via != 0 {
+		n += 1 + sovNebula(uint64(m.Via))
+	}
 	return n
 }
 
@@ -1548,61 +2257,11 @@ func (m *NebulaMetaDetails) Unmarshal(dAtA []byte) error {
 			} else {
 				return fmt.Errorf("proto: wrong wireType = %d for field RelayVpnIp", wireType)
 			}
-		default:
-			iNdEx = preIndex
-			skippy, err := skipNebula(dAtA[iNdEx:])
-			if err != nil {
-				return err
-			}
-			if (skippy < 0) || (iNdEx+skippy) < 0 {
-				return ErrInvalidLengthNebula
-			}
-			if (iNdEx + skippy) > l {
-				return io.ErrUnexpectedEOF
-			}
-			iNdEx += skippy
-		}
-	}
-
-	if iNdEx > l {
-		return io.ErrUnexpectedEOF
-	}
-	return nil
-}
-func (m *Ip4AndPort) Unmarshal(dAtA []byte) error {
-	l := len(dAtA)
-	iNdEx := 0
-	for iNdEx < l {
-		preIndex := iNdEx
-		var wire uint64
-		for shift := uint(0); ; shift += 7 {
-			if shift >= 64 {
-				return ErrIntOverflowNebula
-			}
-			if iNdEx >= l {
-				return io.ErrUnexpectedEOF
-			}
-			b := dAtA[iNdEx]
-			iNdEx++
-			wire |= uint64(b&0x7F) << shift
-			if b < 0x80 {
-				break
-			}
-		}
-		fieldNum := int32(wire >> 3)
-		wireType := int(wire & 0x7)
-		if wireType == 4 {
-			return fmt.Errorf("proto: Ip4AndPort: wiretype end group for non-group")
-		}
-		if fieldNum <= 0 {
-			return fmt.Errorf("proto: Ip4AndPort: illegal tag %d (wire type %d)", fieldNum, wire)
-		}
-		switch fieldNum {
-		case 1:
-			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Ip", wireType)
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Name", wireType)
 			}
-			m.Ip = 0
+			var stringLen uint64
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -1612,18 +2271,31 @@ func (m *Ip4AndPort) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.Ip |= uint32(b&0x7F) << shift
+				stringLen |= uint64(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
-		case 2:
-			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Port", wireType)
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthNebula
 			}
-			m.Port = 0
-			for shift := uint(0); ; shift += 7 {
-				if shift >= 64 {
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Name = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 7:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field TcpIp4AndPorts", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
 					return ErrIntOverflowNebula
 				}
 				if iNdEx >= l {
@@ -1631,11 +2303,249 @@ func (m *Ip4AndPort) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.Port |= uint32(b&0x7F) << shift
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.TcpIp4AndPorts = append(m.TcpIp4AndPorts, &Ip4AndPort{})
+			if err := m.TcpIp4AndPorts[len(m.TcpIp4AndPorts)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 8:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field TcpIp6AndPorts", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.TcpIp6AndPorts = append(m.TcpIp6AndPorts, &Ip6AndPort{})
+			if err := m.TcpIp6AndPorts[len(m.TcpIp6AndPorts)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 9:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field WebSocketIp4AndPorts", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.WebSocketIp4AndPorts = append(m.WebSocketIp4AndPorts, &Ip4AndPort{})
+			if err := m.WebSocketIp4AndPorts[len(m.WebSocketIp4AndPorts)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 10:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field WebSocketIp6AndPorts", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.WebSocketIp6AndPorts = append(m.WebSocketIp6AndPorts, &Ip6AndPort{})
+			if err := m.WebSocketIp6AndPorts[len(m.WebSocketIp6AndPorts)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 11:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field NatType", wireType)
+			}
+			m.NatType = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.NatType |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 12:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field UnsafeRoutes", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.UnsafeRoutes = append(m.UnsafeRoutes, &UnsafeRoute{})
+			if err := m.UnsafeRoutes[len(m.UnsafeRoutes)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 13:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ObservedIp4AndPorts", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.ObservedIp4AndPorts = append(m.ObservedIp4AndPorts, &Ip4AndPort{})
+			if err := m.ObservedIp4AndPorts[len(m.ObservedIp4AndPorts)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 14:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ObservedIp6AndPorts", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.ObservedIp6AndPorts = append(m.ObservedIp6AndPorts, &Ip6AndPort{})
+			if err := m.ObservedIp6AndPorts[len(m.ObservedIp6AndPorts)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipNebula(dAtA[iNdEx:])
@@ -1657,7 +2567,7 @@ func (m *Ip4AndPort) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
-func (m *Ip6AndPort) Unmarshal(dAtA []byte) error {
+func (m *Ip4AndPort) Unmarshal(dAtA []byte) error {
 	l := len(dAtA)
 	iNdEx := 0
 	for iNdEx < l {
@@ -1680,17 +2590,17 @@ func (m *Ip6AndPort) Unmarshal(dAtA []byte) error {
 		fieldNum := int32(wire >> 3)
 		wireType := int(wire & 0x7)
 		if wireType == 4 {
-			return fmt.Errorf("proto: Ip6AndPort: wiretype end group for non-group")
+			return fmt.Errorf("proto: Ip4AndPort: wiretype end group for non-group")
 		}
 		if fieldNum <= 0 {
-			return fmt.Errorf("proto: Ip6AndPort: illegal tag %d (wire type %d)", fieldNum, wire)
+			return fmt.Errorf("proto: Ip4AndPort: illegal tag %d (wire type %d)", fieldNum, wire)
 		}
 		switch fieldNum {
 		case 1:
 			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Hi", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field Ip", wireType)
 			}
-			m.Hi = 0
+			m.Ip = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -1700,31 +2610,12 @@ func (m *Ip6AndPort) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.Hi |= uint64(b&0x7F) << shift
+				m.Ip |= uint32(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
 		case 2:
-			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Lo", wireType)
-			}
-			m.Lo = 0
-			for shift := uint(0); ; shift += 7 {
-				if shift >= 64 {
-					return ErrIntOverflowNebula
-				}
-				if iNdEx >= l {
-					return io.ErrUnexpectedEOF
-				}
-				b := dAtA[iNdEx]
-				iNdEx++
-				m.Lo |= uint64(b&0x7F) << shift
-				if b < 0x80 {
-					break
-				}
-			}
-		case 3:
 			if wireType != 0 {
 				return fmt.Errorf("proto: wrong wireType = %d for field Port", wireType)
 			}
@@ -1764,7 +2655,7 @@ func (m *Ip6AndPort) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
-func (m *NebulaPing) Unmarshal(dAtA []byte) error {
+func (m *Ip6AndPort) Unmarshal(dAtA []byte) error {
 	l := len(dAtA)
 	iNdEx := 0
 	for iNdEx < l {
@@ -1787,7 +2678,114 @@ func (m *NebulaPing) Unmarshal(dAtA []byte) error {
 		fieldNum := int32(wire >> 3)
 		wireType := int(wire & 0x7)
 		if wireType == 4 {
-			return fmt.Errorf("proto: NebulaPing: wiretype end group for non-group")
+			return fmt.Errorf("proto: Ip6AndPort: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: Ip6AndPort: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Hi", wireType)
+			}
+			m.Hi = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Hi |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Lo", wireType)
+			}
+			m.Lo = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Lo |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Port", wireType)
+			}
+			m.Port = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Port |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		default:
+			iNdEx = preIndex
+			skippy, err := skipNebula(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *NebulaPing) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowNebula
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: NebulaPing: wiretype end group for non-group")
 		}
 		if fieldNum <= 0 {
 			return fmt.Errorf("proto: NebulaPing: illegal tag %d (wire type %d)", fieldNum, wire)
@@ -1816,7 +2814,478 @@ func (m *NebulaPing) Unmarshal(dAtA []byte) error {
 			if wireType != 0 {
 				return fmt.Errorf("proto: wrong wireType = %d for field Time", wireType)
 			}
-			m.Time = 0
+			m.Time = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Time |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		default:
+			iNdEx = preIndex
+			skippy, err := skipNebula(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *NebulaHandshake) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowNebula
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: NebulaHandshake: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: NebulaHandshake: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Details", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.Details == nil {
+				m.Details = &NebulaHandshakeDetails{}
+			}
+			if err := m.Details.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Hmac", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Hmac = append(m.Hmac[:0], dAtA[iNdEx:postIndex]...)
+			if m.Hmac == nil {
+				m.Hmac = []byte{}
+			}
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipNebula(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *NebulaHandshakeDetails) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowNebula
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: NebulaHandshakeDetails: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: NebulaHandshakeDetails: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Cert", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Cert = append(m.Cert[:0], dAtA[iNdEx:postIndex]...)
+			if m.Cert == nil {
+				m.Cert = []byte{}
+			}
+			iNdEx = postIndex
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field InitiatorIndex", wireType)
+			}
+			m.InitiatorIndex = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.InitiatorIndex |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ResponderIndex", wireType)
+			}
+			m.ResponderIndex = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.ResponderIndex |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Cookie", wireType)
+			}
+			m.Cookie = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Cookie |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Time", wireType)
+			}
+			m.Time = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Time |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field InitiatorMultiPort", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.InitiatorMultiPort == nil {
+				m.InitiatorMultiPort = &MultiPortDetails{}
+			}
+			if err := m.InitiatorMultiPort.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 7:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ResponderMultiPort", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.ResponderMultiPort == nil {
+				m.ResponderMultiPort = &MultiPortDetails{}
+			}
+			if err := m.ResponderMultiPort.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 8:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field KemKey", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.KemKey = append(m.KemKey[:0], dAtA[iNdEx:postIndex]...)
+			if m.KemKey == nil {
+				m.KemKey = []byte{}
+			}
+			iNdEx = postIndex
+		case 9:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field KemCiphertext", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.KemCiphertext = append(m.KemCiphertext[:0], dAtA[iNdEx:postIndex]...)
+			if m.KemCiphertext == nil {
+				m.KemCiphertext = []byte{}
+			}
+			iNdEx = postIndex
+		case 10:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Ciphers", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Ciphers = append(m.Ciphers, string(dAtA[iNdEx:postIndex]))
+			iNdEx = postIndex
+		case 11:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Cipher", wireType)
+			}
+			var stringLen uint64
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -1826,11 +3295,24 @@ func (m *NebulaPing) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.Time |= uint64(b&0x7F) << shift
+				stringLen |= uint64(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Cipher = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipNebula(dAtA[iNdEx:])
@@ -1852,7 +3334,7 @@ func (m *NebulaPing) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
-func (m *NebulaHandshake) Unmarshal(dAtA []byte) error {
+func (m *MultiPortDetails) Unmarshal(dAtA []byte) error {
 	l := len(dAtA)
 	iNdEx := 0
 	for iNdEx < l {
@@ -1875,17 +3357,17 @@ func (m *NebulaHandshake) Unmarshal(dAtA []byte) error {
 		fieldNum := int32(wire >> 3)
 		wireType := int(wire & 0x7)
 		if wireType == 4 {
-			return fmt.Errorf("proto: NebulaHandshake: wiretype end group for non-group")
+			return fmt.Errorf("proto: MultiPortDetails: wiretype end group for non-group")
 		}
 		if fieldNum <= 0 {
-			return fmt.Errorf("proto: NebulaHandshake: illegal tag %d (wire type %d)", fieldNum, wire)
+			return fmt.Errorf("proto: MultiPortDetails: illegal tag %d (wire type %d)", fieldNum, wire)
 		}
 		switch fieldNum {
 		case 1:
-			if wireType != 2 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Details", wireType)
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field BasePort", wireType)
 			}
-			var msglen int
+			m.BasePort = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -1895,33 +3377,16 @@ func (m *NebulaHandshake) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				msglen |= int(b&0x7F) << shift
+				m.BasePort |= uint32(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
-			if msglen < 0 {
-				return ErrInvalidLengthNebula
-			}
-			postIndex := iNdEx + msglen
-			if postIndex < 0 {
-				return ErrInvalidLengthNebula
-			}
-			if postIndex > l {
-				return io.ErrUnexpectedEOF
-			}
-			if m.Details == nil {
-				m.Details = &NebulaHandshakeDetails{}
-			}
-			if err := m.Details.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
-				return err
-			}
-			iNdEx = postIndex
 		case 2:
-			if wireType != 2 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Hmac", wireType)
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field TotalPorts", wireType)
 			}
-			var byteLen int
+			m.TotalPorts = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -1931,26 +3396,11 @@ func (m *NebulaHandshake) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				byteLen |= int(b&0x7F) << shift
+				m.TotalPorts |= uint32(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
-			if byteLen < 0 {
-				return ErrInvalidLengthNebula
-			}
-			postIndex := iNdEx + byteLen
-			if postIndex < 0 {
-				return ErrInvalidLengthNebula
-			}
-			if postIndex > l {
-				return io.ErrUnexpectedEOF
-			}
-			m.Hmac = append(m.Hmac[:0], dAtA[iNdEx:postIndex]...)
-			if m.Hmac == nil {
-				m.Hmac = []byte{}
-			}
-			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipNebula(dAtA[iNdEx:])
@@ -1972,7 +3422,7 @@ func (m *NebulaHandshake) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
-func (m *NebulaHandshakeDetails) Unmarshal(dAtA []byte) error {
+func (m *NebulaControl) Unmarshal(dAtA []byte) error {
 	l := len(dAtA)
 	iNdEx := 0
 	for iNdEx < l {
@@ -1995,17 +3445,17 @@ func (m *NebulaHandshakeDetails) Unmarshal(dAtA []byte) error {
 		fieldNum := int32(wire >> 3)
 		wireType := int(wire & 0x7)
 		if wireType == 4 {
-			return fmt.Errorf("proto: NebulaHandshakeDetails: wiretype end group for non-group")
+			return fmt.Errorf("proto: NebulaControl: wiretype end group for non-group")
 		}
 		if fieldNum <= 0 {
-			return fmt.Errorf("proto: NebulaHandshakeDetails: illegal tag %d (wire type %d)", fieldNum, wire)
+			return fmt.Errorf("proto: NebulaControl: illegal tag %d (wire type %d)", fieldNum, wire)
 		}
 		switch fieldNum {
 		case 1:
-			if wireType != 2 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Cert", wireType)
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Type", wireType)
 			}
-			var byteLen int
+			m.Type = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -2015,31 +3465,16 @@ func (m *NebulaHandshakeDetails) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				byteLen |= int(b&0x7F) << shift
+				m.Type |= NebulaControl_MessageType(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
-			if byteLen < 0 {
-				return ErrInvalidLengthNebula
-			}
-			postIndex := iNdEx + byteLen
-			if postIndex < 0 {
-				return ErrInvalidLengthNebula
-			}
-			if postIndex > l {
-				return io.ErrUnexpectedEOF
-			}
-			m.Cert = append(m.Cert[:0], dAtA[iNdEx:postIndex]...)
-			if m.Cert == nil {
-				m.Cert = []byte{}
-			}
-			iNdEx = postIndex
 		case 2:
 			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field InitiatorIndex", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field InitiatorRelayIndex", wireType)
 			}
-			m.InitiatorIndex = 0
+			m.InitiatorRelayIndex = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -2049,16 +3484,16 @@ func (m *NebulaHandshakeDetails) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.InitiatorIndex |= uint32(b&0x7F) << shift
+				m.InitiatorRelayIndex |= uint32(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
 		case 3:
 			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field ResponderIndex", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field ResponderRelayIndex", wireType)
 			}
-			m.ResponderIndex = 0
+			m.ResponderRelayIndex = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -2068,16 +3503,16 @@ func (m *NebulaHandshakeDetails) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.ResponderIndex |= uint32(b&0x7F) << shift
+				m.ResponderRelayIndex |= uint32(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
 		case 4:
 			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Cookie", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field RelayToIp", wireType)
 			}
-			m.Cookie = 0
+			m.RelayToIp = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -2087,16 +3522,16 @@ func (m *NebulaHandshakeDetails) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.Cookie |= uint64(b&0x7F) << shift
+				m.RelayToIp |= uint32(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
 		case 5:
 			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Time", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field RelayFromIp", wireType)
 			}
-			m.Time = 0
+			m.RelayFromIp = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -2106,7 +3541,134 @@ func (m *NebulaHandshakeDetails) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.Time |= uint64(b&0x7F) << shift
+				m.RelayFromIp |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Reason", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Reason = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 7:
+			if wireType == 0 {
+				var v uint32
+				for shift := uint(0); ; shift += 7 {
+					if shift >= 64 {
+						return ErrIntOverflowNebula
+					}
+					if iNdEx >= l {
+						return io.ErrUnexpectedEOF
+					}
+					b := dAtA[iNdEx]
+					iNdEx++
+					v |= uint32(b&0x7F) << shift
+					if b < 0x80 {
+						break
+					}
+				}
+				m.RelayPath = append(m.RelayPath, v)
+			} else if wireType == 2 {
+				var packedLen int
+				for shift := uint(0); ; shift += 7 {
+					if shift >= 64 {
+						return ErrIntOverflowNebula
+					}
+					if iNdEx >= l {
+						return io.ErrUnexpectedEOF
+					}
+					b := dAtA[iNdEx]
+					iNdEx++
+					packedLen |= int(b&0x7F) << shift
+					if b < 0x80 {
+						break
+					}
+				}
+				if packedLen < 0 {
+					return ErrInvalidLengthNebula
+				}
+				postIndex := iNdEx + packedLen
+				if postIndex < 0 {
+					return ErrInvalidLengthNebula
+				}
+				if postIndex > l {
+					return io.ErrUnexpectedEOF
+				}
+				var elementCount int
+				var count int
+				for _, integer := range dAtA[iNdEx:postIndex] {
+					if integer < 128 {
+						count++
+					}
+				}
+				elementCount = count
+				if elementCount != 0 && len(m.RelayPath) == 0 {
+					m.RelayPath = make([]uint32, 0, elementCount)
+				}
+				for iNdEx < postIndex {
+					var v uint32
+					for shift := uint(0); ; shift += 7 {
+						if shift >= 64 {
+							return ErrIntOverflowNebula
+						}
+						if iNdEx >= l {
+							return io.ErrUnexpectedEOF
+						}
+						b := dAtA[iNdEx]
+						iNdEx++
+						v |= uint32(b&0x7F) << shift
+						if b < 0x80 {
+							break
+						}
+					}
+					m.RelayPath = append(m.RelayPath, v)
+				}
+			} else {
+				return fmt.Errorf("proto: wrong wireType = %d for field RelayPath", wireType)
+			}
+		case 8:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field HopLimit", wireType)
+			}
+			m.HopLimit = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.HopLimit |= uint32(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
@@ -2132,7 +3694,7 @@ func (m *NebulaHandshakeDetails) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
-func (m *NebulaControl) Unmarshal(dAtA []byte) error {
+func (m *UnsafeRoute) Unmarshal(dAtA []byte) error {
 	l := len(dAtA)
 	iNdEx := 0
 	for iNdEx < l {
@@ -2155,17 +3717,17 @@ func (m *NebulaControl) Unmarshal(dAtA []byte) error {
 		fieldNum := int32(wire >> 3)
 		wireType := int(wire & 0x7)
 		if wireType == 4 {
-			return fmt.Errorf("proto: NebulaControl: wiretype end group for non-group")
+			return fmt.Errorf("proto: UnsafeRoute: wiretype end group for non-group")
 		}
 		if fieldNum <= 0 {
-			return fmt.Errorf("proto: NebulaControl: illegal tag %d (wire type %d)", fieldNum, wire)
+			return fmt.Errorf("proto: UnsafeRoute: illegal tag %d (wire type %d)", fieldNum, wire)
 		}
 		switch fieldNum {
 		case 1:
 			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Type", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field Ip", wireType)
 			}
-			m.Type = 0
+			m.Ip = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -2175,16 +3737,16 @@ func (m *NebulaControl) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.Type |= NebulaControl_MessageType(b&0x7F) << shift
+				m.Ip |= uint32(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
 		case 2:
 			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field InitiatorRelayIndex", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field Bits", wireType)
 			}
-			m.InitiatorRelayIndex = 0
+			m.Bits = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -2194,16 +3756,16 @@ func (m *NebulaControl) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.InitiatorRelayIndex |= uint32(b&0x7F) << shift
+				m.Bits |= uint32(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
 		case 3:
 			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field ResponderRelayIndex", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field Priority", wireType)
 			}
-			m.ResponderRelayIndex = 0
+			m.Priority = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -2213,35 +3775,16 @@ func (m *NebulaControl) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.ResponderRelayIndex |= uint32(b&0x7F) << shift
+				m.Priority |= uint32(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
 		case 4:
 			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field RelayToIp", wireType)
-			}
-			m.RelayToIp = 0
-			for shift := uint(0); ; shift += 7 {
-				if shift >= 64 {
-					return ErrIntOverflowNebula
-				}
-				if iNdEx >= l {
-					return io.ErrUnexpectedEOF
-				}
-				b := dAtA[iNdEx]
-				iNdEx++
-				m.RelayToIp |= uint32(b&0x7F) << shift
-				if b < 0x80 {
-					break
-				}
-			}
-		case 5:
-			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field RelayFromIp", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field Via", wireType)
 			}
-			m.RelayFromIp = 0
+			m.Via = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -2251,7 +3794,7 @@ func (m *NebulaControl) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.RelayFromIp |= uint32(b&0x7F) << shift
+				m.Via |= uint32(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
@@ -8,10 +8,12 @@ import (
 	"time"
 
 	"github.com/flynn/noise"
+	"github.com/rcrowley/go-metrics"
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/cert"
 	"github.com/slackhq/nebula/firewall"
 	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/overlay"
 	"github.com/slackhq/nebula/udp"
 	"golang.org/x/net/ipv4"
 )
@@ -21,7 +23,9 @@ const (
 )
 
 // TODO: IPV6-WORK this can likely be removed now
-func readOutsidePackets(f *Interface) udp.EncReader {
+// readOutsidePackets builds the EncReader for one outside routine, packets for the tun device are added to tunBatch and
+// left for the caller to flush
+func readOutsidePackets(f *Interface, tunBatch *overlay.Coalescer) udp.EncReader {
 	return func(
 		addr netip.AddrPort,
 		out []byte,
@@ -33,11 +37,11 @@ func readOutsidePackets(f *Interface) udp.EncReader {
 		q int,
 		localCache firewall.ConntrackCache,
 	) {
-		f.readOutsidePackets(addr, nil, out, packet, header, fwPacket, lhh, nb, q, localCache)
+		f.readOutsidePackets(addr, nil, out, packet, header, fwPacket, lhh, nb, q, localCache, tunBatch)
 	}
 }
 
-func (f *Interface) readOutsidePackets(ip netip.AddrPort, via *ViaSender, out []byte, packet []byte, h *header.H, fwPacket *firewall.Packet, lhf udp.LightHouseHandlerFunc, nb []byte, q int, localCache firewall.ConntrackCache) {
+func (f *Interface) readOutsidePackets(ip netip.AddrPort, via *ViaSender, out []byte, packet []byte, h *header.H, fwPacket *firewall.Packet, lhf udp.LightHouseHandlerFunc, nb []byte, q int, localCache firewall.ConntrackCache, tunBatch *overlay.Coalescer) {
 	err := h.Parse(packet)
 	if err != nil {
 		// TODO: best if we return this and let caller log
@@ -81,7 +85,11 @@ func (f *Interface) readOutsidePackets(ip netip.AddrPort, via *ViaSender, out []
 
 		switch h.Subtype {
 		case header.MessageNone:
-			if !f.decryptToTun(hostinfo, h.MessageCounter, out, packet, fwPacket, nb, q, localCache) {
+			if !f.decryptToTun(hostinfo, h.MessageCounter, out, packet, fwPacket, nb, q, localCache, tunBatch) {
+				return
+			}
+		case header.MessageEthernet:
+			if !f.decryptToTap(hostinfo, h.MessageCounter, out, packet, fwPacket, nb, localCache, tunBatch) {
 				return
 			}
 		case header.MessageRelay:
@@ -116,13 +124,19 @@ func (f *Interface) readOutsidePackets(ip netip.AddrPort, via *ViaSender, out []
 			case TerminalType:
 				// If I am the target of this relay, process the unwrapped packet
 				// From this recursive point, all these variables are 'burned'. We shouldn't rely on them again.
-				f.readOutsidePackets(netip.AddrPort{}, &ViaSender{relayHI: hostinfo, remoteIdx: relay.RemoteIndex, relay: relay}, out[:0], signedPayload, h, fwPacket, lhf, nb, q, localCache)
+				f.readOutsidePackets(netip.AddrPort{}, &ViaSender{relayHI: hostinfo, remoteIdx: relay.RemoteIndex, relay: relay}, out[:0], signedPayload, h, fwPacket, lhf, nb, q, localCache, tunBatch)
 				return
 			case ForwardingType:
-				// Find the target HostInfo relay object
-				targetHI, targetRelay, err := f.hostMap.QueryVpnIpRelayFor(hostinfo.vpnIp, relay.PeerIp)
+				relayFrom := relay.forwardFrom(hostinfo.vpnIp)
+				if !f.relayManager.allowForward(relayFrom, relay.PeerIp, len(signedPayload)) {
+					// Over the relay.limits rate limits
+					return
+				}
+
+				// Find the target HostInfo relay object, this is the next relay if we are in the middle of a chain
+				targetHI, targetRelay, err := f.hostMap.QueryVpnIpRelayFor(relayFrom, relay.forwardTo())
 				if err != nil {
-					hostinfo.logger(f.l).WithField("relayTo", relay.PeerIp).WithError(err).Info("Failed to find target host info by ip")
+					hostinfo.logger(f.l).WithField("relayTo", relay.forwardTo()).WithError(err).Info("Failed to find target host info by ip")
 					return
 				}
 
@@ -186,7 +200,11 @@ func (f *Interface) readOutsidePackets(ip netip.AddrPort, via *ViaSender, out []
 			// This testRequest might be from TryPromoteBest, so we should roam
 			// to the new IP address before responding
 			f.handleHostRoaming(hostinfo, ip)
-			f.send(header.Test, header.TestReply, ci, hostinfo, d, nb, out)
+			f.send(header.Test, header.TestReply, ci, hostinfo, pathMTUTestReply(d), nb, out)
+		} else if h.Subtype == header.TestReply {
+			if !f.relayManager.health.handleTestReply(hostinfo.vpnIp, d, time.Now()) {
+				f.pmtu.handleTestReply(hostinfo, d)
+			}
 		}
 
 		// Fallthrough to the bottom to record incoming traffic
@@ -254,6 +272,9 @@ func (f *Interface) closeTunnel(hostInfo *HostInfo) {
 	if final {
 		// We no longer have any tunnels with this vpn ip, clear learned lighthouse state to lower memory usage
 		f.lightHouse.DeleteVpnIp(hostInfo.vpnIp)
+		if f.routeLearner != nil {
+			f.routeLearner.gatewayFailed(hostInfo.vpnIp)
+		}
 	}
 }
 
@@ -264,6 +285,11 @@ func (f *Interface) sendCloseTunnel(h *HostInfo) {
 
 func (f *Interface) handleHostRoaming(hostinfo *HostInfo, ip netip.AddrPort) {
 	if ip.IsValid() && hostinfo.remote != ip {
+		if hostinfo.ConnectionState != nil && hostinfo.ConnectionState.multiport.owns(hostinfo.remote, ip) {
+			// The remote is spreading packets across its multiport listeners, this is not a roam
+			return
+		}
+
 		if !f.lightHouse.GetRemoteAllowList().Allow(hostinfo.vpnIp, ip.Addr()) {
 			hostinfo.logger(f.l).WithField("newAddr", ip).Debug("lighthouse.remote_allow_list denied roaming")
 			return
@@ -276,8 +302,13 @@ func (f *Interface) handleHostRoaming(hostinfo *HostInfo, ip netip.AddrPort) {
 			return
 		}
 
-		hostinfo.logger(f.l).WithField("udpAddr", hostinfo.remote).WithField("newAddr", ip).
-			Info("Host roamed to new udp ip/port.")
+		if !hostinfo.remote.IsValid() {
+			metrics.GetOrRegisterCounter("relay.upgrade.succeeded", nil).Inc(1)
+			hostinfo.logger(f.l).WithField("newAddr", ip).Info("Relayed tunnel moved to a direct path")
+		} else {
+			hostinfo.logger(f.l).WithField("udpAddr", hostinfo.remote).WithField("newAddr", ip).
+				Info("Host roamed to new udp ip/port.")
+		}
 		hostinfo.lastRoam = time.Now()
 		hostinfo.lastRoamRemote = hostinfo.remote
 		hostinfo.SetRemote(ip)
@@ -380,7 +411,7 @@ func (f *Interface) decrypt(hostinfo *HostInfo, mc uint64, out []byte, packet []
 	return out, nil
 }
 
-func (f *Interface) decryptToTun(hostinfo *HostInfo, messageCounter uint64, out []byte, packet []byte, fwPacket *firewall.Packet, nb []byte, q int, localCache firewall.ConntrackCache) bool {
+func (f *Interface) decryptToTun(hostinfo *HostInfo, messageCounter uint64, out []byte, packet []byte, fwPacket *firewall.Packet, nb []byte, q int, localCache firewall.ConntrackCache, tunBatch *overlay.Coalescer) bool {
 	var err error
 
 	out, err = hostinfo.ConnectionState.dKey.DecryptDanger(out, packet[:header.Len], packet[header.Len:], messageCounter, nb)
@@ -404,7 +435,12 @@ func (f *Interface) decryptToTun(hostinfo *HostInfo, messageCounter uint64, out
 		return false
 	}
 
-	dropReason := f.firewall.Drop(*fwPacket, true, hostinfo, f.pki.GetCAPool(), localCache)
+	var dropReason error
+	if fo := f.fanout.Load(); fo != nil && f.isFanoutAddr(fwPacket.LocalIP) && fo.allowCert(hostinfo.GetCert()) {
+		dropReason = f.firewall.DropFanout(*fwPacket, true, hostinfo, f.pki.GetCAPool(), localCache)
+	} else {
+		dropReason = f.firewall.Drop(*fwPacket, true, hostinfo, f.pki.GetCAPool(), localCache)
+	}
 	if dropReason != nil {
 		// NOTE: We give `packet` as the `out` here since we already decrypted from it and we don't need it anymore
 		// This gives us a buffer to build the reject packet in
@@ -418,7 +454,12 @@ func (f *Interface) decryptToTun(hostinfo *HostInfo, messageCounter uint64, out
 	}
 
 	f.connectionManager.In(hostinfo.localIndexId)
-	_, err = f.readers[q].Write(out)
+	if f.snat != nil && f.snat.contains(fwPacket.LocalIP) {
+		f.snat.inject(out, fwPacket)
+		return true
+	}
+
+	err = tunBatch.Write(out)
 	if err != nil {
 		f.l.WithError(err).Error("Failed to write to tun")
 	}
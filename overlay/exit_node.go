@@ -0,0 +1,179 @@
+package overlay
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+const (
+	// defaultExitNodeTable is the routing table that holds the default route to the tun device
+	defaultExitNodeTable = 4242
+	// defaultExitNodePriority is where the exit node policy rules start, just ahead of the main table rule
+	defaultExitNodePriority = 32000
+)
+
+// defaultRoute is the route nebula sends everything else to the exit node with
+var defaultRoute = netip.PrefixFrom(netip.IPv4Unspecified(), 0)
+
+// exitNode is the client side of tun.exit_node. Internet traffic goes to Via while policy routing keeps nebula's own
+// underlay packets, which carry listen.so_mark, and the excluded networks on the main table.
+type exitNode struct {
+	// Via is the vpn ip of the exit node
+	Via netip.Addr
+	// Table is the routing table the default route to the tun device is installed in
+	Table int
+	// Priority is the first of the three rule priorities in use
+	Priority int
+	// Mark is listen.so_mark
+	Mark int
+	// Exclude is always routed through the main table, static_host_map addresses are added when resolved
+	Exclude []netip.Prefix
+}
+
+// ServesExitNode is true when this host forwards and masquerades internet traffic for other hosts
+func ServesExitNode(c *config.C) bool {
+	return c.GetBool("tun.exit_node.serve", false)
+}
+
+// usesExitNode is true when either side of tun.exit_node is configured
+func usesExitNode(c *config.C) bool {
+	return ServesExitNode(c) || c.GetString("tun.exit_node.via", "") != ""
+}
+
+// exitNodeChanged is true when anything the installed exit node routing depends on has changed
+func exitNodeChanged(c *config.C) bool {
+	return c.HasChanged("tun.exit_node") || c.HasChanged("static_host_map")
+}
+
+// parseExitNode returns nil if tun.exit_node.via is not set
+func parseExitNode(c *config.C, network netip.Prefix) (*exitNode, error) {
+	rVia := c.GetString("tun.exit_node.via", "")
+	if rVia == "" {
+		return nil, nil
+	}
+
+	if ServesExitNode(c) {
+		return nil, fmt.Errorf("tun.exit_node.serve and tun.exit_node.via can not both be set")
+	}
+
+	via, err := netip.ParseAddr(rVia)
+	if err != nil {
+		return nil, fmt.Errorf("tun.exit_node.via failed to parse address: %v", err)
+	}
+
+	if !network.Contains(via) || via == network.Addr() {
+		return nil, fmt.Errorf("tun.exit_node.via must be another host in the network attached to the certificate; via: %v, network: %v", via, network)
+	}
+
+	e := &exitNode{
+		Via:      via,
+		Table:    c.GetInt("tun.exit_node.table", defaultExitNodeTable),
+		Priority: c.GetInt("tun.exit_node.priority", defaultExitNodePriority),
+		Mark:     c.GetInt("listen.so_mark", 0),
+	}
+
+	// 253 to 255 are the default, main and local tables
+	if e.Table < 1 || (e.Table >= 253 && e.Table <= 255) {
+		return nil, fmt.Errorf("tun.exit_node.table must be a table other than default, main or local: %v", e.Table)
+	}
+
+	// The rules need room before the main table rule at 32766
+	if e.Priority < 1 || e.Priority > 32763 {
+		return nil, fmt.Errorf("tun.exit_node.priority is not in range (1-32763): %v", e.Priority)
+	}
+
+	if e.Mark <= 0 {
+		return nil, fmt.Errorf("tun.exit_node.via requires listen.so_mark so nebula's own packets skip the exit node")
+	}
+
+	for i, v := range c.GetStringSlice("tun.exit_node.exclude", nil) {
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("entry %v in tun.exit_node.exclude failed to parse: %v", i+1, err)
+		}
+
+		if !p.Addr().Is4() {
+			return nil, fmt.Errorf("entry %v in tun.exit_node.exclude is not an ipv4 network: %v", i+1, p)
+		}
+
+		e.Exclude = append(e.Exclude, p.Masked())
+	}
+
+	return e, nil
+}
+
+// route sends everything nebula has no more specific route for to the exit node. It is never installed in the main
+// table, that would take the underlay with it.
+func (e *exitNode) route() Route {
+	return Route{Cidr: defaultRoute, Via: e.Via}
+}
+
+// excludes returns tun.exit_node.exclude and the ipv4 addresses of every static_host_map entry, those are the
+// lighthouses and relays a host needs to reach before it can talk to the exit node at all. Hostnames that fail to
+// resolve are logged and skipped.
+func (e *exitNode) excludes(c *config.C, l *logrus.Logger) []netip.Prefix {
+	excludes := append([]netip.Prefix{}, e.Exclude...)
+	timeout := c.GetDuration("static_map.lookup_timeout", 250*time.Millisecond)
+
+	for k, v := range c.GetMap("static_host_map", map[interface{}]interface{}{}) {
+		vals, ok := v.([]interface{})
+		if !ok {
+			vals = []interface{}{v}
+		}
+
+		for _, v := range vals {
+			entry := fmt.Sprintf("%v", v)
+			host, err := staticHostMapHost(entry)
+			if err == nil {
+				var addrs []netip.Addr
+				addrs, err = lookupIPv4(host, timeout)
+				for _, addr := range addrs {
+					excludes = append(excludes, netip.PrefixFrom(addr, 32))
+				}
+			}
+
+			if err != nil {
+				l.WithField("vpnIp", k).WithField("entry", entry).WithError(err).
+					Warn("Unable to exclude static_host_map entry from tun.exit_node")
+			}
+		}
+	}
+
+	return excludes
+}
+
+// staticHostMapHost pulls the host out of a udp, tcp:// or websocket static_host_map entry
+func staticHostMapHost(entry string) (string, error) {
+	if strings.HasPrefix(entry, "ws://") || strings.HasPrefix(entry, "wss://") {
+		u, err := url.Parse(entry)
+		if err != nil {
+			return "", err
+		}
+		return u.Hostname(), nil
+	}
+
+	host, _, err := net.SplitHostPort(strings.TrimPrefix(entry, "tcp://"))
+	return host, err
+}
+
+func lookupIPv4(host string, timeout time.Duration) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if !addr.Unmap().Is4() {
+			// The exit node only carries ipv4, ipv6 underlay traffic is left alone
+			return nil, nil
+		}
+		return []netip.Addr{addr.Unmap()}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return net.DefaultResolver.LookupNetIP(ctx, "ip4", host)
+}
@@ -0,0 +1,170 @@
+//go:build !android && !e2e_testing
+// +build !android,!e2e_testing
+
+package overlay
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const ipForwardPath = "/proc/sys/net/ipv4/ip_forward"
+
+// reloadExitNode picks up tun.exit_node, on the initial load Activate installs it once the device is up
+func (t *tun) reloadExitNode(c *config.C, initial bool) error {
+	if !initial && !exitNodeChanged(c) && !c.HasChanged("tun.mtu") {
+		return nil
+	}
+
+	e, err := parseExitNode(c, t.cidr)
+	if err != nil {
+		return err
+	}
+
+	var rules []*netlink.Rule
+	if e != nil {
+		rules = exitNodeRules(e, e.excludes(c, t.l))
+	}
+
+	if initial {
+		t.exitNode, t.exitRules, t.servesExitNode = e, rules, ServesExitNode(c)
+		return nil
+	}
+
+	// Serving needs 0.0.0.0/0 in the certificate unsafe networks, which is only checked at startup
+	if ServesExitNode(c) && !t.servesExitNode {
+		return fmt.Errorf("tun.exit_node.serve can not be turned on by a reload, restart nebula to serve as an exit node")
+	}
+
+	t.removeExitNode()
+	t.exitNode, t.exitRules = e, rules
+	if err = t.addExitNode(); err != nil {
+		return err
+	}
+
+	if t.servesExitNode && !ServesExitNode(c) {
+		t.servesExitNode = false
+		t.stopServingExitNode()
+	}
+
+	return nil
+}
+
+// exitNodeRules builds the policy rules that send everything to the exit node table except nebula's own marked
+// packets, the excluded networks and anything the main table has a more specific route for than its default route
+func exitNodeRules(e *exitNode, excludes []netip.Prefix) []*netlink.Rule {
+	var rules []*netlink.Rule
+	for _, p := range excludes {
+		r := netlink.NewRule()
+		r.Family = unix.AF_INET
+		r.Priority = e.Priority
+		r.Table = unix.RT_TABLE_MAIN
+		r.Dst = &net.IPNet{IP: p.Addr().AsSlice(), Mask: net.CIDRMask(p.Bits(), 32)}
+		rules = append(rules, r)
+	}
+
+	r := netlink.NewRule()
+	r.Family = unix.AF_INET
+	r.Priority = e.Priority + 1
+	r.Table = unix.RT_TABLE_MAIN
+	r.SuppressPrefixlen = 0
+	rules = append(rules, r)
+
+	r = netlink.NewRule()
+	r.Family = unix.AF_INET
+	r.Priority = e.Priority + 2
+	r.Table = e.Table
+	r.Mark = uint32(e.Mark)
+	r.Invert = true
+	rules = append(rules, r)
+
+	return rules
+}
+
+// addExitNode installs the default route in the exit node table and then the rules that lead to it
+func (t *tun) addExitNode() error {
+	if t.exitNode == nil {
+		return nil
+	}
+
+	nr := t.exitNodeRoute()
+	if err := netlink.RouteReplace(&nr); err != nil {
+		return fmt.Errorf("failed to add the exit node route to table %v: %w", t.exitNode.Table, err)
+	}
+
+	for _, r := range t.exitRules {
+		if err := netlink.RuleAdd(r); err != nil && !errors.Is(err, unix.EEXIST) {
+			return fmt.Errorf("failed to add exit node rule %v: %w", r, err)
+		}
+	}
+
+	t.l.WithField("via", t.exitNode.Via).WithField("table", t.exitNode.Table).WithField("rules", len(t.exitRules)).
+		Info("Routing all traffic through the exit node")
+	return nil
+}
+
+// removeExitNode undoes addExitNode, failures are logged since the device is usually on its way out
+func (t *tun) removeExitNode() {
+	if t.exitNode == nil {
+		return
+	}
+
+	for _, r := range t.exitRules {
+		if err := netlink.RuleDel(r); err != nil {
+			t.l.WithError(err).WithField("rule", r).Error("Failed to remove exit node rule")
+		}
+	}
+
+	nr := t.exitNodeRoute()
+	if err := netlink.RouteDel(&nr); err != nil {
+		t.l.WithError(err).WithField("table", t.exitNode.Table).Error("Failed to remove the exit node route")
+	}
+}
+
+func (t *tun) exitNodeRoute() netlink.Route {
+	return netlink.Route{
+		LinkIndex: t.deviceIndex,
+		Dst:       &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+		MTU:       t.DefaultMTU,
+		AdvMSS:    t.advMSS(Route{}),
+		Scope:     unix.RT_SCOPE_LINK,
+		Src:       net.IP(t.cidr.Addr().AsSlice()),
+		Table:     t.exitNode.Table,
+		Type:      unix.RTN_UNICAST,
+	}
+}
+
+// serveExitNode turns on ip forwarding and masquerades traffic from the vpn network that leaves through any other
+// interface behind that interface's address
+func (t *tun) serveExitNode() error {
+	if err := os.WriteFile(ipForwardPath, []byte("1"), 0644); err != nil {
+		return fmt.Errorf("failed to enable ip forwarding: %w", err)
+	}
+
+	if err := addMasquerade(t.masqueradeTable(), t.cidr.Masked(), t.Device); err != nil {
+		return fmt.Errorf("failed to add the exit node masquerade rule: %w", err)
+	}
+
+	t.l.WithField("table", t.masqueradeTable()).Info("Serving as an exit node")
+	return nil
+}
+
+// stopServingExitNode removes the masquerade rule, ip forwarding is left on since other things may depend on it
+func (t *tun) stopServingExitNode() {
+	if err := deleteNftTable(t.masqueradeTable()); err != nil {
+		t.l.WithError(err).WithField("table", t.masqueradeTable()).Error("Failed to remove the exit node masquerade rule")
+	}
+}
+
+// masqueradeTable is the nftables table that holds the masquerade rule, named after the device so several nebula
+// instances can serve at once
+func (t *tun) masqueradeTable() string {
+	return "nebula-" + t.Device
+}
@@ -0,0 +1,202 @@
+//go:build !e2e_testing
+// +build !e2e_testing
+
+package overlay
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// inNetns runs f in a new network namespace, the test is skipped when we can not make one
+func inNetns(t *testing.T, f func(ns netns.NsHandle)) {
+	if os.Getuid() != 0 {
+		t.Skip("network namespaces need root")
+	}
+
+	runtime.LockOSThread()
+	orig, err := netns.Get()
+	require.NoError(t, err)
+	defer orig.Close()
+
+	ns, err := netns.New()
+	if err != nil {
+		runtime.UnlockOSThread()
+		t.Skipf("could not create a network namespace: %v", err)
+	}
+	defer ns.Close()
+
+	defer func() {
+		// A thread stuck in the namespace is thrown away with the test goroutine
+		if netns.Set(orig) == nil {
+			runtime.UnlockOSThread()
+		}
+	}()
+
+	f(ns)
+}
+
+func TestExitNodeRules(t *testing.T) {
+	e := &exitNode{Priority: 100, Table: 4242, Mark: 7}
+	rules := exitNodeRules(e, []netip.Prefix{netip.MustParsePrefix("1.1.1.1/32")})
+	require.Len(t, rules, 3)
+
+	assert.Equal(t, 100, rules[0].Priority)
+	assert.Equal(t, unix.RT_TABLE_MAIN, rules[0].Table)
+	assert.Equal(t, "1.1.1.1/32", rules[0].Dst.String())
+
+	assert.Equal(t, 101, rules[1].Priority)
+	assert.Equal(t, unix.RT_TABLE_MAIN, rules[1].Table)
+	assert.Equal(t, 0, rules[1].SuppressPrefixlen)
+
+	assert.Equal(t, 102, rules[2].Priority)
+	assert.Equal(t, 4242, rules[2].Table)
+	assert.Equal(t, uint32(7), rules[2].Mark)
+	assert.True(t, rules[2].Invert)
+}
+
+func TestTun_exitNode(t *testing.T) {
+	inNetns(t, func(_ netns.NsHandle) {
+		// The underlay is a lan with a default route out of it
+		require.NoError(t, netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "underlay0"}, PeerName: "underlay1"}))
+		underlay, err := netlink.LinkByName("underlay0")
+		require.NoError(t, err)
+		require.NoError(t, netlink.AddrAdd(underlay, &netlink.Addr{IPNet: &net.IPNet{IP: net.IPv4(192, 0, 2, 1), Mask: net.CIDRMask(24, 32)}}))
+		require.NoError(t, netlink.LinkSetUp(underlay))
+		require.NoError(t, netlink.RouteAdd(&netlink.Route{Gw: net.IPv4(192, 0, 2, 254)}))
+
+		l := test.NewLogger()
+		c := config.NewC(l)
+		c.Settings["tun"] = map[interface{}]interface{}{
+			"dev":       "nebula-exit",
+			"exit_node": map[interface{}]interface{}{"via": "10.128.0.1", "exclude": []interface{}{"192.168.0.0/16"}},
+		}
+		c.Settings["listen"] = map[interface{}]interface{}{"so_mark": 7}
+		c.Settings["static_host_map"] = map[interface{}]interface{}{"10.128.0.1": []interface{}{"198.51.100.1:4242"}}
+
+		tn, err := newTun(c, l, netip.MustParsePrefix("10.128.0.2/24"), false)
+		require.NoError(t, err)
+		require.NoError(t, tn.Activate())
+		assert.Equal(t, netip.MustParseAddr("10.128.0.1"), tn.RouteFor(netip.MustParseAddr("8.8.8.8")))
+
+		routes, err := netlink.RouteListFiltered(unix.AF_INET, &netlink.Route{Table: defaultExitNodeTable}, netlink.RT_FILTER_TABLE)
+		require.NoError(t, err)
+		require.Len(t, routes, 1)
+		assert.Equal(t, tn.deviceIndex, routes[0].LinkIndex)
+
+		linkFor := func(dst string, mark uint32) int {
+			r, err := netlink.RouteGetWithOptions(net.ParseIP(dst), &netlink.RouteGetOptions{Mark: mark})
+			require.NoError(t, err)
+			require.Len(t, r, 1)
+			return r[0].LinkIndex
+		}
+
+		// Internet traffic goes to the tun device. Nebula's own marked packets, the lan, the excluded networks and the
+		// static_host_map addresses use the underlay.
+		assert.Equal(t, tn.deviceIndex, linkFor("8.8.8.8", 0))
+		assert.Equal(t, tn.deviceIndex, linkFor("10.128.0.1", 0))
+		assert.Equal(t, underlay.Attrs().Index, linkFor("8.8.8.8", 7))
+		assert.Equal(t, underlay.Attrs().Index, linkFor("192.0.2.100", 0))
+		assert.Equal(t, underlay.Attrs().Index, linkFor("192.168.1.1", 0))
+		assert.Equal(t, underlay.Attrs().Index, linkFor("198.51.100.1", 0))
+
+		// Only the local, main and default rules are left behind
+		require.NoError(t, tn.Close())
+		rules, err := netlink.RuleList(unix.AF_INET)
+		require.NoError(t, err)
+		assert.Len(t, rules, 3)
+	})
+}
+
+func TestTun_serveExitNode(t *testing.T) {
+	inNetns(t, func(exit netns.NsHandle) {
+		// The internet is a veth peer in a namespace of its own
+		internet, err := netns.New()
+		require.NoError(t, err)
+		defer internet.Close()
+
+		lo, err := netlink.LinkByName("lo")
+		require.NoError(t, err)
+		require.NoError(t, netlink.LinkSetUp(lo))
+		require.NoError(t, netns.Set(exit))
+
+		require.NoError(t, netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "exit0"}, PeerName: "internet0"}))
+		peer, err := netlink.LinkByName("internet0")
+		require.NoError(t, err)
+		require.NoError(t, netlink.LinkSetNsFd(peer, int(internet)))
+
+		link, err := netlink.LinkByName("exit0")
+		require.NoError(t, err)
+		require.NoError(t, netlink.AddrAdd(link, &netlink.Addr{IPNet: &net.IPNet{IP: net.IPv4(192, 0, 2, 1), Mask: net.CIDRMask(24, 32)}}))
+		require.NoError(t, netlink.LinkSetUp(link))
+
+		// Packets from the vpn network are sent from a local address here, they pass postrouting all the same
+		lo, err = netlink.LinkByName("lo")
+		require.NoError(t, err)
+		require.NoError(t, netlink.AddrAdd(lo, &netlink.Addr{IPNet: &net.IPNet{IP: net.IPv4(10, 128, 0, 1), Mask: net.CIDRMask(32, 32)}}))
+		require.NoError(t, netlink.LinkSetUp(lo))
+
+		require.NoError(t, netns.Set(internet))
+		link, err = netlink.LinkByName("internet0")
+		require.NoError(t, err)
+		require.NoError(t, netlink.AddrAdd(link, &netlink.Addr{IPNet: &net.IPNet{IP: net.IPv4(192, 0, 2, 2), Mask: net.CIDRMask(24, 32)}}))
+		require.NoError(t, netlink.LinkSetUp(link))
+		server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 4242})
+		require.NoError(t, err)
+		defer server.Close()
+		require.NoError(t, netns.Set(exit))
+
+		sourceOf := func() netip.Addr {
+			client, err := net.DialUDP("udp4", &net.UDPAddr{IP: net.IPv4(10, 128, 0, 1)}, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 4242})
+			require.NoError(t, err)
+			defer client.Close()
+			_, err = client.Write([]byte("hi"))
+			require.NoError(t, err)
+
+			require.NoError(t, server.SetReadDeadline(time.Now().Add(5*time.Second)))
+			_, from, err := server.ReadFromUDPAddrPort(make([]byte, 16))
+			require.NoError(t, err)
+			return from.Addr().Unmap()
+		}
+
+		tn := &tun{Device: "nebula-exit", cidr: netip.MustParsePrefix("10.128.0.1/24"), l: test.NewLogger()}
+		require.NoError(t, tn.serveExitNode())
+		assert.Equal(t, netip.MustParseAddr("192.0.2.1"), sourceOf())
+
+		forward, err := os.ReadFile(ipForwardPath)
+		require.NoError(t, err)
+		assert.Equal(t, "1\n", string(forward))
+
+		// Serving again replaces the table instead of failing on it
+		require.NoError(t, tn.serveExitNode())
+
+		tn.stopServingExitNode()
+		assert.Equal(t, netip.MustParseAddr("10.128.0.1"), sourceOf())
+	})
+}
+
+func TestTun_reloadExitNodeServe(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("tun:\n  dev: nebula-exit\n"))
+
+	tn := &tun{Device: "nebula-exit", cidr: netip.MustParsePrefix("10.128.0.1/24"), l: l}
+	require.NoError(t, tn.reloadExitNode(c, true))
+
+	// The certificate is only checked at startup, a reload can not start serving
+	require.NoError(t, c.ReloadConfigString("tun:\n  dev: nebula-exit\n  exit_node:\n    serve: true\n"))
+	assert.ErrorContains(t, tn.reloadExitNode(c, false), "tun.exit_node.serve can not be turned on by a reload")
+	assert.False(t, tn.servesExitNode)
+}
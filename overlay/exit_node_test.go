@@ -0,0 +1,107 @@
+package overlay
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseExitNode(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	n := netip.MustParsePrefix("10.0.0.2/24")
+
+	// not configured
+	e, err := parseExitNode(c, n)
+	assert.Nil(t, err)
+	assert.Nil(t, e)
+
+	parse := func(settings map[interface{}]interface{}) (*exitNode, error) {
+		c.Settings["tun"] = map[interface{}]interface{}{"exit_node": settings}
+		return parseExitNode(c, n)
+	}
+
+	_, err = parse(map[interface{}]interface{}{"via": "10.0.0.1", "serve": true})
+	assert.EqualError(t, err, "tun.exit_node.serve and tun.exit_node.via can not both be set")
+
+	_, err = parse(map[interface{}]interface{}{"via": "nope"})
+	assert.EqualError(t, err, "tun.exit_node.via failed to parse address: ParseAddr(\"nope\"): unable to parse IP")
+
+	_, err = parse(map[interface{}]interface{}{"via": "10.0.1.1"})
+	assert.EqualError(t, err, "tun.exit_node.via must be another host in the network attached to the certificate; via: 10.0.1.1, network: 10.0.0.2/24")
+
+	_, err = parse(map[interface{}]interface{}{"via": "10.0.0.2"})
+	assert.EqualError(t, err, "tun.exit_node.via must be another host in the network attached to the certificate; via: 10.0.0.2, network: 10.0.0.2/24")
+
+	_, err = parse(map[interface{}]interface{}{"via": "10.0.0.1", "table": 254})
+	assert.EqualError(t, err, "tun.exit_node.table must be a table other than default, main or local: 254")
+
+	_, err = parse(map[interface{}]interface{}{"via": "10.0.0.1", "priority": 32764})
+	assert.EqualError(t, err, "tun.exit_node.priority is not in range (1-32763): 32764")
+
+	_, err = parse(map[interface{}]interface{}{"via": "10.0.0.1"})
+	assert.EqualError(t, err, "tun.exit_node.via requires listen.so_mark so nebula's own packets skip the exit node")
+
+	c.Settings["listen"] = map[interface{}]interface{}{"so_mark": 7}
+	_, err = parse(map[interface{}]interface{}{"via": "10.0.0.1", "exclude": []interface{}{"fd00::/8"}})
+	assert.EqualError(t, err, "entry 1 in tun.exit_node.exclude is not an ipv4 network: fd00::/8")
+
+	e, err = parse(map[interface{}]interface{}{"via": "10.0.0.1", "exclude": []interface{}{"192.168.1.1/16"}})
+	require.NoError(t, err)
+	assert.Equal(t, &exitNode{
+		Via:      netip.MustParseAddr("10.0.0.1"),
+		Table:    defaultExitNodeTable,
+		Priority: defaultExitNodePriority,
+		Mark:     7,
+		Exclude:  []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16")},
+	}, e)
+
+	// The default route is only ever known to nebula, never installed
+	routeTree, err := makeRouteTree(l, []Route{e.route()}, true)
+	require.NoError(t, err)
+	r, _ := routeTree.Lookup(netip.MustParseAddr("8.8.8.8"))
+	assert.Equal(t, netip.MustParseAddr("10.0.0.1"), r)
+	assert.False(t, e.route().Install)
+}
+
+func Test_getAllRoutesFromConfig_exitNode(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	n := netip.MustParsePrefix("10.0.0.2/24")
+	c.Settings["listen"] = map[interface{}]interface{}{"so_mark": 7}
+	c.Settings["tun"] = map[interface{}]interface{}{
+		"exit_node":     map[interface{}]interface{}{"via": "10.0.0.1"},
+		"unsafe_routes": []interface{}{map[interface{}]interface{}{"via": "10.0.0.3", "route": "192.168.0.0/16"}},
+	}
+
+	_, routes, err := getAllRoutesFromConfig(c, n, true)
+	require.NoError(t, err)
+	require.Len(t, routes, 2)
+	assert.Equal(t, defaultRoute, routes[1].Cidr)
+
+	c.Settings["tun"] = map[interface{}]interface{}{
+		"exit_node":     map[interface{}]interface{}{"via": "10.0.0.1"},
+		"unsafe_routes": []interface{}{map[interface{}]interface{}{"via": "10.0.0.3", "route": "0.0.0.0/0"}},
+	}
+	_, _, err = getAllRoutesFromConfig(c, n, true)
+	assert.EqualError(t, err, "tun.exit_node.via conflicts with the 0.0.0.0/0 entry in tun.unsafe_routes")
+}
+
+func Test_staticHostMapHost(t *testing.T) {
+	for entry, expected := range map[string]string{
+		"1.1.1.1:4242":            "1.1.1.1",
+		"[fd00::1]:4242":          "fd00::1",
+		"lighthouse.example:4242": "lighthouse.example",
+		"tcp://1.1.1.1:443":       "1.1.1.1",
+		"wss://lh.example/nebula": "lh.example",
+		"ws://1.1.1.1:8080":       "1.1.1.1",
+	} {
+		host, err := staticHostMapHost(entry)
+		require.NoError(t, err)
+		assert.Equal(t, expected, host, entry)
+	}
+}
@@ -0,0 +1,24 @@
+package overlay
+
+import (
+	"github.com/slackhq/nebula/config"
+)
+
+// RouteLearner is a Device that takes unsafe routes learned from lighthouses on top of its configured routes
+type RouteLearner interface {
+	// SetLearnedRoutes replaces every previously learned route with routes
+	SetLearnedRoutes(routes []Route) error
+}
+
+// LearnsUnsafeRoutes is true when the unsafe routes gateways advertise to the lighthouses should be installed
+func LearnsUnsafeRoutes(c *config.C) bool {
+	return c.GetBool("tun.learn_unsafe_routes.enabled", false)
+}
+
+// joinLearnedRoutes returns learned followed by configured in a new slice. Configured routes are inserted last into the
+// route tree so they win over a learned route for the same network.
+func joinLearnedRoutes(learned, configured []Route) []Route {
+	routes := make([]Route, 0, len(learned)+len(configured))
+	routes = append(routes, learned...)
+	return append(routes, configured...)
+}
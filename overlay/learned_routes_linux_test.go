@@ -0,0 +1,79 @@
+//go:build !e2e_testing
+// +build !e2e_testing
+
+package overlay
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+func TestTun_SetLearnedRoutes(t *testing.T) {
+	inNetns(t, func(_ netns.NsHandle) {
+		l := test.NewLogger()
+		c := config.NewC(l)
+		c.Settings["tun"] = map[interface{}]interface{}{
+			"dev": "nebula-learn",
+			"unsafe_routes": []interface{}{
+				map[interface{}]interface{}{"route": "192.168.1.0/24", "via": "10.128.0.1"},
+			},
+		}
+
+		tn, err := newTun(c, l, netip.MustParsePrefix("10.128.0.2/24"), false)
+		require.NoError(t, err)
+		defer tn.Close()
+
+		// Routes learned before the device is up are installed with it
+		require.NoError(t, tn.SetLearnedRoutes([]Route{
+			{Cidr: netip.MustParsePrefix("192.168.1.0/24"), Via: netip.MustParseAddr("10.128.0.3"), Install: true},
+			{Cidr: netip.MustParsePrefix("192.168.2.0/24"), Via: netip.MustParseAddr("10.128.0.3"), Install: true},
+		}))
+		require.NoError(t, tn.Activate())
+
+		installed := func() []string {
+			routes, err := netlink.RouteList(&netlink.Device{LinkAttrs: netlink.LinkAttrs{Index: tn.deviceIndex}}, unix.AF_INET)
+			require.NoError(t, err)
+			var dsts []string
+			for _, r := range routes {
+				if r.Dst != nil && r.Dst.String() != "10.128.0.0/24" {
+					dsts = append(dsts, r.Dst.String())
+				}
+			}
+			return dsts
+		}
+
+		// The configured route wins over a learned one for the same network
+		assert.Equal(t, netip.MustParseAddr("10.128.0.1"), tn.RouteFor(netip.MustParseAddr("192.168.1.1")))
+		assert.Equal(t, netip.MustParseAddr("10.128.0.3"), tn.RouteFor(netip.MustParseAddr("192.168.2.1")))
+		assert.ElementsMatch(t, []string{"192.168.1.0/24", "192.168.2.0/24"}, installed())
+
+		// Failing over to another gateway only changes where nebula sends the traffic
+		require.NoError(t, tn.SetLearnedRoutes([]Route{
+			{Cidr: netip.MustParsePrefix("192.168.2.0/24"), Via: netip.MustParseAddr("10.128.0.4"), Install: true},
+		}))
+		assert.Equal(t, netip.MustParseAddr("10.128.0.4"), tn.RouteFor(netip.MustParseAddr("192.168.2.1")))
+		assert.ElementsMatch(t, []string{"192.168.1.0/24", "192.168.2.0/24"}, installed())
+
+		// A network nobody advertises anymore is removed from the system, configured routes stay
+		require.NoError(t, tn.SetLearnedRoutes(nil))
+		assert.False(t, tn.RouteFor(netip.MustParseAddr("192.168.2.1")).IsValid())
+		assert.Equal(t, []string{"192.168.1.0/24"}, installed())
+
+		// A config reload keeps the learned routes
+		require.NoError(t, tn.SetLearnedRoutes([]Route{
+			{Cidr: netip.MustParsePrefix("192.168.3.0/24"), Via: netip.MustParseAddr("10.128.0.3"), Install: true},
+		}))
+		require.NoError(t, c.ReloadConfigString("tun:\n  dev: nebula-learn\n"))
+		assert.Equal(t, netip.MustParseAddr("10.128.0.3"), tn.RouteFor(netip.MustParseAddr("192.168.3.1")))
+		assert.False(t, tn.RouteFor(netip.MustParseAddr("192.168.1.1")).IsValid())
+		assert.Equal(t, []string{"192.168.3.0/24"}, installed())
+	})
+}
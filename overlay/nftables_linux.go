@@ -0,0 +1,222 @@
+//go:build !android && !e2e_testing
+// +build !android,!e2e_testing
+
+package overlay
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// Just enough nftables over netlink to install a masquerade rule, the equivalent of
+//
+//	nft add table ip <table>
+//	nft add chain ip <table> postrouting '{ type nat hook postrouting priority srcnat; }'
+//	nft add rule ip <table> postrouting ip saddr <network> oifname != <device> masquerade
+//
+// without needing the nft binary on the host.
+
+const (
+	nftChainName = "postrouting"
+	// nftSrcNatPriority is the srcnat hook priority
+	nftSrcNatPriority = 100
+	// ipv4SrcOffset is where the source address starts in the ipv4 header
+	ipv4SrcOffset = 12
+)
+
+// nftBatch is an nftables transaction, the kernel applies all of its messages or none of them
+type nftBatch struct {
+	b    []byte
+	seq  uint32
+	acks int
+}
+
+func newNftBatch() *nftBatch {
+	b := &nftBatch{}
+	b.add(unix.NFNL_MSG_BATCH_BEGIN, unix.NLM_F_REQUEST, unix.AF_UNSPEC, unix.NFNL_SUBSYS_NFTABLES)
+	return b
+}
+
+// add appends a message with an nfgenmsg header, every message with NLM_F_ACK is answered by the kernel
+func (b *nftBatch) add(msgType, flags uint16, family uint8, resID uint16, attrs ...*nl.RtAttr) {
+	var data []byte
+	for _, a := range attrs {
+		data = append(data, a.Serialize()...)
+	}
+
+	b.seq++
+	h := make([]byte, unix.SizeofNlMsghdr+4)
+	binary.NativeEndian.PutUint32(h[0:4], uint32(len(h)+len(data)))
+	binary.NativeEndian.PutUint16(h[4:6], msgType)
+	binary.NativeEndian.PutUint16(h[6:8], flags)
+	binary.NativeEndian.PutUint32(h[8:12], b.seq)
+	h[16] = family
+	h[17] = unix.NFNETLINK_V0
+	binary.BigEndian.PutUint16(h[18:20], resID)
+
+	b.b = append(b.b, h...)
+	b.b = append(b.b, data...)
+	if flags&unix.NLM_F_ACK != 0 {
+		b.acks++
+	}
+}
+
+// addNft appends an nftables message for the ipv4 family
+func (b *nftBatch) addNft(msg int, flags uint16, attrs ...*nl.RtAttr) {
+	b.add(uint16(unix.NFNL_SUBSYS_NFTABLES<<8|msg), unix.NLM_F_REQUEST|unix.NLM_F_ACK|flags, unix.NFPROTO_IPV4, 0, attrs...)
+}
+
+// send closes the batch, hands it to the kernel and waits for every message to be acknowledged
+func (b *nftBatch) send() error {
+	b.add(unix.NFNL_MSG_BATCH_END, unix.NLM_F_REQUEST, unix.AF_UNSPEC, unix.NFNL_SUBSYS_NFTABLES)
+
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	if err = unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	// Never wait forever on a kernel that does not answer
+	tv := unix.Timeval{Sec: 5}
+	if err = unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		return err
+	}
+
+	if err = unix.Sendto(fd, b.b, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, unix.Getpagesize())
+	for acks := 0; acks < b.acks; {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return err
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+
+		for _, m := range msgs {
+			if m.Header.Type != unix.NLMSG_ERROR {
+				continue
+			}
+
+			acks++
+			if len(m.Data) < 4 {
+				return fmt.Errorf("short netlink error message")
+			}
+			if errno := int32(binary.NativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+				return unix.Errno(-errno)
+			}
+		}
+	}
+
+	return nil
+}
+
+// nftExpr wraps one expression of a rule
+func nftExpr(name string, attrs ...*nl.RtAttr) *nl.RtAttr {
+	e := nl.NewRtAttr(unix.NFTA_LIST_ELEM|unix.NLA_F_NESTED, nil)
+	e.AddRtAttr(unix.NFTA_EXPR_NAME, nl.ZeroTerminated(name))
+	if len(attrs) > 0 {
+		data := e.AddRtAttr(unix.NFTA_EXPR_DATA|unix.NLA_F_NESTED, nil)
+		for _, a := range attrs {
+			data.AddChild(a)
+		}
+	}
+	return e
+}
+
+func nftData(attrType int, value []byte) *nl.RtAttr {
+	a := nl.NewRtAttr(attrType|unix.NLA_F_NESTED, nil)
+	a.AddRtAttr(unix.NFTA_DATA_VALUE, value)
+	return a
+}
+
+// nftCmp compares register 1 to value
+func nftCmp(op uint32, value []byte) *nl.RtAttr {
+	return nftExpr("cmp",
+		nl.NewRtAttr(unix.NFTA_CMP_SREG, nl.BEUint32Attr(unix.NFT_REG_1)),
+		nl.NewRtAttr(unix.NFTA_CMP_OP, nl.BEUint32Attr(op)),
+		nftData(unix.NFTA_CMP_DATA, value),
+	)
+}
+
+// masqueradeExprs matches ipv4 packets from network that leave through any interface but device and masquerades them
+func masqueradeExprs(network netip.Prefix, device string) *nl.RtAttr {
+	var ifName [unix.IFNAMSIZ]byte
+	copy(ifName[:], device)
+
+	exprs := nl.NewRtAttr(unix.NFTA_RULE_EXPRESSIONS|unix.NLA_F_NESTED, nil)
+	exprs.AddChild(nftExpr("payload",
+		nl.NewRtAttr(unix.NFTA_PAYLOAD_DREG, nl.BEUint32Attr(unix.NFT_REG_1)),
+		nl.NewRtAttr(unix.NFTA_PAYLOAD_BASE, nl.BEUint32Attr(unix.NFT_PAYLOAD_NETWORK_HEADER)),
+		nl.NewRtAttr(unix.NFTA_PAYLOAD_OFFSET, nl.BEUint32Attr(ipv4SrcOffset)),
+		nl.NewRtAttr(unix.NFTA_PAYLOAD_LEN, nl.BEUint32Attr(4)),
+	))
+	exprs.AddChild(nftExpr("bitwise",
+		nl.NewRtAttr(unix.NFTA_BITWISE_SREG, nl.BEUint32Attr(unix.NFT_REG_1)),
+		nl.NewRtAttr(unix.NFTA_BITWISE_DREG, nl.BEUint32Attr(unix.NFT_REG_1)),
+		nl.NewRtAttr(unix.NFTA_BITWISE_LEN, nl.BEUint32Attr(4)),
+		nftData(unix.NFTA_BITWISE_MASK, net.CIDRMask(network.Bits(), 32)),
+		nftData(unix.NFTA_BITWISE_XOR, make([]byte, 4)),
+	))
+	exprs.AddChild(nftCmp(unix.NFT_CMP_EQ, network.Masked().Addr().AsSlice()))
+	exprs.AddChild(nftExpr("meta",
+		nl.NewRtAttr(unix.NFTA_META_DREG, nl.BEUint32Attr(unix.NFT_REG_1)),
+		nl.NewRtAttr(unix.NFTA_META_KEY, nl.BEUint32Attr(unix.NFT_META_OIFNAME)),
+	))
+	exprs.AddChild(nftCmp(unix.NFT_CMP_NEQ, ifName[:]))
+	exprs.AddChild(nftExpr("masq"))
+	return exprs
+}
+
+// addMasquerade replaces the table with one holding only the masquerade rule
+func addMasquerade(table string, network netip.Prefix, device string) error {
+	name := nl.ZeroTerminated(table)
+	b := newNftBatch()
+
+	// Adding before deleting keeps the delete from failing the batch when the table does not exist yet
+	b.addNft(unix.NFT_MSG_NEWTABLE, unix.NLM_F_CREATE, nl.NewRtAttr(unix.NFTA_TABLE_NAME, name))
+	b.addNft(unix.NFT_MSG_DELTABLE, 0, nl.NewRtAttr(unix.NFTA_TABLE_NAME, name))
+	b.addNft(unix.NFT_MSG_NEWTABLE, unix.NLM_F_CREATE, nl.NewRtAttr(unix.NFTA_TABLE_NAME, name))
+
+	hook := nl.NewRtAttr(unix.NFTA_CHAIN_HOOK|unix.NLA_F_NESTED, nil)
+	hook.AddRtAttr(unix.NFTA_HOOK_HOOKNUM, nl.BEUint32Attr(unix.NF_INET_POST_ROUTING))
+	hook.AddRtAttr(unix.NFTA_HOOK_PRIORITY, nl.BEUint32Attr(nftSrcNatPriority))
+	b.addNft(unix.NFT_MSG_NEWCHAIN, unix.NLM_F_CREATE,
+		nl.NewRtAttr(unix.NFTA_CHAIN_TABLE, name),
+		nl.NewRtAttr(unix.NFTA_CHAIN_NAME, nl.ZeroTerminated(nftChainName)),
+		hook,
+		nl.NewRtAttr(unix.NFTA_CHAIN_TYPE, nl.ZeroTerminated("nat")),
+	)
+
+	b.addNft(unix.NFT_MSG_NEWRULE, unix.NLM_F_CREATE|unix.NLM_F_APPEND,
+		nl.NewRtAttr(unix.NFTA_RULE_TABLE, name),
+		nl.NewRtAttr(unix.NFTA_RULE_CHAIN, nl.ZeroTerminated(nftChainName)),
+		masqueradeExprs(network, device),
+	)
+
+	return b.send()
+}
+
+// deleteNftTable removes the table and everything in it, a table that does not exist is not an error
+func deleteNftTable(table string) error {
+	name := nl.ZeroTerminated(table)
+	b := newNftBatch()
+	b.addNft(unix.NFT_MSG_NEWTABLE, unix.NLM_F_CREATE, nl.NewRtAttr(unix.NFTA_TABLE_NAME, name))
+	b.addNft(unix.NFT_MSG_DELTABLE, 0, nl.NewRtAttr(unix.NFTA_TABLE_NAME, name))
+	return b.send()
+}
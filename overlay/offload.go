@@ -0,0 +1,317 @@
+package overlay
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Tun offloads let the kernel hand us a tcp stream in superpackets much larger than the mtu, and take them back from us.
+// Superpackets are split into mtu sized segments before they are encrypted and decrypted segments of a flow are glued
+// back together before they are written to the tun device.
+
+const (
+	// maxCoalesceSegments is the most segments glued into one superpacket, it matches what the kernel does for gro
+	maxCoalesceSegments = 64
+	// maxCoalesceBytes is the limit of the ip length fields
+	maxCoalesceBytes = 65535
+
+	tcpFlagFIN = 0x01
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+	tcpFlagCWR = 0x80
+)
+
+// segmentWriter is implemented by tun queues that take tcp superpackets, the kernel splits them up again by segment if
+// they are not for the local stack
+type segmentWriter interface {
+	supportsSegments() bool
+	// writeSegments writes the superpacket in b, ipLen is the length of its ip header and hdrLen of the ip and tcp
+	// headers together. Every segment carries segment bytes of payload except the last one which may carry less.
+	writeSegments(b []byte, ipLen, hdrLen, segment int) error
+}
+
+// Coalescer glues consecutive tcp segments of the same flow into a single superpacket for the tun device. It is not
+// safe for concurrent use, every outside routine has its own.
+type Coalescer struct {
+	w  io.Writer
+	sw segmentWriter
+
+	buf     []byte
+	ipLen   int
+	hdrLen  int
+	segment int
+	count   int
+	nextSeq uint32
+	// closed is set once a short segment or one with PSH was added, nothing can follow it in the same superpacket
+	closed bool
+}
+
+// NewCoalescer builds a Coalescer for w, it writes every packet on its own if w can not take superpackets
+func NewCoalescer(w io.Writer) *Coalescer {
+	sw, _ := w.(segmentWriter)
+	return &Coalescer{w: w, sw: sw}
+}
+
+// Write adds the packet in p to the superpacket, the superpacket is written first if p can not join it. Packets that
+// can never join one are written right away. p is copied so the caller is free to reuse it.
+func (c *Coalescer) Write(p []byte) error {
+	if c.sw == nil || !c.sw.supportsSegments() {
+		err := c.Flush()
+		if _, werr := c.w.Write(p); werr != nil {
+			err = werr
+		}
+		return err
+	}
+
+	var err error
+	ipLen, hdrLen, ok := tcpHeaderLen(p)
+	if ok {
+		flags := p[ipLen+13]
+		ok = len(p) > hdrLen && flags&^(tcpFlagACK|tcpFlagPSH) == 0
+	}
+
+	if c.count > 0 && (!ok || !c.canJoin(p, ipLen, hdrLen)) {
+		err = c.Flush()
+	}
+
+	if !ok {
+		if _, werr := c.w.Write(p); werr != nil {
+			err = werr
+		}
+		return err
+	}
+
+	payload := len(p) - hdrLen
+	if c.count == 0 {
+		if c.buf == nil {
+			c.buf = make([]byte, 0, maxCoalesceBytes)
+		}
+		c.buf = append(c.buf[:0], p...)
+		c.ipLen = ipLen
+		c.hdrLen = hdrLen
+		c.segment = payload
+		c.nextSeq = binary.BigEndian.Uint32(p[ipLen+4:])
+	} else {
+		c.buf = append(c.buf, p[hdrLen:]...)
+	}
+
+	c.count++
+	c.nextSeq += uint32(payload)
+	if p[ipLen+13]&tcpFlagPSH != 0 {
+		c.buf[c.ipLen+13] |= tcpFlagPSH
+		c.closed = true
+	}
+	if payload < c.segment {
+		c.closed = true
+	}
+	return err
+}
+
+// canJoin reports if p continues the flow of the superpacket
+func (c *Coalescer) canJoin(p []byte, ipLen, hdrLen int) bool {
+	payload := len(p) - hdrLen
+	if c.closed || c.count == maxCoalesceSegments || len(c.buf)+payload > maxCoalesceBytes || payload > c.segment ||
+		ipLen != c.ipLen || hdrLen != c.hdrLen {
+		return false
+	}
+
+	h := c.buf
+	if p[0]>>4 == 4 {
+		// Version, header length, tos, don't fragment, ttl, protocol and the addresses
+		if p[0] != h[0] || p[1] != h[1] || p[6]&0x40 != h[6]&0x40 || p[8] != h[8] || string(p[12:20]) != string(h[12:20]) {
+			return false
+		}
+	} else {
+		// Version, traffic class, flow label, next header, hop limit and the addresses
+		if string(p[0:4]) != string(h[0:4]) || string(p[6:40]) != string(h[6:40]) {
+			return false
+		}
+	}
+
+	// Ports, ack, header length and window and any options have to match, the sequence has to follow on
+	pt, ht := p[ipLen:hdrLen], h[ipLen:hdrLen]
+	return string(pt[0:4]) == string(ht[0:4]) && string(pt[8:13]) == string(ht[8:13]) &&
+		string(pt[14:16]) == string(ht[14:16]) && string(pt[20:]) == string(ht[20:]) &&
+		binary.BigEndian.Uint32(pt[4:]) == c.nextSeq
+}
+
+// Len is how many segments are waiting to be written
+func (c *Coalescer) Len() int {
+	return c.count
+}
+
+// Flush writes the waiting segments
+func (c *Coalescer) Flush() error {
+	if c.count == 0 {
+		return nil
+	}
+
+	var err error
+	if c.count == 1 {
+		// A lone segment is written untouched
+		_, err = c.w.Write(c.buf)
+	} else {
+		b := c.buf
+		if b[0]>>4 == 4 {
+			binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+			b[10], b[11] = 0, 0
+			binary.BigEndian.PutUint16(b[10:], ^checksumFold(checksumAdd(0, b[:c.ipLen])))
+		} else {
+			binary.BigEndian.PutUint16(b[4:], uint16(len(b)-c.ipLen))
+		}
+
+		// The kernel finishes the checksum of every segment, it wants the sum of the pseudo header to start from
+		binary.BigEndian.PutUint16(b[c.ipLen+16:], checksumFold(pseudoHeaderSum(b, len(b)-c.ipLen)))
+		err = c.sw.writeSegments(b, c.ipLen, c.hdrLen, c.segment)
+	}
+
+	c.buf = c.buf[:0]
+	c.count = 0
+	c.closed = false
+	return err
+}
+
+// tcpHeaderLen returns the length of the ip header and of the ip and tcp headers together if b is a complete and
+// unfragmented tcp packet without ip options or extension headers
+func tcpHeaderLen(b []byte) (int, int, bool) {
+	if len(b) < 1 {
+		return 0, 0, false
+	}
+
+	var ipLen int
+	switch b[0] >> 4 {
+	case 4:
+		ipLen = 20
+		if len(b) < ipLen+20 || b[0]&0x0f != 5 || b[9] != 6 || int(binary.BigEndian.Uint16(b[2:])) != len(b) ||
+			binary.BigEndian.Uint16(b[6:])&0x3fff != 0 {
+			return 0, 0, false
+		}
+	case 6:
+		ipLen = 40
+		if len(b) < ipLen+20 || b[6] != 6 || int(binary.BigEndian.Uint16(b[4:]))+ipLen != len(b) {
+			return 0, 0, false
+		}
+	default:
+		return 0, 0, false
+	}
+
+	hdrLen, ok := superpacketHeaderLen(b, ipLen)
+	return ipLen, hdrLen, ok
+}
+
+// superpacketHeaderLen returns the length of the ip and tcp headers of a superpacket from the kernel, the tcp header
+// starts at ipLen
+func superpacketHeaderLen(b []byte, ipLen int) (int, bool) {
+	if len(b) < ipLen+20 {
+		return 0, false
+	}
+
+	switch b[0] >> 4 {
+	case 4:
+		if ipLen < 20 {
+			return 0, false
+		}
+	case 6:
+		if ipLen < 40 {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+
+	hdrLen := ipLen + int(b[ipLen+12]>>4)*4
+	if hdrLen < ipLen+20 || hdrLen > len(b) {
+		return 0, false
+	}
+	return hdrLen, true
+}
+
+// segmentCount is how many segments a tcp superpacket with the headers hdrLen long splits into
+func segmentCount(b []byte, hdrLen, segment int) int {
+	return (len(b) - hdrLen + segment - 1) / segment
+}
+
+// segmentTCP writes segment i of the tcp superpacket b into dst with its lengths, ids, sequence, flags and checksums
+// fixed up. It returns the length of the segment or 0 if it does not fit in dst.
+func segmentTCP(dst, b []byte, ipLen, hdrLen, segment, i int) int {
+	start := hdrLen + i*segment
+	end := min(start+segment, len(b))
+	n := hdrLen + end - start
+	if n > len(dst) || start >= end {
+		return 0
+	}
+
+	copy(dst, b[:hdrLen])
+	copy(dst[hdrLen:], b[start:end])
+
+	if dst[0]>>4 == 4 {
+		binary.BigEndian.PutUint16(dst[2:], uint16(n))
+		binary.BigEndian.PutUint16(dst[4:], binary.BigEndian.Uint16(b[4:])+uint16(i))
+		dst[10], dst[11] = 0, 0
+		binary.BigEndian.PutUint16(dst[10:], ^checksumFold(checksumAdd(0, dst[:ipLen])))
+	} else {
+		binary.BigEndian.PutUint16(dst[4:], uint16(n-40))
+	}
+
+	tcp := dst[ipLen:n]
+	binary.BigEndian.PutUint32(tcp[4:], binary.BigEndian.Uint32(b[ipLen+4:])+uint32(i*segment))
+	if end < len(b) {
+		// Only the last segment finishes or pushes the stream
+		tcp[13] &^= tcpFlagFIN | tcpFlagPSH
+	}
+	if i > 0 {
+		tcp[13] &^= tcpFlagCWR
+	}
+
+	tcp[16], tcp[17] = 0, 0
+	binary.BigEndian.PutUint16(tcp[16:], ^checksumFold(checksumAdd(pseudoHeaderSum(dst, len(tcp)), tcp)))
+	return n
+}
+
+// finishChecksum completes a checksum the kernel left for us to do, the checksum field at offset from start holds the
+// sum of the pseudo header and everything from start on is covered
+func finishChecksum(b []byte, start, offset int) {
+	if start+offset+2 > len(b) {
+		return
+	}
+
+	sum := ^checksumFold(checksumAdd(0, b[start:]))
+	if sum == 0 && offset == 6 {
+		// A udp checksum of 0 means there is none
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(b[start+offset:], sum)
+}
+
+// pseudoHeaderSum sums the tcp pseudo header of the ip packet in b for a tcp segment length bytes long
+func pseudoHeaderSum(b []byte, length int) uint32 {
+	var sum uint32
+	if b[0]>>4 == 4 {
+		sum = checksumAdd(0, b[12:20])
+	} else {
+		sum = checksumAdd(0, b[8:40])
+	}
+	return sum + 6 + uint32(length)
+}
+
+// checksumAdd adds b to the ones' complement sum
+func checksumAdd(sum uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+		if sum > 0xffff0000 {
+			sum = sum&0xffff + sum>>16
+		}
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+func checksumFold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return uint16(sum)
+}
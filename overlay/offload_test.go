@@ -0,0 +1,174 @@
+package overlay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type segmentRecorder struct {
+	writes   [][]byte
+	segments []int
+}
+
+func (r *segmentRecorder) Write(p []byte) (int, error) {
+	r.writes = append(r.writes, bytes.Clone(p))
+	r.segments = append(r.segments, 0)
+	return len(p), nil
+}
+
+func (r *segmentRecorder) supportsSegments() bool {
+	return true
+}
+
+func (r *segmentRecorder) writeSegments(b []byte, _, _, segment int) error {
+	r.writes = append(r.writes, bytes.Clone(b))
+	r.segments = append(r.segments, segment)
+	return nil
+}
+
+// tcpPacket builds a tcp packet with valid checksums
+func tcpPacket(src, dst netip.Addr, id uint16, seq uint32, flags byte, payload []byte) []byte {
+	ipLen := 20
+	if src.Is6() {
+		ipLen = 40
+	}
+
+	b := make([]byte, ipLen+20+len(payload))
+	if src.Is4() {
+		b[0] = 0x45
+		binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+		binary.BigEndian.PutUint16(b[4:], id)
+		b[6] = 0x40
+		b[8] = 64
+		b[9] = 6
+		copy(b[12:], src.AsSlice())
+		copy(b[16:], dst.AsSlice())
+		binary.BigEndian.PutUint16(b[10:], ^checksumFold(checksumAdd(0, b[:20])))
+	} else {
+		b[0] = 0x60
+		binary.BigEndian.PutUint16(b[4:], uint16(len(b)-40))
+		b[6] = 6
+		b[7] = 64
+		copy(b[8:], src.AsSlice())
+		copy(b[24:], dst.AsSlice())
+	}
+
+	tcp := b[ipLen:]
+	binary.BigEndian.PutUint16(tcp[0:], 4000)
+	binary.BigEndian.PutUint16(tcp[2:], 80)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], 1234)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 512)
+	copy(tcp[20:], payload)
+	binary.BigEndian.PutUint16(tcp[16:], ^checksumFold(checksumAdd(pseudoHeaderSum(b, len(tcp)), tcp)))
+	return b
+}
+
+func TestCoalescer(t *testing.T) {
+	for _, addrs := range [][2]netip.Addr{
+		{netip.MustParseAddr("10.1.0.1"), netip.MustParseAddr("10.1.0.2")},
+		{netip.MustParseAddr("fd00::1"), netip.MustParseAddr("fd00::2")},
+	} {
+		src, dst := addrs[0], addrs[1]
+		t.Run(src.String(), func(t *testing.T) {
+			var packets [][]byte
+			seq := uint32(100)
+			for i := 0; i < 5; i++ {
+				flags := byte(tcpFlagACK)
+				size := 1000
+				if i == 4 {
+					flags |= tcpFlagPSH
+					size = 300
+				}
+				packets = append(packets, tcpPacket(src, dst, uint16(10+i), seq, flags, bytes.Repeat([]byte{byte(i)}, size)))
+				seq += uint32(size)
+			}
+
+			r := &segmentRecorder{}
+			c := NewCoalescer(r)
+			for _, p := range packets {
+				require.NoError(t, c.Write(p))
+			}
+			assert.Equal(t, 5, c.Len())
+			assert.Empty(t, r.writes)
+
+			// Nothing can follow a pushed segment
+			next := tcpPacket(src, dst, 15, seq, tcpFlagACK, make([]byte, 1000))
+			require.NoError(t, c.Write(next))
+			require.Len(t, r.writes, 1)
+			assert.Equal(t, 1000, r.segments[0])
+
+			// Splitting the superpacket up again gives back what went in
+			super := r.writes[0]
+			ipLen, hdrLen, ok := tcpHeaderLen(super)
+			require.True(t, ok)
+			assert.Equal(t, 4*1000+300+hdrLen, len(super))
+			assert.Equal(t, checksumFold(pseudoHeaderSum(super, len(super)-ipLen)), binary.BigEndian.Uint16(super[ipLen+16:]))
+
+			require.Equal(t, len(packets), segmentCount(super, hdrLen, 1000))
+			dst := make([]byte, 1500)
+			for i, p := range packets {
+				n := segmentTCP(dst, super, ipLen, hdrLen, 1000, i)
+				assert.Equal(t, p, dst[:n], "segment %d", i)
+			}
+
+			// A lone segment is written as it is
+			require.NoError(t, c.Flush())
+			require.Len(t, r.writes, 2)
+			assert.Equal(t, next, r.writes[1])
+			assert.Equal(t, 0, r.segments[1])
+			require.NoError(t, c.Flush())
+			assert.Len(t, r.writes, 2)
+		})
+	}
+}
+
+func TestCoalescer_notJoined(t *testing.T) {
+	src, dst := netip.MustParseAddr("10.1.0.1"), netip.MustParseAddr("10.1.0.2")
+	r := &segmentRecorder{}
+	c := NewCoalescer(r)
+
+	require.NoError(t, c.Write(tcpPacket(src, dst, 1, 100, tcpFlagACK, make([]byte, 1000))))
+
+	// A gap in the sequence
+	require.NoError(t, c.Write(tcpPacket(src, dst, 2, 5000, tcpFlagACK, make([]byte, 1000))))
+	assert.Len(t, r.writes, 1)
+
+	// Another flow
+	require.NoError(t, c.Write(tcpPacket(dst, src, 3, 6000, tcpFlagACK, make([]byte, 1000))))
+	assert.Len(t, r.writes, 2)
+
+	// A larger segment
+	require.NoError(t, c.Write(tcpPacket(dst, src, 4, 7000, tcpFlagACK, make([]byte, 1200))))
+	assert.Len(t, r.writes, 3)
+
+	// A FIN, a pure ACK and anything that is not tcp are written right away after what came before
+	require.NoError(t, c.Write(tcpPacket(dst, src, 5, 8200, tcpFlagACK|tcpFlagFIN, make([]byte, 10))))
+	assert.Len(t, r.writes, 5)
+	require.NoError(t, c.Write(tcpPacket(dst, src, 6, 8211, tcpFlagACK, nil)))
+	assert.Len(t, r.writes, 6)
+	require.NoError(t, c.Write([]byte{0x45, 0, 0, 20}))
+	assert.Len(t, r.writes, 7)
+	assert.Equal(t, 0, c.Len())
+	for _, s := range r.segments {
+		assert.Equal(t, 0, s)
+	}
+}
+
+func TestFinishChecksum(t *testing.T) {
+	src, dst := netip.MustParseAddr("10.1.0.1"), netip.MustParseAddr("10.1.0.2")
+	p := tcpPacket(src, dst, 1, 100, tcpFlagACK, []byte("hello world"))
+	expected := bytes.Clone(p)
+
+	// The kernel leaves the sum of the pseudo header in the checksum field
+	binary.BigEndian.PutUint16(p[36:], checksumFold(pseudoHeaderSum(p, len(p)-20)))
+	finishChecksum(p, 20, 16)
+	assert.Equal(t, expected, p)
+}
@@ -1,7 +1,9 @@
 package overlay
 
 import (
+	"fmt"
 	"net/netip"
+	"runtime"
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/config"
@@ -14,7 +16,33 @@ const DefaultMTU = 1300
 type DeviceFactory func(c *config.C, l *logrus.Logger, tunCidr netip.Prefix, routines int) (Device, error)
 
 func NewDeviceFromConfig(c *config.C, l *logrus.Logger, tunCidr netip.Prefix, routines int) (Device, error) {
+	tap, err := TapMode(c)
+	if err != nil {
+		return nil, err
+	}
+
 	switch {
+	case tap && c.GetBool("tun.disabled", false):
+		return nil, fmt.Errorf("tun.mode tap can not be used with tun.disabled")
+
+	case tap && runtime.GOOS != "linux":
+		return nil, fmt.Errorf("tun.mode tap is not supported on %s", runtime.GOOS)
+
+	case usesExitNode(c) && c.GetBool("tun.disabled", false):
+		return nil, fmt.Errorf("tun.exit_node can not be used with tun.disabled")
+
+	case usesExitNode(c) && runtime.GOOS != "linux":
+		return nil, fmt.Errorf("tun.exit_node is not supported on %s", runtime.GOOS)
+
+	case LearnsUnsafeRoutes(c) && c.GetBool("tun.disabled", false):
+		return nil, fmt.Errorf("tun.learn_unsafe_routes can not be used with tun.disabled")
+
+	case LearnsUnsafeRoutes(c) && c.GetBool("tun.use_system_route_table", false):
+		return nil, fmt.Errorf("tun.learn_unsafe_routes can not be used with tun.use_system_route_table")
+
+	case LearnsUnsafeRoutes(c) && runtime.GOOS != "linux":
+		return nil, fmt.Errorf("tun.learn_unsafe_routes is not supported on %s", runtime.GOOS)
+
 	case c.GetBool("tun.disabled", false):
 		tun := newDisabledTun(tunCidr, c.GetInt("tun.tx_queue", 500), c.GetBool("stats.message_metrics", false), l)
 		return tun, nil
@@ -24,6 +52,18 @@ func NewDeviceFromConfig(c *config.C, l *logrus.Logger, tunCidr netip.Prefix, ro
 	}
 }
 
+// TapMode reads tun.mode, it is true when the device carries ethernet frames instead of ip packets
+func TapMode(c *config.C) (bool, error) {
+	switch mode := c.GetString("tun.mode", "tun"); mode {
+	case "tun":
+		return false, nil
+	case "tap":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown tun.mode %q, expected tun or tap", mode)
+	}
+}
+
 func NewFdDeviceFromConfig(fd *int) DeviceFactory {
 	return func(c *config.C, l *logrus.Logger, tunCidr netip.Prefix, routines int) (Device, error) {
 		return newTunFromFd(c, l, *fd, tunCidr)
@@ -31,7 +71,7 @@ func NewFdDeviceFromConfig(fd *int) DeviceFactory {
 }
 
 func getAllRoutesFromConfig(c *config.C, cidr netip.Prefix, initial bool) (bool, []Route, error) {
-	if !initial && !c.HasChanged("tun.routes") && !c.HasChanged("tun.unsafe_routes") {
+	if !initial && !c.HasChanged("tun.routes") && !c.HasChanged("tun.unsafe_routes") && !c.HasChanged("tun.exit_node") {
 		return false, nil, nil
 	}
 
@@ -46,6 +86,21 @@ func getAllRoutesFromConfig(c *config.C, cidr netip.Prefix, initial bool) (bool,
 	}
 
 	routes = append(routes, unsafeRoutes...)
+
+	exit, err := parseExitNode(c, cidr)
+	if err != nil {
+		return true, nil, util.NewContextualError("Could not parse tun.exit_node", nil, err)
+	}
+
+	if exit != nil {
+		for _, r := range unsafeRoutes {
+			if r.Cidr == defaultRoute {
+				return true, nil, fmt.Errorf("tun.exit_node.via conflicts with the %v entry in tun.unsafe_routes", defaultRoute)
+			}
+		}
+		routes = append(routes, exit.route())
+	}
+
 	return true, routes, nil
 }
 
@@ -10,7 +10,9 @@ import (
 	"net/netip"
 	"os"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"unsafe"
 
 	"github.com/gaissmai/bart"
@@ -31,12 +33,27 @@ type tun struct {
 	TXQueueLen  int
 	deviceIndex int
 	ioctlFd     uintptr
+	// offload is set if the queues were opened with IFF_VNET_HDR, see offloadQueue
+	offload bool
+	// tap is set if the device carries ethernet frames
+	tap bool
 
 	Routes          atomic.Pointer[[]Route]
 	routeTree       atomic.Pointer[bart.Table[netip.Addr]]
 	routeChan       chan struct{}
 	useSystemRoutes bool
 
+	// Routes holds configRoutes and the learnedRoutes from tun.learn_unsafe_routes, routesLock keeps a config reload
+	// from racing a change to the learned routes
+	routesLock    sync.Mutex
+	configRoutes  []Route
+	learnedRoutes []Route
+
+	// exitNode is set when all traffic is routed through an exit node, exitRules are the policy rules that do it
+	exitNode       *exitNode
+	exitRules      []*netlink.Rule
+	servesExitNode bool
+
 	l *logrus.Logger
 }
 
@@ -100,17 +117,39 @@ func newTun(c *config.C, l *logrus.Logger, cidr netip.Prefix, multiqueue bool) (
 		}
 	}
 
+	tap, err := TapMode(c)
+	if err != nil {
+		return nil, err
+	}
+
+	offload := c.GetBool("tun.offload", false)
+	if tap && offload {
+		// Superpackets are made of ip packets, frames are always passed through as they are
+		l.Warn("tun.offload is not supported with tun.mode tap, it is disabled")
+		offload = false
+	}
+
 	var req ifReq
-	req.Flags = uint16(unix.IFF_TUN | unix.IFF_NO_PI)
+	req.Flags = uint16(deviceFlags(tap) | unix.IFF_NO_PI)
 	if multiqueue {
 		req.Flags |= unix.IFF_MULTI_QUEUE
 	}
+	if offload {
+		req.Flags |= unix.IFF_VNET_HDR
+	}
 	copy(req.Name[:], c.GetString("tun.dev", ""))
 	if err = ioctl(uintptr(fd), uintptr(unix.TUNSETIFF), uintptr(unsafe.Pointer(&req))); err != nil {
 		return nil, err
 	}
 	name := strings.Trim(string(req.Name[:]), "\x00")
 
+	if offload {
+		if err = setOffloads(uintptr(fd)); err != nil {
+			// The queue still carries virtio headers, the kernel just segments everything before we see it
+			l.WithError(err).Warn("Failed to enable tun offloads")
+		}
+	}
+
 	file := os.NewFile(uintptr(fd), "/dev/net/tun")
 	t, err := newTunGeneric(c, l, file, cidr)
 	if err != nil {
@@ -118,6 +157,11 @@ func newTun(c *config.C, l *logrus.Logger, cidr netip.Prefix, multiqueue bool) (
 	}
 
 	t.Device = name
+	t.tap = tap
+	if offload {
+		t.offload = true
+		t.ReadWriteCloser = newOffloadQueue(file)
+	}
 
 	return t, nil
 }
@@ -137,17 +181,30 @@ func newTunGeneric(c *config.C, l *logrus.Logger, file *os.File, cidr netip.Pref
 		return nil, err
 	}
 
+	err = t.reloadExitNode(c, true)
+	if err != nil {
+		return nil, err
+	}
+
 	c.RegisterReloadCallback(func(c *config.C) {
 		err := t.reload(c, false)
 		if err != nil {
 			util.LogWithContextIfNeeded("failed to reload tun device", err, t.l)
 		}
+
+		err = t.reloadExitNode(c, false)
+		if err != nil {
+			util.LogWithContextIfNeeded("failed to reload tun.exit_node", err, t.l)
+		}
 	})
 
 	return t, nil
 }
 
 func (t *tun) reload(c *config.C, initial bool) error {
+	t.routesLock.Lock()
+	defer t.routesLock.Unlock()
+
 	routeChange, routes, err := getAllRoutesFromConfig(c, t.cidr, initial)
 	if err != nil {
 		return err
@@ -157,6 +214,11 @@ func (t *tun) reload(c *config.C, initial bool) error {
 		return nil
 	}
 
+	if routeChange {
+		t.configRoutes = routes
+	}
+	routes = joinLearnedRoutes(t.learnedRoutes, t.configRoutes)
+
 	routeTree, err := makeRouteTree(t.l, routes, true)
 	if err != nil {
 		return err
@@ -212,6 +274,41 @@ func (t *tun) reload(c *config.C, initial bool) error {
 	return nil
 }
 
+func (t *tun) SetLearnedRoutes(learned []Route) error {
+	t.routesLock.Lock()
+	defer t.routesLock.Unlock()
+
+	routes := joinLearnedRoutes(learned, t.configRoutes)
+	for i, r := range routes {
+		if r.MTU == 0 {
+			routes[i].MTU = t.DefaultMTU
+		}
+	}
+
+	routeTree, err := makeRouteTree(t.l, routes, true)
+	if err != nil {
+		return err
+	}
+
+	t.learnedRoutes = learned
+	oldRoutes := t.Routes.Swap(&routes)
+	t.routeTree.Store(routeTree)
+
+	// Activate installs whatever routes we have by then
+	if t.deviceIndex == 0 {
+		return nil
+	}
+
+	// A new gateway for the same network only changes the route tree
+	removed := findRemovedRoutes(routes, *oldRoutes)
+	if len(removed) == 0 && len(findRemovedRoutes(*oldRoutes, routes)) == 0 {
+		return nil
+	}
+
+	t.removeRoutes(removed)
+	return t.addRoutes(true)
+}
+
 func (t *tun) NewMultiQueueReader() (io.ReadWriteCloser, error) {
 	fd, err := unix.Open("/dev/net/tun", os.O_RDWR, 0)
 	if err != nil {
@@ -219,23 +316,44 @@ func (t *tun) NewMultiQueueReader() (io.ReadWriteCloser, error) {
 	}
 
 	var req ifReq
-	req.Flags = uint16(unix.IFF_TUN | unix.IFF_NO_PI | unix.IFF_MULTI_QUEUE)
+	req.Flags = uint16(deviceFlags(t.tap) | unix.IFF_NO_PI | unix.IFF_MULTI_QUEUE)
+	if t.offload {
+		req.Flags |= unix.IFF_VNET_HDR
+	}
 	copy(req.Name[:], t.Device)
 	if err = ioctl(uintptr(fd), uintptr(unix.TUNSETIFF), uintptr(unsafe.Pointer(&req))); err != nil {
 		return nil, err
 	}
 
 	file := os.NewFile(uintptr(fd), "/dev/net/tun")
+	if t.offload {
+		if err = setOffloads(uintptr(fd)); err != nil {
+			t.l.WithError(err).Warn("Failed to enable tun offloads")
+		}
+		return newOffloadQueue(file), nil
+	}
 
 	return file, nil
 }
 
+// deviceFlags picks the kind of device to open
+func deviceFlags(tap bool) int {
+	if tap {
+		return unix.IFF_TAP
+	}
+	return unix.IFF_TUN
+}
+
 func (t *tun) RouteFor(ip netip.Addr) netip.Addr {
 	r, _ := t.routeTree.Load().Lookup(ip)
 	return r
 }
 
 func (t *tun) Write(b []byte) (int, error) {
+	if q, ok := t.ReadWriteCloser.(*offloadQueue); ok {
+		return q.Write(b)
+	}
+
 	var nn int
 	max := len(b)
 
@@ -258,6 +376,30 @@ func (t *tun) Write(b []byte) (int, error) {
 	}
 }
 
+// Buffered is how many segments of a superpacket are still to be read
+func (t *tun) Buffered() int {
+	if q, ok := t.ReadWriteCloser.(*offloadQueue); ok {
+		return q.Buffered()
+	}
+	return 0
+}
+
+func (t *tun) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := t.ReadWriteCloser.(syscall.Conn)
+	if !ok {
+		return nil, syscall.EINVAL
+	}
+	return sc.SyscallConn()
+}
+
+func (t *tun) supportsSegments() bool {
+	return t.offload
+}
+
+func (t *tun) writeSegments(b []byte, ipLen, hdrLen, segment int) error {
+	return t.ReadWriteCloser.(*offloadQueue).writeSegments(b, ipLen, hdrLen, segment)
+}
+
 func (t *tun) deviceBytes() (o [16]byte) {
 	for i, c := range t.Device {
 		o[i] = byte(c)
@@ -334,7 +476,9 @@ func (t *tun) Activate() error {
 	if err != nil {
 		return fmt.Errorf("failed to get tun device link: %s", err)
 	}
+	t.routesLock.Lock()
 	t.deviceIndex = link.Attrs().Index
+	t.routesLock.Unlock()
 
 	if err = t.setDefaultRoute(); err != nil {
 		return err
@@ -345,6 +489,16 @@ func (t *tun) Activate() error {
 		return err
 	}
 
+	if err = t.addExitNode(); err != nil {
+		return err
+	}
+
+	if t.servesExitNode {
+		if err = t.serveExitNode(); err != nil {
+			return err
+		}
+	}
+
 	// Run the interface
 	ifrf.Flags = ifrf.Flags | unix.IFF_UP | unix.IFF_RUNNING
 	if err = ioctl(t.ioctlFd, unix.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifrf))); err != nil {
@@ -562,6 +716,14 @@ func (t *tun) Close() error {
 		close(t.routeChan)
 	}
 
+	// Nothing was installed if the device never came up
+	if t.deviceIndex > 0 {
+		t.removeExitNode()
+		if t.servesExitNode {
+			t.stopServingExitNode()
+		}
+	}
+
 	if t.ReadWriteCloser != nil {
 		t.ReadWriteCloser.Close()
 	}
@@ -0,0 +1,176 @@
+//go:build !android && !e2e_testing
+// +build !android,!e2e_testing
+
+package overlay
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// virtioNetHdrLen is the size of the struct virtio_net_hdr in front of every packet on a queue opened with
+	// IFF_VNET_HDR
+	virtioNetHdrLen = 10
+	// offloadReadSize fits the largest superpacket the kernel hands us
+	offloadReadSize = virtioNetHdrLen + 65535
+	// tunOffloads asks the kernel for tcp superpackets, they need checksum offload as well
+	tunOffloads = unix.TUN_F_CSUM | unix.TUN_F_TSO4 | unix.TUN_F_TSO6
+)
+
+// virtioNetHdr describes how the packet behind it is to be segmented and checksummed, see linux/virtio_net.h
+type virtioNetHdr struct {
+	flags      uint8
+	gsoType    uint8
+	hdrLen     uint16
+	gsoSize    uint16
+	csumStart  uint16
+	csumOffset uint16
+}
+
+func (h *virtioNetHdr) decode(b []byte) {
+	h.flags = b[0]
+	h.gsoType = b[1]
+	h.hdrLen = binary.NativeEndian.Uint16(b[2:])
+	h.gsoSize = binary.NativeEndian.Uint16(b[4:])
+	h.csumStart = binary.NativeEndian.Uint16(b[6:])
+	h.csumOffset = binary.NativeEndian.Uint16(b[8:])
+}
+
+func (h *virtioNetHdr) encode(b []byte) {
+	b[0] = h.flags
+	b[1] = h.gsoType
+	binary.NativeEndian.PutUint16(b[2:], h.hdrLen)
+	binary.NativeEndian.PutUint16(b[4:], h.gsoSize)
+	binary.NativeEndian.PutUint16(b[6:], h.csumStart)
+	binary.NativeEndian.PutUint16(b[8:], h.csumOffset)
+}
+
+// offloadQueue is a tun queue opened with IFF_VNET_HDR. Reads split the tcp superpackets from the kernel into mtu sized
+// segments one per call, writes take superpackets through writeSegments.
+type offloadQueue struct {
+	*os.File
+	fd int
+
+	buf []byte
+	// super is the superpacket still being handed out, next is the segment the next read returns
+	super   []byte
+	ipLen   int
+	hdrLen  int
+	segment int
+	next    int
+	count   int
+}
+
+func newOffloadQueue(file *os.File) *offloadQueue {
+	return &offloadQueue{
+		File: file,
+		fd:   int(file.Fd()),
+		buf:  make([]byte, offloadReadSize),
+	}
+}
+
+// setOffloads tells the kernel it may hand superpackets to the queue at fd
+func setOffloads(fd uintptr) error {
+	return ioctl(fd, unix.TUNSETOFFLOAD, tunOffloads)
+}
+
+func (q *offloadQueue) Read(p []byte) (int, error) {
+	for {
+		if q.next < q.count {
+			n := segmentTCP(p, q.super, q.ipLen, q.hdrLen, q.segment, q.next)
+			q.next++
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+
+		n, err := q.File.Read(q.buf)
+		if err != nil {
+			return 0, err
+		}
+		if n < virtioNetHdrLen {
+			continue
+		}
+
+		var h virtioNetHdr
+		h.decode(q.buf)
+		b := q.buf[virtioNetHdrLen:n]
+
+		switch h.gsoType &^ unix.VIRTIO_NET_HDR_GSO_ECN {
+		case unix.VIRTIO_NET_HDR_GSO_NONE:
+			if h.flags&unix.VIRTIO_NET_HDR_F_NEEDS_CSUM != 0 {
+				finishChecksum(b, int(h.csumStart), int(h.csumOffset))
+			}
+			if len(b) > len(p) {
+				continue
+			}
+			return copy(p, b), nil
+
+		case unix.VIRTIO_NET_HDR_GSO_TCPV4, unix.VIRTIO_NET_HDR_GSO_TCPV6:
+			// The tcp header starts where the checksum does
+			hdrLen, ok := superpacketHeaderLen(b, int(h.csumStart))
+			if !ok || h.gsoSize == 0 {
+				continue
+			}
+
+			q.super = b
+			q.ipLen = int(h.csumStart)
+			q.hdrLen = hdrLen
+			q.segment = int(h.gsoSize)
+			q.next = 0
+			q.count = segmentCount(b, hdrLen, q.segment)
+		}
+
+		// Anything else was not asked for and is dropped
+	}
+}
+
+// Buffered is how many segments of the last superpacket are still to be read
+func (q *offloadQueue) Buffered() int {
+	return q.count - q.next
+}
+
+// Write writes a single packet behind an empty virtio header
+func (q *offloadQueue) Write(p []byte) (int, error) {
+	var hdr [virtioNetHdrLen]byte
+	return q.writev(hdr[:], p)
+}
+
+func (q *offloadQueue) supportsSegments() bool {
+	return true
+}
+
+func (q *offloadQueue) writeSegments(b []byte, ipLen, hdrLen, segment int) error {
+	h := virtioNetHdr{
+		flags:      unix.VIRTIO_NET_HDR_F_NEEDS_CSUM,
+		gsoType:    unix.VIRTIO_NET_HDR_GSO_TCPV4,
+		hdrLen:     uint16(hdrLen),
+		gsoSize:    uint16(segment),
+		csumStart:  uint16(ipLen),
+		csumOffset: 16,
+	}
+	if b[0]>>4 == 6 {
+		h.gsoType = unix.VIRTIO_NET_HDR_GSO_TCPV6
+	}
+
+	var hdr [virtioNetHdrLen]byte
+	h.encode(hdr[:])
+	_, err := q.writev(hdr[:], b)
+	return err
+}
+
+func (q *offloadQueue) writev(hdr, p []byte) (int, error) {
+	n, err := unix.Writev(q.fd, [][]byte{hdr, p})
+	if err != nil {
+		return 0, err
+	}
+	if n < len(hdr)+len(p) {
+		return max(n-len(hdr), 0), io.ErrShortWrite
+	}
+	return len(p), nil
+}
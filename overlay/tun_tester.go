@@ -19,7 +19,7 @@ type TestTun struct {
 	Device    string
 	cidr      netip.Prefix
 	Routes    []Route
-	routeTree *bart.Table[netip.Addr]
+	routeTree atomic.Pointer[bart.Table[netip.Addr]]
 	l         *logrus.Logger
 
 	closed    atomic.Bool
@@ -37,15 +37,16 @@ func newTun(c *config.C, l *logrus.Logger, cidr netip.Prefix, _ bool) (*TestTun,
 		return nil, err
 	}
 
-	return &TestTun{
+	t := &TestTun{
 		Device:    c.GetString("tun.dev", ""),
 		cidr:      cidr,
 		Routes:    routes,
-		routeTree: routeTree,
 		l:         l,
 		rxPackets: make(chan []byte, 10),
 		TxPackets: make(chan []byte, 10),
-	}, nil
+	}
+	t.routeTree.Store(routeTree)
+	return t, nil
 }
 
 func newTunFromFd(_ *config.C, _ *logrus.Logger, _ int, _ netip.Prefix) (*TestTun, error) {
@@ -87,10 +88,19 @@ func (t *TestTun) Get(block bool) []byte {
 //********************************************************************************************************************//
 
 func (t *TestTun) RouteFor(ip netip.Addr) netip.Addr {
-	r, _ := t.routeTree.Lookup(ip)
+	r, _ := t.routeTree.Load().Lookup(ip)
 	return r
 }
 
+func (t *TestTun) SetLearnedRoutes(routes []Route) error {
+	routeTree, err := makeRouteTree(t.l, joinLearnedRoutes(routes, t.Routes), false)
+	if err != nil {
+		return err
+	}
+	t.routeTree.Store(routeTree)
+	return nil
+}
+
 func (t *TestTun) Activate() error {
 	return nil
 }
@@ -17,6 +17,7 @@ import (
 type PKI struct {
 	cs     atomic.Pointer[CertState]
 	caPool atomic.Pointer[cert.CAPool]
+	psk    atomic.Pointer[Psk]
 	l      *logrus.Logger
 }
 
@@ -54,6 +55,10 @@ func (p *PKI) GetCAPool() *cert.CAPool {
 	return p.caPool.Load()
 }
 
+func (p *PKI) GetPsk() *Psk {
+	return p.psk.Load()
+}
+
 func (p *PKI) reload(c *config.C, initial bool) error {
 	err := p.reloadCert(c, initial)
 	if err != nil {
@@ -71,6 +76,14 @@ func (p *PKI) reload(c *config.C, initial bool) error {
 		err.Log(p.l)
 	}
 
+	err = p.reloadPsk(c, initial)
+	if err != nil {
+		if initial {
+			return err
+		}
+		err.Log(p.l)
+	}
+
 	return nil
 }
 
@@ -116,6 +129,23 @@ func (p *PKI) reloadCAPool(c *config.C) *util.ContextualError {
 	return nil
 }
 
+func (p *PKI) reloadPsk(c *config.C, initial bool) *util.ContextualError {
+	if !initial && !c.HasChanged("pki.psk") && !c.HasChanged("pki.psk_mode") {
+		return nil
+	}
+
+	psk, err := NewPskFromConfig(c)
+	if err != nil {
+		return util.NewContextualError("Failed to load pki.psk from config", nil, err)
+	}
+
+	p.psk.Store(psk)
+	if !initial {
+		p.l.WithField("mode", psk.Mode()).WithField("keys", len(psk.keys)).Info("pki.psk has changed")
+	}
+	return nil
+}
+
 func newCertState(certificate cert.Certificate, pkcs11backed bool, privateKey []byte) (*CertState, error) {
 	// Marshal the certificate to ensure it is valid
 	rawCertificate, err := certificate.Marshal()
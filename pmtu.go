@@ -0,0 +1,303 @@
+package nebula
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/overlay"
+)
+
+const (
+	defaultPathMTUInterval = 10 * time.Minute
+
+	// pathMTUProbeTimeout is how long we wait for a probe reply before counting it as lost, probes are sent at this rate
+	pathMTUProbeTimeout = time.Second
+	// pathMTUProbeAttempts is how many probes of a size must go unanswered before we decide the size does not fit
+	pathMTUProbeAttempts = 2
+	// pathMTUPrecision is how close the search gets to the real path mtu before it stops
+	pathMTUPrecision = 8
+	// pathMTUFloor is the tunnel mtu we assume every path can carry, the search never goes below it
+	pathMTUFloor = 1200
+	// pathMTUCeiling is the largest probe that fits in our buffers with the header and aead tag
+	pathMTUCeiling = mtu - header.Len - 16
+)
+
+// Path mtu probes are tagged test payloads padded out to the size being probed. The layout is a single type byte
+// followed by a big endian probe sequence number, replies only echo this much back.
+const (
+	testProbePathMTU      = 2
+	pathMTUProbeHeaderLen = 9
+)
+
+// PathMTU discovers the largest inside packet each direct tunnel can carry by sending padded Test messages of
+// increasing size. Inside packets larger than the discovered mtu are answered with a packet too big message instead of
+// being silently lost in the underlay, and tcp syns are clamped so tcp never needs one.
+type PathMTU struct {
+	enabled  atomic.Bool
+	interval atomic.Int64
+	max      atomic.Int64
+	seq      atomic.Uint64
+
+	metricProbes  metrics.Counter
+	metricReplies metrics.Counter
+	metricTooBig  metrics.Counter
+	l             *logrus.Logger
+}
+
+// pathMTUState tracks the path mtu search for a single tunnel
+type pathMTUState struct {
+	sync.Mutex
+	// mtu is the largest inside packet known to make it through the tunnel, 0 until the first search completes
+	mtu atomic.Int64
+
+	// remote is the address the search ran against, a new address starts a new search
+	remote netip.AddrPort
+	// lo is the largest size known to fit, hi the largest size that may fit. hi is 0 while no search is running
+	lo, hi int
+	// probing is the size of the probe in flight, 0 when none is
+	probing  int
+	seq      uint64
+	attempts int
+	// nextSearch is when the mtu is next verified
+	nextSearch time.Time
+}
+
+func NewPathMTUFromConfig(l *logrus.Logger, c *config.C) *PathMTU {
+	pm := &PathMTU{
+		metricProbes:  metrics.GetOrRegisterCounter("pmtu.probes.sent", nil),
+		metricReplies: metrics.GetOrRegisterCounter("pmtu.probes.received", nil),
+		metricTooBig:  metrics.GetOrRegisterCounter("pmtu.too_big", nil),
+		l:             l,
+	}
+
+	pm.reload(c, true)
+	c.RegisterReloadCallback(func(c *config.C) {
+		pm.reload(c, false)
+	})
+
+	return pm
+}
+
+func (pm *PathMTU) reload(c *config.C, initial bool) {
+	if initial || c.HasChanged("pmtu.enabled") {
+		pm.enabled.Store(c.GetBool("pmtu.enabled", false))
+		if !initial {
+			pm.l.WithField("enabled", pm.GetEnabled()).Info("pmtu.enabled has changed")
+		}
+	}
+
+	if initial || c.HasChanged("pmtu.interval") {
+		pm.interval.Store(int64(c.GetDuration("pmtu.interval", defaultPathMTUInterval)))
+		if !initial {
+			pm.l.WithField("interval", pm.GetInterval()).Info("pmtu.interval has changed")
+		}
+	}
+
+	if initial || c.HasChanged("tun") {
+		pm.max.Store(int64(pathMTUMax(c)))
+	}
+}
+
+// pathMTUMax is the largest mtu we search for, there is no point in probing for more than the tun device or any of its
+// routes will ever hand us
+func pathMTUMax(c *config.C) int {
+	m := c.GetInt("tun.mtu", overlay.DefaultMTU)
+	for _, key := range []string{"tun.routes", "tun.unsafe_routes"} {
+		routes, _ := c.Get(key).([]interface{})
+		for _, r := range routes {
+			route, _ := r.(map[interface{}]interface{})
+			if rm, err := strconv.Atoi(fmt.Sprintf("%v", route["mtu"])); err == nil && rm > m {
+				m = rm
+			}
+		}
+	}
+
+	return min(m, pathMTUCeiling)
+}
+
+func (pm *PathMTU) GetEnabled() bool {
+	return pm != nil && pm.enabled.Load()
+}
+
+func (pm *PathMTU) GetInterval() time.Duration {
+	return time.Duration(pm.interval.Load())
+}
+
+// MTU returns the discovered mtu for the tunnel, 0 if it is not known or discovery is disabled
+func (pm *PathMTU) MTU(hostinfo *HostInfo) int {
+	if !pm.GetEnabled() {
+		return 0
+	}
+	return int(hostinfo.pmtu.mtu.Load())
+}
+
+// Run steps the search of every tunnel once per probe timeout until the context is done
+func (pm *PathMTU) Run(ctx context.Context, f *Interface) {
+	t := time.NewTicker(pathMTUProbeTimeout)
+	defer t.Stop()
+
+	nb := make([]byte, 12, 12)
+	out := make([]byte, mtu)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			if !pm.GetEnabled() {
+				continue
+			}
+
+			f.hostMap.RLock()
+			hostinfos := make([]*HostInfo, 0, len(f.hostMap.Hosts))
+			for _, hostinfo := range f.hostMap.Hosts {
+				hostinfos = append(hostinfos, hostinfo)
+			}
+			f.hostMap.RUnlock()
+
+			for _, hostinfo := range hostinfos {
+				pm.step(hostinfo, now, func(p []byte) {
+					f.SendMessageToHostInfo(header.Test, header.TestRequest, hostinfo, p, nb, out)
+				})
+			}
+		}
+	}
+}
+
+// step moves the search for a tunnel along by one probe
+func (pm *PathMTU) step(hostinfo *HostInfo, now time.Time, send func([]byte)) {
+	s := &hostinfo.pmtu
+	s.Lock()
+
+	remote := hostinfo.remote
+	if remote != s.remote {
+		// Relayed tunnels are not measured and a new path needs a new search
+		s.mtu.Store(0)
+		s.remote = remote
+		s.hi = 0
+		s.probing = 0
+		s.nextSearch = now
+	}
+
+	if !remote.IsValid() {
+		s.Unlock()
+		return
+	}
+
+	if s.probing != 0 {
+		// The probe from the last round went unanswered
+		s.attempts++
+		if s.attempts >= pathMTUProbeAttempts {
+			s.hi = s.probing - 1
+			s.probing = 0
+		}
+
+	} else if s.hi == 0 {
+		if now.Before(s.nextSearch) {
+			s.Unlock()
+			return
+		}
+
+		s.hi = int(pm.max.Load())
+		s.lo = min(pathMTUFloor, s.hi)
+	}
+
+	if s.probing == 0 && s.hi-s.lo < pathMTUPrecision {
+		// The search is done, lo is the largest size we know makes it through
+		found := int64(s.lo)
+		old := s.mtu.Swap(found)
+		s.hi = 0
+		s.nextSearch = now.Add(pm.GetInterval())
+		s.Unlock()
+
+		if old != found {
+			hostinfo.logger(pm.l).WithField("mtu", found).WithField("previousMtu", old).
+				Info("Discovered the path mtu of the tunnel")
+		}
+		return
+	}
+
+	if s.probing == 0 {
+		s.probing = (s.lo + s.hi + 1) / 2
+		s.attempts = 0
+	}
+
+	s.seq = pm.seq.Add(1)
+	p := make([]byte, s.probing)
+	p[0] = testProbePathMTU
+	binary.BigEndian.PutUint64(p[1:], s.seq)
+	s.Unlock()
+
+	pm.metricProbes.Inc(1)
+	send(p)
+}
+
+// handleTestReply records a successful probe, it returns false if p was not a path mtu probe
+func (pm *PathMTU) handleTestReply(hostinfo *HostInfo, p []byte) bool {
+	if pm == nil || len(p) < pathMTUProbeHeaderLen || p[0] != testProbePathMTU {
+		return false
+	}
+
+	seq := binary.BigEndian.Uint64(p[1:])
+
+	s := &hostinfo.pmtu
+	s.Lock()
+	defer s.Unlock()
+
+	if s.probing == 0 || s.seq != seq {
+		// Late or unsolicited, the size was already decided
+		return true
+	}
+
+	pm.metricReplies.Inc(1)
+	s.lo = s.probing
+	s.probing = 0
+	return true
+}
+
+// pathMTUTestReply is the payload to answer a test request with. Path mtu probes only measure the path towards us so
+// the padding is not sent back.
+func pathMTUTestReply(p []byte) []byte {
+	if len(p) > pathMTUProbeHeaderLen && p[0] == testProbePathMTU {
+		return p[:pathMTUProbeHeaderLen]
+	}
+	return p
+}
+
+// enforcePathMTU clamps tcp syns to the discovered mtu of the tunnel and answers inside packets that do not fit with a
+// packet too big message. It returns false if packet must not be sent.
+func (f *Interface) enforcePathMTU(hostinfo *HostInfo, packet, out []byte, q int) bool {
+	m := f.pmtu.MTU(hostinfo)
+	if m == 0 {
+		return true
+	}
+
+	if len(packet) <= m {
+		iputil.ClampTCPMSS(packet, m)
+		return true
+	}
+
+	out = iputil.CreatePacketTooBig(packet, m, out)
+	if len(out) == 0 {
+		// The sender allows fragmentation, which we can not do. Send it anyway and hope for the best
+		return true
+	}
+
+	f.pmtu.metricTooBig.Inc(1)
+	_, err := f.readers[q].Write(out)
+	if err != nil {
+		f.l.WithError(err).Error("Failed to write to tun")
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPathMTU_search(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["pmtu"] = map[interface{}]interface{}{"enabled": true}
+	c.Settings["tun"] = map[interface{}]interface{}{"mtu": 9000}
+	pm := NewPathMTUFromConfig(l, c)
+
+	hostinfo := &HostInfo{remote: netip.MustParseAddrPort("1.1.1.1:4242")}
+	now := time.Now()
+
+	// A path that carries 1500 byte ip packets, our overhead is the ip, udp, nebula headers and the aead tag
+	pathLimit := 1500 - 20 - 8 - 16 - 16
+	var sent []byte
+	send := func(p []byte) { sent = p }
+
+	for i := 0; i < 100 && pm.MTU(hostinfo) == 0; i++ {
+		sent = nil
+		pm.step(hostinfo, now, send)
+		now = now.Add(pathMTUProbeTimeout)
+
+		if sent == nil {
+			continue
+		}
+
+		require.Equal(t, byte(testProbePathMTU), sent[0])
+		if len(sent) <= pathLimit {
+			assert.True(t, pm.handleTestReply(hostinfo, pathMTUTestReply(sent)))
+		}
+	}
+
+	m := pm.MTU(hostinfo)
+	assert.LessOrEqual(t, m, pathLimit)
+	assert.Greater(t, m, pathLimit-pathMTUPrecision)
+
+	// Nothing happens until the interval has passed
+	sent = nil
+	pm.step(hostinfo, now, send)
+	assert.Nil(t, sent)
+	pm.step(hostinfo, now.Add(defaultPathMTUInterval), send)
+	assert.NotNil(t, sent)
+
+	// A new path starts over
+	hostinfo.remote = netip.MustParseAddrPort("2.2.2.2:4242")
+	pm.step(hostinfo, now, send)
+	assert.Zero(t, pm.MTU(hostinfo))
+
+	// Relayed tunnels are not measured
+	sent = nil
+	hostinfo.remote = netip.AddrPort{}
+	pm.step(hostinfo, now, send)
+	assert.Nil(t, sent)
+	assert.Zero(t, pm.MTU(hostinfo))
+
+	// Disabled discovery does not enforce anything
+	hostinfo.pmtu.mtu.Store(1300)
+	assert.Equal(t, 1300, pm.MTU(hostinfo))
+	pm.enabled.Store(false)
+	assert.Zero(t, pm.MTU(hostinfo))
+	assert.Zero(t, (*PathMTU)(nil).MTU(hostinfo))
+}
+
+func TestPathMTU_handleTestReply(t *testing.T) {
+	l := test.NewLogger()
+	pm := NewPathMTUFromConfig(l, config.NewC(l))
+	hostinfo := &HostInfo{}
+
+	// Relay probes and anything else are left alone
+	assert.False(t, pm.handleTestReply(hostinfo, []byte{testProbeRelay, 0, 0, 0, 0, 0, 0, 0, 1}))
+	assert.False(t, pm.handleTestReply(hostinfo, nil))
+
+	// Stale replies are ignored
+	hostinfo.pmtu.probing = 1400
+	hostinfo.pmtu.seq = 2
+	p := make([]byte, pathMTUProbeHeaderLen)
+	p[0] = testProbePathMTU
+	binary.BigEndian.PutUint64(p[1:], 1)
+	assert.True(t, pm.handleTestReply(hostinfo, p))
+	assert.Equal(t, 1400, hostinfo.pmtu.probing)
+
+	binary.BigEndian.PutUint64(p[1:], 2)
+	assert.True(t, pm.handleTestReply(hostinfo, p))
+	assert.Zero(t, hostinfo.pmtu.probing)
+	assert.Equal(t, 1400, hostinfo.pmtu.lo)
+}
+
+func TestPathMTUTestReply(t *testing.T) {
+	probe := make([]byte, 1400)
+	probe[0] = testProbePathMTU
+	assert.Len(t, pathMTUTestReply(probe), pathMTUProbeHeaderLen)
+
+	other := []byte("hello")
+	assert.Equal(t, other, pathMTUTestReply(other))
+}
+
+func TestPathMTUMax(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	assert.Equal(t, 1300, pathMTUMax(c))
+
+	c.Settings["tun"] = map[interface{}]interface{}{
+		"mtu": 1400,
+		"routes": []interface{}{
+			map[interface{}]interface{}{"mtu": 8800, "route": "10.0.0.0/16"},
+		},
+		"unsafe_routes": []interface{}{
+			map[interface{}]interface{}{"route": "172.16.1.0/24", "via": "192.168.100.99"},
+		},
+	}
+	assert.Equal(t, 8800, pathMTUMax(c))
+
+	c.Settings["tun"] = map[interface{}]interface{}{"mtu": 65000}
+	assert.Equal(t, pathMTUCeiling, pathMTUMax(c))
+}
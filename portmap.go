@@ -0,0 +1,42 @@
+package nebula
+
+import (
+	"net/netip"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/portmap"
+	"github.com/slackhq/nebula/util"
+)
+
+// NewPortMapFromConfig builds the port mapper for listen.port from listen.port_mapping, nil is returned when it is
+// disabled. onChange is called whenever the public address of the mapping changes.
+func NewPortMapFromConfig(l *logrus.Logger, c *config.C, port uint16, onChange func(netip.AddrPort)) (*portmap.Mapper, error) {
+	const key = "listen.port_mapping"
+	if !c.GetBool(key+".enabled", false) {
+		return nil, nil
+	}
+
+	pc := portmap.Config{
+		Methods:  c.GetStringSlice(key+".methods", portmap.Methods),
+		Lifetime: c.GetDuration(key+".lifetime", portmap.DefaultLifetime),
+		Timeout:  c.GetDuration(key+".timeout", portmap.DefaultTimeout),
+		OnChange: onChange,
+	}
+
+	if rawGateway := c.GetString(key+".gateway", ""); rawGateway != "" {
+		var err error
+		pc.Gateway, err = netip.ParseAddr(strings.Trim(rawGateway, "[]"))
+		if err != nil {
+			return nil, util.NewContextualError("Failed to parse "+key+".gateway", m{"gateway": rawGateway}, err)
+		}
+	}
+
+	pm, err := portmap.New(l, pc, port)
+	if err != nil {
+		return nil, util.NewContextualError("Invalid "+key+".methods", m{"methods": pc.Methods}, err)
+	}
+
+	return pm, nil
+}
@@ -0,0 +1,14 @@
+package portmap
+
+import (
+	"net/netip"
+	"os"
+)
+
+func defaultGateway() (netip.Addr, error) {
+	b, err := os.ReadFile("/proc/net/route")
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return parseProcNetRoute(b)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package portmap
+
+import (
+	"errors"
+	"net/netip"
+)
+
+func defaultGateway() (netip.Addr, error) {
+	return netip.Addr{}, errors.New("finding the default gateway is not supported on this platform, set it in the config")
+}
@@ -0,0 +1,115 @@
+package portmap
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// NAT-PMP is RFC 6886, the predecessor of PCP that many home routers still only speak
+const (
+	natPMPVersion        = 0
+	natPMPOpExternalAddr = 0
+	natPMPOpMapUDP       = 1
+	natPMPOpResponse     = 128
+)
+
+var natPMPResults = map[uint16]string{
+	1: "unsupported version",
+	2: "not authorized",
+	3: "network failure",
+	4: "out of resources",
+	5: "unsupported opcode",
+}
+
+type natPMPClient struct {
+	gateway func() (netip.AddrPort, error)
+}
+
+func (c *natPMPClient) String() string {
+	return "natpmp"
+}
+
+func (c *natPMPClient) mapPort(ctx context.Context, internal, external uint16, lifetime time.Duration) (netip.AddrPort, time.Duration, error) {
+	gateway, err := c.gateway()
+	if err != nil {
+		return netip.AddrPort{}, 0, err
+	}
+
+	port, granted, err := c.request(ctx, gateway, internal, external, uint32(lifetime/time.Second))
+	if err != nil {
+		return netip.AddrPort{}, 0, err
+	}
+
+	// Unlike PCP the mapping does not tell us the public address, that takes another request
+	b, err := c.roundTrip(ctx, gateway, []byte{natPMPVersion, natPMPOpExternalAddr}, natPMPOpExternalAddr, 12)
+	if err != nil {
+		return netip.AddrPort{}, 0, fmt.Errorf("failed to get the external address: %w", err)
+	}
+
+	return netip.AddrPortFrom(netip.AddrFrom4([4]byte(b[8:12])), port), granted, nil
+}
+
+func (c *natPMPClient) unmapPort(ctx context.Context, internal, _ uint16) error {
+	gateway, err := c.gateway()
+	if err != nil {
+		return err
+	}
+
+	// A lifetime and external port of 0 deletes the mapping
+	_, _, err = c.request(ctx, gateway, internal, 0, 0)
+	return err
+}
+
+func (c *natPMPClient) request(ctx context.Context, gateway netip.AddrPort, internal, external uint16, lifetime uint32) (uint16, time.Duration, error) {
+	req := make([]byte, 12)
+	req[0] = natPMPVersion
+	req[1] = natPMPOpMapUDP
+	binary.BigEndian.PutUint16(req[4:], internal)
+	binary.BigEndian.PutUint16(req[6:], external)
+	binary.BigEndian.PutUint32(req[8:], lifetime)
+
+	b, err := c.roundTrip(ctx, gateway, req, natPMPOpMapUDP, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if binary.BigEndian.Uint16(b[8:]) != internal {
+		return 0, 0, fmt.Errorf("gateway mapped internal port %d instead of %d", binary.BigEndian.Uint16(b[8:]), internal)
+	}
+
+	return binary.BigEndian.Uint16(b[10:]), time.Duration(binary.BigEndian.Uint32(b[12:])) * time.Second, nil
+}
+
+// roundTrip sends req and returns the reply to op, which must be at least size bytes
+func (c *natPMPClient) roundTrip(ctx context.Context, gateway netip.AddrPort, req []byte, op byte, size int) ([]byte, error) {
+	conn, _, err := dialGateway(ctx, gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	b, err := roundTrip(ctx, conn, req, func(b []byte) bool {
+		// Every reply carries the result code, even when it is too short for the rest
+		return len(b) >= 4 && b[0] == natPMPVersion && b[1] == natPMPOpResponse|op
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result := binary.BigEndian.Uint16(b[2:]); result != 0 {
+		reason, ok := natPMPResults[result]
+		if !ok {
+			reason = fmt.Sprintf("result %d", result)
+		}
+		return nil, fmt.Errorf("gateway refused the request: %s", reason)
+	}
+
+	if len(b) < size {
+		return nil, fmt.Errorf("reply of %d bytes is too short", len(b))
+	}
+
+	return b, nil
+}
@@ -0,0 +1,126 @@
+package portmap
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// PCP is RFC 6887, we only use the MAP opcode for udp
+const (
+	pcpVersion     = 2
+	pcpOpMap       = 1
+	pcpOpResponse  = 0x80
+	pcpProtoUDP    = 17
+	pcpMapLen      = 60
+	pcpResultOk    = 0
+	pcpNonceOffset = 24
+)
+
+var pcpResults = map[byte]string{
+	1:  "unsupported version",
+	2:  "not authorized",
+	3:  "malformed request",
+	4:  "unsupported opcode",
+	5:  "unsupported option",
+	6:  "malformed option",
+	7:  "network failure",
+	8:  "no resources",
+	9:  "unsupported protocol",
+	10: "user exceeded quota",
+	11: "cannot provide external",
+	12: "address mismatch",
+	13: "excessive remote peers",
+}
+
+// errPCPUnsupported is returned when the gateway answers with a NAT-PMP packet, it only speaks the older protocol
+var errPCPUnsupported = errors.New("gateway does not support pcp")
+
+type pcpClient struct {
+	gateway func() (netip.AddrPort, error)
+	// nonce identifies our mapping to the gateway, renewing or deleting it needs the same nonce
+	nonce [12]byte
+}
+
+func newPCPClient(gateway func() (netip.AddrPort, error)) *pcpClient {
+	c := &pcpClient{gateway: gateway}
+	_, _ = rand.Read(c.nonce[:])
+	return c
+}
+
+func (c *pcpClient) String() string {
+	return "pcp"
+}
+
+func (c *pcpClient) mapPort(ctx context.Context, internal, external uint16, lifetime time.Duration) (netip.AddrPort, time.Duration, error) {
+	return c.request(ctx, internal, external, uint32(lifetime/time.Second))
+}
+
+func (c *pcpClient) unmapPort(ctx context.Context, internal, external uint16) error {
+	_, _, err := c.request(ctx, internal, 0, 0)
+	return err
+}
+
+func (c *pcpClient) request(ctx context.Context, internal, external uint16, lifetime uint32) (netip.AddrPort, time.Duration, error) {
+	gateway, err := c.gateway()
+	if err != nil {
+		return netip.AddrPort{}, 0, err
+	}
+
+	conn, local, err := dialGateway(ctx, gateway)
+	if err != nil {
+		return netip.AddrPort{}, 0, err
+	}
+	defer conn.Close()
+
+	req := make([]byte, pcpMapLen)
+	req[0] = pcpVersion
+	req[1] = pcpOpMap
+	binary.BigEndian.PutUint32(req[4:], lifetime)
+	// Ipv4 addresses are sent ipv4 mapped
+	ip := local.As16()
+	copy(req[8:24], ip[:])
+	copy(req[pcpNonceOffset:pcpNonceOffset+12], c.nonce[:])
+	req[36] = pcpProtoUDP
+	binary.BigEndian.PutUint16(req[40:], internal)
+	binary.BigEndian.PutUint16(req[42:], external)
+	// We have no preference for the external address, the unspecified address of our family says so
+	suggested := netip.IPv6Unspecified().As16()
+	if local.Is4() {
+		suggested = netip.AddrFrom4([4]byte{}).As16()
+	}
+	copy(req[44:60], suggested[:])
+
+	b, err := roundTrip(ctx, conn, req, func(b []byte) bool {
+		if len(b) >= 4 && b[0] == 0 {
+			// A NAT-PMP gateway answering with its own version
+			return true
+		}
+		return len(b) >= pcpMapLen && b[0] == pcpVersion && b[1] == pcpOpResponse|pcpOpMap &&
+			bytes.Equal(b[pcpNonceOffset:pcpNonceOffset+12], c.nonce[:])
+	})
+	if err != nil {
+		return netip.AddrPort{}, 0, err
+	}
+
+	if b[0] == 0 {
+		return netip.AddrPort{}, 0, errPCPUnsupported
+	}
+
+	if b[3] != pcpResultOk {
+		reason, ok := pcpResults[b[3]]
+		if !ok {
+			reason = fmt.Sprintf("result %d", b[3])
+		}
+		return netip.AddrPort{}, 0, fmt.Errorf("gateway refused the mapping: %s", reason)
+	}
+
+	granted := time.Duration(binary.BigEndian.Uint32(b[4:])) * time.Second
+	addr := netip.AddrFrom16([16]byte(b[44:60])).Unmap()
+	return netip.AddrPortFrom(addr, binary.BigEndian.Uint16(b[42:])), granted, nil
+}
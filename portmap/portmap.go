@@ -0,0 +1,340 @@
+// Package portmap asks the gateway in front of us to forward a public udp port to our listen port. PCP, NAT-PMP and
+// UPnP-IGD are tried in turn until one of them works, and the mapping is renewed for as long as it is needed.
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultLifetime = 2 * time.Hour
+	DefaultTimeout  = 3 * time.Second
+
+	// gatewayPort is where PCP and NAT-PMP servers listen
+	gatewayPort = 5351
+
+	// minRenewInterval keeps a gateway that hands out very short lifetimes from having us renew in a tight loop
+	minRenewInterval = 10 * time.Second
+	retryInterval    = time.Minute
+	maxRetryInterval = 30 * time.Minute
+
+	// initialResend is the first retransmission delay for PCP and NAT-PMP requests, it doubles with every resend
+	initialResend = 250 * time.Millisecond
+)
+
+// Methods are the supported protocols, in the order they are tried by default
+var Methods = []string{"pcp", "natpmp", "upnp"}
+
+// Config describes how a Mapper finds the gateway and maps the port
+type Config struct {
+	// Gateway is where PCP and NAT-PMP requests are sent, the default gateway is used if it is invalid
+	Gateway netip.Addr
+	// Methods are the protocols to try, in order. Defaults to Methods.
+	Methods []string
+	// Lifetime is how long to ask for the mapping to last, it is renewed halfway through
+	Lifetime time.Duration
+	// Timeout bounds a single attempt with each protocol
+	Timeout time.Duration
+	// OnChange is called with the new public address whenever it changes, the address is invalid when it was lost
+	OnChange func(netip.AddrPort)
+}
+
+// client is one port mapping protocol
+type client interface {
+	// String names the protocol in logs
+	String() string
+	// mapPort asks for external to be forwarded to internal for lifetime. The public address and the lifetime the
+	// gateway granted are returned, a lifetime of 0 means the mapping does not expire.
+	mapPort(ctx context.Context, internal, external uint16, lifetime time.Duration) (netip.AddrPort, time.Duration, error)
+	// unmapPort removes a mapping made by mapPort
+	unmapPort(ctx context.Context, internal, external uint16) error
+}
+
+// Mapper keeps a public port mapped to a local udp port
+type Mapper struct {
+	l        *logrus.Logger
+	port     uint16
+	lifetime time.Duration
+	timeout  time.Duration
+	clients  []client
+	onChange func(netip.AddrPort)
+
+	// lock is held while talking to the gateway, active is the client that holds the current mapping
+	lock   sync.Mutex
+	active client
+	closed bool
+
+	addr atomic.Pointer[netip.AddrPort]
+}
+
+// New builds a Mapper for the udp port, nothing is mapped until Run is called
+func New(l *logrus.Logger, config Config, port uint16) (*Mapper, error) {
+	methods := config.Methods
+	if len(methods) == 0 {
+		methods = Methods
+	}
+
+	gateway := func() (netip.AddrPort, error) {
+		addr := config.Gateway
+		if !addr.IsValid() {
+			var err error
+			addr, err = defaultGateway()
+			if err != nil {
+				return netip.AddrPort{}, fmt.Errorf("failed to find the default gateway: %w", err)
+			}
+		}
+		return netip.AddrPortFrom(addr, gatewayPort), nil
+	}
+
+	var clients []client
+	for _, method := range methods {
+		switch method {
+		case "pcp":
+			clients = append(clients, newPCPClient(gateway))
+		case "natpmp":
+			clients = append(clients, &natPMPClient{gateway: gateway})
+		case "upnp":
+			clients = append(clients, newUPnPClient(ssdpAddr))
+		default:
+			return nil, fmt.Errorf("unknown port mapping method %q, expected one of %v", method, Methods)
+		}
+	}
+
+	return newMapper(l, config, port, clients), nil
+}
+
+func newMapper(l *logrus.Logger, config Config, port uint16, clients []client) *Mapper {
+	if config.Lifetime <= 0 {
+		config.Lifetime = DefaultLifetime
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+
+	m := &Mapper{
+		l:        l,
+		port:     port,
+		lifetime: config.Lifetime,
+		timeout:  config.Timeout,
+		clients:  clients,
+		onChange: config.OnChange,
+	}
+	m.addr.Store(&netip.AddrPort{})
+	return m
+}
+
+// Addr is the public address of the mapping, it is invalid while there is none
+func (m *Mapper) Addr() netip.AddrPort {
+	return *m.addr.Load()
+}
+
+// Run maps the port and keeps renewing it until ctx is done. The mapping is left in place, Close removes it.
+func (m *Mapper) Run(ctx context.Context) {
+	retry := retryInterval
+	for {
+		wait := retry
+		lifetime, err := m.refresh(ctx)
+		switch {
+		case errors.Is(err, net.ErrClosed):
+			return
+		case err != nil:
+			m.l.WithError(err).WithField("port", m.port).WithField("retryIn", retry).Info("Failed to map a public port")
+			retry = min(retry*2, maxRetryInterval)
+		default:
+			retry = retryInterval
+			if lifetime <= 0 {
+				lifetime = m.lifetime
+			}
+			wait = max(lifetime/2, minRenewInterval)
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// refresh renews the mapping with the client that holds it, or tries every client if there is none or renewing fails
+func (m *Mapper) refresh(ctx context.Context) (time.Duration, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return 0, net.ErrClosed
+	}
+
+	clients := m.clients
+	if m.active != nil {
+		clients = []client{m.active}
+		for _, c := range m.clients {
+			if c != m.active {
+				clients = append(clients, c)
+			}
+		}
+	}
+
+	var errs []error
+	for _, c := range clients {
+		// Ask for the port we already have, or the same port as ours for a new mapping
+		external := m.port
+		if c == m.active {
+			external = m.Addr().Port()
+		}
+
+		actx, cancel := context.WithTimeout(ctx, m.timeout)
+		addr, lifetime, err := c.mapPort(actx, m.port, external, m.lifetime)
+		cancel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c, err))
+			continue
+		}
+
+		if m.active != c {
+			m.l.WithField("port", m.port).WithField("method", c).WithField("lifetime", lifetime).Info("Mapped a public port")
+		}
+		m.active = c
+		m.setAddr(addr)
+		return lifetime, nil
+	}
+
+	m.active = nil
+	m.setAddr(netip.AddrPort{})
+	return 0, errors.Join(errs...)
+}
+
+func (m *Mapper) setAddr(addr netip.AddrPort) {
+	old := m.addr.Swap(&addr)
+	if *old == addr {
+		return
+	}
+
+	m.l.WithField("port", m.port).WithField("publicAddr", addr).Info("Public port mapping changed")
+	if m.onChange != nil {
+		m.onChange(addr)
+	}
+}
+
+// Close removes the mapping from the gateway and stops Run from making another
+func (m *Mapper) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+
+	if m.active == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+	err := m.active.unmapPort(ctx, m.port, m.Addr().Port())
+	m.active = nil
+	m.addr.Store(&netip.AddrPort{})
+	if err != nil {
+		return fmt.Errorf("failed to remove the port mapping: %w", err)
+	}
+
+	m.l.WithField("port", m.port).Info("Removed the public port mapping")
+	return nil
+}
+
+// dialGateway opens a udp socket to the gateway, its local address is the one the gateway sees us as
+func dialGateway(ctx context.Context, gateway netip.AddrPort) (*net.UDPConn, netip.Addr, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", gateway.String())
+	if err != nil {
+		return nil, netip.Addr{}, err
+	}
+
+	local := conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap()
+	return conn.(*net.UDPConn), local, nil
+}
+
+// roundTrip sends req until a reply that accept likes arrives or ctx is done. The resend delay starts at 250ms and
+// doubles like RFC 6886 and RFC 6887 ask for.
+func roundTrip(ctx context.Context, conn *net.UDPConn, req []byte, accept func([]byte) bool) ([]byte, error) {
+	b := make([]byte, 1100)
+	resend := initialResend
+	for {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(resend)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		_ = conn.SetReadDeadline(deadline)
+
+		for {
+			n, err := conn.Read(b)
+			if err != nil {
+				var ne net.Error
+				if !errors.As(err, &ne) || !ne.Timeout() {
+					// Usually icmp port unreachable, nothing is listening on the gateway
+					return nil, err
+				}
+				break
+			}
+
+			if accept(b[:n]) {
+				return b[:n], nil
+			}
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		resend *= 2
+	}
+}
+
+// parseProcNetRoute finds the default gateway in the contents of /proc/net/route
+func parseProcNetRoute(b []byte) (netip.Addr, error) {
+	s := bufio.NewScanner(bytes.NewReader(b))
+	// Skip the header
+	s.Scan()
+	for s.Scan() {
+		fields := bytes.Fields(s.Bytes())
+		if len(fields) < 4 || string(fields[1]) != "00000000" {
+			continue
+		}
+
+		flags, err := strconv.ParseUint(string(fields[3]), 16, 16)
+		if err != nil || flags&0x2 == 0 {
+			// Not RTF_GATEWAY
+			continue
+		}
+
+		gw, err := hex.DecodeString(string(fields[2]))
+		if err != nil || len(gw) != 4 {
+			continue
+		}
+
+		// The kernel prints the network order address as a host order number
+		var ip [4]byte
+		binary.NativeEndian.PutUint32(ip[:], binary.BigEndian.Uint32(gw))
+		return netip.AddrFrom4(ip), nil
+	}
+
+	return netip.Addr{}, errors.New("no default route")
+}
@@ -0,0 +1,356 @@
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testPublicIP = netip.MustParseAddr("203.0.113.7")
+
+func newTestLogger() *logrus.Logger {
+	l := logrus.New()
+	l.Out = io.Discard
+	return l
+}
+
+// testGateway records the mappings a stand-in gateway holds, by internal port
+type testGateway struct {
+	sync.Mutex
+	mappings map[uint16]uint16
+	lifetime uint32
+}
+
+func (g *testGateway) set(internal, external uint16, lifetime uint32) uint16 {
+	g.Lock()
+	defer g.Unlock()
+	if lifetime == 0 {
+		delete(g.mappings, internal)
+		return 0
+	}
+
+	// Hand out a different port than asked for to make sure the client listens
+	if _, ok := g.mappings[internal]; !ok {
+		g.mappings[internal] = external + 1000
+	}
+	return g.mappings[internal]
+}
+
+func (g *testGateway) get(internal uint16) (uint16, bool) {
+	g.Lock()
+	defer g.Unlock()
+	p, ok := g.mappings[internal]
+	return p, ok
+}
+
+// listenUDPGateway runs handle for every packet sent to a local udp socket
+func listenUDPGateway(t *testing.T, handle func(req []byte, from netip.AddrPort) []byte) (netip.AddrPort, *testGateway) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		b := make([]byte, 1100)
+		for {
+			n, from, err := conn.ReadFromUDPAddrPort(b)
+			if err != nil {
+				return
+			}
+			if res := handle(b[:n], from); res != nil {
+				_, _ = conn.WriteToUDPAddrPort(res, from)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort(), &testGateway{mappings: map[uint16]uint16{}, lifetime: 60}
+}
+
+// listenPCPGateway runs a stand-in PCP server
+func listenPCPGateway(t *testing.T) (netip.AddrPort, *testGateway) {
+	var g *testGateway
+	addr, g := listenUDPGateway(t, func(req []byte, from netip.AddrPort) []byte {
+		if len(req) != pcpMapLen || req[0] != pcpVersion || req[1] != pcpOpMap || req[36] != pcpProtoUDP {
+			return nil
+		}
+
+		res := append([]byte{}, req...)
+		res[1] |= pcpOpResponse
+		if netip.AddrFrom16([16]byte(req[8:24])).Unmap() != from.Addr() {
+			res[3] = 12
+			return res
+		}
+
+		lifetime := min(binary.BigEndian.Uint32(req[4:]), g.lifetime)
+		binary.BigEndian.PutUint32(res[4:], lifetime)
+		binary.BigEndian.PutUint16(res[42:], g.set(binary.BigEndian.Uint16(req[40:]), binary.BigEndian.Uint16(req[42:]), lifetime))
+		ip := testPublicIP.As16()
+		copy(res[44:], ip[:])
+		return res
+	})
+	return addr, g
+}
+
+// listenNATPMPGateway runs a stand-in NAT-PMP server, it answers PCP requests like a real NAT-PMP only gateway
+func listenNATPMPGateway(t *testing.T) (netip.AddrPort, *testGateway) {
+	var g *testGateway
+	addr, g := listenUDPGateway(t, func(req []byte, _ netip.AddrPort) []byte {
+		if len(req) < 2 {
+			return nil
+		}
+		if req[0] != natPMPVersion {
+			return []byte{natPMPVersion, natPMPOpResponse | req[1], 0, 1, 0, 0, 0, 0}
+		}
+
+		switch {
+		case req[1] == natPMPOpExternalAddr:
+			res := []byte{natPMPVersion, natPMPOpResponse, 0, 0, 0, 0, 0, 0}
+			return append(res, testPublicIP.AsSlice()...)
+
+		case req[1] == natPMPOpMapUDP && len(req) == 12:
+			lifetime := min(binary.BigEndian.Uint32(req[8:]), g.lifetime)
+			res := make([]byte, 16)
+			res[1] = natPMPOpResponse | natPMPOpMapUDP
+			copy(res[8:10], req[4:6])
+			binary.BigEndian.PutUint16(res[10:], g.set(binary.BigEndian.Uint16(req[4:]), binary.BigEndian.Uint16(req[6:]), lifetime))
+			binary.BigEndian.PutUint32(res[12:], lifetime)
+			return res
+		}
+
+		return []byte{natPMPVersion, natPMPOpResponse | req[1], 0, 5}
+	})
+	return addr, g
+}
+
+// listenUPnPGateway runs a stand-in internet gateway device that only supports permanent leases
+func listenUPnPGateway(t *testing.T) (netip.AddrPort, *testGateway) {
+	g := &testGateway{mappings: map[uint16]uint16{}}
+	const serviceType = "urn:schemas-upnp-org:service:WANIPConnection:1"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rootDesc.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<?xml version="1.0"?><root xmlns="urn:schemas-upnp-org:device-1-0"><device>
+<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+<serviceList><service><serviceType>urn:schemas-upnp-org:service:Layer3Forwarding:1</serviceType><controlURL>/l3f</controlURL></service></serviceList>
+<deviceList><device><deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType><deviceList><device>
+<serviceList><service><serviceType>%s</serviceType><controlURL>/ctl/IPConn</controlURL></service></serviceList>
+</device></deviceList></device></deviceList></device></root>`, serviceType)
+	})
+	mux.HandleFunc("/ctl/IPConn", func(w http.ResponseWriter, r *http.Request) {
+		action := strings.Trim(r.Header.Get("SOAPAction"), `"`)
+		values, err := parseSOAPResponse(r.Body)
+		if err != nil || !strings.HasPrefix(action, serviceType+"#") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		fault := func(code, description string) {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault><detail>`+
+				`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%s</errorCode><errorDescription>%s</errorDescription></UPnPError>`+
+				`</detail></s:Fault></s:Body></s:Envelope>`, code, description)
+		}
+
+		var port int
+		switch strings.TrimPrefix(action, serviceType+"#") {
+		case "AddPortMapping":
+			if values["NewLeaseDuration"] != "0" {
+				fault(upnpErrorOnlyPermanentLeases, "OnlyPermanentLeasesSupported")
+				return
+			}
+			if values["NewInternalClient"] != "127.0.0.1" || values["NewProtocol"] != "UDP" {
+				fault("402", "Invalid Args")
+				return
+			}
+			_, _ = fmt.Sscan(values["NewInternalPort"], &port)
+			g.Lock()
+			var external int
+			_, _ = fmt.Sscan(values["NewExternalPort"], &external)
+			g.mappings[uint16(port)] = uint16(external)
+			g.Unlock()
+			fmt.Fprint(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:AddPortMappingResponse xmlns:u="`+serviceType+`"/></s:Body></s:Envelope>`)
+
+		case "GetExternalIPAddress":
+			fmt.Fprint(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:GetExternalIPAddressResponse xmlns:u="`+serviceType+`">`+
+				`<NewExternalIPAddress>`+testPublicIP.String()+`</NewExternalIPAddress></u:GetExternalIPAddressResponse></s:Body></s:Envelope>`)
+
+		case "DeletePortMapping":
+			_, _ = fmt.Sscan(values["NewExternalPort"], &port)
+			g.Lock()
+			for internal, external := range g.mappings {
+				if external == uint16(port) {
+					delete(g.mappings, internal)
+				}
+			}
+			g.Unlock()
+			fmt.Fprint(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:DeletePortMappingResponse xmlns:u="`+serviceType+`"/></s:Body></s:Envelope>`)
+
+		default:
+			fault("401", "Invalid Action")
+		}
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	ssdp, _ := listenUDPGateway(t, func(req []byte, _ netip.AddrPort) []byte {
+		r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(req)))
+		if err != nil || r.Method != "M-SEARCH" || r.Header.Get("St") != upnpSearchTargets[0] {
+			return nil
+		}
+		return []byte("HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=120\r\nST: " + upnpSearchTargets[0] + "\r\n" +
+			"LOCATION: " + server.URL + "/rootDesc.xml\r\n\r\n")
+	})
+
+	return ssdp, g
+}
+
+func staticGateway(addr netip.AddrPort) func() (netip.AddrPort, error) {
+	return func() (netip.AddrPort, error) { return addr, nil }
+}
+
+func TestClients(t *testing.T) {
+	pcpAddr, pcpGateway := listenPCPGateway(t)
+	natPMPAddr, natPMPGateway := listenNATPMPGateway(t)
+	upnpAddr, upnpGateway := listenUPnPGateway(t)
+
+	tests := []struct {
+		client   client
+		gateway  *testGateway
+		external uint16
+		lifetime time.Duration
+	}{
+		{client: newPCPClient(staticGateway(pcpAddr)), gateway: pcpGateway, external: 5242, lifetime: time.Minute},
+		{client: &natPMPClient{gateway: staticGateway(natPMPAddr)}, gateway: natPMPGateway, external: 5242, lifetime: time.Minute},
+		{client: newUPnPClient(upnpAddr), gateway: upnpGateway, external: 4242, lifetime: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.client.String(), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			addr, lifetime, err := tt.client.mapPort(ctx, 4242, 4242, time.Hour)
+			require.NoError(t, err)
+			assert.Equal(t, netip.AddrPortFrom(testPublicIP, tt.external), addr)
+			assert.Equal(t, tt.lifetime, lifetime)
+			external, ok := tt.gateway.get(4242)
+			assert.True(t, ok)
+			assert.Equal(t, tt.external, external)
+
+			// Renewing keeps the same port
+			addr, _, err = tt.client.mapPort(ctx, 4242, addr.Port(), time.Hour)
+			require.NoError(t, err)
+			assert.Equal(t, tt.external, addr.Port())
+
+			assert.NoError(t, tt.client.unmapPort(ctx, 4242, addr.Port()))
+			_, ok = tt.gateway.get(4242)
+			assert.False(t, ok)
+		})
+	}
+
+	// A NAT-PMP only gateway tells PCP clients so right away
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _, err := newPCPClient(staticGateway(natPMPAddr)).mapPort(ctx, 4242, 4242, time.Hour)
+	assert.ErrorIs(t, err, errPCPUnsupported)
+}
+
+func TestMapper(t *testing.T) {
+	l := newTestLogger()
+	natPMPAddr, natPMPGateway := listenNATPMPGateway(t)
+	natPMPGateway.lifetime = 1
+
+	changes := make(chan netip.AddrPort, 10)
+	m := newMapper(l, Config{
+		Timeout:  time.Second,
+		OnChange: func(addr netip.AddrPort) { changes <- addr },
+	}, 4242, []client{
+		// The gateway does not speak PCP, the mapping falls through to NAT-PMP
+		newPCPClient(staticGateway(natPMPAddr)),
+		&natPMPClient{gateway: staticGateway(natPMPAddr)},
+	})
+
+	lifetime, err := m.refresh(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, time.Second, lifetime)
+	assert.Equal(t, netip.AddrPortFrom(testPublicIP, 5242), m.Addr())
+	assert.Equal(t, netip.AddrPortFrom(testPublicIP, 5242), <-changes)
+	assert.Equal(t, "natpmp", m.active.String())
+
+	// Renewing the same mapping is not a change
+	_, err = m.refresh(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+
+	assert.NoError(t, m.Close())
+	_, ok := natPMPGateway.get(4242)
+	assert.False(t, ok, "closing removes the mapping")
+	assert.False(t, m.Addr().IsValid())
+
+	_, err = m.refresh(context.Background())
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestMapper_lost(t *testing.T) {
+	l := newTestLogger()
+	changes := make(chan netip.AddrPort, 10)
+
+	// Nothing is listening, every client fails and there is no address to report
+	dead := netip.MustParseAddrPort("127.0.0.1:1")
+	m := newMapper(l, Config{Timeout: 500 * time.Millisecond, OnChange: func(addr netip.AddrPort) { changes <- addr }}, 4242, []client{
+		newPCPClient(staticGateway(dead)),
+		&natPMPClient{gateway: staticGateway(dead)},
+	})
+
+	_, err := m.refresh(context.Background())
+	assert.ErrorContains(t, err, "pcp: ")
+	assert.ErrorContains(t, err, "natpmp: ")
+	assert.Empty(t, changes)
+	assert.NoError(t, m.Close())
+}
+
+func TestNew(t *testing.T) {
+	l := newTestLogger()
+	m, err := New(l, Config{}, 4242)
+	require.NoError(t, err)
+	assert.Len(t, m.clients, len(Methods))
+	assert.Equal(t, DefaultLifetime, m.lifetime)
+
+	m, err = New(l, Config{Methods: []string{"upnp"}}, 4242)
+	require.NoError(t, err)
+	assert.Equal(t, "upnp", m.clients[0].String())
+
+	_, err = New(l, Config{Methods: []string{"upnp", "carrier-pigeon"}}, 4242)
+	assert.ErrorContains(t, err, `unknown port mapping method "carrier-pigeon"`)
+}
+
+func TestParseProcNetRoute(t *testing.T) {
+	route := `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	0000A8C0	00000000	0001	0	0	100	00FFFFFF	0	0	0
+eth0	00000000	0100A8C0	0003	0	0	100	00000000	0	0	0
+`
+	gw, err := parseProcNetRoute([]byte(route))
+	require.NoError(t, err)
+	if binary.NativeEndian.Uint16([]byte{1, 0}) == 1 {
+		assert.Equal(t, netip.MustParseAddr("192.168.0.1"), gw)
+	}
+
+	lines := strings.SplitAfterN(route, "\n", 3)
+	_, err = parseProcNetRoute([]byte(lines[0] + lines[1]))
+	assert.ErrorContains(t, err, "no default route")
+}
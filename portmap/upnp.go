@@ -0,0 +1,334 @@
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ssdpAddr is where UPnP devices listen for searches
+var ssdpAddr = netip.MustParseAddrPort("239.255.255.250:1900")
+
+// upnpSearchTargets are the device types we search for, most gateways only answer one of them
+var upnpSearchTargets = []string{
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:2",
+}
+
+// upnpErrorOnlyPermanentLeases is returned by gateways that can not expire mappings on their own
+const upnpErrorOnlyPermanentLeases = "725"
+
+type upnpClient struct {
+	ssdp netip.AddrPort
+	http *http.Client
+
+	// Found by discovery and kept for renewals, controlURL is empty until then
+	controlURL  string
+	serviceType string
+	local       netip.Addr
+}
+
+func newUPnPClient(ssdp netip.AddrPort) *upnpClient {
+	return &upnpClient{ssdp: ssdp, http: &http.Client{}}
+}
+
+func (c *upnpClient) String() string {
+	return "upnp"
+}
+
+func (c *upnpClient) mapPort(ctx context.Context, internal, external uint16, lifetime time.Duration) (netip.AddrPort, time.Duration, error) {
+	if c.controlURL == "" {
+		if err := c.discover(ctx); err != nil {
+			return netip.AddrPort{}, 0, err
+		}
+	}
+
+	addr, granted, err := c.addPortMapping(ctx, internal, external, lifetime)
+	if err != nil {
+		// The gateway may have rebooted or gone away, look for it again next time
+		c.controlURL = ""
+		return netip.AddrPort{}, 0, err
+	}
+
+	return addr, granted, nil
+}
+
+func (c *upnpClient) addPortMapping(ctx context.Context, internal, external uint16, lifetime time.Duration) (netip.AddrPort, time.Duration, error) {
+	lease := uint32(lifetime / time.Second)
+	for {
+		_, err := c.call(ctx, "AddPortMapping", [][2]string{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", strconv.Itoa(int(external))},
+			{"NewProtocol", "UDP"},
+			{"NewInternalPort", strconv.Itoa(int(internal))},
+			{"NewInternalClient", c.local.String()},
+			{"NewEnabled", "1"},
+			{"NewPortMappingDescription", "nebula"},
+			{"NewLeaseDuration", strconv.FormatUint(uint64(lease), 10)},
+		})
+
+		var ue *upnpError
+		if errors.As(err, &ue) && ue.code == upnpErrorOnlyPermanentLeases && lease != 0 {
+			// Fine, we still renew it and remove it on the way out
+			lease = 0
+			continue
+		}
+		if err != nil {
+			return netip.AddrPort{}, 0, err
+		}
+		break
+	}
+
+	res, err := c.call(ctx, "GetExternalIPAddress", nil)
+	if err != nil {
+		return netip.AddrPort{}, 0, fmt.Errorf("failed to get the external address: %w", err)
+	}
+
+	ip, err := netip.ParseAddr(res["NewExternalIPAddress"])
+	if err != nil {
+		return netip.AddrPort{}, 0, fmt.Errorf("gateway returned an invalid external address: %w", err)
+	}
+
+	return netip.AddrPortFrom(ip.Unmap(), external), time.Duration(lease) * time.Second, nil
+}
+
+func (c *upnpClient) unmapPort(ctx context.Context, _, external uint16) error {
+	if c.controlURL == "" {
+		return errors.New("no gateway was discovered")
+	}
+
+	_, err := c.call(ctx, "DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(int(external))},
+		{"NewProtocol", "UDP"},
+	})
+	return err
+}
+
+// discover searches for a gateway with ssdp and finds the service that maps ports in its description
+func (c *upnpClient) discover(ctx context.Context) error {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, st := range upnpSearchTargets {
+		req := "M-SEARCH * HTTP/1.1\r\n" +
+			"HOST: " + ssdpAddr.String() + "\r\n" +
+			"MAN: \"ssdp:discover\"\r\n" +
+			"MX: 2\r\n" +
+			"ST: " + st + "\r\n\r\n"
+		if _, err := conn.WriteToUDPAddrPort([]byte(req), c.ssdp); err != nil {
+			return err
+		}
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetReadDeadline(deadline)
+	}
+
+	b := make([]byte, 2048)
+	var errs []error
+	for {
+		n, _, err := conn.ReadFromUDPAddrPort(b)
+		if err != nil {
+			errs = append(errs, errors.New("no gateway answered the ssdp search"))
+			return errors.Join(errs...)
+		}
+
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b[:n])), nil)
+		if err != nil {
+			continue
+		}
+		res.Body.Close()
+
+		location := res.Header.Get("Location")
+		if location == "" {
+			continue
+		}
+
+		if err := c.describe(ctx, location); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", location, err))
+			continue
+		}
+		return nil
+	}
+}
+
+type upnpRoot struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+type upnpDevice struct {
+	Services []upnpService `xml:"serviceList>service"`
+	Devices  []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// findService finds the first WANIPConnection or WANPPPConnection service on the device or the devices inside it
+func (d *upnpDevice) findService() (upnpService, bool) {
+	for _, s := range d.Services {
+		if strings.Contains(s.ServiceType, ":WANIPConnection:") || strings.Contains(s.ServiceType, ":WANPPPConnection:") {
+			return s, true
+		}
+	}
+
+	for i := range d.Devices {
+		if s, ok := d.Devices[i].findService(); ok {
+			return s, true
+		}
+	}
+
+	return upnpService{}, false
+}
+
+// describe fetches the device description at location and remembers how to control the gateway
+func (c *upnpClient) describe(ctx context.Context, location string) error {
+	base, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch the device description: %s", res.Status)
+	}
+
+	var root upnpRoot
+	if err := xml.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&root); err != nil {
+		return fmt.Errorf("failed to parse the device description: %w", err)
+	}
+
+	s, ok := root.Device.findService()
+	if !ok {
+		return errors.New("device does not map ports")
+	}
+
+	if root.URLBase != "" {
+		if base, err = url.Parse(root.URLBase); err != nil {
+			return err
+		}
+	}
+
+	control, err := base.Parse(s.ControlURL)
+	if err != nil {
+		return err
+	}
+
+	// The mapping has to point at the address the gateway sees us as
+	conn, err := net.Dial("udp", base.Host)
+	if err != nil {
+		return err
+	}
+	c.local = conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap()
+	conn.Close()
+
+	c.controlURL = control.String()
+	c.serviceType = s.ServiceType
+	return nil
+}
+
+type upnpError struct {
+	code        string
+	description string
+}
+
+func (e *upnpError) Error() string {
+	return fmt.Sprintf("upnp error %s: %s", e.code, e.description)
+}
+
+// call runs a soap action against the gateway and returns the elements of the response by name
+func (c *upnpClient) call(ctx context.Context, action string, args [][2]string) (map[string]string, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:` + action + ` xmlns:u="` + c.serviceType + `">`)
+	for _, arg := range args {
+		body.WriteString("<" + arg[0] + ">")
+		_ = xml.EscapeText(&body, []byte(arg[1]))
+		body.WriteString("</" + arg[0] + ">")
+	}
+	body.WriteString(`</u:` + action + `></s:Body></s:Envelope>`)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.controlURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+c.serviceType+"#"+action+`"`)
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	values, err := parseSOAPResponse(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the %s response: %w", action, err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		if code, ok := values["errorCode"]; ok {
+			return nil, &upnpError{code: code, description: values["errorDescription"]}
+		}
+		return nil, fmt.Errorf("%s failed: %s", action, res.Status)
+	}
+
+	return values, nil
+}
+
+// parseSOAPResponse collects the text of every element in a soap response by its local name. The elements we care
+// about, including those in faults, all have unique names.
+func parseSOAPResponse(r io.Reader) (map[string]string, error) {
+	values := map[string]string{}
+	d := xml.NewDecoder(r)
+	var name string
+	for {
+		t, err := d.Token()
+		if errors.Is(err, io.EOF) {
+			return values, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := t.(type) {
+		case xml.StartElement:
+			name = t.Name.Local
+		case xml.CharData:
+			if name != "" {
+				values[name] += strings.TrimSpace(string(t))
+			}
+		case xml.EndElement:
+			name = ""
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package nebula
+
+import (
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPortMapFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	pm, err := NewPortMapFromConfig(l, c, 4242, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, pm, "port mapping is disabled by default")
+
+	c.Settings["listen"] = map[interface{}]interface{}{"port_mapping": map[interface{}]interface{}{
+		"enabled": true, "gateway": "192.168.1.1", "methods": []interface{}{"natpmp", "upnp"},
+	}}
+	pm, err = NewPortMapFromConfig(l, c, 4242, nil)
+	require.NoError(t, err)
+	assert.False(t, pm.Addr().IsValid(), "nothing is mapped until the mapper runs")
+	assert.NoError(t, pm.Close())
+
+	c.Settings["listen"] = map[interface{}]interface{}{"port_mapping": map[interface{}]interface{}{
+		"enabled": true, "gateway": "router.local",
+	}}
+	_, err = NewPortMapFromConfig(l, c, 4242, nil)
+	assert.ErrorContains(t, err, "Failed to parse listen.port_mapping.gateway")
+
+	c.Settings["listen"] = map[interface{}]interface{}{"port_mapping": map[interface{}]interface{}{
+		"enabled": true, "methods": []interface{}{"pcp", "ssh"},
+	}}
+	_, err = NewPortMapFromConfig(l, c, 4242, nil)
+	assert.ErrorContains(t, err, "Invalid listen.port_mapping.methods")
+}
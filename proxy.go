@@ -0,0 +1,49 @@
+package nebula
+
+import (
+	"net/netip"
+	"net/url"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/udp"
+	"github.com/slackhq/nebula/util"
+)
+
+// socks5DialerFromConfig builds the dialer for the socks5 proxy at listen.proxy.url, nil is returned when there is none
+func socks5DialerFromConfig(c *config.C) (*udp.Socks5Dialer, error) {
+	rawProxy := c.GetString("listen.proxy.url", "")
+	if rawProxy == "" {
+		return nil, nil
+	}
+
+	proxy, err := url.Parse(rawProxy)
+	if err != nil || proxy.Scheme != "socks5" || proxy.Hostname() == "" || proxy.Port() == "" {
+		return nil, util.NewContextualError("Invalid listen.proxy.url, expected socks5://host:port", m{"url": rawProxy}, err)
+	}
+
+	d := &udp.Socks5Dialer{Server: proxy.Host, Mark: c.GetInt("listen.so_mark", 0)}
+	if proxy.User != nil {
+		d.Username = proxy.User.Username()
+		d.Password, _ = proxy.User.Password()
+	}
+
+	return d, nil
+}
+
+// NewSocks5FromConfig sends udp through the socks5 proxy at listen.proxy with UDP ASSOCIATE. Nil is returned when there
+// is no proxy or listen.proxy.udp is false, the error wraps udp.ErrSocks5CommandNotSupported if the proxy does not relay
+// udp. The stream transports dial through the proxy with CONNECT regardless.
+func NewSocks5FromConfig(l *logrus.Logger, c *config.C, listen netip.AddrPort) (*udp.Socks5Conn, error) {
+	dialer, err := socks5DialerFromConfig(c)
+	if err != nil || dialer == nil || !c.GetBool("listen.proxy.udp", true) {
+		return nil, err
+	}
+
+	conn, err := udp.NewSocks5Conn(l, dialer, listen, c.GetDuration("listen.proxy.dial_timeout", defaultTCPDialTimeout))
+	if err != nil {
+		return nil, util.NewContextualError("Failed to get a udp relay from the socks5 proxy", m{"proxy": dialer.Server}, err)
+	}
+
+	return conn, nil
+}
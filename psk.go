@@ -0,0 +1,136 @@
+package nebula
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/slackhq/nebula/config"
+	"golang.org/x/crypto/hkdf"
+)
+
+// pskInfo is mixed into the key derivation so a psk string can not be confused with key material used elsewhere
+const pskInfo = "NEBULA PSK"
+
+// pskMinLength is the shortest psk string we will accept
+const pskMinLength = 8
+
+type PskMode int
+
+const (
+	// PskNone does not use a pre-shared key
+	PskNone PskMode = iota
+	// PskTransitional sends handshakes without a pre-shared key but accepts handshakes with or without one
+	PskTransitional
+	// PskEnforced sends handshakes with the primary pre-shared key and only accepts handshakes using a known key
+	PskEnforced
+)
+
+func (m PskMode) String() string {
+	switch m {
+	case PskNone:
+		return "none"
+	case PskTransitional:
+		return "transitional"
+	case PskEnforced:
+		return "enforced"
+	}
+	return "unknown"
+}
+
+func NewPskMode(s string) (PskMode, error) {
+	switch strings.ToLower(s) {
+	case "none":
+		return PskNone, nil
+	case "transitional":
+		return PskTransitional, nil
+	case "enforced":
+		return PskEnforced, nil
+	}
+	return PskNone, fmt.Errorf("unknown psk mode: %v", s)
+}
+
+// Psk holds the pre-shared keys that are mixed into the noise handshake
+type Psk struct {
+	mode PskMode
+	// keys are derived from the configured psk strings, the first is used when initiating a handshake
+	keys [][]byte
+	// accepted is every key a received handshake may use, a nil entry allows a handshake without a key
+	accepted [][]byte
+}
+
+func NewPskFromConfig(c *config.C) (*Psk, error) {
+	raw := c.GetStringSlice("pki.psk", nil)
+
+	defaultMode := "none"
+	if len(raw) > 0 {
+		defaultMode = "enforced"
+	}
+
+	mode, err := NewPskMode(c.GetString("pki.psk_mode", defaultMode))
+	if err != nil {
+		return nil, err
+	}
+
+	return NewPsk(mode, raw)
+}
+
+func NewPsk(mode PskMode, raw []string) (*Psk, error) {
+	if mode == PskNone {
+		return &Psk{mode: mode, accepted: [][]byte{nil}}, nil
+	}
+
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("pki.psk must contain at least one key when pki.psk_mode is %s", mode)
+	}
+
+	p := &Psk{mode: mode, keys: make([][]byte, len(raw))}
+	for i, s := range raw {
+		if len(s) < pskMinLength {
+			return nil, fmt.Errorf("pki.psk entry %v is shorter than %v characters", i, pskMinLength)
+		}
+
+		key, err := derivePsk(s)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive pki.psk entry %v: %w", i, err)
+		}
+		p.keys[i] = key
+	}
+
+	p.accepted = p.keys
+	if mode == PskTransitional {
+		p.accepted = append(append([][]byte{}, p.keys...), nil)
+	}
+
+	return p, nil
+}
+
+// derivePsk turns a configured psk string into a 32 byte key suitable for noise
+func derivePsk(s string) ([]byte, error) {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, []byte(s), nil, []byte(pskInfo)), key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Mode returns the configured psk mode
+func (p *Psk) Mode() PskMode {
+	return p.mode
+}
+
+// Primary returns the key to use when initiating a handshake, nil means no key
+func (p *Psk) Primary() []byte {
+	if p.mode != PskEnforced {
+		return nil
+	}
+	return p.keys[0]
+}
+
+// Accepted returns every key a received handshake may use, in the order they should be tried.
+// A nil entry means the handshake may be sent without a key.
+func (p *Psk) Accepted() [][]byte {
+	return p.accepted
+}
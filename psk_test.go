@@ -0,0 +1,60 @@
+package nebula
+
+import (
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPskFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	// No psk configured
+	p, err := NewPskFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, PskNone, p.Mode())
+	assert.Nil(t, p.Primary())
+	assert.Equal(t, [][]byte{nil}, p.Accepted())
+
+	// A psk defaults to enforced
+	c.Settings["pki"] = map[interface{}]interface{}{"psk": []interface{}{"new network key", "old network key"}}
+	p, err = NewPskFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, PskEnforced, p.Mode())
+	assert.Len(t, p.Primary(), 32)
+	assert.Len(t, p.Accepted(), 2)
+	assert.Equal(t, p.Primary(), p.Accepted()[0])
+	assert.NotEqual(t, p.Accepted()[0], p.Accepted()[1])
+
+	// Derivation is stable
+	old, err := NewPsk(PskEnforced, []string{"old network key"})
+	require.NoError(t, err)
+	assert.Equal(t, p.Accepted()[1], old.Primary())
+
+	// Transitional sends without a key and accepts no key last
+	c.Settings["pki"] = map[interface{}]interface{}{"psk": []interface{}{"new network key"}, "psk_mode": "transitional"}
+	p, err = NewPskFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, PskTransitional, p.Mode())
+	assert.Nil(t, p.Primary())
+	assert.Len(t, p.Accepted(), 2)
+	assert.Len(t, p.Accepted()[0], 32)
+	assert.Nil(t, p.Accepted()[1])
+
+	// Errors
+	c.Settings["pki"] = map[interface{}]interface{}{"psk_mode": "enforced"}
+	_, err = NewPskFromConfig(c)
+	assert.EqualError(t, err, "pki.psk must contain at least one key when pki.psk_mode is enforced")
+
+	c.Settings["pki"] = map[interface{}]interface{}{"psk": []interface{}{"short"}}
+	_, err = NewPskFromConfig(c)
+	assert.EqualError(t, err, "pki.psk entry 0 is shorter than 8 characters")
+
+	c.Settings["pki"] = map[interface{}]interface{}{"psk": []interface{}{"new network key"}, "psk_mode": "nope"}
+	_, err = NewPskFromConfig(c)
+	assert.EqualError(t, err, "unknown psk mode: nope")
+}
@@ -1,9 +1,14 @@
 package nebula
 
 import (
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/rcrowley/go-metrics"
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/config"
 )
@@ -14,11 +19,38 @@ type Punchy struct {
 	delay           atomic.Int64
 	respondDelay    atomic.Int64
 	punchEverything atomic.Bool
+	upgradeInterval atomic.Int64
+	natDetection    atomic.Bool
+	spray           atomic.Bool
+	sprayRange      atomic.Int64
+	sprayCount      atomic.Int64
 	l               *logrus.Logger
+
+	// sprays holds a timer for every peer we sprayed at that has not completed a handshake yet
+	sprayLock sync.Mutex
+	sprays    map[netip.Addr]*time.Timer
+	// sprayTargets holds when every address was last sprayed at, no matter which peer it was for
+	sprayTargets map[netip.Addr]time.Time
+
+	metricSprayAttempts metrics.Counter
+	metricSprayPackets  metrics.Counter
+	metricSpraySuccess  metrics.Counter
+	metricSprayFailure  metrics.Counter
 }
 
+// sprayResultTimeout is how long after a spray a direct tunnel to the peer still counts as its success
+const sprayResultTimeout = time.Minute
+
 func NewPunchyFromConfig(l *logrus.Logger, c *config.C) *Punchy {
-	p := &Punchy{l: l}
+	p := &Punchy{
+		l:                   l,
+		sprays:              make(map[netip.Addr]*time.Timer),
+		sprayTargets:        make(map[netip.Addr]time.Time),
+		metricSprayAttempts: metrics.GetOrRegisterCounter("punchy.spray.attempts", nil),
+		metricSprayPackets:  metrics.GetOrRegisterCounter("punchy.spray.packets", nil),
+		metricSpraySuccess:  metrics.GetOrRegisterCounter("punchy.spray.success", nil),
+		metricSprayFailure:  metrics.GetOrRegisterCounter("punchy.spray.failure", nil),
+	}
 
 	p.reload(c, true)
 	c.RegisterReloadCallback(func(c *config.C) {
@@ -87,6 +119,43 @@ func (p *Punchy) reload(c *config.C, initial bool) {
 			p.l.Infof("punchy.respond_delay changed to %s", p.GetRespondDelay())
 		}
 	}
+
+	if initial || c.HasChanged("punchy.relayed_upgrade_interval") {
+		p.upgradeInterval.Store((int64)(c.GetDuration("punchy.relayed_upgrade_interval", 30*time.Second)))
+		if !initial {
+			p.l.Infof("punchy.relayed_upgrade_interval changed to %s", p.GetRelayedUpgradeInterval())
+		}
+	}
+
+	if initial || c.HasChanged("punchy.nat_detection") {
+		p.natDetection.Store(c.GetBool("punchy.nat_detection", false))
+		if !initial {
+			p.l.WithField("nat_detection", p.GetNatDetection()).Info("punchy.nat_detection changed")
+		}
+	}
+
+	if initial || c.HasChanged("punchy.spray") {
+		p.spray.Store(c.GetBool("punchy.spray.enabled", false))
+
+		sprayRange := c.GetInt("punchy.spray.range", 256)
+		if sprayRange < 1 || sprayRange > 32768 {
+			p.l.WithField("range", sprayRange).Warn("punchy.spray.range must be between 1 and 32768, using 256")
+			sprayRange = 256
+		}
+		p.sprayRange.Store(int64(sprayRange))
+
+		sprayCount := c.GetInt("punchy.spray.count", 64)
+		if sprayCount < 1 {
+			p.l.WithField("count", sprayCount).Warn("punchy.spray.count must be at least 1, using 64")
+			sprayCount = 64
+		}
+		p.sprayCount.Store(int64(sprayCount))
+
+		if !initial {
+			p.l.WithField("enabled", p.GetSpray()).WithField("range", sprayRange).WithField("count", sprayCount).
+				Info("punchy.spray changed")
+		}
+	}
 }
 
 func (p *Punchy) GetPunch() bool {
@@ -108,3 +177,100 @@ func (p *Punchy) GetRespondDelay() time.Duration {
 func (p *Punchy) GetTargetEverything() bool {
 	return p.punchEverything.Load()
 }
+
+func (p *Punchy) GetRelayedUpgradeInterval() time.Duration {
+	return (time.Duration)(p.upgradeInterval.Load())
+}
+
+func (p *Punchy) GetNatDetection() bool {
+	return p.natDetection.Load()
+}
+
+func (p *Punchy) GetSpray() bool {
+	return p.spray.Load()
+}
+
+// startSpray records that we are about to spray at targets for vpnIp and returns the ones to spray at. An address
+// that was sprayed at within sprayResultTimeout is left out, this caps the packets any one address can receive from us
+// however many peers or lighthouse answers point at it. Nothing is returned if a spray at vpnIp is already waiting for
+// its result or no targets are left. The spray counts as a failure if no direct tunnel completes before
+// sprayResultTimeout.
+func (p *Punchy) startSpray(vpnIp netip.Addr, targets []netip.AddrPort, now time.Time) []netip.AddrPort {
+	p.sprayLock.Lock()
+	defer p.sprayLock.Unlock()
+	if _, ok := p.sprays[vpnIp]; ok {
+		return nil
+	}
+
+	for k, v := range p.sprayTargets {
+		if now.Sub(v) >= sprayResultTimeout {
+			delete(p.sprayTargets, k)
+		}
+	}
+
+	var allowed []netip.AddrPort
+	for _, a := range targets {
+		if _, ok := p.sprayTargets[a.Addr()]; ok {
+			continue
+		}
+		if slices.ContainsFunc(allowed, func(b netip.AddrPort) bool { return a.Addr() == b.Addr() }) {
+			continue
+		}
+		allowed = append(allowed, a)
+	}
+
+	if len(allowed) == 0 {
+		return nil
+	}
+
+	// Only addresses we actually spray at are held back from other sprays
+	for _, a := range allowed {
+		p.sprayTargets[a.Addr()] = now
+	}
+
+	p.metricSprayAttempts.Inc(1)
+	p.sprays[vpnIp] = time.AfterFunc(sprayResultTimeout, func() {
+		p.sprayLock.Lock()
+		defer p.sprayLock.Unlock()
+		if _, ok := p.sprays[vpnIp]; ok {
+			delete(p.sprays, vpnIp)
+			p.metricSprayFailure.Inc(1)
+		}
+	})
+	return allowed
+}
+
+// sprayCompleted is called when a direct tunnel to vpnIp completes, if we sprayed at it the spray worked
+func (p *Punchy) sprayCompleted(vpnIp netip.Addr) {
+	p.sprayLock.Lock()
+	defer p.sprayLock.Unlock()
+	if t, ok := p.sprays[vpnIp]; ok {
+		t.Stop()
+		delete(p.sprays, vpnIp)
+		p.metricSpraySuccess.Inc(1)
+	}
+}
+
+// sprayAddrs guesses the ports a symmetric NAT will pick for the peer behind addr. They tend to hand out ports close
+// to the last one, so punchy.spray.count distinct ports are picked at random within punchy.spray.range of the port the
+// lighthouse saw. With both sides spraying the odds of a pair of guesses meeting grow like the birthday problem.
+func (p *Punchy) sprayAddrs(addr netip.AddrPort) []netip.AddrPort {
+	port := int(addr.Port())
+	lo := max(port-int(p.sprayRange.Load()), 1)
+	hi := min(port+int(p.sprayRange.Load()), 65535)
+	// The port itself is punched normally
+	count := min(int(p.sprayCount.Load()), hi-lo)
+
+	picked := make(map[int]struct{}, count)
+	addrs := make([]netip.AddrPort, 0, count)
+	for len(addrs) < count {
+		guess := lo + rand.IntN(hi-lo+1)
+		if _, ok := picked[guess]; ok || guess == port {
+			continue
+		}
+		picked[guess] = struct{}{}
+		addrs = append(addrs, netip.AddrPortFrom(addr.Addr(), uint16(guess)))
+	}
+
+	return addrs
+}
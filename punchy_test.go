@@ -1,6 +1,7 @@
 package nebula
 
 import (
+	"net/netip"
 	"testing"
 	"time"
 
@@ -19,6 +20,11 @@ func TestNewPunchyFromConfig(t *testing.T) {
 	assert.Equal(t, false, p.GetRespond())
 	assert.Equal(t, time.Second, p.GetDelay())
 	assert.Equal(t, 5*time.Second, p.GetRespondDelay())
+	assert.Equal(t, 30*time.Second, p.GetRelayedUpgradeInterval())
+	assert.Equal(t, false, p.GetNatDetection())
+	assert.Equal(t, false, p.GetSpray())
+	assert.Equal(t, int64(256), p.sprayRange.Load())
+	assert.Equal(t, int64(64), p.sprayCount.Load())
 
 	// punchy deprecation
 	c.Settings["punchy"] = true
@@ -50,6 +56,108 @@ func TestNewPunchyFromConfig(t *testing.T) {
 	c.Settings["punchy"] = map[interface{}]interface{}{"respond_delay": "1m"}
 	p = NewPunchyFromConfig(l, c)
 	assert.Equal(t, time.Minute, p.GetRespondDelay())
+
+	// punchy.relayed_upgrade_interval
+	c.Settings["punchy"] = map[interface{}]interface{}{"relayed_upgrade_interval": "0"}
+	p = NewPunchyFromConfig(l, c)
+	assert.Equal(t, time.Duration(0), p.GetRelayedUpgradeInterval())
+
+	// punchy.nat_detection
+	c.Settings["punchy"] = map[interface{}]interface{}{"nat_detection": true}
+	p = NewPunchyFromConfig(l, c)
+	assert.Equal(t, true, p.GetNatDetection())
+
+	// punchy.spray
+	c.Settings["punchy"] = map[interface{}]interface{}{"spray": map[interface{}]interface{}{"enabled": true, "range": 16, "count": 8}}
+	p = NewPunchyFromConfig(l, c)
+	assert.Equal(t, true, p.GetSpray())
+	assert.Equal(t, int64(16), p.sprayRange.Load())
+	assert.Equal(t, int64(8), p.sprayCount.Load())
+
+	// Nonsense falls back to the defaults
+	c.Settings["punchy"] = map[interface{}]interface{}{"spray": map[interface{}]interface{}{"range": 0, "count": -1}}
+	p = NewPunchyFromConfig(l, c)
+	assert.Equal(t, int64(256), p.sprayRange.Load())
+	assert.Equal(t, int64(64), p.sprayCount.Load())
+}
+
+func TestPunchy_sprayAddrs(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["punchy"] = map[interface{}]interface{}{"spray": map[interface{}]interface{}{"range": 16, "count": 8}}
+	p := NewPunchyFromConfig(l, c)
+
+	check := func(addr netip.AddrPort, lo, hi uint16, count int) {
+		addrs := p.sprayAddrs(addr)
+		assert.Len(t, addrs, count)
+		seen := map[netip.AddrPort]struct{}{}
+		for _, a := range addrs {
+			assert.Equal(t, addr.Addr(), a.Addr())
+			assert.NotEqual(t, addr.Port(), a.Port(), "the port itself is punched normally")
+			assert.GreaterOrEqual(t, a.Port(), lo)
+			assert.LessOrEqual(t, a.Port(), hi)
+			seen[a] = struct{}{}
+		}
+		assert.Len(t, seen, count, "every guess is a different port")
+	}
+
+	check(netip.MustParseAddrPort("1.1.1.1:30000"), 29984, 30016, 8)
+	check(netip.MustParseAddrPort("[1::1]:30000"), 29984, 30016, 8)
+
+	// The range is clamped to real ports and can hold fewer guesses than asked for
+	check(netip.MustParseAddrPort("1.1.1.1:2"), 1, 18, 8)
+	check(netip.MustParseAddrPort("1.1.1.1:65535"), 65519, 65535, 8)
+	p.sprayCount.Store(100)
+	check(netip.MustParseAddrPort("1.1.1.1:65535"), 65519, 65535, 16)
+	check(netip.MustParseAddrPort("1.1.1.1:3"), 1, 19, 18)
+}
+
+func TestPunchy_spray(t *testing.T) {
+	l := test.NewLogger()
+	p := NewPunchyFromConfig(l, config.NewC(l))
+	vpnIp := netip.MustParseAddr("10.128.0.2")
+	targets := []netip.AddrPort{netip.MustParseAddrPort("1.1.1.1:4242")}
+	now := time.Now()
+
+	attempts := p.metricSprayAttempts.Count()
+	success := p.metricSpraySuccess.Count()
+
+	// A peer is sprayed at once until we know how it went
+	assert.Equal(t, targets, p.startSpray(vpnIp, targets, now))
+	assert.Empty(t, p.startSpray(vpnIp, []netip.AddrPort{netip.MustParseAddrPort("2.2.2.2:4242")}, now))
+	assert.Equal(t, attempts+1, p.metricSprayAttempts.Count())
+
+	p.sprayCompleted(vpnIp)
+	assert.Equal(t, success+1, p.metricSpraySuccess.Count())
+
+	// Tunnels to peers we did not spray at are not counted
+	p.sprayCompleted(vpnIp)
+	assert.Equal(t, success+1, p.metricSpraySuccess.Count())
+
+	// The refused spray did not use up its address
+	assert.Len(t, p.startSpray(vpnIp, []netip.AddrPort{netip.MustParseAddrPort("2.2.2.2:4242")}, now), 1)
+	p.sprayCompleted(vpnIp)
+}
+
+func TestPunchy_sprayTargets(t *testing.T) {
+	l := test.NewLogger()
+	p := NewPunchyFromConfig(l, config.NewC(l))
+	peer1 := netip.MustParseAddr("10.128.0.2")
+	peer2 := netip.MustParseAddr("10.128.0.3")
+	addr := netip.MustParseAddrPort("1.1.1.1:4242")
+	other := netip.MustParseAddrPort("2.2.2.2:4242")
+	now := time.Now()
+
+	// An address is sprayed at once per sprayResultTimeout whoever asks, whatever the port
+	assert.Equal(t, []netip.AddrPort{addr}, p.startSpray(peer1, []netip.AddrPort{addr, netip.MustParseAddrPort("1.1.1.1:4243")}, now))
+	p.sprayCompleted(peer1)
+	assert.Empty(t, p.startSpray(peer2, []netip.AddrPort{addr}, now.Add(sprayResultTimeout-time.Second)))
+	assert.Equal(t, []netip.AddrPort{other}, p.startSpray(peer2, []netip.AddrPort{addr, other}, now))
+	p.sprayCompleted(peer2)
+
+	assert.Equal(t, []netip.AddrPort{addr}, p.startSpray(peer1, []netip.AddrPort{addr}, now.Add(sprayResultTimeout)))
+	p.sprayCompleted(peer1)
+	assert.Len(t, p.sprayTargets, 1, "old targets are pruned")
 }
 
 func TestPunchy_reload(t *testing.T) {
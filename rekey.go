@@ -0,0 +1,102 @@
+package nebula
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+type Rekey struct {
+	maxAge      atomic.Int64
+	maxMessages atomic.Uint64
+	maxBytes    atomic.Uint64
+	l           *logrus.Logger
+}
+
+func NewRekeyFromConfig(l *logrus.Logger, c *config.C) *Rekey {
+	r := &Rekey{l: l}
+
+	r.reload(c, true)
+	c.RegisterReloadCallback(func(c *config.C) {
+		r.reload(c, false)
+	})
+
+	return r
+}
+
+func (r *Rekey) reload(c *config.C, initial bool) {
+	if initial || c.HasChanged("rekey.max_age") {
+		maxAge := c.GetDuration("rekey.max_age", 0)
+		if maxAge < 0 {
+			r.l.WithField("max_age", maxAge).Warn("rekey.max_age must not be negative, disabling")
+			maxAge = 0
+		}
+		r.maxAge.Store((int64)(maxAge))
+		if !initial {
+			r.l.Infof("rekey.max_age changed to %s", r.GetMaxAge())
+		}
+	}
+
+	if initial || c.HasChanged("rekey.max_messages") {
+		maxMessages := c.GetInt("rekey.max_messages", 0)
+		if maxMessages < 0 {
+			r.l.WithField("max_messages", maxMessages).Warn("rekey.max_messages must not be negative, disabling")
+			maxMessages = 0
+		}
+		r.maxMessages.Store(uint64(maxMessages))
+		if !initial {
+			r.l.Infof("rekey.max_messages changed to %v", r.GetMaxMessages())
+		}
+	}
+
+	if initial || c.HasChanged("rekey.max_bytes") {
+		maxBytes := c.GetInt("rekey.max_bytes", 0)
+		if maxBytes < 0 {
+			r.l.WithField("max_bytes", maxBytes).Warn("rekey.max_bytes must not be negative, disabling")
+			maxBytes = 0
+		}
+		r.maxBytes.Store(uint64(maxBytes))
+		if !initial {
+			r.l.Infof("rekey.max_bytes changed to %v", r.GetMaxBytes())
+		}
+	}
+}
+
+func (r *Rekey) GetMaxAge() time.Duration {
+	return (time.Duration)(r.maxAge.Load())
+}
+
+func (r *Rekey) GetMaxMessages() uint64 {
+	return r.maxMessages.Load()
+}
+
+func (r *Rekey) GetMaxBytes() uint64 {
+	return r.maxBytes.Load()
+}
+
+// reason returns why the tunnel using ci should be rekeyed, or an empty string if it should not be.
+// The side that responded to the current handshake waits an extra 10% of max_age so both sides
+// are unlikely to start a new handshake at the same time.
+func (r *Rekey) reason(ci *ConnectionState, now time.Time) string {
+	if maxAge := r.GetMaxAge(); maxAge > 0 {
+		if !ci.initiator {
+			maxAge += maxAge / 10
+		}
+
+		if now.Sub(ci.created) >= maxAge {
+			return "rekey.max_age reached"
+		}
+	}
+
+	if maxMessages := r.GetMaxMessages(); maxMessages > 0 && ci.messageCounter.Load() >= maxMessages {
+		return "rekey.max_messages reached"
+	}
+
+	if maxBytes := r.GetMaxBytes(); maxBytes > 0 && ci.bytesSent.Load() >= maxBytes {
+		return "rekey.max_bytes reached"
+	}
+
+	return ""
+}
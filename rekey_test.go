@@ -0,0 +1,68 @@
+package nebula
+
+import (
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRekeyFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	// Test defaults
+	r := NewRekeyFromConfig(l, c)
+	assert.Equal(t, time.Duration(0), r.GetMaxAge())
+	assert.Equal(t, uint64(0), r.GetMaxMessages())
+	assert.Equal(t, uint64(0), r.GetMaxBytes())
+
+	c.Settings["rekey"] = map[interface{}]interface{}{"max_age": "1h", "max_messages": 1000, "max_bytes": 1 << 30}
+	r = NewRekeyFromConfig(l, c)
+	assert.Equal(t, time.Hour, r.GetMaxAge())
+	assert.Equal(t, uint64(1000), r.GetMaxMessages())
+	assert.Equal(t, uint64(1<<30), r.GetMaxBytes())
+
+	// Negative values disable
+	c.Settings["rekey"] = map[interface{}]interface{}{"max_age": "-1h", "max_messages": -1, "max_bytes": -1}
+	r = NewRekeyFromConfig(l, c)
+	assert.Equal(t, time.Duration(0), r.GetMaxAge())
+	assert.Equal(t, uint64(0), r.GetMaxMessages())
+	assert.Equal(t, uint64(0), r.GetMaxBytes())
+}
+
+func TestRekey_reason(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	r := NewRekeyFromConfig(l, c)
+
+	now := time.Now()
+	ci := &ConnectionState{initiator: true, created: now.Add(-2 * time.Hour)}
+	ci.messageCounter.Store(500)
+
+	// Disabled by default
+	assert.Equal(t, "", r.reason(ci, now))
+
+	c.Settings["rekey"] = map[interface{}]interface{}{"max_age": "2h"}
+	r = NewRekeyFromConfig(l, c)
+	assert.Equal(t, "rekey.max_age reached", r.reason(ci, now))
+
+	// The responder waits a little longer
+	ci.initiator = false
+	assert.Equal(t, "", r.reason(ci, now))
+	assert.Equal(t, "rekey.max_age reached", r.reason(ci, now.Add(12*time.Minute)))
+
+	c.Settings["rekey"] = map[interface{}]interface{}{"max_messages": 1000}
+	r = NewRekeyFromConfig(l, c)
+	assert.Equal(t, "", r.reason(ci, now))
+	ci.messageCounter.Store(1000)
+	assert.Equal(t, "rekey.max_messages reached", r.reason(ci, now))
+
+	c.Settings["rekey"] = map[interface{}]interface{}{"max_bytes": 4096}
+	r = NewRekeyFromConfig(l, c)
+	assert.Equal(t, "", r.reason(ci, now))
+	ci.bytesSent.Store(4096)
+	assert.Equal(t, "rekey.max_bytes reached", r.reason(ci, now))
+}
@@ -0,0 +1,361 @@
+package nebula
+
+import (
+	"context"
+	"encoding/binary"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+)
+
+const (
+	defaultRelayProbeInterval = 5 * time.Second
+
+	// relayProbeWindow is the number of probes loss is measured over
+	relayProbeWindow = 10
+	// relayDegradedLoss is the loss ratio at which a relay is considered degraded
+	relayDegradedLoss = 0.5
+	// relayMinProbes is how many probe results we need before declaring a relay degraded
+	relayMinProbes = 3
+)
+
+// Test payloads are echoed back verbatim by the remote, relay probes are tagged so we can tell them apart
+// from other test packets. The layout is a single type byte followed by a big endian probe sequence number.
+const (
+	testProbeRelay = 1
+	relayProbeLen  = 9
+)
+
+const (
+	relayRankHealthy = iota
+	relayRankUnknown
+	relayRankDegraded
+)
+
+type relayStats struct {
+	rtt       time.Duration // smoothed round trip time
+	results   [relayProbeWindow]bool
+	count     int // number of valid entries in results
+	next      int // next slot in results to write
+	inflight  uint64
+	sentAt    time.Time
+	lastReply time.Time
+}
+
+func (rs *relayStats) record(ok bool) {
+	rs.results[rs.next] = ok
+	rs.next = (rs.next + 1) % relayProbeWindow
+	if rs.count < relayProbeWindow {
+		rs.count++
+	}
+}
+
+func (rs *relayStats) loss() float64 {
+	if rs.count == 0 {
+		return 0
+	}
+
+	lost := 0
+	for i := 0; i < rs.count; i++ {
+		if !rs.results[i] {
+			lost++
+		}
+	}
+	return float64(lost) / float64(rs.count)
+}
+
+func (rs *relayStats) rank() int {
+	switch {
+	case rs == nil || rs.count == 0:
+		return relayRankUnknown
+	case rs.count >= relayMinProbes && rs.loss() >= relayDegradedLoss:
+		return relayRankDegraded
+	case rs.lastReply.IsZero():
+		return relayRankUnknown
+	default:
+		return relayRankHealthy
+	}
+}
+
+// relayHealth measures round trip time and loss to the relays we use by sending tagged Test messages over
+// the tunnel to each relay. The results are used to rank relays for new relayed tunnels and to decide when
+// established relayed tunnels should move to a different relay.
+type relayHealth struct {
+	sync.RWMutex
+	stats map[netip.Addr]*relayStats
+	seq   uint64
+	// generation changes with every probe round and reply, rankings made before that may be out of date
+	generation atomic.Uint64
+
+	interval atomic.Int64
+
+	metricProbes  metrics.Counter
+	metricReplies metrics.Counter
+	l             *logrus.Logger
+}
+
+type RelayHealthStatus struct {
+	Relay  netip.Addr
+	Rank   int
+	State  string
+	Rtt    string
+	Loss   float64
+	Probes int
+}
+
+func newRelayHealth(l *logrus.Logger) *relayHealth {
+	return &relayHealth{
+		stats:         make(map[netip.Addr]*relayStats),
+		metricProbes:  metrics.GetOrRegisterCounter("relay.probes.sent", nil),
+		metricReplies: metrics.GetOrRegisterCounter("relay.probes.received", nil),
+		l:             l,
+	}
+}
+
+func (rh *relayHealth) reload(c *config.C, initial bool) {
+	if initial || c.HasChanged("relay.probe_interval") {
+		rh.interval.Store(int64(c.GetDuration("relay.probe_interval", defaultRelayProbeInterval)))
+		if !initial {
+			rh.l.WithField("interval", rh.GetInterval()).Info("relay.probe_interval has changed")
+		}
+	}
+}
+
+func (rh *relayHealth) GetInterval() time.Duration {
+	return time.Duration(rh.interval.Load())
+}
+
+// Run probes the relays we are using every relay.probe_interval until the context is done
+func (rh *relayHealth) Run(ctx context.Context, f *Interface) {
+	t := time.NewTimer(rh.GetInterval())
+	defer t.Stop()
+
+	nb := make([]byte, 12, 12)
+	out := make([]byte, mtu)
+
+	for {
+		interval := rh.GetInterval()
+		if interval <= 0 {
+			// Probing is disabled, check back later in case it is turned on
+			interval = defaultRelayProbeInterval
+		} else {
+			rh.probe(time.Now(), rh.candidates(f), func(hostinfo *HostInfo, p []byte) {
+				f.SendMessageToHostInfo(header.Test, header.TestRequest, hostinfo, p, nb, out)
+			})
+		}
+
+		t.Reset(interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// candidates returns the hostinfos of relays worth measuring, our configured relays and any host we are
+// terminating relays through.
+func (rh *relayHealth) candidates(f *Interface) []*HostInfo {
+	seen := map[netip.Addr]struct{}{}
+	var relays []*HostInfo
+
+	add := func(vpnIp netip.Addr) {
+		if _, ok := seen[vpnIp]; ok {
+			return
+		}
+		seen[vpnIp] = struct{}{}
+
+		hostinfo := f.hostMap.QueryVpnIp(vpnIp)
+		if hostinfo == nil || !hostinfo.remote.IsValid() {
+			return
+		}
+		relays = append(relays, hostinfo)
+	}
+
+	for _, vpnIp := range f.lightHouse.GetRelaysForMe() {
+		add(vpnIp)
+	}
+
+	f.hostMap.RLock()
+	relayHosts := make([]*HostInfo, 0, len(f.hostMap.Relays))
+	for _, hostinfo := range f.hostMap.Relays {
+		relayHosts = append(relayHosts, hostinfo)
+	}
+	f.hostMap.RUnlock()
+
+	for _, hostinfo := range relayHosts {
+		if hostinfo.relayState.hasTerminalRelays() {
+			add(hostinfo.vpnIp)
+		}
+	}
+
+	return relays
+}
+
+// probe records a loss for any probe still outstanding from the previous round and sends a new one to each relay.
+// Stats for relays that are no longer candidates are dropped.
+func (rh *relayHealth) probe(now time.Time, relays []*HostInfo, send func(*HostInfo, []byte)) {
+	type pending struct {
+		hostinfo *HostInfo
+		p        []byte
+	}
+	toSend := make([]pending, 0, len(relays))
+
+	rh.Lock()
+	keep := make(map[netip.Addr]*relayStats, len(relays))
+	for _, hostinfo := range relays {
+		rs := rh.stats[hostinfo.vpnIp]
+		if rs == nil {
+			rs = &relayStats{}
+		}
+		keep[hostinfo.vpnIp] = rs
+
+		if rs.inflight != 0 {
+			rs.record(false)
+		}
+
+		rh.seq++
+		rs.inflight = rh.seq
+		rs.sentAt = now
+
+		p := make([]byte, relayProbeLen)
+		p[0] = testProbeRelay
+		binary.BigEndian.PutUint64(p[1:], rs.inflight)
+		toSend = append(toSend, pending{hostinfo: hostinfo, p: p})
+	}
+	rh.stats = keep
+	rh.generation.Add(1)
+	rh.Unlock()
+
+	for _, s := range toSend {
+		rh.metricProbes.Inc(1)
+		send(s.hostinfo, s.p)
+	}
+}
+
+// handleTestReply records the round trip time for a relay probe, it returns false if p was not a relay probe
+func (rh *relayHealth) handleTestReply(vpnIp netip.Addr, p []byte, now time.Time) bool {
+	if len(p) != relayProbeLen || p[0] != testProbeRelay {
+		return false
+	}
+
+	seq := binary.BigEndian.Uint64(p[1:])
+
+	rh.Lock()
+	defer rh.Unlock()
+	rs := rh.stats[vpnIp]
+	if rs == nil || rs.inflight != seq {
+		// Late or unsolicited, the probe was already counted as lost
+		return true
+	}
+
+	rh.metricReplies.Inc(1)
+	rtt := now.Sub(rs.sentAt)
+	if rs.lastReply.IsZero() {
+		rs.rtt = rtt
+	} else {
+		// Smooth the same way TCP does, rtt = 7/8 rtt + 1/8 sample
+		rs.rtt = (7*rs.rtt + rtt) / 8
+	}
+	rs.lastReply = now
+	rs.inflight = 0
+	rs.record(true)
+	rh.generation.Add(1)
+	return true
+}
+
+// Generation returns a number that changes whenever Rank may order relays differently
+func (rh *relayHealth) Generation() uint64 {
+	return rh.generation.Load()
+}
+
+// IsDegraded returns true if the relay is losing too many probes to be relied upon
+func (rh *relayHealth) IsDegraded(vpnIp netip.Addr) bool {
+	rh.RLock()
+	defer rh.RUnlock()
+	return rh.stats[vpnIp].rank() == relayRankDegraded
+}
+
+// Rank returns a copy of relays ordered best first. Healthy relays are ordered by round trip time, relays we have not
+// measured follow in their original order and degraded relays are last.
+func (rh *relayHealth) Rank(relays []netip.Addr) []netip.Addr {
+	ranked := slices.Clone(relays)
+	if len(ranked) < 2 {
+		return ranked
+	}
+
+	rh.RLock()
+	defer rh.RUnlock()
+	slices.SortStableFunc(ranked, func(a, b netip.Addr) int {
+		sa, sb := rh.stats[a], rh.stats[b]
+		ra, rb := sa.rank(), sb.rank()
+		if ra != rb {
+			return ra - rb
+		}
+
+		if ra == relayRankHealthy {
+			switch {
+			case sa.rtt < sb.rtt:
+				return -1
+			case sa.rtt > sb.rtt:
+				return 1
+			}
+		}
+		return 0
+	})
+
+	return ranked
+}
+
+// Status returns the current measurements for every relay we are probing, best first
+func (rh *relayHealth) Status() []RelayHealthStatus {
+	rh.RLock()
+	relays := make([]netip.Addr, 0, len(rh.stats))
+	for vpnIp := range rh.stats {
+		relays = append(relays, vpnIp)
+	}
+	rh.RUnlock()
+
+	slices.SortFunc(relays, netip.Addr.Compare)
+	relays = rh.Rank(relays)
+
+	rh.RLock()
+	defer rh.RUnlock()
+	ret := make([]RelayHealthStatus, 0, len(relays))
+	for i, vpnIp := range relays {
+		rs := rh.stats[vpnIp]
+		if rs == nil {
+			continue
+		}
+
+		s := RelayHealthStatus{
+			Relay:  vpnIp,
+			Rank:   i + 1,
+			Loss:   rs.loss(),
+			Probes: rs.count,
+		}
+
+		switch rs.rank() {
+		case relayRankHealthy:
+			s.State = "healthy"
+		case relayRankDegraded:
+			s.State = "degraded"
+		default:
+			s.State = "unknown"
+		}
+
+		if !rs.lastReply.IsZero() {
+			s.Rtt = rs.rtt.String()
+		}
+		ret = append(ret, s)
+	}
+
+	return ret
+}
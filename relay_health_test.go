@@ -0,0 +1,103 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRelayHealth_reload(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	rh := newRelayHealth(l)
+	rh.reload(c, true)
+	assert.Equal(t, defaultRelayProbeInterval, rh.GetInterval())
+
+	c.Settings["relay"] = map[interface{}]interface{}{"probe_interval": "1s"}
+	rh.reload(c, true)
+	assert.Equal(t, time.Second, rh.GetInterval())
+}
+
+func TestRelayHealth_probe(t *testing.T) {
+	l := test.NewLogger()
+	rh := newRelayHealth(l)
+
+	fast := &HostInfo{vpnIp: netip.MustParseAddr("10.0.0.1")}
+	slow := &HostInfo{vpnIp: netip.MustParseAddr("10.0.0.2")}
+	dead := &HostInfo{vpnIp: netip.MustParseAddr("10.0.0.3")}
+	relays := []*HostInfo{dead, slow, fast}
+	relayIps := []netip.Addr{dead.vpnIp, slow.vpnIp, fast.vpnIp}
+
+	now := time.Now()
+	sent := map[netip.Addr][]byte{}
+	send := func(h *HostInfo, p []byte) { sent[h.vpnIp] = p }
+
+	// Nothing is known yet, the original order is kept
+	rh.probe(now, relays, send)
+	assert.Len(t, sent, 3)
+	assert.Equal(t, relayIps, rh.Rank(relayIps))
+
+	// Non probe test payloads are ignored
+	assert.False(t, rh.handleTestReply(fast.vpnIp, []byte("hello"), now))
+
+	for i := 0; i < relayMinProbes; i++ {
+		assert.True(t, rh.handleTestReply(fast.vpnIp, sent[fast.vpnIp], now.Add(10*time.Millisecond)))
+		assert.True(t, rh.handleTestReply(slow.vpnIp, sent[slow.vpnIp], now.Add(100*time.Millisecond)))
+		now = now.Add(time.Second)
+		rh.probe(now, relays, send)
+	}
+
+	// A duplicate reply does not count twice
+	assert.True(t, rh.handleTestReply(fast.vpnIp, sent[fast.vpnIp], now.Add(10*time.Millisecond)))
+	assert.True(t, rh.handleTestReply(fast.vpnIp, sent[fast.vpnIp], now.Add(20*time.Millisecond)))
+
+	assert.Equal(t, []netip.Addr{fast.vpnIp, slow.vpnIp, dead.vpnIp}, rh.Rank(relayIps))
+	assert.True(t, rh.IsDegraded(dead.vpnIp))
+	assert.False(t, rh.IsDegraded(fast.vpnIp))
+	assert.False(t, rh.IsDegraded(netip.MustParseAddr("10.0.0.4")))
+
+	status := rh.Status()
+	assert.Len(t, status, 3)
+	assert.Equal(t, fast.vpnIp, status[0].Relay)
+	assert.Equal(t, "healthy", status[0].State)
+	assert.Equal(t, "10ms", status[0].Rtt)
+	assert.Equal(t, dead.vpnIp, status[2].Relay)
+	assert.Equal(t, "degraded", status[2].State)
+	assert.Equal(t, float64(1), status[2].Loss)
+
+	// Relays that are no longer in use are forgotten
+	rh.probe(now, []*HostInfo{fast}, send)
+	assert.Len(t, rh.Status(), 1)
+}
+
+func TestRelayState_RankedRelayIps(t *testing.T) {
+	l := test.NewLogger()
+	rh := newRelayHealth(l)
+	fast := &HostInfo{vpnIp: netip.MustParseAddr("10.0.0.1")}
+	slow := &HostInfo{vpnIp: netip.MustParseAddr("10.0.0.2")}
+	rs := &RelayState{relays: map[netip.Addr]struct{}{slow.vpnIp: {}}}
+
+	// The order is kept until something changes
+	ranked := rs.RankedRelayIps(rh)
+	assert.Equal(t, []netip.Addr{slow.vpnIp}, ranked)
+	assert.Same(t, &ranked[0], &rs.RankedRelayIps(rh)[0])
+
+	rs.InsertRelayTo(fast.vpnIp)
+	assert.ElementsMatch(t, []netip.Addr{fast.vpnIp, slow.vpnIp}, rs.RankedRelayIps(rh))
+
+	// New measurements reorder the relays
+	now := time.Now()
+	sent := map[netip.Addr][]byte{}
+	rh.probe(now, []*HostInfo{slow, fast}, func(h *HostInfo, p []byte) { sent[h.vpnIp] = p })
+	rh.handleTestReply(fast.vpnIp, sent[fast.vpnIp], now.Add(10*time.Millisecond))
+	rh.handleTestReply(slow.vpnIp, sent[slow.vpnIp], now.Add(100*time.Millisecond))
+	assert.Equal(t, []netip.Addr{fast.vpnIp, slow.vpnIp}, rs.RankedRelayIps(rh))
+
+	rs.DeleteRelay(fast.vpnIp)
+	assert.Equal(t, []netip.Addr{slow.vpnIp}, rs.RankedRelayIps(rh))
+}
@@ -0,0 +1,133 @@
+package nebula
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/udp"
+)
+
+// relayPairIdleTimeout is how long an unused per pair rate limiter is kept around
+const relayPairIdleTimeout = time.Minute
+
+// relayPair identifies the two peers of a relay regardless of direction
+type relayPair struct {
+	a, b netip.Addr
+}
+
+func newRelayPair(x, y netip.Addr) relayPair {
+	if y.Less(x) {
+		x, y = y, x
+	}
+	return relayPair{a: x, b: y}
+}
+
+// relayLimits holds the restrictions a relay places on the peers it relays for
+type relayLimits struct {
+	// maxPairs is the number of distinct peer pairs we will relay for at once, 0 is unlimited
+	maxPairs int
+	// pairRate is the bytes per second allowed between a pair of peers, 0 is unlimited
+	pairRate float64
+	// groups is the set of certificate groups allowed to use this relay, nil allows everyone
+	groups map[string]struct{}
+
+	// total limits the bytes per second relayed for all peers combined, nil is unlimited
+	total *tokenBucket
+
+	sync.Mutex
+	pairs     map[relayPair]*tokenBucket
+	lastPrune time.Time
+}
+
+func newRelayLimitsFromConfig(c *config.C) (*relayLimits, error) {
+	maxPairs := c.GetInt("relay.limits.max_pairs", 0)
+	if maxPairs < 0 {
+		return nil, fmt.Errorf("relay.limits.max_pairs must not be negative: %v", maxPairs)
+	}
+
+	pairRate := c.GetInt("relay.limits.pair_rate", 0)
+	if pairRate < 0 {
+		return nil, fmt.Errorf("relay.limits.pair_rate must not be negative: %v", pairRate)
+	}
+
+	totalRate := c.GetInt("relay.limits.total_rate", 0)
+	if totalRate < 0 {
+		return nil, fmt.Errorf("relay.limits.total_rate must not be negative: %v", totalRate)
+	}
+
+	rl := &relayLimits{
+		maxPairs: maxPairs,
+		pairRate: float64(pairRate),
+		pairs:    map[relayPair]*tokenBucket{},
+	}
+
+	if totalRate > 0 {
+		rl.total = newTokenBucket(float64(totalRate), relayBurst(float64(totalRate)), time.Now())
+	}
+
+	if groups := c.GetStringSlice("relay.limits.groups", nil); len(groups) > 0 {
+		rl.groups = make(map[string]struct{}, len(groups))
+		for _, g := range groups {
+			rl.groups[g] = struct{}{}
+		}
+	}
+
+	return rl, nil
+}
+
+// relayBurst allows a full second of traffic at rate to be sent at once but never less than a single packet
+func relayBurst(rate float64) float64 {
+	return max(rate, udp.MTU)
+}
+
+// allowCert returns true if the certificate has a group that is permitted to use this relay
+func (rl *relayLimits) allowCert(c *cert.CachedCertificate) bool {
+	if rl.groups == nil {
+		return true
+	}
+
+	if c == nil {
+		return false
+	}
+
+	for g := range rl.groups {
+		if _, ok := c.InvertedGroups[g]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// hasRateLimits returns true if relayed traffic needs to be metered
+func (rl *relayLimits) hasRateLimits() bool {
+	return rl.pairRate > 0 || rl.total != nil
+}
+
+// pairBucket returns the rate limiter for traffic between from and to, creating it if needed
+func (rl *relayLimits) pairBucket(from, to netip.Addr, now time.Time) *tokenBucket {
+	p := newRelayPair(from, to)
+
+	rl.Lock()
+	defer rl.Unlock()
+	b, ok := rl.pairs[p]
+	if ok {
+		return b
+	}
+
+	if now.Sub(rl.lastPrune) > relayPairIdleTimeout {
+		for k, v := range rl.pairs {
+			if now.Sub(v.idleSince()) > relayPairIdleTimeout {
+				delete(rl.pairs, k)
+			}
+		}
+		rl.lastPrune = now
+	}
+
+	b = newTokenBucket(rl.pairRate, relayBurst(rl.pairRate), now)
+	rl.pairs[p] = b
+	return b
+}
@@ -0,0 +1,72 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRelayLimitsFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	// Defaults are unlimited
+	rl, err := newRelayLimitsFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, 0, rl.maxPairs)
+	assert.False(t, rl.hasRateLimits())
+	assert.True(t, rl.allowCert(nil))
+
+	c.Settings["relay"] = map[interface{}]interface{}{"limits": map[interface{}]interface{}{
+		"max_pairs":  10,
+		"pair_rate":  1000,
+		"total_rate": 100000,
+		"groups":     []interface{}{"relay-users"},
+	}}
+	rl, err = newRelayLimitsFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, 10, rl.maxPairs)
+	assert.Equal(t, float64(1000), rl.pairRate)
+	assert.True(t, rl.hasRateLimits())
+	assert.Equal(t, float64(100000), rl.total.burst)
+
+	assert.False(t, rl.allowCert(nil))
+	assert.False(t, rl.allowCert(&cert.CachedCertificate{InvertedGroups: map[string]struct{}{"other": {}}}))
+	assert.True(t, rl.allowCert(&cert.CachedCertificate{InvertedGroups: map[string]struct{}{"other": {}, "relay-users": {}}}))
+
+	c.Settings["relay"] = map[interface{}]interface{}{"limits": map[interface{}]interface{}{"pair_rate": -1}}
+	_, err = newRelayLimitsFromConfig(c)
+	assert.EqualError(t, err, "relay.limits.pair_rate must not be negative: -1")
+}
+
+func TestRelayLimits_pairBucket(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["relay"] = map[interface{}]interface{}{"limits": map[interface{}]interface{}{"pair_rate": 1000}}
+	rl, err := newRelayLimitsFromConfig(c)
+	require.NoError(t, err)
+
+	a := netip.MustParseAddr("10.0.0.1")
+	b := netip.MustParseAddr("10.0.0.2")
+	other := netip.MustParseAddr("10.0.0.3")
+	now := time.Now()
+
+	// Both directions share a bucket, which always allows at least a full packet
+	ab := rl.pairBucket(a, b, now)
+	assert.Same(t, ab, rl.pairBucket(b, a, now))
+	assert.NotSame(t, ab, rl.pairBucket(a, other, now))
+	assert.True(t, ab.allow(now, udp.MTU))
+	assert.False(t, ab.allow(now, 1))
+
+	// Idle buckets are pruned when a new pair shows up
+	now = now.Add(2 * relayPairIdleTimeout)
+	rl.pairBucket(b, other, now)
+	assert.Len(t, rl.pairs, 1)
+}
@@ -6,8 +6,11 @@ import (
 	"errors"
 	"fmt"
 	"net/netip"
+	"slices"
 	"sync/atomic"
+	"time"
 
+	"github.com/rcrowley/go-metrics"
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/header"
@@ -17,27 +20,91 @@ type relayManager struct {
 	l       *logrus.Logger
 	hostmap *HostMap
 	amRelay atomic.Bool
+	maxHops atomic.Int64
+	health  *relayHealth
+	limits  atomic.Pointer[relayLimits]
+	// chainRelays are the relays from relay.chain_from that may pass chained requests on to us
+	chainRelays atomic.Pointer[[]netip.Addr]
+
+	metricRejectedGroups   metrics.Counter
+	metricRejectedMaxPairs metrics.Counter
+	metricDroppedPairRate  metrics.Counter
+	metricDroppedTotalRate metrics.Counter
 }
 
-func NewRelayManager(ctx context.Context, l *logrus.Logger, hostmap *HostMap, c *config.C) *relayManager {
+func NewRelayManager(ctx context.Context, l *logrus.Logger, hostmap *HostMap, c *config.C) (*relayManager, error) {
 	rm := &relayManager{
-		l:       l,
-		hostmap: hostmap,
+		l:                      l,
+		hostmap:                hostmap,
+		health:                 newRelayHealth(l),
+		metricRejectedGroups:   metrics.GetOrRegisterCounter("relay.rejected.groups", nil),
+		metricRejectedMaxPairs: metrics.GetOrRegisterCounter("relay.rejected.max_pairs", nil),
+		metricDroppedPairRate:  metrics.GetOrRegisterCounter("relay.dropped.pair_rate", nil),
+		metricDroppedTotalRate: metrics.GetOrRegisterCounter("relay.dropped.total_rate", nil),
+	}
+	err := rm.reload(c, true)
+	if err != nil {
+		return nil, err
 	}
-	rm.reload(c, true)
+
 	c.RegisterReloadCallback(func(c *config.C) {
 		err := rm.reload(c, false)
 		if err != nil {
 			l.WithError(err).Error("Failed to reload relay_manager")
 		}
 	})
-	return rm
+	return rm, nil
 }
 
 func (rm *relayManager) reload(c *config.C, initial bool) error {
 	if initial || c.HasChanged("relay.am_relay") {
 		rm.setAmRelay(c.GetBool("relay.am_relay", false))
 	}
+
+	if initial || c.HasChanged("relay.max_hops") {
+		maxHops := c.GetInt("relay.max_hops", 1)
+		if maxHops < 1 {
+			return fmt.Errorf("relay.max_hops must be at least 1: %v", maxHops)
+		}
+
+		rm.maxHops.Store(int64(maxHops))
+		if !initial {
+			rm.l.WithField("maxHops", maxHops).Info("relay.max_hops has changed")
+		}
+	}
+
+	if initial || c.HasChanged("relay.chain_from") {
+		chainRelays := []netip.Addr{}
+		for i, v := range c.GetStringSlice("relay.chain_from", nil) {
+			ip, err := netip.ParseAddr(v)
+			if err != nil {
+				return fmt.Errorf("entry %v in relay.chain_from failed to parse: %v", i+1, err)
+			}
+			chainRelays = append(chainRelays, ip)
+		}
+
+		rm.chainRelays.Store(&chainRelays)
+		if !initial {
+			rm.l.WithField("chainFrom", chainRelays).Info("relay.chain_from has changed")
+		}
+	}
+
+	if initial || c.HasChanged("relay.limits") {
+		limits, err := newRelayLimitsFromConfig(c)
+		if err != nil {
+			return err
+		}
+
+		rm.limits.Store(limits)
+		if !initial {
+			rm.l.WithField("maxPairs", limits.maxPairs).
+				WithField("pairRate", limits.pairRate).
+				WithField("groups", limits.groups).
+				Info("relay.limits has changed")
+		}
+	}
+
+	rm.health.reload(c, initial)
 	return nil
 }
 
@@ -45,6 +112,11 @@ func (rm *relayManager) GetAmRelay() bool {
 	return rm.amRelay.Load()
 }
 
+// GetMaxHops returns the maximum number of relays allowed between two peers
+func (rm *relayManager) GetMaxHops() int {
+	return int(rm.maxHops.Load())
+}
+
 func (rm *relayManager) setAmRelay(v bool) {
 	rm.amRelay.Store(v)
 }
@@ -52,6 +124,11 @@ func (rm *relayManager) setAmRelay(v bool) {
 // AddRelay finds an available relay index on the hostmap, and associates the relay info with it.
 // relayHostInfo is the Nebula peer which can be used as a relay to access the target vpnIp.
 func AddRelay(l *logrus.Logger, relayHostInfo *HostInfo, hm *HostMap, vpnIp netip.Addr, remoteIdx *uint32, relayType int, state int) (uint32, error) {
+	return addChainedRelay(l, relayHostInfo, hm, vpnIp, netip.Addr{}, netip.Addr{}, remoteIdx, relayType, state)
+}
+
+// addChainedRelay is AddRelay for a forwarding relay that is part of a chain of relays, see Relay.ViaIp and Relay.FromIp
+func addChainedRelay(l *logrus.Logger, relayHostInfo *HostInfo, hm *HostMap, vpnIp, viaIp, fromIp netip.Addr, remoteIdx *uint32, relayType int, state int) (uint32, error) {
 	hm.Lock()
 	defer hm.Unlock()
 	for i := 0; i < 32; i++ {
@@ -73,6 +150,8 @@ func AddRelay(l *logrus.Logger, relayHostInfo *HostInfo, hm *HostMap, vpnIp neti
 				State:      state,
 				LocalIndex: index,
 				PeerIp:     vpnIp,
+				ViaIp:      viaIp,
+				FromIp:     fromIp,
 			}
 
 			if remoteIdx != nil {
@@ -101,6 +180,134 @@ func (rm *relayManager) EstablishRelay(relayHostInfo *HostInfo, m *NebulaControl
 	return relay, nil
 }
 
+// addRelayToTunnel makes relayHostInfo available for sending to vpnIp if we have a relayed tunnel with vpnIp.
+// This happens when a relayed tunnel is moved to a different relay.
+func (rm *relayManager) addRelayToTunnel(relayHostInfo *HostInfo, vpnIp netip.Addr) {
+	hostinfo := rm.hostmap.QueryVpnIp(vpnIp)
+	if hostinfo == nil || hostinfo.remote.IsValid() {
+		return
+	}
+	hostinfo.relayState.InsertRelayTo(relayHostInfo.vpnIp)
+}
+
+// hopLimit returns the maximum number of relays allowed between the peers of a CreateRelayRequest
+func (rm *relayManager) hopLimit(m *NebulaControl) int {
+	if m.HopLimit == 0 {
+		// The initiator does not know about relay chains
+		return 1
+	}
+	return min(rm.GetMaxHops(), int(m.HopLimit))
+}
+
+// checkRelayPath returns the relays a CreateRelayRequest has passed through and false if the request is not allowed,
+// either because it loops, it exceeds the hop limit or it was not sent by the host that should have sent it. Chained
+// requests are only taken from relays listed in relay.relays since the path they carry can not be verified.
+func (rm *relayManager) checkRelayPath(f *Interface, h *HostInfo, m *NebulaControl, from, target netip.Addr) ([]netip.Addr, bool) {
+	path := make([]netip.Addr, len(m.RelayPath))
+	b := [4]byte{}
+	for i, ip := range m.RelayPath {
+		//TODO: IPV6-WORK
+		binary.BigEndian.PutUint32(b[:], ip)
+		path[i] = netip.AddrFrom4(b)
+	}
+
+	if len(path) == 0 {
+		// Only the peer itself may ask us to be the first relay
+		return path, from == h.vpnIp
+	}
+
+	// Chained requests must come from the last relay they passed through, which must be a relay we trust
+	if path[len(path)-1] != h.vpnIp || !slices.Contains(*rm.chainRelays.Load(), h.vpnIp) {
+		return path, false
+	}
+
+	me := f.myVpnNet.Addr()
+	if slices.Contains(path, me) || slices.Contains(path, from) || slices.Contains(path, target) {
+		return path, false
+	}
+
+	// The relays before us plus us
+	return path, len(path)+1 <= rm.hopLimit(m)
+}
+
+// nextChainHop returns a relay advertised by target that we have a direct tunnel with, so a CreateRelayRequest can be
+// passed along a chain of relays. nil is returned if the hop limit is reached or no usable relay is known yet.
+func (rm *relayManager) nextChainHop(f *Interface, m *NebulaControl, path []netip.Addr, from, target netip.Addr) *HostInfo {
+	// The relays before us, us, and the next relay
+	if len(path)+2 > rm.hopLimit(m) {
+		return nil
+	}
+
+	relays := f.lightHouse.QueryCache(target).CopyRelays()
+	if len(relays) == 0 {
+		// Ask the lighthouse which relays target uses so a later request can succeed
+		f.lightHouse.QueryServer(target)
+		return nil
+	}
+
+	me := f.myVpnNet.Addr()
+	for _, relay := range rm.health.Rank(relays) {
+		if relay == me || relay == from || relay == target || slices.Contains(path, relay) {
+			continue
+		}
+
+		hostinfo := rm.hostmap.QueryVpnIp(relay)
+		if hostinfo == nil || !hostinfo.remote.IsValid() {
+			// Get a tunnel up with this relay so it can be used by a later request
+			f.Handshake(relay)
+			continue
+		}
+
+		return hostinfo
+	}
+
+	return nil
+}
+
+// forwardingPairs returns the number of distinct peer pairs we are relaying for
+func (rm *relayManager) forwardingPairs() int {
+	rm.hostmap.RLock()
+	defer rm.hostmap.RUnlock()
+
+	pairs := map[relayPair]struct{}{}
+	for idx, hostinfo := range rm.hostmap.Relays {
+		r, ok := hostinfo.relayState.QueryRelayForByIdx(idx)
+		if ok && r.Type == ForwardingType {
+			pairs[newRelayPair(r.forwardFrom(hostinfo.vpnIp), r.PeerIp)] = struct{}{}
+		}
+	}
+	return len(pairs)
+}
+
+// allowForward returns true if n more bytes relayed between from and to are within the configured rate limits
+func (rm *relayManager) allowForward(from, to netip.Addr, n int) bool {
+	limits := rm.limits.Load()
+	if !limits.hasRateLimits() {
+		return true
+	}
+
+	now := time.Now()
+	var pair *tokenBucket
+	if limits.pairRate > 0 {
+		pair = limits.pairBucket(from, to, now)
+		if !pair.allow(now, float64(n)) {
+			rm.metricDroppedPairRate.Inc(1)
+			return false
+		}
+	}
+
+	if limits.total != nil && !limits.total.allow(now, float64(n)) {
+		// The pair did not get to send, don't charge it for the packet
+		if pair != nil {
+			pair.refund(float64(n))
+		}
+		rm.metricDroppedTotalRate.Inc(1)
+		return false
+	}
+
+	return true
+}
+
 func (rm *relayManager) HandleControlMsg(h *HostInfo, m *NebulaControl, f *Interface) {
 
 	switch m.Type {
@@ -108,10 +315,53 @@ func (rm *relayManager) HandleControlMsg(h *HostInfo, m *NebulaControl, f *Inter
 		rm.handleCreateRelayRequest(h, f, m)
 	case NebulaControl_CreateRelayResponse:
 		rm.handleCreateRelayResponse(h, f, m)
+	case NebulaControl_CreateRelayRejected:
+		rm.handleCreateRelayRejected(h, m)
 	}
 
 }
 
+// handleCreateRelayRejected removes the relay we requested through h, h will not relay for us
+func (rm *relayManager) handleCreateRelayRejected(h *HostInfo, m *NebulaControl) {
+	//TODO: IPV6-WORK
+	b := [4]byte{}
+	binary.BigEndian.PutUint32(b[:], m.RelayToIp)
+	target := netip.AddrFrom4(b)
+
+	rm.l.WithFields(logrus.Fields{
+		"relay":               h.vpnIp,
+		"relayTo":             target,
+		"initiatorRelayIndex": m.InitiatorRelayIndex,
+		"reason":              m.Reason}).
+		Info("Relay rejected our CreateRelayRequest")
+
+	relay, ok := h.relayState.QueryRelayForByIdx(m.InitiatorRelayIndex)
+	if !ok || relay.Type != TerminalType || relay.State != Requested || relay.PeerIp != target {
+		return
+	}
+
+	h.relayState.RemoveRelay(relay.LocalIndex)
+	rm.hostmap.RemoveRelay(relay.LocalIndex)
+}
+
+// sendCreateRelayRejected tells h that we will not relay for it and why
+func (rm *relayManager) sendCreateRelayRejected(h *HostInfo, f *Interface, m *NebulaControl, reason string) {
+	resp := NebulaControl{
+		Type:                NebulaControl_CreateRelayRejected,
+		InitiatorRelayIndex: m.InitiatorRelayIndex,
+		RelayFromIp:         m.RelayFromIp,
+		RelayToIp:           m.RelayToIp,
+		Reason:              reason,
+	}
+	msg, err := resp.Marshal()
+	if err != nil {
+		rm.l.WithError(err).Error("relayManager Failed to marshal Control CreateRelayRejected message")
+		return
+	}
+
+	f.SendMessageToHostInfo(header.Control, 0, h, msg, make([]byte, 12), make([]byte, mtu))
+}
+
 func (rm *relayManager) handleCreateRelayResponse(h *HostInfo, f *Interface, m *NebulaControl) {
 	rm.l.WithFields(logrus.Fields{
 		"relayFrom":           m.RelayFromIp,
@@ -133,12 +383,14 @@ func (rm *relayManager) handleCreateRelayResponse(h *HostInfo, f *Interface, m *
 	}
 	// Do I need to complete the relays now?
 	if relay.Type == TerminalType {
+		// If we already have a relayed tunnel with the peer this relay is an additional path to it
+		rm.addRelayToTunnel(h, relay.PeerIp)
 		return
 	}
-	// I'm the middle man. Let the initiator know that the I've established the relay they requested.
-	peerHostInfo := rm.hostmap.QueryVpnIp(relay.PeerIp)
+	// I'm the middle man. Let the initiator, or the previous relay in a chain, know that I've established the relay they requested.
+	peerHostInfo := rm.hostmap.QueryVpnIp(relay.forwardTo())
 	if peerHostInfo == nil {
-		rm.l.WithField("relayTo", relay.PeerIp).Error("Can't find a HostInfo for peer")
+		rm.l.WithField("relayTo", relay.forwardTo()).Error("Can't find a HostInfo for peer")
 		return
 	}
 	peerRelay, ok := peerHostInfo.relayState.QueryRelayForByIp(targetAddr)
@@ -148,7 +400,7 @@ func (rm *relayManager) handleCreateRelayResponse(h *HostInfo, f *Interface, m *
 	}
 	if peerRelay.State == PeerRequested {
 		//TODO: IPV6-WORK
-		b = peerHostInfo.vpnIp.As4()
+		b = relay.PeerIp.As4()
 		peerRelay.State = Established
 		resp := NebulaControl{
 			Type:                NebulaControl_CreateRelayResponse,
@@ -229,6 +481,7 @@ func (rm *relayManager) handleCreateRelayRequest(h *HostInfo, f *Interface, m *N
 			logMsg.Error("Relay State not found")
 			return
 		}
+		rm.addRelayToTunnel(h, from)
 
 		//TODO: IPV6-WORK
 		fromB := from.As4()
@@ -262,21 +515,66 @@ func (rm *relayManager) handleCreateRelayRequest(h *HostInfo, f *Interface, m *N
 		if !rm.GetAmRelay() {
 			return
 		}
-		peer := rm.hostmap.QueryVpnIp(target)
-		if peer == nil {
-			// Try to establish a connection to this host. If we get a future relay request,
-			// we'll be ready!
-			f.Handshake(target)
+
+		path, ok := rm.checkRelayPath(f, h, m, from, target)
+		if !ok {
+			logMsg.WithField("relayPath", path).Info("Discarding relay request with an invalid relay path")
+			return
+		}
+
+		// The certificate of the peer is only known when it asked us itself, chained requests can not be checked
+		limits := rm.limits.Load()
+		if len(path) > 0 && limits.groups != nil {
+			rm.metricRejectedGroups.Inc(1)
+			logMsg.Info("Rejecting chained CreateRelayRequest, relay.limits.groups is set")
+			rm.sendCreateRelayRejected(h, f, m, "chained requests are not allowed when groups are limited")
+			return
+		}
+
+		if !limits.allowCert(h.GetCert()) {
+			rm.metricRejectedGroups.Inc(1)
+			logMsg.Info("Rejecting CreateRelayRequest, requester is not in relay.limits.groups")
+			rm.sendCreateRelayRejected(h, f, m, "not a member of a group allowed to use this relay")
 			return
 		}
-		if !peer.remote.IsValid() {
-			// Only create relays to peers for whom I have a direct connection
+
+		if _, ok := h.relayState.QueryRelayForByIp(target); !ok && limits.maxPairs > 0 && rm.forwardingPairs() >= limits.maxPairs {
+			rm.metricRejectedMaxPairs.Inc(1)
+			logMsg.WithField("maxPairs", limits.maxPairs).Info("Rejecting CreateRelayRequest, relay.limits.max_pairs reached")
+			rm.sendCreateRelayRejected(h, f, m, "relay is at its maximum number of relayed pairs")
 			return
 		}
+
+		next := rm.hostmap.QueryVpnIp(target)
+		if next == nil || !next.remote.IsValid() {
+			if next == nil {
+				// Try to establish a connection to this host. If we get a future relay request,
+				// we'll be ready!
+				f.Handshake(target)
+			}
+
+			// Only create relays to peers for whom I have a direct connection, or through another relay that does
+			next = rm.nextChainHop(f, m, path, from, target)
+			if next == nil {
+				return
+			}
+		}
+
+		// When we are in the middle of a chain of relays the hosts on either side of us are not the peers
+		var viaIp, fromIp, nextViaIp, nextFromIp netip.Addr
+		if next.vpnIp != target {
+			viaIp = next.vpnIp
+			nextFromIp = target
+		}
+		if h.vpnIp != from {
+			fromIp = from
+			nextViaIp = h.vpnIp
+		}
+
 		sendCreateRequest := false
 		var index uint32
 		var err error
-		targetRelay, ok := peer.relayState.QueryRelayForByIp(from)
+		targetRelay, ok := next.relayState.QueryRelayForByIp(from)
 		if ok {
 			index = targetRelay.LocalIndex
 			if targetRelay.State == Requested {
@@ -284,7 +582,7 @@ func (rm *relayManager) handleCreateRelayRequest(h *HostInfo, f *Interface, m *N
 			}
 		} else {
 			// Allocate an index in the hostMap for this relay peer
-			index, err = AddRelay(rm.l, peer, f.hostMap, from, nil, ForwardingType, Requested)
+			index, err = addChainedRelay(rm.l, next, f.hostMap, from, nextViaIp, nextFromIp, nil, ForwardingType, Requested)
 			if err != nil {
 				return
 			}
@@ -292,29 +590,34 @@ func (rm *relayManager) handleCreateRelayRequest(h *HostInfo, f *Interface, m *N
 		}
 		if sendCreateRequest {
 			//TODO: IPV6-WORK
-			fromB := h.vpnIp.As4()
+			fromB := from.As4()
 			targetB := target.As4()
 
-			// Send a CreateRelayRequest to the peer.
+			// Send a CreateRelayRequest to the peer, or the next relay in the chain.
 			req := NebulaControl{
 				Type:                NebulaControl_CreateRelayRequest,
 				InitiatorRelayIndex: index,
 				RelayFromIp:         binary.BigEndian.Uint32(fromB[:]),
 				RelayToIp:           binary.BigEndian.Uint32(targetB[:]),
 			}
+			if viaIp.IsValid() {
+				myB := f.myVpnNet.Addr().As4()
+				req.RelayPath = append(m.RelayPath, binary.BigEndian.Uint32(myB[:]))
+				req.HopLimit = m.HopLimit
+			}
 			msg, err := req.Marshal()
 			if err != nil {
 				logMsg.
 					WithError(err).Error("relayManager Failed to marshal Control message to create relay")
 			} else {
-				f.SendMessageToHostInfo(header.Control, 0, peer, msg, make([]byte, 12), make([]byte, mtu))
+				f.SendMessageToHostInfo(header.Control, 0, next, msg, make([]byte, 12), make([]byte, mtu))
 				rm.l.WithFields(logrus.Fields{
 					//TODO: IPV6-WORK another lazy used to use the req object
-					"relayFrom":           h.vpnIp,
+					"relayFrom":           from,
 					"relayTo":             target,
 					"initiatorRelayIndex": req.InitiatorRelayIndex,
 					"responderRelayIndex": req.ResponderRelayIndex,
-					"vpnIp":               target}).
+					"vpnIp":               next.vpnIp}).
 					Info("send CreateRelayRequest")
 			}
 		}
@@ -326,7 +629,7 @@ func (rm *relayManager) handleCreateRelayRequest(h *HostInfo, f *Interface, m *N
 			if targetRelay != nil && targetRelay.State == Established {
 				state = Established
 			}
-			_, err := AddRelay(rm.l, h, f.hostMap, target, &m.InitiatorRelayIndex, ForwardingType, state)
+			_, err := addChainedRelay(rm.l, h, f.hostMap, target, viaIp, fromIp, &m.InitiatorRelayIndex, ForwardingType, state)
 			if err != nil {
 				logMsg.
 					WithError(err).Error("relayManager Failed to allocate a local index for relay")
@@ -343,7 +646,7 @@ func (rm *relayManager) handleCreateRelayRequest(h *HostInfo, f *Interface, m *N
 					return
 				}
 				//TODO: IPV6-WORK
-				fromB := h.vpnIp.As4()
+				fromB := from.As4()
 				targetB := target.As4()
 				resp := NebulaControl{
 					Type:                NebulaControl_CreateRelayResponse,
@@ -360,7 +663,7 @@ func (rm *relayManager) handleCreateRelayRequest(h *HostInfo, f *Interface, m *N
 					f.SendMessageToHostInfo(header.Control, 0, h, msg, make([]byte, 12), make([]byte, mtu))
 					rm.l.WithFields(logrus.Fields{
 						//TODO: IPV6-WORK more lazy, used to use resp object
-						"relayFrom":           h.vpnIp,
+						"relayFrom":           from,
 						"relayTo":             target,
 						"initiatorRelayIndex": resp.InitiatorRelayIndex,
 						"responderRelayIndex": resp.ResponderRelayIndex,
@@ -0,0 +1,122 @@
+package nebula
+
+import (
+	"context"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRelayManager_checkRelayPath(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["relay"] = map[interface{}]interface{}{"am_relay": true, "max_hops": 3, "chain_from": []interface{}{"10.0.0.4", "10.0.0.5"}}
+	rm, err := NewRelayManager(context.Background(), l, newHostMap(l, netip.MustParsePrefix("10.0.0.1/24")), c)
+	require.NoError(t, err)
+	assert.Equal(t, 3, rm.GetMaxHops())
+
+	me := netip.MustParseAddr("10.0.0.1")
+	from := netip.MustParseAddr("10.0.0.2")
+	target := netip.MustParseAddr("10.0.0.3")
+	relay1 := netip.MustParseAddr("10.0.0.4")
+	relay2 := netip.MustParseAddr("10.0.0.5")
+	f := &Interface{myVpnNet: netip.MustParsePrefix("10.0.0.1/24")}
+
+	ip := func(addr netip.Addr) uint32 {
+		b := addr.As4()
+		return binary.BigEndian.Uint32(b[:])
+	}
+
+	// Peers that don't know about chains can only use us directly
+	assert.Equal(t, 1, rm.hopLimit(&NebulaControl{}))
+	assert.Equal(t, 2, rm.hopLimit(&NebulaControl{HopLimit: 2}))
+	assert.Equal(t, 3, rm.hopLimit(&NebulaControl{HopLimit: 5}))
+
+	// The first relay must be asked by the peer itself
+	_, ok := rm.checkRelayPath(f, &HostInfo{vpnIp: from}, &NebulaControl{}, from, target)
+	assert.True(t, ok)
+	_, ok = rm.checkRelayPath(f, &HostInfo{vpnIp: relay1}, &NebulaControl{}, from, target)
+	assert.False(t, ok)
+
+	// Chained requests must come from the last relay
+	m := &NebulaControl{HopLimit: 3, RelayPath: []uint32{ip(relay1), ip(relay2)}}
+	path, ok := rm.checkRelayPath(f, &HostInfo{vpnIp: relay2}, m, from, target)
+	assert.True(t, ok)
+	assert.Equal(t, []netip.Addr{relay1, relay2}, path)
+	_, ok = rm.checkRelayPath(f, &HostInfo{vpnIp: relay1}, m, from, target)
+	assert.False(t, ok)
+
+	// A host that is not one of our relays can not claim to be part of a chain
+	m = &NebulaControl{HopLimit: 3, RelayPath: []uint32{ip(target)}}
+	_, ok = rm.checkRelayPath(f, &HostInfo{vpnIp: target}, m, from, relay1)
+	assert.False(t, ok)
+
+	// relay.relays does not let a relay extend chains through us
+	c.Settings["relay"] = map[interface{}]interface{}{"am_relay": true, "max_hops": 3, "relays": []interface{}{"10.0.0.4"}}
+	rmRelays, err := NewRelayManager(context.Background(), l, newHostMap(l, netip.MustParsePrefix("10.0.0.1/24")), c)
+	require.NoError(t, err)
+	_, ok = rmRelays.checkRelayPath(f, &HostInfo{vpnIp: relay1}, &NebulaControl{HopLimit: 3, RelayPath: []uint32{ip(relay1)}}, from, target)
+	assert.False(t, ok)
+
+	c.Settings["relay"] = map[interface{}]interface{}{"chain_from": []interface{}{"nope"}}
+	_, err = NewRelayManager(context.Background(), l, newHostMap(l, netip.MustParsePrefix("10.0.0.1/24")), c)
+	assert.ErrorContains(t, err, "entry 1 in relay.chain_from failed to parse")
+
+	// No loops
+	m = &NebulaControl{HopLimit: 3, RelayPath: []uint32{ip(me), ip(relay1)}}
+	_, ok = rm.checkRelayPath(f, &HostInfo{vpnIp: relay1}, m, from, target)
+	assert.False(t, ok)
+	m = &NebulaControl{HopLimit: 3, RelayPath: []uint32{ip(target), ip(relay1)}}
+	_, ok = rm.checkRelayPath(f, &HostInfo{vpnIp: relay1}, m, from, target)
+	assert.False(t, ok)
+
+	// We would be over the hop limit
+	m = &NebulaControl{HopLimit: 2, RelayPath: []uint32{ip(relay1), ip(relay2)}}
+	_, ok = rm.checkRelayPath(f, &HostInfo{vpnIp: relay2}, m, from, target)
+	assert.False(t, ok)
+}
+
+func TestRelay_forward(t *testing.T) {
+	peer := netip.MustParseAddr("10.0.0.2")
+	via := netip.MustParseAddr("10.0.0.3")
+	from := netip.MustParseAddr("10.0.0.4")
+	relayHost := netip.MustParseAddr("10.0.0.5")
+
+	r := &Relay{PeerIp: peer}
+	assert.Equal(t, peer, r.forwardTo())
+	assert.Equal(t, relayHost, r.forwardFrom(relayHost))
+
+	r = &Relay{PeerIp: peer, ViaIp: via, FromIp: from}
+	assert.Equal(t, via, r.forwardTo())
+	assert.Equal(t, from, r.forwardFrom(relayHost))
+}
+
+func TestRelayManager_allowForward(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["relay"] = map[interface{}]interface{}{"am_relay": true, "limits": map[interface{}]interface{}{
+		"pair_rate":  100000,
+		"total_rate": 100000,
+	}}
+	rm, err := NewRelayManager(context.Background(), l, newHostMap(l, netip.MustParsePrefix("10.0.0.1/24")), c)
+	require.NoError(t, err)
+
+	a := netip.MustParseAddr("10.0.0.2")
+	b := netip.MustParseAddr("10.0.0.3")
+	other := netip.MustParseAddr("10.0.0.4")
+
+	// Another pair uses up most of the total budget
+	assert.True(t, rm.allowForward(other, b, 90000))
+
+	// A packet the total budget drops is not charged to the pair
+	assert.False(t, rm.allowForward(a, b, 20000))
+	assert.False(t, rm.allowForward(a, b, 20000))
+	pair := rm.limits.Load().pairBucket(a, b, time.Now())
+	assert.True(t, pair.allow(time.Now(), 99000))
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"net"
 	"net/netip"
+	"slices"
 	"sort"
 	"strconv"
 	"sync"
@@ -27,9 +28,11 @@ type CacheMap map[string]*Cache
 // Cache is the other part of CacheMap to better represent the lighthouse cache for humans
 // We don't reason about ipv4 vs ipv6 here
 type Cache struct {
-	Learned  []netip.AddrPort `json:"learned,omitempty"`
-	Reported []netip.AddrPort `json:"reported,omitempty"`
-	Relay    []netip.Addr     `json:"relay"`
+	Learned   []netip.AddrPort `json:"learned,omitempty"`
+	Reported  []netip.AddrPort `json:"reported,omitempty"`
+	Relay     []netip.Addr     `json:"relay"`
+	TCP       []netip.AddrPort `json:"tcp,omitempty"`
+	WebSocket []netip.AddrPort `json:"websocket,omitempty"`
 }
 
 //TODO: Seems like we should plop static host entries in here too since the are protected by the lighthouse from deletion
@@ -37,15 +40,25 @@ type Cache struct {
 
 // cache is an internal struct that splits v4 and v6 addresses inside the cache map
 type cache struct {
-	v4    *cacheV4
-	v6    *cacheV6
-	relay *cacheRelay
+	v4        *cacheV4
+	v6        *cacheV6
+	relay     *cacheRelay
+	tcp       *cacheStream
+	websocket *cacheStream
+	// natType is what the owner last reported about the NAT in front of it
+	natType NatType
 }
 
 type cacheRelay struct {
 	relay []netip.Addr
 }
 
+// cacheStream stores reported tcp or websocket endpoints under cache, there is no learned endpoint as streams we
+// accepted come from a port nobody else can reach
+type cacheStream struct {
+	reported []netip.AddrPort
+}
+
 // cacheV4 stores learned and reported ipv4 records under cache
 type cacheV4 struct {
 	learned  *Ip4AndPort
@@ -265,6 +278,48 @@ func (r *RemoteList) CopyAddrs(preferredRanges []netip.Prefix) []netip.AddrPort
 	return c
 }
 
+// CopyRelays locks and makes a copy of the relay vpn ips the remote identified
+func (r *RemoteList) CopyRelays() []netip.Addr {
+	r.RLock()
+	defer r.RUnlock()
+	return slices.Clone(r.relays)
+}
+
+// CopyTCPAddrs locks and makes a sorted, deduplicated copy of the tcp endpoints the remote can be reached on
+func (r *RemoteList) CopyTCPAddrs() []netip.AddrPort {
+	return r.copyStreamAddrs(func(c *cache) *cacheStream { return c.tcp })
+}
+
+// CopyWebSocketAddrs locks and makes a sorted, deduplicated copy of the websocket endpoints the remote can be reached on
+func (r *RemoteList) CopyWebSocketAddrs() []netip.AddrPort {
+	return r.copyStreamAddrs(func(c *cache) *cacheStream { return c.websocket })
+}
+
+func (r *RemoteList) copyStreamAddrs(get func(*cache) *cacheStream) []netip.AddrPort {
+	if r == nil {
+		return nil
+	}
+
+	r.RLock()
+	defer r.RUnlock()
+
+	var addrs []netip.AddrPort
+	for _, c := range r.cache {
+		cs := get(c)
+		if cs == nil {
+			continue
+		}
+		for _, v := range cs.reported {
+			if !r.unlockedIsBad(v) {
+				addrs = append(addrs, v)
+			}
+		}
+	}
+
+	slices.SortFunc(addrs, func(a, b netip.AddrPort) int { return a.Compare(b) })
+	return slices.Compact(addrs)
+}
+
 // LearnRemote locks and sets the learned slot for the owner vpn ip to the provided addr
 // Currently this is only needed when HostInfo.SetRemote is called as that should cover both handshaking and roaming.
 // It will mark the deduplicated address list as dirty, so do not call it unless new information is available
@@ -327,6 +382,14 @@ func (r *RemoteList) CopyCache() *CacheMap {
 				c.Relay = append(c.Relay, a)
 			}
 		}
+
+		if mc.tcp != nil {
+			c.TCP = append(c.TCP, mc.tcp.reported...)
+		}
+
+		if mc.websocket != nil {
+			c.WebSocket = append(c.WebSocket, mc.websocket.reported...)
+		}
 	}
 
 	return &cm
@@ -434,6 +497,37 @@ func (r *RemoteList) unlockedSetRelay(ownerVpnIp, vpnIp netip.Addr, to []netip.A
 	c.relay = append(c.relay, to[:minInt(len(to), MaxRemotes)]...)
 }
 
+// unlockedSetTCP assumes you have the write lock and resets the tcp endpoints reported by the owner
+func (r *RemoteList) unlockedSetTCP(ownerVpnIp, vpnIp netip.Addr, to []netip.AddrPort, check func(vpnIp, to netip.Addr) bool) {
+	r.unlockedGetOrMakeTCP(ownerVpnIp).set(vpnIp, to, check)
+}
+
+// unlockedSetWebSocket assumes you have the write lock and resets the websocket endpoints reported by the owner
+func (r *RemoteList) unlockedSetWebSocket(ownerVpnIp, vpnIp netip.Addr, to []netip.AddrPort, check func(vpnIp, to netip.Addr) bool) {
+	r.unlockedGetOrMakeWebSocket(ownerVpnIp).set(vpnIp, to, check)
+}
+
+// unlockedSetNatType assumes you have the write lock and records the NAT type reported by the owner
+func (r *RemoteList) unlockedSetNatType(ownerVpnIp netip.Addr, natType NatType) {
+	am := r.cache[ownerVpnIp]
+	if am == nil {
+		am = &cache{}
+		r.cache[ownerVpnIp] = am
+	}
+	am.natType = natType
+}
+
+func (c *cacheStream) set(vpnIp netip.Addr, to []netip.AddrPort, check func(vpnIp, to netip.Addr) bool) {
+	// Reset the slice
+	c.reported = c.reported[:0]
+
+	for _, v := range to[:minInt(len(to), MaxRemotes)] {
+		if check(vpnIp, v.Addr()) {
+			c.reported = append(c.reported, v)
+		}
+	}
+}
+
 // unlockedPrependV4 assumes you have the write lock and prepends the address in the reported list for this owner
 // This is only useful for establishing static hosts
 func (r *RemoteList) unlockedPrependV4(ownerVpnIp netip.Addr, to *Ip4AndPort) {
@@ -497,6 +591,32 @@ func (r *RemoteList) unlockedGetOrMakeRelay(ownerVpnIp netip.Addr) *cacheRelay {
 	return am.relay
 }
 
+func (r *RemoteList) unlockedGetOrMakeTCP(ownerVpnIp netip.Addr) *cacheStream {
+	am := r.cache[ownerVpnIp]
+	if am == nil {
+		am = &cache{}
+		r.cache[ownerVpnIp] = am
+	}
+	// Avoid occupying memory for tcp endpoints if we never have any
+	if am.tcp == nil {
+		am.tcp = &cacheStream{}
+	}
+	return am.tcp
+}
+
+func (r *RemoteList) unlockedGetOrMakeWebSocket(ownerVpnIp netip.Addr) *cacheStream {
+	am := r.cache[ownerVpnIp]
+	if am == nil {
+		am = &cache{}
+		r.cache[ownerVpnIp] = am
+	}
+	// Avoid occupying memory for websocket endpoints if we never have any
+	if am.websocket == nil {
+		am.websocket = &cacheStream{}
+	}
+	return am.websocket
+}
+
 // unlockedGetOrMakeV4 assumes you have the write lock and builds the cache and owner entry. Only the v4 pointer is established.
 // The caller must dirty the learned address cache if required
 func (r *RemoteList) unlockedGetOrMakeV4(ownerVpnIp netip.Addr) *cacheV4 {
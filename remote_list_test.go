@@ -97,6 +97,44 @@ func TestRemoteList_Rebuild(t *testing.T) {
 	assert.Equal(t, "172.31.0.1:10101", rl.addrs[9].String())
 }
 
+func TestRemoteList_CopyTCPAddrs(t *testing.T) {
+	rl := NewRemoteList(nil)
+	assert.Empty(t, rl.CopyTCPAddrs())
+	assert.Empty(t, (*RemoteList)(nil).CopyTCPAddrs())
+
+	allow := func(_, to netip.Addr) bool { return to != netip.MustParseAddr("10.0.0.1") }
+	rl.unlockedSetTCP(
+		netip.MustParseAddr("0.0.0.1"),
+		netip.MustParseAddr("0.0.0.3"),
+		[]netip.AddrPort{
+			netip.MustParseAddrPort("1.1.1.1:443"),
+			netip.MustParseAddrPort("[1::1]:443"),
+			netip.MustParseAddrPort("10.0.0.1:443"), // this is not allowed
+		},
+		allow,
+	)
+	rl.unlockedSetTCP(
+		netip.MustParseAddr("0.0.0.2"),
+		netip.MustParseAddr("0.0.0.3"),
+		[]netip.AddrPort{
+			netip.MustParseAddrPort("2.2.2.2:443"),
+			netip.MustParseAddrPort("1.1.1.1:443"), // this is a dupe
+		},
+		allow,
+	)
+
+	assert.Equal(t, []netip.AddrPort{
+		netip.MustParseAddrPort("1.1.1.1:443"),
+		netip.MustParseAddrPort("2.2.2.2:443"),
+		netip.MustParseAddrPort("[1::1]:443"),
+	}, rl.CopyTCPAddrs())
+
+	// Blocked endpoints are left out and an owner replaces what it reported before
+	rl.BlockRemote(netip.MustParseAddrPort("2.2.2.2:443"))
+	rl.unlockedSetTCP(netip.MustParseAddr("0.0.0.1"), netip.MustParseAddr("0.0.0.3"), nil, allow)
+	assert.Equal(t, []netip.AddrPort{netip.MustParseAddrPort("1.1.1.1:443")}, rl.CopyTCPAddrs())
+}
+
 func BenchmarkFullRebuild(b *testing.B) {
 	rl := NewRemoteList(nil)
 	rl.unlockedSetV4(
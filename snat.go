@@ -0,0 +1,349 @@
+package nebula
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/overlay"
+	"github.com/slackhq/nebula/udp"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	gvheader "gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	gvudp "gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const (
+	snatNicID = 1
+	// snatQueueLen is how many packets the stack may have waiting for the vpn
+	snatQueueLen = 512
+	// snatMaxInFlight is how many tcp connections may be waiting on a dial at once, more syns are dropped
+	snatMaxInFlight = 1024
+	// snatDialTimeout is how long a host behind the gateway has to accept a tcp connection
+	snatDialTimeout = 10 * time.Second
+	// snatCheckInterval is how often flows are checked against the firewall conntrack
+	snatCheckInterval = 5 * time.Second
+	// snatBufferSize fits the largest udp datagram
+	snatBufferSize = 65535
+)
+
+// snat carries packets from other hosts to unsafe networks through a userspace network stack instead of the tun device.
+// The stack ends every tcp and udp flow and opens it again from this host's own sockets, so the hosts behind the gateway
+// see the gateway's lan address and need no route back to the vpn, and the kernel needs neither ip forwarding nor nat
+// rules. A flow is closed once the firewall conntrack entry that let it in expires.
+type snat struct {
+	l *logrus.Logger
+	// networks are the unsafe networks nat is done for, anything else still goes to the tun device
+	networks []netip.Prefix
+	stack    *stack.Stack
+	ep       *channel.Endpoint
+
+	flowsLock sync.Mutex
+	flows     map[firewall.Packet]*snatFlow
+
+	metricTcp        metrics.Counter
+	metricUdp        metrics.Counter
+	metricDialFailed metrics.Counter
+	metricDropped    metrics.Counter
+}
+
+// snatFlow is a connection from a vpn host spliced to the same connection made from this host
+type snatFlow struct {
+	inside  net.Conn
+	outside net.Conn
+}
+
+func (fl *snatFlow) close() {
+	fl.inside.Close()
+	fl.outside.Close()
+}
+
+// newSnatFromConfig returns nil if tun.snat is not enabled
+func newSnatFromConfig(l *logrus.Logger, c *config.C, crt cert.Certificate) (*snat, error) {
+	if !c.GetBool("tun.snat.enabled", false) {
+		return nil, nil
+	}
+
+	networks, err := unsafeNetworksFromConfig(c, "tun.snat.networks", crt.UnsafeNetworks())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(networks) == 0 {
+		return nil, fmt.Errorf("tun.snat.enabled requires ipv4 unsafe networks in the certificate")
+	}
+
+	s := &snat{
+		l:                l,
+		networks:         networks,
+		flows:            map[firewall.Packet]*snatFlow{},
+		metricTcp:        metrics.GetOrRegisterCounter("snat.tcp", nil),
+		metricUdp:        metrics.GetOrRegisterCounter("snat.udp", nil),
+		metricDialFailed: metrics.GetOrRegisterCounter("snat.dial_failed", nil),
+		metricDropped:    metrics.GetOrRegisterCounter("snat.dropped", nil),
+	}
+
+	s.stack = stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, gvudp.NewProtocol},
+	})
+
+	sackEnabledOpt := tcpip.TCPSACKEnabled(true) // TCP SACK is disabled by default
+	if tcpipErr := s.stack.SetTransportProtocolOption(tcp.ProtocolNumber, &sackEnabledOpt); tcpipErr != nil {
+		return nil, fmt.Errorf("could not enable TCP SACK: %v", tcpipErr)
+	}
+
+	s.ep = channel.New(snatQueueLen, uint32(c.GetInt("tun.mtu", overlay.DefaultMTU)), "")
+	if tcpipErr := s.stack.CreateNIC(snatNicID, s.ep); tcpipErr != nil {
+		return nil, fmt.Errorf("could not create netstack NIC: %v", tcpipErr)
+	}
+
+	// The stack answers for every address behind us and replies from them
+	if tcpipErr := s.stack.SetPromiscuousMode(snatNicID, true); tcpipErr != nil {
+		return nil, fmt.Errorf("could not enable netstack promiscuous mode: %v", tcpipErr)
+	}
+	if tcpipErr := s.stack.SetSpoofing(snatNicID, true); tcpipErr != nil {
+		return nil, fmt.Errorf("could not enable netstack spoofing: %v", tcpipErr)
+	}
+	s.stack.SetRouteTable([]tcpip.Route{{Destination: gvheader.IPv4EmptySubnet, NIC: snatNicID}})
+
+	tcpFwd := tcp.NewForwarder(s.stack, 0, snatMaxInFlight, s.handleTCP)
+	s.stack.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpFwd.HandlePacket)
+	udpFwd := gvudp.NewForwarder(s.stack, s.handleUDP)
+	s.stack.SetTransportProtocolHandler(gvudp.ProtocolNumber, udpFwd.HandlePacket)
+
+	l.WithField("networks", networks).Info("Userspace nat enabled for unsafe networks")
+	return s, nil
+}
+
+// contains returns true if packets for addr are handled by the stack
+func (s *snat) contains(addr netip.Addr) bool {
+	for _, n := range s.networks {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// inject hands a decrypted packet that passed the firewall to the stack. Only tcp and udp are carried, anything else is
+// dropped.
+func (s *snat) inject(packet []byte, fp *firewall.Packet) {
+	if fp.Protocol != firewall.ProtoTCP && fp.Protocol != firewall.ProtoUDP {
+		s.metricDropped.Inc(1)
+		if s.l.Level >= logrus.DebugLevel {
+			s.l.WithField("fwPacket", fp).Debugln("dropping inbound packet, only tcp and udp are carried by tun.snat")
+		}
+		return
+	}
+
+	s.write(packet)
+}
+
+func (s *snat) write(packet []byte) {
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(packet)})
+	s.ep.InjectInbound(gvheader.IPv4ProtocolNumber, pkt)
+	pkt.DecRef()
+}
+
+// snatReplies is the tun queue of the userspace nat, rejects and icmp errors for packets from the stack go back to it
+type snatReplies struct {
+	s *snat
+}
+
+func (r snatReplies) Write(packet []byte) (int, error) {
+	r.s.write(packet)
+	return len(packet), nil
+}
+
+func (r snatReplies) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (r snatReplies) Close() error {
+	return nil
+}
+
+// Run sends the replies from the stack back through the vpn and closes flows the firewall no longer tracks. It uses the
+// queue after the routines so nothing is shared with the routine reading the tun device.
+func (s *snat) Run(ctx context.Context, f *Interface) {
+	out := make([]byte, mtu)
+	nb := make([]byte, 12, 12)
+	fwPacket := &firewall.Packet{}
+	q := f.routines
+	batch := udp.NewBatch(f.writers[q], f.writeBatchLatency)
+
+	send := func(packet []byte) {
+		f.consumeInsidePacket(packet, fwPacket, nb, out, q, nil, batch)
+		if batch.Len() > 0 && (batch.Due() || s.ep.NumQueued() == 0) {
+			if err := batch.Flush(); err != nil {
+				f.l.WithError(err).Error("Failed to write outgoing packets")
+			}
+		}
+	}
+
+	s.run(ctx, send, func(fp firewall.Packet) bool {
+		return f.firewall.tracked(fp, time.Now())
+	})
+}
+
+func (s *snat) run(ctx context.Context, send func([]byte), tracked func(firewall.Packet) bool) {
+	go s.expire(ctx, tracked)
+
+	for {
+		pkt := s.ep.ReadContext(ctx)
+		if pkt == nil {
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		view := pkt.ToView()
+		pkt.DecRef()
+		send(view.AsSlice())
+		view.Release()
+	}
+
+	s.ep.Close()
+	s.stack.Close()
+}
+
+// expire closes every flow tracked no longer reports as alive, and every flow once ctx is done
+func (s *snat) expire(ctx context.Context, tracked func(firewall.Packet) bool) {
+	ticker := time.NewTicker(snatCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			tracked = func(firewall.Packet) bool { return false }
+		case <-ticker.C:
+		}
+
+		s.flowsLock.Lock()
+		for fp, fl := range s.flows {
+			if !tracked(fp) {
+				fl.close()
+				delete(s.flows, fp)
+			}
+		}
+		s.flowsLock.Unlock()
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// snatPacket is the firewall conntrack key of the inbound packets of a flow
+func snatPacket(id stack.TransportEndpointID, proto uint8) firewall.Packet {
+	return firewall.Packet{
+		LocalIP:    netip.AddrFrom4(id.LocalAddress.As4()),
+		RemoteIP:   netip.AddrFrom4(id.RemoteAddress.As4()),
+		LocalPort:  id.LocalPort,
+		RemotePort: id.RemotePort,
+		Protocol:   proto,
+	}
+}
+
+func (s *snat) handleTCP(r *tcp.ForwarderRequest) {
+	fp := snatPacket(r.ID(), firewall.ProtoTCP)
+
+	// Dial first so a host that refuses the connection is refused to the vpn host as well
+	outside, err := net.DialTimeout("tcp", netip.AddrPortFrom(fp.LocalIP, fp.LocalPort).String(), snatDialTimeout)
+	if err != nil {
+		s.metricDialFailed.Inc(1)
+		s.l.WithError(err).WithField("fwPacket", fp).Debugln("Failed to dial for tun.snat")
+		r.Complete(true)
+		return
+	}
+
+	var wq waiter.Queue
+	ep, tcpipErr := r.CreateEndpoint(&wq)
+	if tcpipErr != nil {
+		s.l.WithField("fwPacket", fp).WithField("error", tcpipErr).Debugln("Failed to accept a tcp connection for tun.snat")
+		outside.Close()
+		r.Complete(true)
+		return
+	}
+	r.Complete(false)
+
+	s.metricTcp.Inc(1)
+	s.splice(fp, &snatFlow{inside: gonet.NewTCPConn(&wq, ep), outside: outside})
+}
+
+func (s *snat) handleUDP(r *gvudp.ForwarderRequest) {
+	fp := snatPacket(r.ID(), firewall.ProtoUDP)
+
+	// The endpoint takes the packet that made the request, it has to be created before we return
+	var wq waiter.Queue
+	ep, tcpipErr := r.CreateEndpoint(&wq)
+	if tcpipErr != nil {
+		s.l.WithField("fwPacket", fp).WithField("error", tcpipErr).Debugln("Failed to accept a udp flow for tun.snat")
+		return
+	}
+	inside := gonet.NewUDPConn(&wq, ep)
+
+	go func() {
+		outside, err := net.Dial("udp", netip.AddrPortFrom(fp.LocalIP, fp.LocalPort).String())
+		if err != nil {
+			s.metricDialFailed.Inc(1)
+			s.l.WithError(err).WithField("fwPacket", fp).Debugln("Failed to dial for tun.snat")
+			inside.Close()
+			return
+		}
+
+		s.metricUdp.Inc(1)
+		s.splice(fp, &snatFlow{inside: inside, outside: outside})
+	}()
+}
+
+// splice copies both ways until both sides are done or the flow is closed. A tcp side that finishes sending is half
+// closed on the other side.
+func (s *snat) splice(fp firewall.Packet, fl *snatFlow) {
+	s.flowsLock.Lock()
+	if old, ok := s.flows[fp]; ok {
+		old.close()
+	}
+	s.flows[fp] = fl
+	s.flowsLock.Unlock()
+
+	var wg sync.WaitGroup
+	cp := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, err := io.CopyBuffer(dst, src, make([]byte, snatBufferSize))
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok && err == nil {
+			cw.CloseWrite()
+			return
+		}
+		fl.close()
+	}
+
+	wg.Add(2)
+	go cp(fl.outside, fl.inside)
+	cp(fl.inside, fl.outside)
+	wg.Wait()
+
+	fl.close()
+	s.flowsLock.Lock()
+	if s.flows[fp] == fl {
+		delete(s.flows, fp)
+	}
+	s.flowsLock.Unlock()
+}
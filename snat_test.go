@@ -0,0 +1,209 @@
+package nebula
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	gvheader "gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	gvudp "gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+func TestNewSnatFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	crt := &dummyCert{unsafeNetworks: []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16"), netip.MustParsePrefix("fd00::/8")}}
+
+	s, err := newSnatFromConfig(l, c, crt)
+	require.NoError(t, err)
+	assert.Nil(t, s)
+
+	c.Settings["tun"] = map[interface{}]interface{}{"snat": map[interface{}]interface{}{"enabled": true}}
+	s, err = newSnatFromConfig(l, c, crt)
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16")}, s.networks)
+	assert.True(t, s.contains(netip.MustParseAddr("192.168.1.1")))
+	assert.False(t, s.contains(netip.MustParseAddr("10.0.0.1")))
+
+	_, err = newSnatFromConfig(l, c, &dummyCert{})
+	assert.EqualError(t, err, "tun.snat.enabled requires ipv4 unsafe networks in the certificate")
+
+	snatNetworks := func(networks ...interface{}) ([]netip.Prefix, error) {
+		c.Settings["tun"] = map[interface{}]interface{}{"snat": map[interface{}]interface{}{"enabled": true, "networks": networks}}
+		s, err := newSnatFromConfig(l, c, crt)
+		if err != nil {
+			return nil, err
+		}
+		return s.networks, nil
+	}
+
+	networks, err := snatNetworks("192.168.1.1/24")
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24")}, networks)
+
+	_, err = snatNetworks("nope")
+	assert.EqualError(t, err, "entry 1 in tun.snat.networks failed to parse: netip.ParsePrefix(\"nope\"): no '/'")
+
+	_, err = snatNetworks("192.168.1.0/24", "fd00::/16")
+	assert.EqualError(t, err, "entry 2 in tun.snat.networks is not an ipv4 network: fd00::/16")
+
+	_, err = snatNetworks("192.0.0.0/8")
+	assert.EqualError(t, err, "entry 1 in tun.snat.networks is not within the certificate unsafe networks: 192.0.0.0/8")
+}
+
+// newSnatPeer returns a network stack for a vpn host at addr that is wired to s. Its packets pass through newPacket and
+// are injected into s the same way decryptToTun does.
+func newSnatPeer(t *testing.T, ctx context.Context, s *snat, addr netip.Addr) (*stack.Stack, func([]byte)) {
+	peer := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, gvudp.NewProtocol},
+	})
+	ep := channel.New(snatQueueLen, 1300, "")
+	require.Nil(t, peer.CreateNIC(snatNicID, ep))
+	require.Nil(t, peer.AddProtocolAddress(snatNicID, tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddrFrom4(addr.As4()).WithPrefix(),
+	}, stack.AddressProperties{}))
+	peer.SetRouteTable([]tcpip.Route{{Destination: gvheader.IPv4EmptySubnet, NIC: snatNicID}})
+
+	go func() {
+		fp := &firewall.Packet{}
+		for {
+			pkt := ep.ReadContext(ctx)
+			if pkt == nil {
+				return
+			}
+
+			view := pkt.ToView()
+			pkt.DecRef()
+			if newPacket(view.AsSlice(), true, fp) == nil {
+				s.inject(view.AsSlice(), fp)
+			}
+			view.Release()
+		}
+	}()
+
+	return peer, func(b []byte) {
+		pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(b)})
+		ep.InjectInbound(gvheader.IPv4ProtocolNumber, pkt)
+		pkt.DecRef()
+	}
+}
+
+// lanAddr returns a non loopback ipv4 address of this host to stand in for a host behind the gateway, the stack drops
+// packets for loopback addresses
+func lanAddr(t *testing.T) netip.Addr {
+	addrs, err := net.InterfaceAddrs()
+	require.NoError(t, err)
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok {
+			addr, _ := netip.AddrFromSlice(n.IP)
+			if addr = addr.Unmap(); addr.Is4() && !addr.IsLoopback() {
+				return addr
+			}
+		}
+	}
+
+	t.Skip("no non loopback ipv4 address to test with")
+	return netip.Addr{}
+}
+
+func TestSnat(t *testing.T) {
+	lan := lanAddr(t)
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["tun"] = map[interface{}]interface{}{"snat": map[interface{}]interface{}{"enabled": true}}
+	s, err := newSnatFromConfig(l, c, &dummyCert{unsafeNetworks: []netip.Prefix{netip.PrefixFrom(lan, 32)}})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	peerAddr := netip.MustParseAddr("10.128.0.2")
+	peer, send := newSnatPeer(t, ctx, s, peerAddr)
+
+	var alive atomic.Bool
+	alive.Store(true)
+	go s.run(ctx, send, func(fp firewall.Packet) bool {
+		return alive.Load()
+	})
+
+	// A tcp echo server on the lan sees the connection come from this host
+	lis, err := net.Listen("tcp4", netip.AddrPortFrom(lan, 0).String())
+	require.NoError(t, err)
+	defer lis.Close()
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	lisAddr := netip.MustParseAddrPort(lis.Addr().String())
+	conn, err := gonet.DialTCP(peer, tcpip.FullAddress{NIC: snatNicID, Addr: tcpip.AddrFrom4(lisAddr.Addr().As4()), Port: lisAddr.Port()}, ipv4.ProtocolNumber)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	_, err = conn.Write([]byte("hi tcp"))
+	require.NoError(t, err)
+	b := make([]byte, 16)
+	n, err := io.ReadFull(conn, b[:6])
+	require.NoError(t, err)
+	assert.Equal(t, "hi tcp", string(b[:n]))
+
+	// A udp server sees the datagrams come from this host and its replies make it back
+	server, err := net.ListenUDP("udp4", net.UDPAddrFromAddrPort(netip.AddrPortFrom(lan, 0)))
+	require.NoError(t, err)
+	defer server.Close()
+
+	serverAddr := server.LocalAddr().(*net.UDPAddr).AddrPort()
+	uconn, err := gonet.DialUDP(peer, nil, &tcpip.FullAddress{NIC: snatNicID, Addr: tcpip.AddrFrom4(serverAddr.Addr().Unmap().As4()), Port: serverAddr.Port()}, ipv4.ProtocolNumber)
+	require.NoError(t, err)
+	defer uconn.Close()
+
+	_, err = uconn.Write([]byte("hi udp"))
+	require.NoError(t, err)
+	require.NoError(t, server.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, from, err := server.ReadFromUDPAddrPort(b)
+	require.NoError(t, err)
+	assert.Equal(t, "hi udp", string(b[:n]))
+	assert.NotEqual(t, peerAddr, from.Addr().Unmap())
+
+	_, err = server.WriteToUDPAddrPort([]byte("hi peer"), from)
+	require.NoError(t, err)
+	require.NoError(t, uconn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, err = uconn.Read(b)
+	require.NoError(t, err)
+	assert.Equal(t, "hi peer", string(b[:n]))
+
+	// Both flows end once the firewall forgets them
+	s.flowsLock.Lock()
+	assert.Len(t, s.flows, 2)
+	s.flowsLock.Unlock()
+
+	alive.Store(false)
+	assert.Eventually(t, func() bool {
+		s.flowsLock.Lock()
+		defer s.flowsLock.Unlock()
+		return len(s.flows) == 0
+	}, 2*snatCheckInterval, 100*time.Millisecond)
+}
@@ -868,10 +868,11 @@ func sshPrintRelays(ifce *Interface, fs interface{}, a []string, w sshd.StringWr
 	}
 
 	type CmdOutput struct {
-		Relays []*RelayOutput
+		Relays  []*RelayOutput
+		Ranking []RelayHealthStatus
 	}
 
-	co := CmdOutput{}
+	co := CmdOutput{Ranking: ifce.relayManager.health.Status()}
 
 	enc := json.NewEncoder(w.GetWriter())
 
@@ -0,0 +1,302 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/overlay"
+	"github.com/slackhq/nebula/udp"
+)
+
+// In tap mode the device hands us ethernet frames and every tunnel to a member of the configured group is a port of
+// a learning switch. Frames to a mac address we have seen behind a tunnel go to that tunnel, everything else is
+// flooded to every member with a tunnel up. Frames from tunnels are only ever written to the device, never flooded
+// again, so members must be able to reach each other directly or through relays.
+
+const (
+	defaultTapMacTimeout = 5 * time.Minute
+
+	ethernetHeaderLen = 14
+	etherTypeIPv4     = 0x0800
+	etherTypeARP      = 0x0806
+)
+
+type macAddr [6]byte
+
+// isGroup is true for broadcast and multicast addresses
+func (m macAddr) isGroup() bool {
+	return m[0]&1 == 1
+}
+
+type macEntry struct {
+	vpnIp netip.Addr
+	seen  time.Time
+}
+
+// tapSwitch is the mac address table of a tap mode device
+type tapSwitch struct {
+	// group is the certificate group of the hosts we exchange frames with
+	group string
+	// peers are the group members we start tunnels to when we flood
+	peers []netip.Addr
+	// allowNonIP lets frames that are neither ipv4 nor arp through, the firewall can not look inside them
+	allowNonIP bool
+	macTimeout time.Duration
+
+	sync.RWMutex
+	macs      map[macAddr]macEntry
+	lastPrune time.Time
+
+	metricFlooded metrics.Counter
+	metricDropped metrics.Counter
+	l             *logrus.Logger
+}
+
+// NewTapSwitchFromConfig returns nil unless the device is in tap mode
+func NewTapSwitchFromConfig(l *logrus.Logger, c *config.C) (*tapSwitch, error) {
+	tap, err := overlay.TapMode(c)
+	if err != nil || !tap {
+		return nil, err
+	}
+
+	ts := &tapSwitch{
+		group:         c.GetString("tun.tap.group", ""),
+		allowNonIP:    c.GetBool("tun.tap.allow_non_ip", false),
+		macTimeout:    c.GetDuration("tun.tap.mac_timeout", defaultTapMacTimeout),
+		macs:          map[macAddr]macEntry{},
+		metricFlooded: metrics.GetOrRegisterCounter("tap.flooded", nil),
+		metricDropped: metrics.GetOrRegisterCounter("tap.dropped", nil),
+		l:             l,
+	}
+
+	if ts.group == "" {
+		return nil, fmt.Errorf("tun.tap.group must be set when tun.mode is tap")
+	}
+
+	if ts.macTimeout <= 0 {
+		return nil, fmt.Errorf("tun.tap.mac_timeout must be greater than 0")
+	}
+
+	for _, v := range c.GetStringSlice("tun.tap.peers", []string{}) {
+		vpnIp, err := netip.ParseAddr(v)
+		if err != nil {
+			return nil, fmt.Errorf("tun.tap.peers has an invalid ip address %q: %w", v, err)
+		}
+		ts.peers = append(ts.peers, vpnIp)
+	}
+
+	return ts, nil
+}
+
+// member is true if the host behind the tunnel has a certificate in our group
+func (ts *tapSwitch) member(hostinfo *HostInfo) bool {
+	c := hostinfo.ConnectionState.peerCert
+	if c == nil {
+		return false
+	}
+	_, ok := c.InvertedGroups[ts.group]
+	return ok
+}
+
+// learn records that frames from mac arrived through the tunnel to vpnIp. The table is only written when the entry
+// moves or is halfway to expiring so the common case is a read lock.
+func (ts *tapSwitch) learn(mac macAddr, vpnIp netip.Addr, now time.Time) {
+	if mac.isGroup() {
+		return
+	}
+
+	ts.RLock()
+	e, ok := ts.macs[mac]
+	ts.RUnlock()
+	if ok && e.vpnIp == vpnIp && now.Sub(e.seen) < ts.macTimeout/2 {
+		return
+	}
+
+	ts.Lock()
+	ts.macs[mac] = macEntry{vpnIp: vpnIp, seen: now}
+	if now.Sub(ts.lastPrune) > ts.macTimeout {
+		for k, v := range ts.macs {
+			if now.Sub(v.seen) >= ts.macTimeout {
+				delete(ts.macs, k)
+			}
+		}
+		ts.lastPrune = now
+	}
+	ts.Unlock()
+}
+
+// lookup returns the vpn ip mac was last seen behind, if it has not expired
+func (ts *tapSwitch) lookup(mac macAddr, now time.Time) (netip.Addr, bool) {
+	ts.RLock()
+	e, ok := ts.macs[mac]
+	ts.RUnlock()
+	if !ok || now.Sub(e.seen) >= ts.macTimeout {
+		return netip.Addr{}, false
+	}
+	return e.vpnIp, true
+}
+
+// parseFrame checks the ethernet header of frame and fills in fp from the ip packet it carries. isIP is false for
+// frames the firewall has nothing to say about, an error means the frame must be dropped.
+func (ts *tapSwitch) parseFrame(frame []byte, incoming bool, fp *firewall.Packet) (isIP bool, err error) {
+	if len(frame) < ethernetHeaderLen {
+		return false, fmt.Errorf("frame is less than %v bytes", ethernetHeaderLen)
+	}
+
+	switch etherType := binary.BigEndian.Uint16(frame[12:14]); etherType {
+	case etherTypeIPv4:
+		return true, newPacket(frame[ethernetHeaderLen:], incoming, fp)
+	case etherTypeARP:
+		return false, nil
+	default:
+		if ts.allowNonIP {
+			return false, nil
+		}
+		return false, fmt.Errorf("frame has an unsupported ether type: %#04x", etherType)
+	}
+}
+
+// consumeInsideFrame sends a frame read from the tap device to the tunnel its destination was learned on, or floods
+// it to every member of the group
+func (f *Interface) consumeInsideFrame(frame []byte, fwPacket *firewall.Packet, nb, out []byte, q int, localCache firewall.ConntrackCache, batch *udp.Batch) {
+	ts := f.tap
+	isIP, err := ts.parseFrame(frame, false, fwPacket)
+	if err != nil {
+		ts.metricDropped.Inc(1)
+		if f.l.Level >= logrus.DebugLevel {
+			f.l.WithField("frame", frame).Debugf("Error while validating outbound frame: %s", err)
+		}
+		return
+	}
+
+	dst := macAddr(frame[0:6])
+	fanout := dst.isGroup()
+	if !fanout {
+		if vpnIp, ok := ts.lookup(dst, time.Now()); ok {
+			if hostinfo := f.hostMap.QueryVpnIp(vpnIp); hostinfo != nil {
+				f.sendFrame(hostinfo, frame, fwPacket, isIP, false, nb, out, q, localCache, batch)
+				return
+			}
+		}
+	}
+
+	// Broadcast, multicast and unknown unicast
+	ts.metricFlooded.Inc(1)
+	for _, vpnIp := range ts.peers {
+		if f.hostMap.QueryVpnIp(vpnIp) == nil {
+			f.Handshake(vpnIp)
+		}
+	}
+
+	var hostinfos []*HostInfo
+	f.hostMap.ForEachVpnIp(func(hostinfo *HostInfo) {
+		hostinfos = append(hostinfos, hostinfo)
+	})
+
+	for _, hostinfo := range hostinfos {
+		f.sendFrame(hostinfo, frame, fwPacket, isIP, fanout, nb, out, q, localCache, batch)
+	}
+}
+
+// sendFrame sends a frame to a single member of the group, the firewall sees the ip packet inside it
+func (f *Interface) sendFrame(hostinfo *HostInfo, frame []byte, fwPacket *firewall.Packet, isIP, fanout bool, nb, out []byte, q int, localCache firewall.ConntrackCache, batch *udp.Batch) {
+	if !f.tap.member(hostinfo) {
+		return
+	}
+
+	if isIP {
+		var dropReason error
+		if fanout {
+			dropReason = f.firewall.DropFanout(*fwPacket, false, hostinfo, f.pki.GetCAPool(), localCache)
+		} else {
+			dropReason = f.firewall.Drop(*fwPacket, false, hostinfo, f.pki.GetCAPool(), localCache)
+		}
+
+		if dropReason != nil {
+			if f.l.Level >= logrus.DebugLevel {
+				hostinfo.logger(f.l).
+					WithField("fwPacket", fwPacket).
+					WithField("reason", dropReason).
+					Debugln("dropping outbound frame")
+			}
+			return
+		}
+	}
+
+	f.sendNoMetricsBatch(header.Message, header.MessageEthernet, hostinfo.ConnectionState, hostinfo, netip.AddrPort{}, frame, nb, out, q, batch)
+}
+
+// decryptToTap is decryptToTun for frames, the source mac of a frame that makes it through is learned
+func (f *Interface) decryptToTap(hostinfo *HostInfo, messageCounter uint64, out []byte, packet []byte, fwPacket *firewall.Packet, nb []byte, localCache firewall.ConntrackCache, tunBatch *overlay.Coalescer) bool {
+	ts := f.tap
+	if ts == nil {
+		if f.l.Level >= logrus.DebugLevel {
+			hostinfo.logger(f.l).Debug("dropping inbound frame, the device is not in tap mode")
+		}
+		return false
+	}
+
+	if !ts.member(hostinfo) {
+		ts.metricDropped.Inc(1)
+		if f.l.Level >= logrus.DebugLevel {
+			hostinfo.logger(f.l).WithField("group", ts.group).Debug("dropping inbound frame, host is not in the tap group")
+		}
+		return false
+	}
+
+	var err error
+	out, err = hostinfo.ConnectionState.dKey.DecryptDanger(out, packet[:header.Len], packet[header.Len:], messageCounter, nb)
+	if err != nil {
+		hostinfo.logger(f.l).WithError(err).Error("Failed to decrypt frame")
+		return false
+	}
+
+	isIP, err := ts.parseFrame(out, true, fwPacket)
+	if err != nil {
+		ts.metricDropped.Inc(1)
+		hostinfo.logger(f.l).WithError(err).WithField("frame", out).
+			Warnf("Error while validating inbound frame")
+		return false
+	}
+
+	if !hostinfo.ConnectionState.window.Update(f.l, messageCounter) {
+		hostinfo.logger(f.l).WithField("fwPacket", fwPacket).
+			Debugln("dropping out of window frame")
+		return false
+	}
+
+	if isIP {
+		var dropReason error
+		if macAddr(out[0:6]).isGroup() {
+			dropReason = f.firewall.DropFanout(*fwPacket, true, hostinfo, f.pki.GetCAPool(), localCache)
+		} else {
+			dropReason = f.firewall.Drop(*fwPacket, true, hostinfo, f.pki.GetCAPool(), localCache)
+		}
+
+		if dropReason != nil {
+			if f.l.Level >= logrus.DebugLevel {
+				hostinfo.logger(f.l).WithField("fwPacket", fwPacket).
+					WithField("reason", dropReason).
+					Debugln("dropping inbound frame")
+			}
+			return false
+		}
+	}
+
+	ts.learn(macAddr(out[6:12]), hostinfo.vpnIp, time.Now())
+
+	f.connectionManager.In(hostinfo.localIndexId)
+	err = tunBatch.Write(out)
+	if err != nil {
+		f.l.WithError(err).Error("Failed to write to tap")
+	}
+	return true
+}
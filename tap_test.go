@@ -0,0 +1,139 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTapSwitchFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	ts, err := NewTapSwitchFromConfig(l, c)
+	require.NoError(t, err)
+	assert.Nil(t, ts)
+
+	c.Settings["tun"] = map[interface{}]interface{}{"mode": "tap"}
+	_, err = NewTapSwitchFromConfig(l, c)
+	assert.EqualError(t, err, "tun.tap.group must be set when tun.mode is tap")
+
+	c.Settings["tun"] = map[interface{}]interface{}{"mode": "bridge"}
+	_, err = NewTapSwitchFromConfig(l, c)
+	assert.EqualError(t, err, `unknown tun.mode "bridge", expected tun or tap`)
+
+	c.Settings["tun"] = map[interface{}]interface{}{
+		"mode": "tap",
+		"tap": map[interface{}]interface{}{
+			"group":       "l2",
+			"peers":       []interface{}{"10.1.0.2", "10.1.0.3"},
+			"mac_timeout": "1m",
+		},
+	}
+	ts, err = NewTapSwitchFromConfig(l, c)
+	require.NoError(t, err)
+	assert.Equal(t, "l2", ts.group)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("10.1.0.2"), netip.MustParseAddr("10.1.0.3")}, ts.peers)
+	assert.Equal(t, time.Minute, ts.macTimeout)
+}
+
+func TestTapSwitch_learn(t *testing.T) {
+	ts := &tapSwitch{macTimeout: time.Minute, macs: map[macAddr]macEntry{}}
+	a := macAddr{0x02, 0, 0, 0, 0, 1}
+	b := macAddr{0x02, 0, 0, 0, 0, 2}
+	hostA := netip.MustParseAddr("10.1.0.2")
+	hostB := netip.MustParseAddr("10.1.0.3")
+	now := time.Now()
+
+	_, ok := ts.lookup(a, now)
+	assert.False(t, ok)
+
+	ts.learn(a, hostA, now)
+	vpnIp, ok := ts.lookup(a, now)
+	assert.True(t, ok)
+	assert.Equal(t, hostA, vpnIp)
+
+	// Group addresses are never learned
+	ts.learn(macAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, hostA, now)
+	ts.learn(macAddr{0x01, 0x00, 0x5e, 0, 0, 1}, hostA, now)
+	assert.Len(t, ts.macs, 1)
+
+	// Seeing the address again early does not touch the table
+	ts.learn(a, hostA, now.Add(10*time.Second))
+	assert.Equal(t, now, ts.macs[a].seen)
+
+	// Halfway to expiring it is refreshed
+	ts.learn(a, hostA, now.Add(40*time.Second))
+	assert.Equal(t, now.Add(40*time.Second), ts.macs[a].seen)
+
+	// A mac that moves follows the host right away
+	ts.learn(a, hostB, now.Add(41*time.Second))
+	vpnIp, ok = ts.lookup(a, now.Add(41*time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, hostB, vpnIp)
+
+	// Entries expire and are pruned by later writes
+	_, ok = ts.lookup(a, now.Add(41*time.Second+time.Minute))
+	assert.False(t, ok)
+	ts.learn(b, hostA, now.Add(3*time.Minute))
+	assert.Len(t, ts.macs, 1)
+	assert.Contains(t, ts.macs, b)
+}
+
+func TestTapSwitch_member(t *testing.T) {
+	ts := &tapSwitch{group: "l2"}
+	hostinfo := &HostInfo{ConnectionState: &ConnectionState{}}
+	assert.False(t, ts.member(hostinfo))
+
+	hostinfo.ConnectionState.peerCert = &cert.CachedCertificate{InvertedGroups: map[string]struct{}{"other": {}}}
+	assert.False(t, ts.member(hostinfo))
+
+	hostinfo.ConnectionState.peerCert.InvertedGroups["l2"] = struct{}{}
+	assert.True(t, ts.member(hostinfo))
+}
+
+func TestTapSwitch_parseFrame(t *testing.T) {
+	ts := &tapSwitch{}
+	fp := &firewall.Packet{}
+	header := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02, 0, 0, 0, 0, 1}
+
+	_, err := ts.parseFrame(header, false, fp)
+	assert.Error(t, err)
+
+	// Arp carries no ip packet for the firewall
+	isIP, err := ts.parseFrame(append(header, 0x08, 0x06, 0, 1), false, fp)
+	assert.NoError(t, err)
+	assert.False(t, isIP)
+
+	// A udp packet from 10.1.0.1:68 to 255.255.255.255:67
+	ip := []byte{
+		0x45, 0, 0, 28, 0, 0, 0, 0, 64, firewall.ProtoUDP, 0, 0,
+		10, 1, 0, 1, 255, 255, 255, 255,
+		0, 68, 0, 67, 0, 8, 0, 0,
+	}
+	isIP, err = ts.parseFrame(append(append(header, 0x08, 0x00), ip...), false, fp)
+	assert.NoError(t, err)
+	assert.True(t, isIP)
+	assert.Equal(t, firewall.Packet{
+		LocalIP:    netip.MustParseAddr("10.1.0.1"),
+		RemoteIP:   netip.MustParseAddr("255.255.255.255"),
+		LocalPort:  68,
+		RemotePort: 67,
+		Protocol:   firewall.ProtoUDP,
+	}, *fp)
+
+	// Anything else is dropped unless it is allowed
+	_, err = ts.parseFrame(append(header, 0x86, 0xdd, 0, 1), false, fp)
+	assert.EqualError(t, err, "frame has an unsupported ether type: 0x86dd")
+	ts.allowNonIP = true
+	isIP, err = ts.parseFrame(append(header, 0x86, 0xdd, 0, 1), false, fp)
+	assert.NoError(t, err)
+	assert.False(t, isIP)
+}
@@ -0,0 +1,188 @@
+package nebula
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/udp"
+	"github.com/slackhq/nebula/util"
+)
+
+const (
+	defaultTCPDialTimeout = 5 * time.Second
+	defaultTCPMaxStreams  = 1024
+	defaultTCPIdleTimeout = 5 * time.Minute
+)
+
+// NewTCPFromConfig builds the tcp transport from listen.transports.tcp, nil is returned when it is disabled. Streams are
+// only accepted when listen.transports.tcp.port is set, otherwise we only dial out to the tcp endpoints of other hosts.
+func NewTCPFromConfig(l *logrus.Logger, c *config.C, listenHost netip.Addr) (*udp.TCPConn, error) {
+	const key = "listen.transports.tcp"
+	if !c.GetBool(key+".enabled", false) {
+		return nil, nil
+	}
+
+	listen, err := streamListenAddr(c, key, listenHost)
+	if err != nil {
+		return nil, err
+	}
+
+	tc := udp.TCPConfig{
+		Listen:      listen,
+		DialTimeout: c.GetDuration(key+".dial_timeout", defaultTCPDialTimeout),
+		MaxStreams:  c.GetInt(key+".max_streams", defaultTCPMaxStreams),
+		IdleTimeout: c.GetDuration(key+".idle_timeout", defaultTCPIdleTimeout),
+		Mark:        c.GetInt("listen.so_mark", 0),
+	}
+
+	proxy, err := socks5DialerFromConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	if proxy != nil {
+		tc.Dialer = proxy
+	}
+
+	if c.GetBool(key+".tls", false) {
+		tc.TLSServer, err = streamTLSServer(c, key)
+		if err != nil {
+			return nil, err
+		}
+		tc.TLSClient = streamTLSClient(c, key)
+	}
+
+	conn, err := udp.NewTCPConn(l, tc)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to open tcp listener", m{"addr": tc.Listen}, err)
+	}
+
+	if tc.Listen.IsValid() {
+		addr, _ := conn.LocalAddr()
+		l.WithField("tls", tc.TLSServer != nil).Infof("listening on tcp %v", addr)
+	}
+
+	return conn, nil
+}
+
+// streamListenAddr is the address a stream transport under key accepts streams on, it is invalid unless the port is set
+func streamListenAddr(c *config.C, key string, listenHost netip.Addr) (netip.AddrPort, error) {
+	if !c.IsSet(key + ".port") {
+		return netip.AddrPort{}, nil
+	}
+
+	host := listenHost
+	if rawHost := c.GetString(key+".host", ""); rawHost != "" {
+		var err error
+		host, err = netip.ParseAddr(strings.Trim(rawHost, "[]"))
+		if err != nil {
+			return netip.AddrPort{}, util.NewContextualError("Failed to parse "+key+".host", m{"host": rawHost}, err)
+		}
+	}
+
+	return netip.AddrPortFrom(host, uint16(c.GetInt(key+".port", 0))), nil
+}
+
+// streamTLSServer builds the tls config a stream transport under key accepts streams with
+func streamTLSServer(c *config.C, key string) (*tls.Config, error) {
+	crt, err := loadStreamCertificate(c, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{crt},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// streamTLSClient builds the tls config a stream transport under key dials streams with
+func streamTLSClient(c *config.C, key string) *tls.Config {
+	// The nebula handshake inside the stream authenticates both ends, tls only makes the stream look like any other
+	// https connection. There is nothing for the certificate of the remote to prove.
+	return &tls.Config{
+		ServerName:         c.GetString(key+".tls_server_name", ""),
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+	}
+}
+
+// loadStreamCertificate loads the tls_cert and tls_key of the stream transport under key, a self signed certificate is
+// generated when neither is set
+func loadStreamCertificate(c *config.C, key string) (tls.Certificate, error) {
+	certPathOrPEM := c.GetString(key+".tls_cert", "")
+	keyPathOrPEM := c.GetString(key+".tls_key", "")
+
+	if certPathOrPEM == "" && keyPathOrPEM == "" {
+		crt, err := generateTCPCertificate(c.GetString(key+".tls_server_name", "localhost"))
+		if err != nil {
+			return tls.Certificate{}, util.NewContextualError("Failed to generate a tls certificate for "+key, nil, err)
+		}
+		return crt, nil
+	}
+
+	rawCert, err := readPathOrPEM(certPathOrPEM)
+	if err != nil {
+		return tls.Certificate{}, util.NewContextualError("Failed to read "+key+".tls_cert", m{"tls_cert": certPathOrPEM}, err)
+	}
+
+	rawKey, err := readPathOrPEM(keyPathOrPEM)
+	if err != nil {
+		return tls.Certificate{}, util.NewContextualError("Failed to read "+key+".tls_key", m{"tls_key": keyPathOrPEM}, err)
+	}
+
+	crt, err := tls.X509KeyPair(rawCert, rawKey)
+	if err != nil {
+		return tls.Certificate{}, util.NewContextualError("Failed to load "+key+" tls certificate", nil, err)
+	}
+
+	return crt, nil
+}
+
+func readPathOrPEM(pathOrPEM string) ([]byte, error) {
+	if strings.Contains(pathOrPEM, "-----BEGIN") {
+		return []byte(pathOrPEM), nil
+	}
+	return os.ReadFile(pathOrPEM)
+}
+
+func generateTCPCertificate(name string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to create certificate: %w", err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
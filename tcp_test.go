@@ -0,0 +1,225 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type tcpTestPacket struct {
+	addr netip.AddrPort
+	b    []byte
+}
+
+// listenTCPTest collects everything conn receives
+func listenTCPTest(conn udp.Conn) <-chan tcpTestPacket {
+	rx := make(chan tcpTestPacket, 10)
+	go conn.ListenOut(func(addr netip.AddrPort, _ []byte, packet []byte, _ *header.H, _ *firewall.Packet, _ udp.LightHouseHandlerFunc, _ []byte, _ int, _ firewall.ConntrackCache) {
+		rx <- tcpTestPacket{addr: addr, b: append([]byte{}, packet...)}
+	}, nil, nil, 0)
+	return rx
+}
+
+// nebulaTestPacket is payload behind a nebula header, accepted streams are closed unless their first packet has one
+func nebulaTestPacket(payload string) []byte {
+	return append(header.Encode(make([]byte, header.Len), header.Version, header.Message, 0, 1, 1), payload...)
+}
+
+func readTCPTest(t *testing.T, rx <-chan tcpTestPacket) tcpTestPacket {
+	select {
+	case p := <-rx:
+		return p
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a packet over tcp")
+	}
+	return tcpTestPacket{}
+}
+
+func TestNewTCPFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	conn, err := NewTCPFromConfig(l, c, netip.MustParseAddr("127.0.0.1"))
+	assert.NoError(t, err)
+	assert.Nil(t, conn, "the tcp transport is disabled by default")
+
+	// Without a port we only dial out
+	c.Settings["listen"] = map[interface{}]interface{}{"transports": map[interface{}]interface{}{"tcp": map[interface{}]interface{}{"enabled": true}}}
+	conn, err = NewTCPFromConfig(l, c, netip.MustParseAddr("127.0.0.1"))
+	require.NoError(t, err)
+	addr, err := conn.LocalAddr()
+	assert.NoError(t, err)
+	assert.False(t, addr.IsValid())
+	conn.Close()
+
+	c.Settings["listen"] = map[interface{}]interface{}{"transports": map[interface{}]interface{}{"tcp": map[interface{}]interface{}{
+		"enabled": true, "port": 0, "host": "::1", "tls": true,
+	}}}
+	conn, err = NewTCPFromConfig(l, c, netip.MustParseAddr("127.0.0.1"))
+	require.NoError(t, err)
+	addr, err = conn.LocalAddr()
+	assert.NoError(t, err)
+	assert.Equal(t, netip.MustParseAddr("::1"), addr.Addr())
+	assert.NotZero(t, addr.Port())
+	conn.Close()
+
+	c.Settings["listen"] = map[interface{}]interface{}{"transports": map[interface{}]interface{}{"tcp": map[interface{}]interface{}{
+		"enabled": true, "tls": true, "tls_cert": "/does/not/exist", "tls_key": "/does/not/exist",
+	}}}
+	_, err = NewTCPFromConfig(l, c, netip.MustParseAddr("127.0.0.1"))
+	assert.ErrorContains(t, err, "Failed to read listen.transports.tcp.tls_cert")
+}
+
+func TestTCPConn(t *testing.T) {
+	l := test.NewLogger()
+	listenConfig := func(tls bool) *config.C {
+		c := config.NewC(l)
+		c.Settings["listen"] = map[interface{}]interface{}{"transports": map[interface{}]interface{}{"tcp": map[interface{}]interface{}{
+			"enabled": true, "port": 0, "tls": tls,
+		}}}
+		return c
+	}
+
+	server, err := NewTCPFromConfig(l, listenConfig(true), netip.MustParseAddr("127.0.0.1"))
+	require.NoError(t, err)
+	defer server.Close()
+	serverAddr, _ := server.LocalAddr()
+	serverRx := listenTCPTest(server)
+
+	// The server accepts both plain and tls wrapped streams
+	for _, tls := range []bool{false, true} {
+		c := config.NewC(l)
+		c.Settings["listen"] = map[interface{}]interface{}{"transports": map[interface{}]interface{}{"tcp": map[interface{}]interface{}{"enabled": true, "tls": tls}}}
+		client, err := NewTCPFromConfig(l, c, netip.MustParseAddr("127.0.0.1"))
+		require.NoError(t, err)
+		clientRx := listenTCPTest(client)
+
+		assert.False(t, client.Has(serverAddr))
+		assert.NoError(t, client.WriteTo(nebulaTestPacket("hello"), serverAddr))
+		assert.NoError(t, client.WriteTo(make([]byte, udp.MTU), serverAddr))
+		assert.True(t, client.Has(serverAddr))
+
+		p := readTCPTest(t, serverRx)
+		assert.Equal(t, nebulaTestPacket("hello"), p.b)
+		assert.Len(t, readTCPTest(t, serverRx).b, udp.MTU)
+
+		// Replies go back over the stream the client dialed
+		assert.True(t, server.Has(p.addr))
+		assert.NoError(t, server.WriteTo([]byte("hi"), p.addr))
+		assert.Equal(t, tcpTestPacket{addr: serverAddr, b: []byte("hi")}, readTCPTest(t, clientRx))
+
+		// Closing the client closes the stream on the server
+		client.Close()
+		assert.Eventually(t, func() bool { return !server.Has(p.addr) }, 5*time.Second, 10*time.Millisecond)
+	}
+}
+
+func TestFallbackConn(t *testing.T) {
+	l := test.NewLogger()
+	server, err := udp.NewTCPConn(l, udp.TCPConfig{Listen: netip.MustParseAddrPort("127.0.0.1:0"), DialTimeout: time.Second})
+	require.NoError(t, err)
+	defer server.Close()
+	serverAddr, _ := server.LocalAddr()
+	serverRx := listenTCPTest(server)
+
+	client, err := udp.NewTCPConn(l, udp.TCPConfig{DialTimeout: time.Second})
+	require.NoError(t, err)
+	defer client.Close()
+
+	// Nothing goes over tcp until a stream to the address exists
+	u := &tcpTestUDPConn{}
+	fc := &udp.FallbackConn{Conn: u, Streams: []*udp.TCPConn{client}}
+	assert.NoError(t, fc.WriteTo([]byte("udp"), serverAddr))
+	assert.Equal(t, 1, u.writes)
+
+	assert.NoError(t, client.WriteTo(nebulaTestPacket("tcp"), serverAddr))
+	assert.Equal(t, nebulaTestPacket("tcp"), readTCPTest(t, serverRx).b)
+	assert.NoError(t, fc.WriteTo([]byte("also tcp"), serverAddr))
+	assert.Equal(t, []byte("also tcp"), readTCPTest(t, serverRx).b)
+	assert.Equal(t, 1, u.writes)
+
+	assert.Same(t, u, udp.Unwrap(fc))
+	assert.Same(t, u, udp.Unwrap(u))
+
+	// A failed dial goes back to udp
+	server.Close()
+	dead := netip.MustParseAddrPort("127.0.0.1:1")
+	assert.NoError(t, client.WriteTo([]byte("tcp"), dead))
+	assert.Eventually(t, func() bool { return !client.Has(dead) }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestTCPConn_limits(t *testing.T) {
+	l := test.NewLogger()
+	server, err := udp.NewTCPConn(l, udp.TCPConfig{
+		Listen:      netip.MustParseAddrPort("127.0.0.1:0"),
+		DialTimeout: 200 * time.Millisecond,
+		MaxStreams:  1,
+		IdleTimeout: 500 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer server.Close()
+	serverAddr, _ := server.LocalAddr()
+	serverRx := listenTCPTest(server)
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", serverAddr.String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	send := func(conn net.Conn, p []byte) {
+		_, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(p))), p...))
+		require.NoError(t, err)
+	}
+	closed := func(conn net.Conn) bool {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := conn.Read(make([]byte, 1))
+		return errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET)
+	}
+
+	// A stream that never sends anything is closed once the first packet is overdue
+	assert.True(t, closed(dial()))
+
+	// So is one whose first packet is not a nebula packet
+	conn := dial()
+	send(conn, []byte("GET / HTTP/1.1"))
+	assert.True(t, closed(conn))
+
+	// Only one stream may be open at a time
+	conn = dial()
+	send(conn, nebulaTestPacket("hello"))
+	assert.Equal(t, nebulaTestPacket("hello"), readTCPTest(t, serverRx).b)
+	assert.True(t, closed(dial()))
+
+	// The stream is closed once it goes idle, which makes room for another
+	send(conn, []byte("not checked after the first packet"))
+	assert.Equal(t, []byte("not checked after the first packet"), readTCPTest(t, serverRx).b)
+	assert.True(t, closed(conn))
+
+	conn = dial()
+	send(conn, nebulaTestPacket("hello again"))
+	assert.Equal(t, nebulaTestPacket("hello again"), readTCPTest(t, serverRx).b)
+}
+
+type tcpTestUDPConn struct {
+	udp.NoopConn
+	writes int
+}
+
+func (u *tcpTestUDPConn) WriteTo([]byte, netip.AddrPort) error {
+	u.writes++
+	return nil
+}
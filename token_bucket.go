@@ -0,0 +1,59 @@
+package nebula
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket is a rate limiter that refills rate tokens per second, holding at most burst tokens
+type tokenBucket struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   now,
+	}
+}
+
+// allow consumes n tokens and returns true if they were available
+func (b *tokenBucket) allow(now time.Time, n float64) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+
+	if b.tokens < n {
+		return false
+	}
+
+	b.tokens -= n
+	return true
+}
+
+// refund gives back n tokens taken by allow when the action they paid for did not happen
+func (b *tokenBucket) refund(n float64) {
+	b.Lock()
+	defer b.Unlock()
+	b.tokens = min(b.tokens+n, b.burst)
+}
+
+// idleSince returns the last time the bucket was used
+func (b *tokenBucket) idleSince() time.Time {
+	b.Lock()
+	defer b.Unlock()
+	return b.last
+}
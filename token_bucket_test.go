@@ -0,0 +1,41 @@
+package nebula
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(100, 200, now)
+
+	// Starts full
+	assert.True(t, b.allow(now, 150))
+	assert.False(t, b.allow(now, 100))
+	assert.True(t, b.allow(now, 50))
+	assert.False(t, b.allow(now, 1))
+
+	// Refills at rate
+	now = now.Add(500 * time.Millisecond)
+	assert.False(t, b.allow(now, 51))
+	assert.True(t, b.allow(now, 50))
+
+	// Never holds more than burst
+	now = now.Add(time.Hour)
+	assert.False(t, b.allow(now, 201))
+	assert.True(t, b.allow(now, 200))
+	assert.Equal(t, now, b.idleSince())
+
+	// Time going backwards does not add tokens
+	assert.False(t, b.allow(now.Add(-time.Second), 1))
+
+	// Refunds are capped at burst too
+	b.refund(150)
+	assert.False(t, b.allow(now, 151))
+	assert.True(t, b.allow(now, 150))
+	b.refund(1000)
+	assert.False(t, b.allow(now, 201))
+	assert.True(t, b.allow(now, 200))
+}
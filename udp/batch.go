@@ -0,0 +1,179 @@
+package udp
+
+import (
+	"net/netip"
+	"time"
+)
+
+const (
+	// maxBatchSegments is the most packets the kernel takes in a single segmented write
+	maxBatchSegments = 64
+	// maxBatchBytes keeps a segmented write and the udp and ip headers in front of it under the 64KiB limit of a datagram
+	maxBatchBytes = 65000
+	// maxBatchPackets is the most writes handed to WriteBatch at once
+	maxBatchPackets = 64
+	// batchBufferSize is how many bytes of packets a Batch holds before it has to be written
+	batchBufferSize = 4 * maxBatchBytes
+)
+
+// BatchPacket is one write of a WriteBatch
+type BatchPacket struct {
+	Addr    netip.AddrPort
+	Payload []byte
+	// Segment is the size of the packets glued together in Payload, every packet is that long except the last one which
+	// may be shorter. It is 0 if Payload is a single packet, only conns that support segments are given anything else.
+	Segment int
+}
+
+// SegmentWriter is implemented by conns that can hand the kernel many packets for one destination in a single write
+type SegmentWriter interface {
+	// SupportsSegments reports if WriteSegments currently writes a whole batch at once, it is one write per packet
+	// otherwise and batching is not worth the copy
+	SupportsSegments() bool
+	// WriteSegments writes the packets glued together in b to addr, every packet is segment bytes long except the last
+	// one which may be shorter
+	WriteSegments(b []byte, segment int, addr netip.AddrPort) error
+}
+
+// Batch collects packets until they are written with a single WriteBatch, consecutive packets for the same destination
+// are glued into one segmented write if the conn supports it. It is not safe for concurrent use, every inside routine
+// has its own.
+type Batch struct {
+	conn    Conn
+	w       SegmentWriter
+	latency time.Duration
+
+	buf  []byte
+	pkts []BatchPacket
+	// count is how many packets are waiting, segments is how many of them are in the last write
+	count    int
+	segments int
+	// short is set once a packet smaller than the segment was added to the last write, nothing can follow it
+	short bool
+	// first is when the oldest waiting packet was added
+	first time.Time
+}
+
+// NewBatch builds a Batch for conn. Packets should not wait longer than latency for the batch to be written, see Due.
+func NewBatch(conn Conn, latency time.Duration) *Batch {
+	w, _ := conn.(SegmentWriter)
+	return &Batch{conn: conn, w: w, latency: latency}
+}
+
+// WriteTo adds the packet in b to the batch, the batch is written first if it is full. b is copied so the caller is
+// free to reuse it. The error of an earlier packet that had to be written may be returned.
+func (b *Batch) WriteTo(p []byte, addr netip.AddrPort) error {
+	if b.buf == nil {
+		b.buf = make([]byte, 0, batchBufferSize)
+		b.pkts = make([]BatchPacket, 0, maxBatchPackets)
+	}
+
+	var err error
+	if len(b.buf)+len(p) > cap(b.buf) {
+		err = b.Flush()
+	}
+
+	if n := len(b.pkts); n > 0 && b.canJoin(&b.pkts[n-1], p, addr) {
+		// The last write is at the end of buf, appending the packet grows it in place
+		last := &b.pkts[n-1]
+		if last.Segment == 0 {
+			last.Segment = len(last.Payload)
+		}
+
+		b.buf = append(b.buf, p...)
+		last.Payload = last.Payload[:len(last.Payload)+len(p)]
+		b.segments++
+		b.count++
+		b.short = len(p) < last.Segment
+		return err
+	}
+
+	if len(b.pkts) == maxBatchPackets {
+		if ferr := b.Flush(); ferr != nil {
+			err = ferr
+		}
+	}
+
+	if b.count == 0 {
+		b.first = time.Now()
+	}
+
+	start := len(b.buf)
+	b.buf = append(b.buf, p...)
+	b.pkts = append(b.pkts, BatchPacket{Addr: addr, Payload: b.buf[start:]})
+	b.segments = 1
+	b.count++
+	b.short = false
+	return err
+}
+
+// canJoin reports if p can be glued to the last write
+func (b *Batch) canJoin(last *BatchPacket, p []byte, addr netip.AddrPort) bool {
+	if b.w == nil || !b.w.SupportsSegments() || addr != last.Addr || b.short || b.segments == maxBatchSegments ||
+		len(last.Payload)+len(p) > maxBatchBytes {
+		return false
+	}
+
+	segment := last.Segment
+	if segment == 0 {
+		segment = len(last.Payload)
+	}
+	return len(p) <= segment
+}
+
+// Len is how many packets are waiting to be written
+func (b *Batch) Len() int {
+	return b.count
+}
+
+// Due reports if the oldest waiting packet has waited for the latency given to NewBatch
+func (b *Batch) Due() bool {
+	return b.count > 0 && time.Since(b.first) >= b.latency
+}
+
+// Flush writes the waiting packets
+func (b *Batch) Flush() error {
+	if b.count == 0 {
+		return nil
+	}
+
+	err := b.conn.WriteBatch(b.pkts)
+
+	b.buf = b.buf[:0]
+	b.pkts = b.pkts[:0]
+	b.count = 0
+	b.segments = 0
+	b.short = false
+	return err
+}
+
+// writeEach writes every packet of a batch on its own, for conns that have no batched write. Every packet is tried, the
+// first error is returned.
+func writeEach(c Conn, pkts []BatchPacket) error {
+	var err error
+	for _, p := range pkts {
+		var werr error
+		if p.Segment > 0 {
+			werr = writeEachSegment(c, p.Payload, p.Segment, p.Addr)
+		} else {
+			werr = c.WriteTo(p.Payload, p.Addr)
+		}
+
+		if werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+// writeEachSegment writes the packets in b one at a time, for conns that can not write segments
+func writeEachSegment(c Conn, b []byte, segment int, addr netip.AddrPort) error {
+	for len(b) > 0 {
+		n := min(segment, len(b))
+		if err := c.WriteTo(b[:n], addr); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package udp
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type segmentConn struct {
+	NoopConn
+	segments bool
+	batches  [][]BatchPacket
+	writes   [][]byte
+}
+
+func (c *segmentConn) WriteTo(b []byte, _ netip.AddrPort) error {
+	c.writes = append(c.writes, bytes.Clone(b))
+	return nil
+}
+
+func (c *segmentConn) WriteBatch(pkts []BatchPacket) error {
+	batch := make([]BatchPacket, len(pkts))
+	for i, p := range pkts {
+		batch[i] = BatchPacket{Addr: p.Addr, Payload: bytes.Clone(p.Payload), Segment: p.Segment}
+	}
+	c.batches = append(c.batches, batch)
+	return nil
+}
+
+func (c *segmentConn) SupportsSegments() bool {
+	return c.segments
+}
+
+func (c *segmentConn) WriteSegments(b []byte, segment int, addr netip.AddrPort) error {
+	return writeEachSegment(c, b, segment, addr)
+}
+
+func TestBatch_WriteTo(t *testing.T) {
+	a := netip.MustParseAddrPort("1.1.1.1:4242")
+	b := netip.MustParseAddrPort("2.2.2.2:4242")
+
+	c := &segmentConn{segments: true}
+	batch := NewBatch(c, time.Hour)
+
+	// Same size packets to the same remote join, a shorter one can close the write
+	assert.NoError(t, batch.WriteTo(bytes.Repeat([]byte{1}, 100), a))
+	assert.NoError(t, batch.WriteTo(bytes.Repeat([]byte{2}, 100), a))
+	assert.NoError(t, batch.WriteTo(bytes.Repeat([]byte{3}, 50), a))
+	// Nothing can follow the short packet
+	assert.NoError(t, batch.WriteTo(bytes.Repeat([]byte{4}, 50), a))
+	// Another remote
+	assert.NoError(t, batch.WriteTo(bytes.Repeat([]byte{5}, 100), b))
+	// A larger packet can not join
+	assert.NoError(t, batch.WriteTo(bytes.Repeat([]byte{6}, 200), b))
+	assert.Equal(t, 6, batch.Len())
+	assert.False(t, batch.Due())
+	assert.Empty(t, c.batches)
+
+	assert.NoError(t, batch.Flush())
+	require.Len(t, c.batches, 1)
+	assert.Equal(t, []BatchPacket{
+		{Addr: a, Payload: append(append(bytes.Repeat([]byte{1}, 100), bytes.Repeat([]byte{2}, 100)...), bytes.Repeat([]byte{3}, 50)...), Segment: 100},
+		{Addr: a, Payload: bytes.Repeat([]byte{4}, 50)},
+		{Addr: b, Payload: bytes.Repeat([]byte{5}, 100)},
+		{Addr: b, Payload: bytes.Repeat([]byte{6}, 200)},
+	}, c.batches[0])
+	assert.Equal(t, 0, batch.Len())
+	assert.NoError(t, batch.Flush())
+	assert.Len(t, c.batches, 1)
+
+	// A write is capped by the number of segments
+	c.batches = nil
+	for i := 0; i < maxBatchSegments+1; i++ {
+		assert.NoError(t, batch.WriteTo(make([]byte, 10), a))
+	}
+	assert.NoError(t, batch.Flush())
+	require.Len(t, c.batches, 1)
+	require.Len(t, c.batches[0], 2)
+	assert.Len(t, c.batches[0][0].Payload, maxBatchSegments*10)
+	assert.Len(t, c.batches[0][1].Payload, 10)
+
+	// And by bytes
+	c.batches = nil
+	for i := 0; i < maxBatchBytes/9000+1; i++ {
+		assert.NoError(t, batch.WriteTo(make([]byte, 9000), a))
+	}
+	assert.NoError(t, batch.Flush())
+	require.Len(t, c.batches, 1)
+	require.Len(t, c.batches[0], 2)
+	assert.Len(t, c.batches[0][0].Payload, maxBatchBytes/9000*9000)
+
+	// The batch is written once it holds the most writes WriteBatch takes
+	c.batches = nil
+	for i := 0; i < maxBatchPackets+1; i++ {
+		addr := a
+		if i%2 == 1 {
+			addr = b
+		}
+		assert.NoError(t, batch.WriteTo(make([]byte, 10), addr))
+	}
+	require.Len(t, c.batches, 1)
+	assert.Len(t, c.batches[0], maxBatchPackets)
+	assert.Equal(t, 1, batch.Len())
+	assert.NoError(t, batch.Flush())
+
+	// Or once its buffer is full
+	c.batches = nil
+	for i := 0; i < batchBufferSize/9000+1; i++ {
+		addr := a
+		if i%2 == 1 {
+			addr = b
+		}
+		assert.NoError(t, batch.WriteTo(make([]byte, 9000), addr))
+	}
+	require.Len(t, c.batches, 1)
+	assert.Len(t, c.batches[0], batchBufferSize/9000)
+	assert.NoError(t, batch.Flush())
+
+	// Conns that can not write segments get every packet in a write of its own
+	c = &segmentConn{}
+	batch = NewBatch(c, 0)
+	assert.False(t, batch.Due())
+	assert.NoError(t, batch.WriteTo(make([]byte, 100), a))
+	assert.NoError(t, batch.WriteTo(make([]byte, 100), a))
+	assert.True(t, batch.Due())
+	assert.NoError(t, batch.Flush())
+	require.Len(t, c.batches, 1)
+	assert.Equal(t, []BatchPacket{{Addr: a, Payload: make([]byte, 100)}, {Addr: a, Payload: make([]byte, 100)}}, c.batches[0])
+}
+
+func TestWriteEach(t *testing.T) {
+	a := netip.MustParseAddrPort("1.1.1.1:4242")
+	c := &segmentConn{}
+	assert.NoError(t, writeEach(c, []BatchPacket{
+		{Addr: a, Payload: make([]byte, 250), Segment: 100},
+		{Addr: a, Payload: make([]byte, 30)},
+	}))
+	assert.Equal(t, [][]byte{make([]byte, 100), make([]byte, 100), make([]byte, 50), make([]byte, 30)}, c.writes)
+}
@@ -22,11 +22,20 @@ type EncReader func(
 	localCache firewall.ConntrackCache,
 )
 
+// BatchListener is implemented by conns that read many packets with one syscall. ListenOutBatch is ListenOut that calls
+// flush once every packet of a read was handed to r, before it waits for the next one.
+type BatchListener interface {
+	ListenOutBatch(r EncReader, flush func(), lhf LightHouseHandlerFunc, cache *firewall.ConntrackCacheTicker, q int)
+}
+
 type Conn interface {
 	Rebind() error
 	LocalAddr() (netip.AddrPort, error)
 	ListenOut(r EncReader, lhf LightHouseHandlerFunc, cache *firewall.ConntrackCacheTicker, q int)
 	WriteTo(b []byte, addr netip.AddrPort) error
+	// WriteBatch writes every packet in pkts, with as few syscalls as the platform allows. Every packet is tried even if
+	// an earlier one failed, the first error is returned.
+	WriteBatch(pkts []BatchPacket) error
 	ReloadConfig(c *config.C)
 	Close() error
 }
@@ -45,6 +54,9 @@ func (NoopConn) ListenOut(_ EncReader, _ LightHouseHandlerFunc, _ *firewall.Conn
 func (NoopConn) WriteTo(_ []byte, _ netip.AddrPort) error {
 	return nil
 }
+func (NoopConn) WriteBatch(_ []BatchPacket) error {
+	return nil
+}
 func (NoopConn) ReloadConfig(_ *config.C) {
 	return
 }
@@ -0,0 +1,29 @@
+//go:build linux
+// +build linux
+
+package udp
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// markControl sets SO_MARK on a socket before it connects or binds so policy routing can tell nebula's own stream and
+// proxy traffic apart, like listen.so_mark does for the udp listeners. Nil is returned for mark 0.
+func markControl(mark int) func(network, address string, c syscall.RawConn) error {
+	if mark == 0 {
+		return nil
+	}
+
+	return func(_, _ string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, mark)
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+}
@@ -0,0 +1,53 @@
+//go:build linux
+// +build linux
+
+package udp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestMarkControl(t *testing.T) {
+	assert.Nil(t, markControl(0))
+
+	lc := net.ListenConfig{Control: markControl(7)}
+	ln, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if errors.Is(err, unix.EPERM) {
+		t.Skip("setting SO_MARK requires CAP_NET_ADMIN")
+	}
+	require.NoError(t, err)
+	defer ln.Close()
+	assert.Equal(t, 7, socketMark(t, ln.(syscall.Conn)))
+
+	conn, err := dialStream(context.Background(), nil, ln.Addr().String(), 7)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, 7, socketMark(t, conn.(syscall.Conn)))
+
+	// A dialer marks its own connections
+	unmarked, err := dialStream(context.Background(), &net.Dialer{}, ln.Addr().String(), 7)
+	require.NoError(t, err)
+	defer unmarked.Close()
+	assert.Equal(t, 0, socketMark(t, unmarked.(syscall.Conn)))
+}
+
+func socketMark(t *testing.T, c syscall.Conn) int {
+	rc, err := c.SyscallConn()
+	require.NoError(t, err)
+
+	var mark int
+	var serr error
+	require.NoError(t, rc.Control(func(fd uintptr) {
+		mark, serr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK)
+	}))
+	require.NoError(t, serr)
+	return mark
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package udp
+
+import "syscall"
+
+// markControl does nothing, SO_MARK only exists on linux
+func markControl(int) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
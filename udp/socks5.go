@@ -0,0 +1,444 @@
+package udp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+)
+
+const (
+	socks5Version = 5
+
+	socks5AuthNone     = 0
+	socks5AuthPassword = 2
+	socks5AuthNoMatch  = 0xff
+
+	socks5CmdConnect      = 1
+	socks5CmdUDPAssociate = 3
+
+	socks5AtypIPv4   = 1
+	socks5AtypDomain = 3
+	socks5AtypIPv6   = 4
+
+	// socks5UDPHeaderLen is the longest header in front of a datagram to or from the relay, an ipv6 destination
+	socks5UDPHeaderLen = 4 + 16 + 2
+)
+
+// ErrSocks5CommandNotSupported is returned when the proxy refuses a command, usually UDP ASSOCIATE
+var ErrSocks5CommandNotSupported = errors.New("socks5 proxy does not support the command")
+
+var socks5Replies = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "ttl expired",
+	8: "address type not supported",
+}
+
+// Socks5Dialer talks to a socks5 proxy, it connects tcp streams with CONNECT and sets up udp relays with UDP ASSOCIATE
+type Socks5Dialer struct {
+	// Server is the host:port of the proxy
+	Server string
+	// Username and Password are sent if the proxy asks for them
+	Username string
+	Password string
+	// Mark is set as SO_MARK on the connections to the proxy and the local udp socket, 0 leaves them unmarked
+	Mark int
+}
+
+// DialContext connects to address through the proxy, network must be tcp
+func (d *Socks5Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("socks5 can not dial network %s", network)
+	}
+
+	host, sPort, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(sPort, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, _, err := d.request(ctx, socks5CmdConnect, host, uint16(port))
+	return conn, err
+}
+
+// associate asks the proxy for a udp relay, the relay lives as long as the returned control connection
+func (d *Socks5Dialer) associate(ctx context.Context, local netip.AddrPort) (net.Conn, netip.AddrPort, error) {
+	// We do not know the address the proxy will see our datagrams from, only the port
+	conn, relay, err := d.request(ctx, socks5CmdUDPAssociate, "0.0.0.0", local.Port())
+	if err != nil {
+		return nil, netip.AddrPort{}, err
+	}
+
+	if relay.Addr().IsUnspecified() {
+		// The relay is on the address we reached the proxy at
+		server := conn.RemoteAddr().(*net.TCPAddr).AddrPort()
+		relay = netip.AddrPortFrom(server.Addr(), relay.Port())
+	}
+
+	return conn, netip.AddrPortFrom(relay.Addr().Unmap(), relay.Port()), nil
+}
+
+// request runs a socks5 command and returns the connection along with the address the proxy bound for it
+func (d *Socks5Dialer) request(ctx context.Context, cmd byte, host string, port uint16) (net.Conn, netip.AddrPort, error) {
+	nd := net.Dialer{Control: markControl(d.Mark)}
+	conn, err := nd.DialContext(ctx, "tcp", d.Server)
+	if err != nil {
+		return nil, netip.AddrPort{}, fmt.Errorf("failed to dial socks5 proxy %s: %w", d.Server, err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	bound, err := d.handshake(conn, cmd, host, port)
+	if err != nil {
+		conn.Close()
+		return nil, netip.AddrPort{}, err
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+	return conn, bound, nil
+}
+
+func (d *Socks5Dialer) handshake(conn net.Conn, cmd byte, host string, port uint16) (netip.AddrPort, error) {
+	methods := []byte{socks5Version, 1, socks5AuthNone}
+	if d.Username != "" {
+		methods = []byte{socks5Version, 2, socks5AuthNone, socks5AuthPassword}
+	}
+	if _, err := conn.Write(methods); err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if b[0] != socks5Version {
+		return netip.AddrPort{}, fmt.Errorf("unexpected socks version %d", b[0])
+	}
+
+	switch b[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if d.Username == "" {
+			return netip.AddrPort{}, errors.New("socks5 proxy requires a username and password")
+		}
+		if len(d.Username) > 255 || len(d.Password) > 255 {
+			return netip.AddrPort{}, errors.New("socks5 username and password must be at most 255 bytes")
+		}
+
+		auth := []byte{1, byte(len(d.Username))}
+		auth = append(auth, d.Username...)
+		auth = append(auth, byte(len(d.Password)))
+		auth = append(auth, d.Password...)
+		if _, err := conn.Write(auth); err != nil {
+			return netip.AddrPort{}, err
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return netip.AddrPort{}, err
+		}
+		if b[1] != 0 {
+			return netip.AddrPort{}, errors.New("socks5 proxy rejected the username and password")
+		}
+	case socks5AuthNoMatch:
+		return netip.AddrPort{}, errors.New("socks5 proxy did not accept any of our authentication methods")
+	default:
+		return netip.AddrPort{}, fmt.Errorf("socks5 proxy chose unknown authentication method %d", b[1])
+	}
+
+	req := []byte{socks5Version, cmd, 0}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		req = appendSocks5Addr(req, netip.AddrPortFrom(ip.Unmap(), port))
+	} else {
+		if len(host) > 255 {
+			return netip.AddrPort{}, fmt.Errorf("hostname %s is too long for socks5", host)
+		}
+		req = append(req, socks5AtypDomain, byte(len(host)))
+		req = append(req, host...)
+		req = binary.BigEndian.AppendUint16(req, port)
+	}
+	if _, err := conn.Write(req); err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	// Version, reply, reserved and the address type
+	rep := make([]byte, 4)
+	if _, err := io.ReadFull(conn, rep); err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	switch rep[1] {
+	case 0:
+	case 7:
+		return netip.AddrPort{}, ErrSocks5CommandNotSupported
+	default:
+		reason, ok := socks5Replies[rep[1]]
+		if !ok {
+			reason = fmt.Sprintf("reply %d", rep[1])
+		}
+		return netip.AddrPort{}, fmt.Errorf("socks5 proxy refused the request: %s", reason)
+	}
+
+	var addr netip.Addr
+	switch rep[3] {
+	case socks5AtypIPv4:
+		var ip [4]byte
+		if _, err := io.ReadFull(conn, ip[:]); err != nil {
+			return netip.AddrPort{}, err
+		}
+		addr = netip.AddrFrom4(ip)
+	case socks5AtypIPv6:
+		var ip [16]byte
+		if _, err := io.ReadFull(conn, ip[:]); err != nil {
+			return netip.AddrPort{}, err
+		}
+		addr = netip.AddrFrom16(ip)
+	case socks5AtypDomain:
+		// There is nothing we can do with a name, only a relay address matters and that is always an ip
+		if _, err := io.ReadFull(conn, b[:1]); err != nil {
+			return netip.AddrPort{}, err
+		}
+		if _, err := io.ReadFull(conn, make([]byte, b[0])); err != nil {
+			return netip.AddrPort{}, err
+		}
+	default:
+		return netip.AddrPort{}, fmt.Errorf("socks5 proxy replied with unknown address type %d", rep[3])
+	}
+
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	return netip.AddrPortFrom(addr, binary.BigEndian.Uint16(b)), nil
+}
+
+func appendSocks5Addr(b []byte, addr netip.AddrPort) []byte {
+	if addr.Addr().Is4() {
+		b = append(b, socks5AtypIPv4)
+	} else {
+		b = append(b, socks5AtypIPv6)
+	}
+	b = append(b, addr.Addr().AsSlice()...)
+	return binary.BigEndian.AppendUint16(b, addr.Port())
+}
+
+// Socks5Conn sends and receives udp packets through the relay of a socks5 proxy. Every datagram to or from the relay
+// carries the address of the remote in a small header. The relay is kept for as long as the control connection to the
+// proxy stays up, a new one is requested if it goes away.
+type Socks5Conn struct {
+	l           *logrus.Logger
+	dialer      *Socks5Dialer
+	dialTimeout time.Duration
+	pc          *net.UDPConn
+
+	ctrlLock sync.Mutex
+	ctrl     net.Conn
+	relay    atomic.Pointer[netip.AddrPort]
+
+	bufs   sync.Pool
+	closed atomic.Bool
+}
+
+// NewSocks5Conn binds a local udp socket on listen and asks the proxy for a relay. ErrSocks5CommandNotSupported is
+// returned if the proxy does not relay udp.
+func NewSocks5Conn(l *logrus.Logger, dialer *Socks5Dialer, listen netip.AddrPort, dialTimeout time.Duration) (*Socks5Conn, error) {
+	lc := net.ListenConfig{Control: markControl(dialer.Mark)}
+	lpc, err := lc.ListenPacket(context.Background(), "udp", listen.String())
+	if err != nil {
+		return nil, err
+	}
+	pc := lpc.(*net.UDPConn)
+
+	u := &Socks5Conn{
+		l:           l,
+		dialer:      dialer,
+		dialTimeout: dialTimeout,
+		pc:          pc,
+		bufs: sync.Pool{New: func() any {
+			b := make([]byte, socks5UDPHeaderLen+MTU)
+			return &b
+		}},
+	}
+
+	if err := u.associate(); err != nil {
+		pc.Close()
+		return nil, err
+	}
+
+	return u, nil
+}
+
+func (u *Socks5Conn) associate() error {
+	ctx, cancel := context.WithTimeout(context.Background(), u.dialTimeout)
+	defer cancel()
+
+	local, _ := u.LocalAddr()
+	ctrl, relay, err := u.dialer.associate(ctx, local)
+	if err != nil {
+		return err
+	}
+
+	u.ctrlLock.Lock()
+	if u.closed.Load() {
+		u.ctrlLock.Unlock()
+		ctrl.Close()
+		return net.ErrClosed
+	}
+	u.ctrl = ctrl
+	u.relay.Store(&relay)
+	u.ctrlLock.Unlock()
+
+	u.l.WithField("proxy", u.dialer.Server).WithField("relay", relay).Info("Sending udp through the socks5 proxy")
+	go u.watch(ctrl)
+	return nil
+}
+
+// watch asks for a new relay when the control connection closes
+func (u *Socks5Conn) watch(ctrl net.Conn) {
+	// Nothing is ever sent on the control connection after the request, it only tells us when the relay goes away
+	_, err := io.Copy(io.Discard, ctrl)
+	if u.closed.Load() {
+		return
+	}
+	u.l.WithField("proxy", u.dialer.Server).WithError(err).Warn("Lost the socks5 udp relay, asking for a new one")
+
+	for backoff := time.Second; !u.closed.Load(); backoff = min(backoff*2, time.Minute) {
+		err := u.associate()
+		if err == nil || errors.Is(err, net.ErrClosed) {
+			return
+		}
+
+		u.l.WithField("proxy", u.dialer.Server).WithError(err).Error("Failed to get a socks5 udp relay")
+		time.Sleep(backoff)
+	}
+}
+
+// RelayAddr is the address of the relay, other hosts see our packets coming from it
+func (u *Socks5Conn) RelayAddr() netip.AddrPort {
+	return *u.relay.Load()
+}
+
+func (u *Socks5Conn) WriteTo(b []byte, addr netip.AddrPort) error {
+	bp := u.bufs.Get().(*[]byte)
+	defer u.bufs.Put(bp)
+
+	// Reserved and fragment number, fragmented datagrams are not supported
+	p := append((*bp)[:0], 0, 0, 0)
+	p = appendSocks5Addr(p, netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port()))
+	p = append(p, b...)
+
+	_, err := u.pc.WriteToUDPAddrPort(p, *u.relay.Load())
+	return err
+}
+
+func (u *Socks5Conn) WriteBatch(pkts []BatchPacket) error {
+	return writeEach(u, pkts)
+}
+
+// parseSocks5UDP returns the remote address and packet of a datagram from the relay
+func parseSocks5UDP(b []byte) (netip.AddrPort, []byte, bool) {
+	if len(b) < 4 || b[2] != 0 {
+		// Too short or a fragment
+		return netip.AddrPort{}, nil, false
+	}
+
+	var addr netip.Addr
+	switch b[3] {
+	case socks5AtypIPv4:
+		if len(b) < 4+4+2 {
+			return netip.AddrPort{}, nil, false
+		}
+		addr = netip.AddrFrom4([4]byte(b[4:8]))
+		b = b[8:]
+	case socks5AtypIPv6:
+		if len(b) < 4+16+2 {
+			return netip.AddrPort{}, nil, false
+		}
+		addr = netip.AddrFrom16([16]byte(b[4:20])).Unmap()
+		b = b[20:]
+	default:
+		return netip.AddrPort{}, nil, false
+	}
+
+	return netip.AddrPortFrom(addr, binary.BigEndian.Uint16(b)), b[2:], true
+}
+
+func (u *Socks5Conn) ListenOut(r EncReader, lhf LightHouseHandlerFunc, cache *firewall.ConntrackCacheTicker, q int) {
+	plaintext := make([]byte, MTU)
+	buffer := make([]byte, socks5UDPHeaderLen+MTU)
+	h := &header.H{}
+	fwPacket := &firewall.Packet{}
+	nb := make([]byte, 12, 12)
+
+	for {
+		n, from, err := u.pc.ReadFromUDPAddrPort(buffer)
+		if err != nil {
+			u.l.WithError(err).Debug("udp socket is closed, exiting read loop")
+			return
+		}
+
+		// Only the relay may hand us packets, anything else is trying to get around the proxy
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+		if from != *u.relay.Load() {
+			continue
+		}
+
+		addr, packet, ok := parseSocks5UDP(buffer[:n])
+		if !ok {
+			continue
+		}
+
+		r(addr, plaintext[:0], packet, h, fwPacket, lhf, nb, q, cache.Get(u.l))
+	}
+}
+
+// LocalAddr is the local socket we talk to the relay from
+func (u *Socks5Conn) LocalAddr() (netip.AddrPort, error) {
+	ap := u.pc.LocalAddr().(*net.UDPAddr).AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), nil
+}
+
+// Rebind drops the control connection so a new relay is requested from wherever the network now takes us
+func (u *Socks5Conn) Rebind() error {
+	u.ctrlLock.Lock()
+	defer u.ctrlLock.Unlock()
+	if u.ctrl != nil {
+		return u.ctrl.Close()
+	}
+	return nil
+}
+
+func (u *Socks5Conn) ReloadConfig(*config.C) {}
+
+func (u *Socks5Conn) Close() error {
+	if !u.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	u.ctrlLock.Lock()
+	if u.ctrl != nil {
+		u.ctrl.Close()
+	}
+	u.ctrlLock.Unlock()
+
+	return u.pc.Close()
+}
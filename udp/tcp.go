@@ -0,0 +1,601 @@
+package udp
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+)
+
+const (
+	// tcpFrameHeaderLen is the length prefix in front of every packet on a stream
+	tcpFrameHeaderLen = 2
+	// tcpStreamQueue is how many packets may wait for a stream before we start dropping them
+	tcpStreamQueue = 256
+	tcpBufferSize  = 64 * 1024
+)
+
+// TCPConfig describes how a TCPConn accepts and dials streams
+type TCPConfig struct {
+	// Listen is the address to accept streams on, an invalid address only dials out
+	Listen netip.AddrPort
+	// TLSServer allows accepted streams to be wrapped in tls, plain streams are always accepted as well
+	TLSServer *tls.Config
+	// TLSClient wraps dialed streams in tls, nil dials plain streams
+	TLSClient *tls.Config
+	// DialTimeout bounds connecting a stream, including the tls handshake. An accepted stream must send its first nebula
+	// packet within DialTimeout as well.
+	DialTimeout time.Duration
+	// Dialer connects streams, nil dials directly
+	Dialer Dialer
+	// MaxStreams caps how many accepted streams may be open at once, connections beyond it are closed right away. 0 is
+	// unlimited.
+	MaxStreams int
+	// IdleTimeout closes a stream nothing has been read from for this long, 0 keeps idle streams open
+	IdleTimeout time.Duration
+	// Mark is set as SO_MARK on the streams we dial directly and on the listener, 0 leaves them unmarked. A Dialer marks
+	// its own connections.
+	Mark int
+}
+
+// Dialer connects a stream to address, net.Dialer and Socks5Dialer are both one
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// TCPConn carries packets over tcp streams for networks that do not let udp through. Every packet is prefixed with its
+// length as a big endian uint16. A stream is dialed the first time a packet is written to an address without one and
+// lives until either end closes it. Has reports the addresses that currently have a stream.
+type TCPConn struct {
+	l        *logrus.Logger
+	config   TCPConfig
+	listener net.Listener
+
+	// kind names the transport in logs, dialer connects a new stream to an address
+	kind   string
+	dialer func(ctx context.Context, addr netip.AddrPort) (net.Conn, error)
+
+	streamsLock sync.RWMutex
+	streams     map[netip.AddrPort]*tcpStream
+	// open is len(streams), it lets Has skip the lock while no streams are open which is the common case
+	open atomic.Int64
+	// accepted counts the accepted streams that are open or still being set up
+	accepted atomic.Int64
+
+	rx     chan tcpFrame
+	done   chan struct{}
+	closed atomic.Bool
+}
+
+type tcpStream struct {
+	addr netip.AddrPort
+	tx   chan []byte
+	done chan struct{}
+	once sync.Once
+}
+
+type tcpFrame struct {
+	addr netip.AddrPort
+	b    []byte
+}
+
+// NewTCPConn starts accepting streams if config.Listen is valid
+func NewTCPConn(l *logrus.Logger, config TCPConfig) (*TCPConn, error) {
+	u := newTCPConn(l, "tcp")
+	u.config = config
+	u.dialer = u.dialTCP
+
+	if config.Listen.IsValid() {
+		var err error
+		lc := net.ListenConfig{Control: markControl(config.Mark)}
+		u.listener, err = lc.Listen(context.Background(), "tcp", config.Listen.String())
+		if err != nil {
+			return nil, err
+		}
+		go u.accept()
+	}
+
+	return u, nil
+}
+
+func newTCPConn(l *logrus.Logger, kind string) *TCPConn {
+	return &TCPConn{
+		l:       l,
+		kind:    kind,
+		streams: map[netip.AddrPort]*tcpStream{},
+		rx:      make(chan tcpFrame, tcpStreamQueue),
+		done:    make(chan struct{}),
+	}
+}
+
+// Kind names the transport, tcp or websocket
+func (u *TCPConn) Kind() string {
+	return u.kind
+}
+
+// Has reports if packets to addr are carried by a tcp stream
+func (u *TCPConn) Has(addr netip.AddrPort) bool {
+	if u == nil {
+		return false
+	}
+
+	if u.open.Load() == 0 {
+		return false
+	}
+
+	u.streamsLock.RLock()
+	_, ok := u.streams[addr]
+	u.streamsLock.RUnlock()
+	return ok
+}
+
+// WriteTo queues b on the stream to addr, dialing one if needed. Like a full udp socket buffer, packets are dropped
+// while the stream is backed up.
+func (u *TCPConn) WriteTo(b []byte, addr netip.AddrPort) error {
+	if u.closed.Load() {
+		return io.ErrClosedPipe
+	}
+
+	if len(b) > math.MaxUint16 {
+		return fmt.Errorf("packet of %v bytes is too large for a tcp stream", len(b))
+	}
+
+	p := make([]byte, len(b))
+	copy(p, b)
+
+	s := u.stream(addr)
+	select {
+	case s.tx <- p:
+	case <-s.done:
+		return io.ErrClosedPipe
+	default:
+		if u.l.Level >= logrus.DebugLevel {
+			u.l.WithField("tcpAddr", addr).Debug("Dropping packet, the tcp stream is backed up")
+		}
+	}
+
+	return nil
+}
+
+func (u *TCPConn) WriteBatch(pkts []BatchPacket) error {
+	return writeEach(u, pkts)
+}
+
+// stream returns the stream to addr, dialing a new one if there is none
+func (u *TCPConn) stream(addr netip.AddrPort) *tcpStream {
+	u.streamsLock.RLock()
+	s := u.streams[addr]
+	u.streamsLock.RUnlock()
+	if s != nil {
+		return s
+	}
+
+	u.streamsLock.Lock()
+	defer u.streamsLock.Unlock()
+	if s = u.streams[addr]; s != nil {
+		return s
+	}
+
+	s = newTCPStream(addr)
+	u.streams[addr] = s
+	u.open.Store(int64(len(u.streams)))
+	go u.dial(s)
+	return s
+}
+
+func newTCPStream(addr netip.AddrPort) *tcpStream {
+	return &tcpStream{
+		addr: addr,
+		tx:   make(chan []byte, tcpStreamQueue),
+		done: make(chan struct{}),
+	}
+}
+
+func (u *TCPConn) dial(s *tcpStream) {
+	ctx, cancel := context.WithTimeout(context.Background(), u.config.DialTimeout)
+	defer cancel()
+
+	conn, err := u.dialer(ctx, s.addr)
+	if err != nil {
+		u.l.WithField("tcpAddr", s.addr).WithField("transport", u.kind).WithError(err).Info("Failed to dial tcp stream")
+		u.closeStream(s)
+		return
+	}
+
+	u.l.WithField("tcpAddr", s.addr).WithField("transport", u.kind).Info("Dialed tcp stream")
+	u.serve(s, conn, false)
+}
+
+func (u *TCPConn) dialTCP(ctx context.Context, addr netip.AddrPort) (net.Conn, error) {
+	conn, err := dialStream(ctx, u.config.Dialer, addr.String(), u.config.Mark)
+	if err != nil || u.config.TLSClient == nil {
+		return conn, err
+	}
+
+	tc := tls.Client(conn, u.config.TLSClient)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// dialStream connects a tcp stream to address with d, or directly with mark as SO_MARK if d is nil
+func dialStream(ctx context.Context, d Dialer, address string, mark int) (net.Conn, error) {
+	if d == nil {
+		d = &net.Dialer{Control: markControl(mark)}
+	}
+	return d.DialContext(ctx, "tcp", address)
+}
+
+func (u *TCPConn) accept() {
+	for {
+		conn, err := u.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			u.l.WithError(err).Error("Failed to accept tcp stream")
+			time.Sleep(time.Second)
+			continue
+		}
+
+		if !u.acquireAccepted() {
+			if u.l.Level >= logrus.DebugLevel {
+				u.l.WithField("tcpAddr", conn.RemoteAddr()).Debug("Closing accepted tcp stream, too many streams are open")
+			}
+			conn.Close()
+			continue
+		}
+
+		go func() {
+			defer u.releaseAccepted()
+			u.acceptStream(conn)
+		}()
+	}
+}
+
+// acquireAccepted counts a newly accepted stream, false is returned if MaxStreams are already open
+func (u *TCPConn) acquireAccepted() bool {
+	if n := u.accepted.Add(1); u.config.MaxStreams > 0 && n > int64(u.config.MaxStreams) {
+		u.accepted.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (u *TCPConn) releaseAccepted() {
+	u.accepted.Add(-1)
+}
+
+func (u *TCPConn) acceptStream(conn net.Conn) {
+	ap := conn.RemoteAddr().(*net.TCPAddr).AddrPort()
+	addr := netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+
+	// Anyone can connect, the deadline stays until the stream has sent us a nebula packet
+	u.setFirstPacketDeadline(conn)
+
+	useTLS := false
+	if u.config.TLSServer != nil {
+		// Peek at the first bytes to tell a tls record from a length prefixed nebula packet. A tls handshake record starts
+		// 0x16 0x03 while the third byte of a nebula frame is the header version, which never looks like a tls version.
+		pc := &peekedConn{Conn: conn, r: bufio.NewReader(conn)}
+		b, err := pc.r.Peek(3)
+		if err != nil {
+			u.l.WithField("tcpAddr", addr).WithError(err).Debug("Failed to read from accepted tcp stream")
+			conn.Close()
+			return
+		}
+
+		conn = pc
+		if b[0] == 0x16 && b[1] == 0x03 && b[2] <= 0x04 {
+			useTLS = true
+			tc := tls.Server(pc, u.config.TLSServer)
+			if err := tc.Handshake(); err != nil {
+				u.l.WithField("tcpAddr", addr).WithError(err).Info("Failed tls handshake on accepted tcp stream")
+				conn.Close()
+				return
+			}
+			conn = tc
+		}
+	}
+
+	u.serveAccepted(addr, conn, useTLS)
+}
+
+// setFirstPacketDeadline bounds how long an accepted stream has to send its first nebula packet
+func (u *TCPConn) setFirstPacketDeadline(conn net.Conn) {
+	if u.config.DialTimeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(u.config.DialTimeout))
+	}
+}
+
+// serveAccepted runs a stream the remote dialed until either end closes it
+func (u *TCPConn) serveAccepted(addr netip.AddrPort, conn net.Conn, useTLS bool) {
+	s := newTCPStream(addr)
+	u.streamsLock.Lock()
+	old := u.streams[addr]
+	u.streams[addr] = s
+	u.open.Store(int64(len(u.streams)))
+	u.streamsLock.Unlock()
+
+	if old != nil {
+		// The remote reconnected from the same address, the old stream is dead to it
+		u.closeStream(old)
+	}
+
+	u.l.WithField("tcpAddr", addr).WithField("transport", u.kind).WithField("tls", useTLS).Info("Accepted tcp stream")
+	u.serve(s, conn, true)
+}
+
+// serve runs the stream until either end closes it, the first packet read from an accepted stream must be a nebula
+// packet
+func (u *TCPConn) serve(s *tcpStream, conn net.Conn, accepted bool) {
+	defer conn.Close()
+	go u.readStream(s, conn, accepted)
+
+	w := bufio.NewWriterSize(conn, tcpBufferSize)
+	for {
+		select {
+		case <-s.done:
+			return
+		case p := <-s.tx:
+			err := writeTCPFrame(w, p)
+			// Pick up everything else that is queued before paying for a write to the socket
+			for n := len(s.tx); err == nil && n > 0; n-- {
+				err = writeTCPFrame(w, <-s.tx)
+			}
+			if err == nil {
+				err = w.Flush()
+			}
+
+			if err != nil {
+				u.l.WithField("tcpAddr", s.addr).WithError(err).Info("Failed to write to tcp stream")
+				u.closeStream(s)
+				return
+			}
+		}
+	}
+}
+
+func writeTCPFrame(w *bufio.Writer, p []byte) error {
+	var l [tcpFrameHeaderLen]byte
+	binary.BigEndian.PutUint16(l[:], uint16(len(p)))
+	if _, err := w.Write(l[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(p)
+	return err
+}
+
+func (u *TCPConn) readStream(s *tcpStream, conn net.Conn, accepted bool) {
+	defer u.closeStream(s)
+
+	idle := u.config.IdleTimeout
+	var idleSince time.Time
+	if !accepted && idle > 0 {
+		idleSince = time.Now()
+		_ = conn.SetReadDeadline(idleSince.Add(idle))
+	}
+
+	verified := !accepted
+	h := &header.H{}
+	r := bufio.NewReaderSize(conn, tcpBufferSize)
+	var l [tcpFrameHeaderLen]byte
+	for {
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				u.l.WithField("tcpAddr", s.addr).WithField("verified", verified).Info("Closing idle tcp stream")
+			} else if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				u.l.WithField("tcpAddr", s.addr).WithError(err).Info("Failed to read from tcp stream")
+			}
+			return
+		}
+
+		p := make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, err := io.ReadFull(r, p); err != nil {
+			u.l.WithField("tcpAddr", s.addr).WithError(err).Info("Failed to read from tcp stream")
+			return
+		}
+
+		if !verified {
+			if h.Parse(p) != nil || h.Version != header.Version {
+				u.l.WithField("tcpAddr", s.addr).Info("Closing accepted tcp stream, the first packet is not a nebula packet")
+				return
+			}
+
+			verified = true
+			if idle == 0 {
+				_ = conn.SetReadDeadline(time.Time{})
+			}
+		}
+
+		// Pushing the deadline out on every packet costs more than it is worth, the stream may sit idle a little longer
+		if idle > 0 {
+			if now := time.Now(); now.Sub(idleSince) > idle/4 {
+				idleSince = now
+				_ = conn.SetReadDeadline(now.Add(idle))
+			}
+		}
+
+		select {
+		case u.rx <- tcpFrame{addr: s.addr, b: p}:
+		case <-s.done:
+			return
+		case <-u.done:
+			return
+		}
+	}
+}
+
+// closeStream stops the stream and forgets it, packets to its address go back to udp
+func (u *TCPConn) closeStream(s *tcpStream) {
+	s.once.Do(func() {
+		close(s.done)
+
+		u.streamsLock.Lock()
+		if u.streams[s.addr] == s {
+			delete(u.streams, s.addr)
+			u.open.Store(int64(len(u.streams)))
+		}
+		u.streamsLock.Unlock()
+
+		if u.l.Level >= logrus.DebugLevel {
+			u.l.WithField("tcpAddr", s.addr).Debug("Closed tcp stream")
+		}
+	})
+}
+
+func (u *TCPConn) ListenOut(r EncReader, lhf LightHouseHandlerFunc, cache *firewall.ConntrackCacheTicker, q int) {
+	plaintext := make([]byte, MTU)
+	h := &header.H{}
+	fwPacket := &firewall.Packet{}
+	nb := make([]byte, 12, 12)
+
+	for {
+		select {
+		case <-u.done:
+			return
+		case f := <-u.rx:
+			r(f.addr, plaintext[:0], f.b, h, fwPacket, lhf, nb, q, cache.Get(u.l))
+		}
+	}
+}
+
+// LocalAddr is the address streams are accepted on, it is invalid if we only dial out
+func (u *TCPConn) LocalAddr() (netip.AddrPort, error) {
+	if u.listener == nil {
+		return netip.AddrPort{}, nil
+	}
+	ap := u.listener.Addr().(*net.TCPAddr).AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), nil
+}
+
+func (u *TCPConn) Rebind() error {
+	return nil
+}
+
+func (u *TCPConn) ReloadConfig(*config.C) {}
+
+func (u *TCPConn) Close() error {
+	if !u.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	close(u.done)
+
+	var err error
+	if u.listener != nil {
+		err = u.listener.Close()
+	}
+
+	u.streamsLock.RLock()
+	streams := make([]*tcpStream, 0, len(u.streams))
+	for _, s := range u.streams {
+		streams = append(streams, s)
+	}
+	u.streamsLock.RUnlock()
+
+	for _, s := range streams {
+		u.closeStream(s)
+	}
+
+	return err
+}
+
+// peekedConn reads through a bufio.Reader that has already peeked at the start of the stream
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// FallbackConn writes to addresses that have a stream in one of Streams over the stream and everything else over Conn
+type FallbackConn struct {
+	Conn
+	Streams []*TCPConn
+}
+
+func (c *FallbackConn) WriteTo(b []byte, addr netip.AddrPort) error {
+	for _, s := range c.Streams {
+		if s.Has(addr) {
+			return s.WriteTo(b, addr)
+		}
+	}
+	return c.Conn.WriteTo(b, addr)
+}
+
+func (c *FallbackConn) SupportsSegments() bool {
+	w, ok := c.Conn.(SegmentWriter)
+	return ok && w.SupportsSegments()
+}
+
+// WriteSegments sends the packets over the stream one by one if addr has one, streams have no use for segments
+func (c *FallbackConn) WriteSegments(b []byte, segment int, addr netip.AddrPort) error {
+	for _, s := range c.Streams {
+		if s.Has(addr) {
+			return writeEachSegment(s, b, segment, addr)
+		}
+	}
+
+	if w, ok := c.Conn.(SegmentWriter); ok {
+		return w.WriteSegments(b, segment, addr)
+	}
+	return writeEachSegment(c.Conn, b, segment, addr)
+}
+
+// WriteBatch writes the packets for addresses with a stream over the stream, the runs of packets in between go to Conn
+// in one batch each
+func (c *FallbackConn) WriteBatch(pkts []BatchPacket) error {
+	var err error
+	keep := func(werr error) {
+		if werr != nil && err == nil {
+			err = werr
+		}
+	}
+
+	start := 0
+	for i, p := range pkts {
+		for _, s := range c.Streams {
+			if s.Has(p.Addr) {
+				if i > start {
+					keep(c.Conn.WriteBatch(pkts[start:i]))
+				}
+				keep(writeEach(s, pkts[i:i+1]))
+				start = i + 1
+				break
+			}
+		}
+	}
+
+	if start < len(pkts) {
+		keep(c.Conn.WriteBatch(pkts[start:]))
+	}
+	return err
+}
+
+// Unwrap returns the udp Conn underneath a FallbackConn
+func Unwrap(c Conn) Conn {
+	if fc, ok := c.(*FallbackConn); ok {
+		return fc.Conn
+	}
+	return c
+}
@@ -0,0 +1,48 @@
+package udp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFallbackConn_WriteTo(t *testing.T) {
+	l := test.NewLogger()
+	u := newTCPConn(l, "tcp")
+	u.config.DialTimeout = time.Second
+	release := make(chan struct{})
+	u.dialer = func(context.Context, netip.AddrPort) (net.Conn, error) {
+		<-release
+		return nil, errors.New("refused")
+	}
+
+	conn := &segmentConn{}
+	fc := &FallbackConn{Conn: conn, Streams: []*TCPConn{u}}
+	addr := netip.MustParseAddrPort("1.1.1.1:4242")
+
+	// Without any streams everything goes over udp
+	assert.NoError(t, fc.WriteTo([]byte("udp"), addr))
+	assert.Len(t, conn.writes, 1)
+	assert.Equal(t, int64(0), u.open.Load())
+
+	// Packets follow a stream while it is open
+	u.stream(addr)
+	assert.Equal(t, int64(1), u.open.Load())
+	assert.NoError(t, fc.WriteTo([]byte("tcp"), addr))
+	assert.Len(t, conn.writes, 1)
+	assert.NoError(t, fc.WriteTo([]byte("udp"), netip.MustParseAddrPort("2.2.2.2:4242")))
+	assert.Len(t, conn.writes, 2)
+
+	// And go back to udp once it is gone
+	close(release)
+	assert.Eventually(t, func() bool { return !u.Has(addr) }, time.Second, time.Millisecond)
+	assert.Equal(t, int64(0), u.open.Load())
+	assert.NoError(t, fc.WriteTo([]byte("udp"), addr))
+	assert.Len(t, conn.writes, 3)
+}
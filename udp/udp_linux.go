@@ -5,9 +5,12 @@ package udp
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 	"net/netip"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"unsafe"
 
@@ -26,6 +29,40 @@ type StdConn struct {
 	isV4  bool
 	l     *logrus.Logger
 	batch int
+
+	// gso is set while listen.gso is on and the kernel takes UDP_SEGMENT writes, gro the same for listen.gro and UDP_GRO
+	// reads. reading is set once ListenOut sized its buffers, gro can not change after that.
+	gso     atomic.Bool
+	gro     atomic.Bool
+	reading atomic.Bool
+}
+
+// groBufferSize holds the largest datagram the kernel coalesces received packets into
+const groBufferSize = 65535
+
+// sendBatch holds what sendmmsg needs for maxBatchPackets writes, they are pooled since every inside routine writes
+// batches many times a second
+type sendBatch struct {
+	msgs     [maxBatchPackets]rawMessage
+	iovs     [maxBatchPackets]iovec
+	names    [maxBatchPackets]unix.RawSockaddrInet6
+	controls [maxBatchPackets]segmentControl
+}
+
+var sendBatchPool = sync.Pool{New: func() any { return new(sendBatch) }}
+
+// segmentControl is a buffer for a UDP_SEGMENT control message, the uint64s keep the cmsghdr in it aligned
+type segmentControl [4]uint64
+
+// set writes the control message for segment and returns it
+func (c *segmentControl) set(segment int) []byte {
+	b := unsafe.Slice((*byte)(unsafe.Pointer(c)), unix.CmsgSpace(2))
+	cmsg := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+	cmsg.Level = unix.SOL_UDP
+	cmsg.Type = unix.UDP_SEGMENT
+	cmsg.SetLen(unix.CmsgLen(2))
+	binary.NativeEndian.PutUint16(b[unix.CmsgLen(0):], uint16(segment))
+	return b
 }
 
 func maybeIPV4(ip net.IP) (net.IP, bool) {
@@ -102,6 +139,14 @@ func (u *StdConn) GetSendBuffer() (int, error) {
 	return unix.GetsockoptInt(int(u.sysFd), unix.SOL_SOCKET, unix.SO_SNDBUF)
 }
 
+func (u *StdConn) SetSoMark(mark int) error {
+	return unix.SetsockoptInt(u.sysFd, unix.SOL_SOCKET, unix.SO_MARK, mark)
+}
+
+func (u *StdConn) GetSoMark() (int, error) {
+	return unix.GetsockoptInt(u.sysFd, unix.SOL_SOCKET, unix.SO_MARK)
+}
+
 func (u *StdConn) LocalAddr() (netip.AddrPort, error) {
 	sa, err := unix.Getsockname(u.sysFd)
 	if err != nil {
@@ -121,6 +166,10 @@ func (u *StdConn) LocalAddr() (netip.AddrPort, error) {
 }
 
 func (u *StdConn) ListenOut(r EncReader, lhf LightHouseHandlerFunc, cache *firewall.ConntrackCacheTicker, q int) {
+	u.ListenOutBatch(r, nil, lhf, cache, q)
+}
+
+func (u *StdConn) ListenOutBatch(r EncReader, flush func(), lhf LightHouseHandlerFunc, cache *firewall.ConntrackCacheTicker, q int) {
 	plaintext := make([]byte, MTU)
 	h := &header.H{}
 	fwPacket := &firewall.Packet{}
@@ -129,7 +178,14 @@ func (u *StdConn) ListenOut(r EncReader, lhf LightHouseHandlerFunc, cache *firew
 
 	//TODO: should we track this?
 	//metric := metrics.GetOrRegisterHistogram("test.batch_read", nil, metrics.NewExpDecaySample(1028, 0.015))
-	msgs, buffers, names := u.PrepareRawMessages(u.batch)
+	u.reading.Store(true)
+	size, controlSize := MTU, 0
+	if u.gro.Load() {
+		// Packets from the same sender arrive glued together, the segment size is in a control message
+		size, controlSize = groBufferSize, unix.CmsgSpace(4)
+	}
+
+	msgs, buffers, names, controls := u.PrepareRawMessages(u.batch, size, controlSize)
 	read := u.ReadMulti
 	if u.batch == 1 {
 		read = u.ReadSingle
@@ -151,19 +207,49 @@ func (u *StdConn) ListenOut(r EncReader, lhf LightHouseHandlerFunc, cache *firew
 				ip, _ = netip.AddrFromSlice(names[i][8:24])
 				//TODO: IPV6-WORK what is not ok?
 			}
-			r(
-				netip.AddrPortFrom(ip.Unmap(), binary.BigEndian.Uint16(names[i][2:4])),
-				plaintext[:0],
-				buffers[i][:msgs[i].Len],
-				h,
-				fwPacket,
-				lhf,
-				nb,
-				q,
-				cache.Get(u.l),
-			)
+			addr := netip.AddrPortFrom(ip.Unmap(), binary.BigEndian.Uint16(names[i][2:4]))
+
+			packet := buffers[i][:msgs[i].Len]
+			segment := len(packet)
+			if controlSize > 0 {
+				if s := groSegmentSize(controls[i], msgs[i].Hdr.Controllen); s > 0 {
+					segment = s
+				}
+				msgs[i].Hdr.setControl(controls[i])
+			}
+
+			for len(packet) > 0 {
+				n := min(segment, len(packet))
+				r(addr, plaintext[:0], packet[:n], h, fwPacket, lhf, nb, q, cache.Get(u.l))
+				packet = packet[n:]
+			}
+		}
+
+		if flush != nil {
+			flush()
+		}
+	}
+}
+
+// groSegmentSize finds the size of the packets the kernel glued together in the UDP_GRO control message, 0 if the
+// datagram is a single packet
+func groSegmentSize[T uint32 | uint64](control []byte, controlLen T) int {
+	control = control[:min(int(controlLen), len(control))]
+	for len(control) >= unix.SizeofCmsghdr {
+		h := (*unix.Cmsghdr)(unsafe.Pointer(&control[0]))
+		l := int(h.Len)
+		if l < unix.SizeofCmsghdr || l > len(control) {
+			return 0
+		}
+
+		if h.Level == unix.SOL_UDP && h.Type == unix.UDP_GRO && l >= unix.CmsgLen(4) {
+			return int(binary.NativeEndian.Uint32(control[unix.CmsgLen(0):]))
 		}
+
+		control = control[min(unix.CmsgSpace(l-unix.CmsgLen(0)), len(control)):]
 	}
+
+	return 0
 }
 
 func (u *StdConn) ReadSingle(msgs []rawMessage) (int, error) {
@@ -272,7 +358,194 @@ func (u *StdConn) writeTo4(b []byte, ip netip.AddrPort) error {
 	}
 }
 
+// WriteBatch hands the kernel up to maxBatchPackets writes with each sendmmsg. A write the kernel refuses is retried on
+// its own with WriteTo or WriteSegments, they know how to fall back or report the error.
+func (u *StdConn) WriteBatch(pkts []BatchPacket) error {
+	s := sendBatchPool.Get().(*sendBatch)
+	defer sendBatchPool.Put(s)
+
+	var err error
+	for len(pkts) > 0 {
+		if n := u.prepareBatch(s, pkts); n > 0 {
+			sent, serr := u.sendmmsg(s.msgs[:n])
+			if serr == nil && sent > 0 {
+				pkts = pkts[sent:]
+				continue
+			}
+		}
+
+		var werr error
+		if pkts[0].Segment > 0 {
+			werr = u.WriteSegments(pkts[0].Payload, pkts[0].Segment, pkts[0].Addr)
+		} else {
+			werr = u.WriteTo(pkts[0].Payload, pkts[0].Addr)
+		}
+		if werr != nil && err == nil {
+			err = werr
+		}
+		pkts = pkts[1:]
+	}
+	return err
+}
+
+// prepareBatch fills s with the writes at the front of pkts and returns how many it took. It stops at a write that
+// can not go out with sendmmsg, a segmented one while gso is off or one the socket can not address.
+func (u *StdConn) prepareBatch(s *sendBatch, pkts []BatchPacket) int {
+	n := min(len(pkts), maxBatchPackets)
+	for i := 0; i < n; i++ {
+		p := pkts[i]
+		segmented := p.Segment > 0 && len(p.Payload) > p.Segment
+		if segmented && !u.gso.Load() {
+			return i
+		}
+
+		namelen, err := u.putSockaddr(&s.names[i], p.Addr)
+		if err != nil {
+			return i
+		}
+
+		h := &s.msgs[i].Hdr
+		h.Name = (*byte)(unsafe.Pointer(&s.names[i]))
+		h.Namelen = namelen
+		s.iovs[i].set(p.Payload)
+		h.setIov(&s.iovs[i])
+		if segmented {
+			h.setControl(s.controls[i].set(p.Segment))
+		} else {
+			h.Control = nil
+			h.Controllen = 0
+		}
+	}
+	return n
+}
+
+func (u *StdConn) sendmmsg(msgs []rawMessage) (int, error) {
+	n, _, err := unix.Syscall6(
+		unix.SYS_SENDMMSG,
+		uintptr(u.sysFd),
+		uintptr(unsafe.Pointer(&msgs[0])),
+		uintptr(len(msgs)),
+		0,
+		0,
+		0,
+	)
+
+	if err != 0 {
+		return 0, &net.OpError{Op: "sendmmsg", Err: err}
+	}
+
+	return int(n), nil
+}
+
+// putSockaddr writes ip into rsa in the address family of the socket and returns its length
+func (u *StdConn) putSockaddr(rsa *unix.RawSockaddrInet6, ip netip.AddrPort) (uint32, error) {
+	if u.isV4 {
+		if !ip.Addr().Is4() {
+			return 0, fmt.Errorf("Listener is IPv4, but writing to IPv6 remote")
+		}
+		rsa4 := (*unix.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		*rsa4 = unix.RawSockaddrInet4{Family: unix.AF_INET, Addr: ip.Addr().As4()}
+		binary.BigEndian.PutUint16((*[2]byte)(unsafe.Pointer(&rsa4.Port))[:], ip.Port())
+		return unix.SizeofSockaddrInet4, nil
+	}
+
+	*rsa = unix.RawSockaddrInet6{Family: unix.AF_INET6, Addr: ip.Addr().As16()}
+	binary.BigEndian.PutUint16((*[2]byte)(unsafe.Pointer(&rsa.Port))[:], ip.Port())
+	return unix.SizeofSockaddrInet6, nil
+}
+
+func (u *StdConn) SupportsSegments() bool {
+	return u.gso.Load()
+}
+
+// WriteSegments hands the kernel every packet in b with a single sendmsg, it splits them up again by segment. The
+// packets are written one by one when gso is off. A device that can not checksum udp on its own fails the write, gso
+// is turned off for good then.
+func (u *StdConn) WriteSegments(b []byte, segment int, ip netip.AddrPort) error {
+	if !u.gso.Load() || len(b) <= segment {
+		return writeEachSegment(u, b, segment, ip)
+	}
+
+	err := u.writeSegments(b, segment, ip)
+	switch {
+	case errors.Is(err, unix.EIO):
+		u.gso.Store(false)
+		u.l.WithError(err).Warn("The kernel can not segment udp packets for this device, disabling listen.gso")
+		return writeEachSegment(u, b, segment, ip)
+	case errors.Is(err, unix.EINVAL):
+		// The segments are larger than the path mtu allows, those have to be fragmented
+		return writeEachSegment(u, b, segment, ip)
+	}
+	return err
+}
+
+func (u *StdConn) writeSegments(b []byte, segment int, ip netip.AddrPort) error {
+	var rsa unix.RawSockaddrInet6
+	namelen, err := u.putSockaddr(&rsa, ip)
+	if err != nil {
+		return err
+	}
+
+	var hdr msghdr
+	hdr.Name = (*byte)(unsafe.Pointer(&rsa))
+	hdr.Namelen = namelen
+
+	var control segmentControl
+	hdr.setControl(control.set(segment))
+
+	var iov iovec
+	iov.set(b)
+	hdr.setIov(&iov)
+
+	_, _, errno := unix.Syscall(unix.SYS_SENDMSG, uintptr(u.sysFd), uintptr(unsafe.Pointer(&hdr)), 0)
+	if errno != 0 {
+		return &net.OpError{Op: "sendmsg", Err: errno}
+	}
+
+	//TODO: handle incomplete writes
+
+	return nil
+}
+
+// setGSO turns segmented writes on if the kernel supports them
+func (u *StdConn) setGSO(enabled bool) {
+	if enabled {
+		if _, err := unix.GetsockoptInt(u.sysFd, unix.SOL_UDP, unix.UDP_SEGMENT); err != nil {
+			u.l.WithError(err).Info("The kernel does not support udp segmentation offload, listen.gso is disabled")
+			enabled = false
+		}
+	}
+	u.gso.Store(enabled)
+}
+
+// setGRO asks the kernel to glue received packets together if it supports that, the read buffers are sized for it
+// when ListenOut starts so turning it on later is refused
+func (u *StdConn) setGRO(enabled bool) {
+	if u.reading.Load() {
+		if enabled != u.gro.Load() {
+			u.l.Warn("Changing listen.gro with reload is not supported, ignoring.")
+		}
+		return
+	}
+
+	v := 0
+	if enabled {
+		v = 1
+	}
+
+	if err := unix.SetsockoptInt(u.sysFd, unix.SOL_UDP, unix.UDP_GRO, v); err != nil {
+		if enabled {
+			u.l.WithError(err).Info("The kernel does not support udp receive offload, listen.gro is disabled")
+		}
+		enabled = false
+	}
+	u.gro.Store(enabled)
+}
+
 func (u *StdConn) ReloadConfig(c *config.C) {
+	u.setGSO(c.GetBool("listen.gso", false))
+	u.setGRO(c.GetBool("listen.gro", false))
+
 	b := c.GetInt("listen.read_buffer", 0)
 	if b > 0 {
 		err := u.SetRecvBuffer(b)
@@ -302,6 +575,43 @@ func (u *StdConn) ReloadConfig(c *config.C) {
 			u.l.WithError(err).Error("Failed to set listen.write_buffer")
 		}
 	}
+
+	mark := c.GetInt("listen.so_mark", 0)
+	if mark > 0 {
+		err := u.SetSoMark(mark)
+		if err == nil {
+			s, err := u.GetSoMark()
+			if err == nil {
+				u.l.WithField("mark", s).Info("listen.so_mark was set")
+			} else {
+				u.l.WithError(err).Warn("Failed to get listen.so_mark")
+			}
+		} else {
+			u.l.WithError(err).Error("Failed to set listen.so_mark")
+		}
+	}
+
+	err := u.SetPathMTUProbe(c.GetBool("pmtu.enabled", false))
+	if err != nil {
+		u.l.WithError(err).Error("Failed to configure the socket for pmtu.enabled")
+	}
+}
+
+// SetPathMTUProbe sets the don't fragment flag on every packet and stops the kernel from fragmenting them when
+// enabled, so path mtu probes that are too large get dropped along the way. Otherwise the kernel default is restored.
+func (u *StdConn) SetPathMTUProbe(enabled bool) error {
+	v4, v6 := unix.IP_PMTUDISC_WANT, unix.IPV6_PMTUDISC_WANT
+	if enabled {
+		v4, v6 = unix.IP_PMTUDISC_PROBE, unix.IPV6_PMTUDISC_PROBE
+	}
+
+	if u.isV4 {
+		return unix.SetsockoptInt(u.sysFd, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, v4)
+	}
+
+	// Dual stack sockets carry ipv4 as well
+	_ = unix.SetsockoptInt(u.sysFd, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, v4)
+	return unix.SetsockoptInt(u.sysFd, unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, v6)
 }
 
 func (u *StdConn) getMemInfo(meminfo *[unix.SK_MEMINFO_VARS]uint32) error {
@@ -322,7 +632,8 @@ func NewUDPStatsEmitter(udpConns []Conn) func() {
 	// Check if our kernel supports SO_MEMINFO before registering the gauges
 	var udpGauges [][unix.SK_MEMINFO_VARS]metrics.Gauge
 	var meminfo [unix.SK_MEMINFO_VARS]uint32
-	if err := udpConns[0].(*StdConn).getMemInfo(&meminfo); err == nil {
+	// Sockets that talk to a proxy are not worth watching
+	if sc, ok := Unwrap(udpConns[0]).(*StdConn); ok && sc.getMemInfo(&meminfo) == nil {
 		udpGauges = make([][unix.SK_MEMINFO_VARS]metrics.Gauge, len(udpConns))
 		for i := range udpConns {
 			udpGauges[i] = [unix.SK_MEMINFO_VARS]metrics.Gauge{
@@ -341,7 +652,7 @@ func NewUDPStatsEmitter(udpConns []Conn) func() {
 
 	return func() {
 		for i, gauges := range udpGauges {
-			if err := udpConns[i].(*StdConn).getMemInfo(&meminfo); err == nil {
+			if sc, ok := Unwrap(udpConns[i]).(*StdConn); ok && sc.getMemInfo(&meminfo) == nil {
 				for j := 0; j < unix.SK_MEMINFO_VARS; j++ {
 					gauges[j].Update(int64(meminfo[j]))
 				}
@@ -30,13 +30,16 @@ type rawMessage struct {
 	Len uint32
 }
 
-func (u *StdConn) PrepareRawMessages(n int) ([]rawMessage, [][]byte, [][]byte) {
+// PrepareRawMessages allocates n messages for recvmmsg with a buffer of size bytes each. Every message also gets a
+// control buffer of controlSize bytes when it is not 0, setControl has to restore its length before every read.
+func (u *StdConn) PrepareRawMessages(n, size, controlSize int) ([]rawMessage, [][]byte, [][]byte, [][]byte) {
 	msgs := make([]rawMessage, n)
 	buffers := make([][]byte, n)
 	names := make([][]byte, n)
+	controls := make([][]byte, n)
 
 	for i := range msgs {
-		buffers[i] = make([]byte, MTU)
+		buffers[i] = make([]byte, size)
 		names[i] = make([]byte, unix.SizeofSockaddrInet6)
 
 		//TODO: this is still silly, no need for an array
@@ -49,7 +52,27 @@ func (u *StdConn) PrepareRawMessages(n int) ([]rawMessage, [][]byte, [][]byte) {
 
 		msgs[i].Hdr.Name = &names[i][0]
 		msgs[i].Hdr.Namelen = uint32(len(names[i]))
+
+		if controlSize > 0 {
+			controls[i] = make([]byte, controlSize)
+			msgs[i].Hdr.setControl(controls[i])
+		}
 	}
 
-	return msgs, buffers, names
+	return msgs, buffers, names, controls
+}
+
+func (h *msghdr) setIov(v *iovec) {
+	h.Iov = v
+	h.Iovlen = 1
+}
+
+func (h *msghdr) setControl(b []byte) {
+	h.Control = &b[0]
+	h.Controllen = uint32(len(b))
+}
+
+func (v *iovec) set(b []byte) {
+	v.Base = &b[0]
+	v.Len = uint32(len(b))
 }
@@ -0,0 +1,172 @@
+//go:build !android && !e2e_testing
+// +build !android,!e2e_testing
+
+package udp
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestStdConn(t testing.TB, l *logrus.Logger, gso, gro bool) (*StdConn, netip.AddrPort) {
+	c, err := NewListener(l, netip.MustParseAddr("127.0.0.1"), 0, false, 64)
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+
+	cfg := config.NewC(l)
+	require.NoError(t, cfg.LoadString(fmt.Sprintf("listen: {gso: %v, gro: %v}", gso, gro)))
+	c.ReloadConfig(cfg)
+
+	addr, err := c.LocalAddr()
+	require.NoError(t, err)
+	return c.(*StdConn), addr
+}
+
+func TestStdConn_WriteSegments(t *testing.T) {
+	l := test.NewLogger()
+	for _, gro := range []bool{true, false} {
+		sender, _ := newTestStdConn(t, l, true, false)
+		receiver, addr := newTestStdConn(t, l, false, gro)
+		if !sender.SupportsSegments() {
+			t.Skip("the kernel does not support udp segmentation offload")
+		}
+
+		var lock sync.Mutex
+		var sizes []int
+		go receiver.ListenOut(func(_ netip.AddrPort, _, packet []byte, _ *header.H, _ *firewall.Packet, _ LightHouseHandlerFunc, _ []byte, _ int, _ firewall.ConntrackCache) {
+			lock.Lock()
+			sizes = append(sizes, len(packet))
+			lock.Unlock()
+		}, nil, nil, 0)
+
+		// Ten full packets and a short one in a single write, the receiver must see them as they were
+		b := make([]byte, 10*1000+500)
+		require.NoError(t, sender.WriteSegments(b, 1000, addr))
+
+		expected := []int{1000, 1000, 1000, 1000, 1000, 1000, 1000, 1000, 1000, 1000, 500}
+		assert.Eventually(t, func() bool {
+			lock.Lock()
+			defer lock.Unlock()
+			return len(sizes) == len(expected)
+		}, time.Second, 10*time.Millisecond)
+
+		lock.Lock()
+		assert.Equal(t, expected, sizes, "gro: %v", gro)
+		lock.Unlock()
+	}
+}
+
+func TestStdConn_WriteBatch(t *testing.T) {
+	l := test.NewLogger()
+	for _, gso := range []bool{true, false} {
+		sender, _ := newTestStdConn(t, l, gso, false)
+
+		var lock sync.Mutex
+		sizes := map[netip.AddrPort][]int{}
+		listen := func() netip.AddrPort {
+			receiver, addr := newTestStdConn(t, l, false, false)
+			go receiver.ListenOut(func(_ netip.AddrPort, _, packet []byte, _ *header.H, _ *firewall.Packet, _ LightHouseHandlerFunc, _ []byte, _ int, _ firewall.ConntrackCache) {
+				lock.Lock()
+				sizes[addr] = append(sizes[addr], len(packet))
+				lock.Unlock()
+			}, nil, nil, 0)
+			return addr
+		}
+		a, b := listen(), listen()
+
+		// The ipv6 remote can not be written to by an ipv4 socket, everything else still has to arrive
+		err := sender.WriteBatch([]BatchPacket{
+			{Addr: a, Payload: make([]byte, 2500), Segment: 1000},
+			{Addr: b, Payload: make([]byte, 700)},
+			{Addr: netip.MustParseAddrPort("[::1]:4242"), Payload: make([]byte, 600)},
+			{Addr: a, Payload: make([]byte, 300)},
+		})
+		assert.Error(t, err)
+
+		expected := map[netip.AddrPort][]int{a: {1000, 1000, 500, 300}, b: {700}}
+		assert.Eventually(t, func() bool {
+			lock.Lock()
+			defer lock.Unlock()
+			return len(sizes[a]) == 4 && len(sizes[b]) == 1
+		}, time.Second, 10*time.Millisecond)
+
+		lock.Lock()
+		assert.Equal(t, expected, sizes, "gso: %v", gso)
+		lock.Unlock()
+	}
+}
+
+func benchmarkStdConnWrite(b *testing.B, gso bool, remotes int) {
+	l := test.NewLogger()
+	sender, _ := newTestStdConn(b, l, gso, false)
+	if gso && !sender.SupportsSegments() {
+		b.Skip("the kernel does not support udp segmentation offload")
+	}
+
+	// The receivers are never read, the kernel drops what does not fit which keeps this about the cost of writing
+	addrs := make([]netip.AddrPort, remotes)
+	for i := range addrs {
+		_, addrs[i] = newTestStdConn(b, l, false, false)
+	}
+
+	batch := NewBatch(sender, time.Hour)
+	p := make([]byte, 1300)
+	b.SetBytes(int64(len(p)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := batch.WriteTo(p, addrs[i%remotes]); err != nil {
+			b.Fatal(err)
+		}
+
+		// Like the inside routine running out of packets to read
+		if batch.Len() == maxBatchSegments/2 {
+			if err := batch.Flush(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	if err := batch.Flush(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// BenchmarkStdConn_WriteTo is the path without batching, one sendto per packet
+func BenchmarkStdConn_WriteTo(b *testing.B) {
+	l := test.NewLogger()
+	sender, _ := newTestStdConn(b, l, false, false)
+	_, addr := newTestStdConn(b, l, false, false)
+
+	p := make([]byte, 1300)
+	b.SetBytes(int64(len(p)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := sender.WriteTo(p, addr); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkStdConn_WriteBatch interleaves remotes so every packet is a write of its own in a sendmmsg
+func BenchmarkStdConn_WriteBatch(b *testing.B) {
+	benchmarkStdConnWrite(b, false, 4)
+}
+
+func BenchmarkStdConn_WriteSegments(b *testing.B) {
+	benchmarkStdConnWrite(b, true, 1)
+}
@@ -0,0 +1,332 @@
+package udp
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/websocket"
+)
+
+// DefaultWebSocketPath is the http path websocket streams are accepted on
+const DefaultWebSocketPath = "/nebula"
+
+// WebSocketConfig describes how a WebSocketConn accepts and dials streams
+type WebSocketConfig struct {
+	// Listen is the address to accept http requests on, an invalid address only dials out
+	Listen netip.AddrPort
+	// Path is the http path streams are upgraded on and the default path we dial
+	Path string
+	// TLSServer serves https instead of http. Leave it nil when a reverse proxy in front of us terminates tls.
+	TLSServer *tls.Config
+	// TLSClient is used when dialing an endpoint with tls
+	TLSClient *tls.Config
+	// TLS dials addresses without a StreamEndpoint with tls
+	TLS bool
+	// Proxy returns the http proxy to CONNECT through for a request, nil connects with Dialer
+	Proxy func(*http.Request) (*url.URL, error)
+	// Dialer connects streams that do not go through an http proxy, nil dials directly
+	Dialer Dialer
+	// DialTimeout bounds connecting a stream, including the proxy, tls and websocket handshakes. An accepted stream must
+	// send its first nebula packet within DialTimeout as well.
+	DialTimeout time.Duration
+	// MaxStreams, IdleTimeout and Mark work like they do in TCPConfig, Mark also applies to http proxy connections
+	MaxStreams  int
+	IdleTimeout time.Duration
+	Mark        int
+}
+
+// StreamEndpoint is what we know about dialing an address beyond the address itself, usually from a static host map
+// entry. Addresses without one use the defaults of the transport.
+type StreamEndpoint struct {
+	// Host is sent as the tls server name and the http Host header
+	Host string
+	// Path is the http path to request
+	Path string
+	// TLS wraps the stream in tls
+	TLS bool
+}
+
+// WebSocketConn carries packets over websocket streams for networks that only let http out, possibly through a proxy.
+// The stream inside the websocket is framed exactly like a TCPConn stream, so a single websocket message may hold many
+// packets. Accepting plain http allows the listener to sit behind any reverse proxy that forwards websockets.
+type WebSocketConn struct {
+	*TCPConn
+	wsConfig WebSocketConfig
+	server   *http.Server
+
+	// endpoints finds the StreamEndpoint of an address
+	endpoints atomic.Pointer[func(netip.AddrPort) (StreamEndpoint, bool)]
+}
+
+// NewWebSocketConn starts accepting streams if config.Listen is valid
+func NewWebSocketConn(l *logrus.Logger, config WebSocketConfig) (*WebSocketConn, error) {
+	if config.Path == "" {
+		config.Path = DefaultWebSocketPath
+	}
+
+	if config.TLSClient == nil {
+		// The nebula handshake inside the stream authenticates both ends, like TCPConn there is nothing to verify
+		config.TLSClient = &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS12}
+	}
+
+	u := &WebSocketConn{
+		TCPConn:  newTCPConn(l, "websocket"),
+		wsConfig: config,
+	}
+	u.config = TCPConfig{
+		Listen:      config.Listen,
+		DialTimeout: config.DialTimeout,
+		Dialer:      config.Dialer,
+		MaxStreams:  config.MaxStreams,
+		IdleTimeout: config.IdleTimeout,
+		Mark:        config.Mark,
+	}
+	u.dialer = u.dialWebSocket
+
+	if config.Listen.IsValid() {
+		lc := net.ListenConfig{Control: markControl(config.Mark)}
+		ln, err := lc.Listen(context.Background(), "tcp", config.Listen.String())
+		if err != nil {
+			return nil, err
+		}
+
+		u.listener = ln
+		if config.TLSServer != nil {
+			u.listener = tls.NewListener(ln, config.TLSServer)
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle(config.Path, websocket.Server{
+			// We are not serving browsers, there is no origin worth checking
+			Handshake: func(*websocket.Config, *http.Request) error { return nil },
+			Handler:   u.accept,
+		})
+
+		u.server = &http.Server{
+			Handler:           mux,
+			ReadHeaderTimeout: config.DialTimeout,
+		}
+		go func() {
+			err := u.server.Serve(u.listener)
+			if err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, http.ErrServerClosed) {
+				l.WithError(err).Error("Failed to serve websocket streams")
+			}
+		}()
+	}
+
+	return u, nil
+}
+
+// SetEndpoints sets where to look up how to dial an address, addresses it does not know use the defaults
+func (u *WebSocketConn) SetEndpoints(f func(netip.AddrPort) (StreamEndpoint, bool)) {
+	u.endpoints.Store(&f)
+}
+
+func (u *WebSocketConn) endpoint(addr netip.AddrPort) StreamEndpoint {
+	var ep StreamEndpoint
+	ok := false
+	if f := u.endpoints.Load(); f != nil {
+		ep, ok = (*f)(addr)
+	}
+	if !ok {
+		ep = StreamEndpoint{TLS: u.wsConfig.TLS}
+	}
+
+	if ep.Path == "" {
+		ep.Path = u.wsConfig.Path
+	}
+	return ep
+}
+
+func (u *WebSocketConn) accept(ws *websocket.Conn) {
+	if !u.acquireAccepted() {
+		if u.l.Level >= logrus.DebugLevel {
+			u.l.WithField("remoteAddr", ws.Request().RemoteAddr).Debug("Closing websocket stream, too many streams are open")
+		}
+		return
+	}
+	defer u.releaseAccepted()
+
+	req := ws.Request()
+	ap, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil {
+		u.l.WithField("remoteAddr", req.RemoteAddr).WithError(err).Error("Failed to parse the address of a websocket stream")
+		return
+	}
+
+	// The http server may have left a deadline from reading the request, replace it with the one for the first packet
+	_ = ws.SetDeadline(time.Time{})
+	u.setFirstPacketDeadline(ws)
+	ws.PayloadType = websocket.BinaryFrame
+
+	if fwd := req.Header.Get("X-Forwarded-For"); fwd != "" && u.l.Level >= logrus.DebugLevel {
+		u.l.WithField("tcpAddr", ap).WithField("forwardedFor", fwd).Debug("Accepting websocket stream through a reverse proxy")
+	}
+
+	u.serveAccepted(netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), ws, req.TLS != nil)
+}
+
+func (u *WebSocketConn) dialWebSocket(ctx context.Context, addr netip.AddrPort) (net.Conn, error) {
+	ep := u.endpoint(addr)
+
+	// Prefer the name of the endpoint so proxies and virtual hosts in front of the remote see what they expect
+	scheme, defaultPort := "http", uint16(80)
+	if ep.TLS {
+		scheme, defaultPort = "https", 443
+	}
+
+	host := addr.String()
+	if ep.Host != "" {
+		host = ep.Host
+		if addr.Port() != defaultPort {
+			host = net.JoinHostPort(ep.Host, strconv.Itoa(int(addr.Port())))
+		}
+	}
+	location := &url.URL{Scheme: scheme, Host: host, Path: ep.Path}
+
+	var proxy *url.URL
+	if u.wsConfig.Proxy != nil {
+		var err error
+		proxy, err = u.wsConfig.Proxy(&http.Request{URL: location})
+		if err != nil {
+			return nil, fmt.Errorf("failed to find a proxy: %w", err)
+		}
+	}
+
+	var conn net.Conn
+	var err error
+	if proxy != nil {
+		target := addr.String()
+		if ep.Host != "" {
+			target = net.JoinHostPort(ep.Host, strconv.Itoa(int(addr.Port())))
+		}
+		conn, err = dialConnect(ctx, proxy, target, u.wsConfig.Mark)
+	} else {
+		conn, err = dialStream(ctx, u.wsConfig.Dialer, addr.String(), u.wsConfig.Mark)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if ep.TLS {
+		tlsConfig := u.wsConfig.TLSClient.Clone()
+		if ep.Host != "" {
+			tlsConfig.ServerName = ep.Host
+		}
+
+		tc := tls.Client(conn, tlsConfig)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+
+	wsScheme := "ws"
+	if ep.TLS {
+		wsScheme = "wss"
+	}
+	wsLocation := *location
+	wsLocation.Scheme = wsScheme
+
+	wsConfig, err := websocket.NewConfig(wsLocation.String(), location.String())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	ws, err := websocket.NewClient(wsConfig, conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed websocket handshake: %w", err)
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+// dialConnect opens a tunnel to target through an http proxy with the CONNECT method, mark is set as SO_MARK on the
+// connection to the proxy
+func dialConnect(ctx context.Context, proxy *url.URL, target string, mark int) (net.Conn, error) {
+	if proxy.Scheme != "http" {
+		return nil, fmt.Errorf("unsupported proxy scheme %q, only http proxies are supported", proxy.Scheme)
+	}
+
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), "80")
+	}
+
+	d := net.Dialer{Control: markControl(mark)}
+	conn, err := d.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial proxy %s: %w", proxyAddr, err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: http.Header{},
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to write to proxy %s: %w", proxyAddr, err)
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read from proxy %s: %w", proxyAddr, err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused to connect to %s: %s", proxyAddr, target, res.Status)
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		// The remote spoke before we did, keep what the proxy sent along with its answer
+		return &peekedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+func (u *WebSocketConn) Close() error {
+	err := u.TCPConn.Close()
+	if u.server != nil {
+		// Streams were hijacked from the server and are already closed, this only drops requests still being read
+		_ = u.server.Close()
+	}
+	return err
+}
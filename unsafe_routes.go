@@ -0,0 +1,448 @@
+package nebula
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"math"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/overlay"
+)
+
+const (
+	defaultUnsafeRoutePriority = 100
+
+	// learnedRouteIntervals is how many lighthouse intervals an answer is kept for and a gateway whose tunnel failed is
+	// passed over for
+	learnedRouteIntervals = 3
+	// defaultLearnedRouteInterval is how often the lighthouses are asked when lighthouse.interval is 0
+	defaultLearnedRouteInterval = 10 * time.Second
+	// maxUnsafeRoutesReplySize keeps a lighthouse answer within a single packet at the default tun mtu, leaving room for
+	// the headers and cipher overhead of a relayed tunnel
+	maxUnsafeRoutesReplySize = overlay.DefaultMTU - 2*(header.Len+16)
+)
+
+const (
+	gatewayRankUp = iota
+	gatewayRankUnknown
+	gatewayRankFailed
+)
+
+// unsafeNetworksFromConfig returns the networks listed at key, every ipv4 certificate unsafe network if it is not set.
+// Listed networks must fit within the certificate unsafe networks.
+func unsafeNetworksFromConfig(c *config.C, key string, unsafeNetworks []netip.Prefix) ([]netip.Prefix, error) {
+	var networks []netip.Prefix
+	for _, n := range unsafeNetworks {
+		if n.Addr().Is4() {
+			networks = append(networks, n)
+		}
+	}
+
+	if rNetworks := c.GetStringSlice(key, nil); len(rNetworks) > 0 {
+		networks = nil
+		for i, v := range rNetworks {
+			n, err := netip.ParsePrefix(v)
+			if err != nil {
+				return nil, fmt.Errorf("entry %v in %s failed to parse: %v", i+1, key, err)
+			}
+
+			n = n.Masked()
+			if !n.Addr().Is4() {
+				return nil, fmt.Errorf("entry %v in %s is not an ipv4 network: %v", i+1, key, n)
+			}
+
+			if !networksCover(unsafeNetworks, n) {
+				return nil, fmt.Errorf("entry %v in %s is not within the certificate unsafe networks: %v", i+1, key, n)
+			}
+
+			networks = append(networks, n)
+		}
+	}
+
+	return networks, nil
+}
+
+// networksCover returns true if n fits entirely within one of networks
+func networksCover(networks []netip.Prefix, n netip.Prefix) bool {
+	for _, u := range networks {
+		if u.Bits() <= n.Bits() && u.Contains(n.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// newAdvertisedRoutesFromConfig returns the unsafe networks we send to the lighthouses as a gateway, nil unless
+// lighthouse.advertise_unsafe_routes is enabled
+func newAdvertisedRoutesFromConfig(c *config.C, crt cert.Certificate) ([]*UnsafeRoute, error) {
+	if !c.GetBool("lighthouse.advertise_unsafe_routes.enabled", false) {
+		return nil, nil
+	}
+
+	priority := c.GetInt("lighthouse.advertise_unsafe_routes.priority", defaultUnsafeRoutePriority)
+	if priority < 0 || int64(priority) > math.MaxUint32 {
+		return nil, fmt.Errorf("lighthouse.advertise_unsafe_routes.priority must be between 0 and %v", uint32(math.MaxUint32))
+	}
+
+	networks, err := unsafeNetworksFromConfig(c, "lighthouse.advertise_unsafe_routes.networks", crt.UnsafeNetworks())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(networks) == 0 {
+		return nil, fmt.Errorf("lighthouse.advertise_unsafe_routes.enabled requires ipv4 unsafe networks in the certificate")
+	}
+
+	routes := make([]*UnsafeRoute, len(networks))
+	for i, n := range networks {
+		//TODO: IPV6-WORK
+		b := n.Addr().As4()
+		routes[i] = &UnsafeRoute{Ip: binary.BigEndian.Uint32(b[:]), Bits: uint32(n.Bits()), Priority: uint32(priority)}
+	}
+
+	return routes, nil
+}
+
+// fitUnsafeRoutes sorts routes and returns as many of them as fit in room bytes of an encoded NebulaMetaDetails. The
+// order is stable so the same routes are left out of every answer instead of a different few each time.
+func fitUnsafeRoutes(routes []*UnsafeRoute, room int) []*UnsafeRoute {
+	slices.SortFunc(routes, func(a, b *UnsafeRoute) int {
+		return cmp.Or(
+			cmp.Compare(a.Ip, b.Ip),
+			cmp.Compare(a.Bits, b.Bits),
+			cmp.Compare(b.Priority, a.Priority),
+			cmp.Compare(a.Via, b.Via),
+		)
+	})
+
+	for i, r := range routes {
+		l := r.Size()
+		room -= 1 + sovNebula(uint64(l)) + l
+		if room < 0 {
+			return routes[:i]
+		}
+	}
+
+	return routes
+}
+
+// unsafeRouteCidr returns the network r is for, ok is false if r does not hold a valid ipv4 network
+func unsafeRouteCidr(r *UnsafeRoute) (netip.Prefix, bool) {
+	//TODO: IPV6-WORK
+	b := [4]byte{}
+	binary.BigEndian.PutUint32(b[:], r.Ip)
+	n := netip.PrefixFrom(netip.AddrFrom4(b), int(r.Bits))
+	return n, n.IsValid() && n.Masked() == n
+}
+
+// advertisedRoute is an unsafe network a gateway told a lighthouse it carries traffic for
+type advertisedRoute struct {
+	cidr     netip.Prefix
+	via      netip.Addr
+	priority uint32
+}
+
+type learnedAnswer struct {
+	at     time.Time
+	routes []advertisedRoute
+}
+
+// routeLearner asks the lighthouses which gateways advertise unsafe networks and routes each network through one of
+// them. A gateway we have a tunnel with is preferred, then one we have not tried and last one whose tunnel failed
+// recently, the priority the gateway advertised decides between equals. Gateways preferred over the one in use are
+// handshaken with in the background so traffic goes back to them once they are reachable again.
+type routeLearner struct {
+	sync.Mutex
+	l       *logrus.Logger
+	hostMap *HostMap
+	device  overlay.RouteLearner
+
+	// answers holds the last answer from each lighthouse
+	answers map[netip.Addr]learnedAnswer
+	// failed holds when the tunnel to a gateway last timed out or went away
+	failed map[netip.Addr]time.Time
+	// selected holds the gateway in use for each network, as given to the device
+	selected map[netip.Prefix]netip.Addr
+	// dirty forces the routes to the device again, like after their metric changed
+	dirty bool
+
+	// trigger wakes up Run to select gateways before the next interval
+	trigger chan struct{}
+
+	metric  atomic.Int64
+	install atomic.Bool
+}
+
+// newRouteLearnerFromConfig returns nil if tun.learn_unsafe_routes is not enabled, device is nil during a config test
+func newRouteLearnerFromConfig(l *logrus.Logger, c *config.C, hostMap *HostMap, device overlay.Device) (*routeLearner, error) {
+	if !overlay.LearnsUnsafeRoutes(c) {
+		return nil, nil
+	}
+
+	if c.GetBool("lighthouse.am_lighthouse", false) {
+		return nil, fmt.Errorf("tun.learn_unsafe_routes can not be used on a lighthouse")
+	}
+
+	r := &routeLearner{
+		l:        l,
+		hostMap:  hostMap,
+		answers:  map[netip.Addr]learnedAnswer{},
+		failed:   map[netip.Addr]time.Time{},
+		selected: map[netip.Prefix]netip.Addr{},
+		trigger:  make(chan struct{}, 1),
+	}
+
+	if device != nil {
+		rl, ok := device.(overlay.RouteLearner)
+		if !ok {
+			return nil, fmt.Errorf("tun.learn_unsafe_routes is not supported by this device")
+		}
+		r.device = rl
+	}
+
+	r.reload(c, true)
+	c.RegisterReloadCallback(func(c *config.C) {
+		r.reload(c, false)
+	})
+
+	return r, nil
+}
+
+func (r *routeLearner) reload(c *config.C, initial bool) {
+	if !initial && !c.HasChanged("tun.learn_unsafe_routes") {
+		return
+	}
+
+	r.metric.Store(int64(c.GetInt("tun.learn_unsafe_routes.metric", 0)))
+	r.install.Store(c.GetBool("tun.learn_unsafe_routes.install", true))
+
+	if !initial {
+		r.Lock()
+		r.dirty = true
+		r.Unlock()
+		r.wake()
+	}
+}
+
+// Run asks the lighthouses for unsafe routes every lighthouse interval and keeps the device routes up to date
+func (r *routeLearner) Run(ctx context.Context, f *Interface) {
+	t := time.NewTimer(0)
+	defer t.Stop()
+
+	interval := defaultLearnedRouteInterval
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-r.trigger:
+			r.update(time.Now(), learnedRouteIntervals*interval)
+
+		case <-t.C:
+			interval = time.Duration(f.lightHouse.GetUpdateInterval()) * time.Second
+			if interval <= 0 {
+				interval = defaultLearnedRouteInterval
+			}
+
+			f.lightHouse.queryUnsafeRoutes()
+			for _, via := range r.update(time.Now(), learnedRouteIntervals*interval) {
+				f.Handshake(via)
+			}
+			t.Reset(interval)
+		}
+	}
+}
+
+func (r *routeLearner) wake() {
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// answer records the unsafe routes a lighthouse answered with
+func (r *routeLearner) answer(lighthouse netip.Addr, routes []*UnsafeRoute, now time.Time) {
+	a := learnedAnswer{at: now, routes: make([]advertisedRoute, 0, len(routes))}
+	for _, u := range routes {
+		cidr, ok := unsafeRouteCidr(u)
+		if !ok {
+			continue
+		}
+
+		//TODO: IPV6-WORK
+		b := [4]byte{}
+		binary.BigEndian.PutUint32(b[:], u.Via)
+		a.routes = append(a.routes, advertisedRoute{cidr: cidr, via: netip.AddrFrom4(b), priority: u.Priority})
+	}
+
+	r.Lock()
+	r.answers[lighthouse] = a
+	r.Unlock()
+	r.wake()
+}
+
+// gatewayFailed is called when the last tunnel to vpnIp went away or a handshake with it timed out
+func (r *routeLearner) gatewayFailed(vpnIp netip.Addr) {
+	r.Lock()
+	defer r.Unlock()
+
+	if !r.isGateway(vpnIp) {
+		return
+	}
+
+	r.failed[vpnIp] = time.Now()
+	r.wake()
+}
+
+func (r *routeLearner) isGateway(vpnIp netip.Addr) bool {
+	for _, a := range r.answers {
+		for _, route := range a.routes {
+			if route.via == vpnIp {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rank orders the gateways for cidr, ok is false if via can not be used for it
+func (r *routeLearner) rank(via netip.Addr, cidr netip.Prefix) (int, bool) {
+	if hostinfo := r.hostMap.QueryVpnIp(via); hostinfo != nil {
+		// The lighthouse checked the certificate already, but we don't have to trust it
+		c := hostinfo.GetCert()
+		if c == nil || !networksCover(c.Certificate.UnsafeNetworks(), cidr) {
+			return 0, false
+		}
+		return gatewayRankUp, true
+	}
+
+	if _, ok := r.failed[via]; ok {
+		return gatewayRankFailed, true
+	}
+
+	return gatewayRankUnknown, true
+}
+
+// update selects a gateway for every network and hands the routes to the device if that changed anything. Answers and
+// gateway failures older than window are forgotten. It returns the gateways that are preferred over the ones in use but
+// have no tunnel.
+func (r *routeLearner) update(now time.Time, window time.Duration) []netip.Addr {
+	r.Lock()
+	defer r.Unlock()
+
+	candidates := map[netip.Prefix][]advertisedRoute{}
+	for lighthouse, a := range r.answers {
+		if now.Sub(a.at) > window {
+			delete(r.answers, lighthouse)
+			continue
+		}
+
+		for _, route := range a.routes {
+			candidates[route.cidr] = append(candidates[route.cidr], route)
+		}
+	}
+
+	for via, at := range r.failed {
+		if now.Sub(at) >= window {
+			delete(r.failed, via)
+		}
+	}
+
+	type ranked struct {
+		advertisedRoute
+		rank int
+	}
+
+	selected := map[netip.Prefix]netip.Addr{}
+	var probe []netip.Addr
+	for cidr, routes := range candidates {
+		var usable []ranked
+		for _, route := range routes {
+			if rank, ok := r.rank(route.via, cidr); ok {
+				usable = append(usable, ranked{route, rank})
+			}
+		}
+
+		if len(usable) == 0 {
+			continue
+		}
+
+		slices.SortFunc(usable, func(a, b ranked) int {
+			if a.rank != b.rank {
+				return a.rank - b.rank
+			}
+			if a.priority != b.priority {
+				if a.priority > b.priority {
+					return -1
+				}
+				return 1
+			}
+			return a.via.Compare(b.via)
+		})
+
+		best := usable[0]
+		selected[cidr] = best.via
+
+		for _, u := range usable[1:] {
+			if u.rank == gatewayRankUnknown && u.priority > best.priority && !slices.Contains(probe, u.via) {
+				probe = append(probe, u.via)
+			}
+		}
+	}
+
+	if !r.dirty && maps.Equal(selected, r.selected) {
+		return probe
+	}
+
+	for cidr, via := range selected {
+		if old, ok := r.selected[cidr]; !ok || old != via {
+			r.l.WithField("network", cidr).WithField("via", via).Info("Learned unsafe route")
+		}
+	}
+	for cidr, via := range r.selected {
+		if _, ok := selected[cidr]; !ok {
+			r.l.WithField("network", cidr).WithField("via", via).Info("Unsafe route is no longer advertised")
+		}
+	}
+
+	r.selected = selected
+	r.dirty = false
+
+	if r.device != nil {
+		err := r.device.SetLearnedRoutes(r.routes())
+		if err != nil {
+			r.l.WithError(err).Error("Failed to set learned unsafe routes")
+		}
+	}
+
+	return probe
+}
+
+// routes returns the selected gateways as routes for the device, sorted to keep the device changes predictable
+func (r *routeLearner) routes() []overlay.Route {
+	routes := make([]overlay.Route, 0, len(r.selected))
+	metric := int(r.metric.Load())
+	install := r.install.Load()
+	for cidr, via := range r.selected {
+		routes = append(routes, overlay.Route{Cidr: cidr, Via: via, Metric: metric, Install: install})
+	}
+
+	slices.SortFunc(routes, func(a, b overlay.Route) int {
+		if c := a.Cidr.Addr().Compare(b.Cidr.Addr()); c != 0 {
+			return c
+		}
+		return a.Cidr.Bits() - b.Cidr.Bits()
+	})
+	return routes
+}
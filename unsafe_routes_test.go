@@ -0,0 +1,287 @@
+package nebula
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/overlay"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAdvertisedRoutesFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	crt := &dummyCert{unsafeNetworks: []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16"), netip.MustParsePrefix("fd00::/8")}}
+
+	routes, err := newAdvertisedRoutesFromConfig(c, crt)
+	require.NoError(t, err)
+	assert.Nil(t, routes)
+
+	advertise := func(settings map[interface{}]interface{}) ([]*UnsafeRoute, error) {
+		settings["enabled"] = true
+		c.Settings["lighthouse"] = map[interface{}]interface{}{"advertise_unsafe_routes": settings}
+		return newAdvertisedRoutesFromConfig(c, crt)
+	}
+
+	// Every ipv4 unsafe network in the certificate by default
+	routes, err = advertise(map[interface{}]interface{}{})
+	require.NoError(t, err)
+	assert.Equal(t, []*UnsafeRoute{{Ip: 0xc0a80000, Bits: 16, Priority: defaultUnsafeRoutePriority}}, routes)
+
+	routes, err = advertise(map[interface{}]interface{}{"priority": 200, "networks": []interface{}{"192.168.1.1/24", "192.168.2.0/24"}})
+	require.NoError(t, err)
+	assert.Equal(t, []*UnsafeRoute{
+		{Ip: 0xc0a80100, Bits: 24, Priority: 200},
+		{Ip: 0xc0a80200, Bits: 24, Priority: 200},
+	}, routes)
+
+	_, err = advertise(map[interface{}]interface{}{"priority": -1})
+	assert.EqualError(t, err, "lighthouse.advertise_unsafe_routes.priority must be between 0 and 4294967295")
+
+	_, err = advertise(map[interface{}]interface{}{"networks": []interface{}{"10.0.0.0/8"}})
+	assert.EqualError(t, err, "entry 1 in lighthouse.advertise_unsafe_routes.networks is not within the certificate unsafe networks: 10.0.0.0/8")
+
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"advertise_unsafe_routes": map[interface{}]interface{}{"enabled": true}}
+	_, err = newAdvertisedRoutesFromConfig(c, &dummyCert{})
+	assert.EqualError(t, err, "lighthouse.advertise_unsafe_routes.enabled requires ipv4 unsafe networks in the certificate")
+}
+
+func TestNewRouteLearnerFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	r, err := newRouteLearnerFromConfig(l, c, newHostMap(l, netip.Prefix{}), nil)
+	require.NoError(t, err)
+	assert.Nil(t, r)
+
+	c.Settings["tun"] = map[interface{}]interface{}{"learn_unsafe_routes": map[interface{}]interface{}{"enabled": true, "metric": 50}}
+	r, err = newRouteLearnerFromConfig(l, c, newHostMap(l, netip.Prefix{}), nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(50), r.metric.Load())
+	assert.True(t, r.install.Load())
+
+	_, err = newRouteLearnerFromConfig(l, c, newHostMap(l, netip.Prefix{}), &testDevice{})
+	assert.EqualError(t, err, "tun.learn_unsafe_routes is not supported by this device")
+
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"am_lighthouse": true}
+	_, err = newRouteLearnerFromConfig(l, c, newHostMap(l, netip.Prefix{}), nil)
+	assert.EqualError(t, err, "tun.learn_unsafe_routes can not be used on a lighthouse")
+}
+
+// addTestGateway puts a tunnel to vpnIp in hm whose certificate has unsafeNetworks
+func addTestGateway(hm *HostMap, vpnIp netip.Addr, unsafeNetworks ...netip.Prefix) *HostInfo {
+	b := vpnIp.As4()
+	hostinfo := &HostInfo{
+		ConnectionState: &ConnectionState{
+			peerCert: &cert.CachedCertificate{Certificate: &dummyCert{unsafeNetworks: unsafeNetworks}},
+		},
+		localIndexId:  uint32(b[3]),
+		remoteIndexId: uint32(b[3]),
+		vpnIp:         vpnIp,
+		relayState: RelayState{
+			relays:        map[netip.Addr]struct{}{},
+			relayForByIp:  map[netip.Addr]*Relay{},
+			relayForByIdx: map[uint32]*Relay{},
+		},
+	}
+
+	hm.Lock()
+	hm.unlockedAddHostInfo(hostinfo, &Interface{})
+	hm.Unlock()
+	return hostinfo
+}
+
+func TestLighthouse_unsafeRoutes(t *testing.T) {
+	l := test.NewLogger()
+	myVpnNet := netip.MustParsePrefix("10.128.0.1/24")
+	gateway := netip.MustParseAddr("10.128.0.3")
+
+	lc := config.NewC(l)
+	lc.Settings["lighthouse"] = map[interface{}]interface{}{"am_lighthouse": true}
+	lc.Settings["listen"] = map[interface{}]interface{}{"port": 4242}
+	lighthouse, err := NewLightHouseFromConfig(context.Background(), l, lc, myVpnNet, nil, nil)
+	require.NoError(t, err)
+	lighthouse.hostMap = newHostMap(l, myVpnNet)
+	addTestGateway(lighthouse.hostMap, gateway, netip.MustParsePrefix("192.168.0.0/16"))
+
+	// The gateway advertises a network in its certificate and one that is not
+	update := &NebulaMeta{
+		Type: NebulaMeta_HostUpdateNotification,
+		Details: &NebulaMetaDetails{
+			VpnIp: 0x0a800003,
+			UnsafeRoutes: []*UnsafeRoute{
+				{Ip: 0xc0a80100, Bits: 24, Priority: 200},
+				{Ip: 0xac100000, Bits: 12, Priority: 200},
+			},
+		},
+	}
+	b, err := update.Marshal()
+	require.NoError(t, err)
+	lighthouse.NewRequestHandler().HandleRequest(netip.AddrPort{}, gateway, b, &testEncWriter{})
+	assert.Equal(t, []*UnsafeRoute{{Ip: 0xc0a80100, Bits: 24, Priority: 200, Via: 0x0a800003}}, lighthouse.unsafeRoutes[gateway])
+
+	cc := config.NewC(l)
+	cc.Settings["lighthouse"] = map[interface{}]interface{}{"hosts": []interface{}{"10.128.0.1"}}
+	cc.Settings["static_host_map"] = map[interface{}]interface{}{"10.128.0.1": []interface{}{"1.1.1.1:4242"}}
+	cc.Settings["listen"] = map[interface{}]interface{}{"port": 4242}
+	cc.Settings["tun"] = map[interface{}]interface{}{"learn_unsafe_routes": map[interface{}]interface{}{"enabled": true}}
+	client, err := NewLightHouseFromConfig(context.Background(), l, cc, netip.MustParsePrefix("10.128.0.2/24"), nil, nil)
+	require.NoError(t, err)
+	client.routeLearner, err = newRouteLearnerFromConfig(l, cc, newHostMap(l, myVpnNet), nil)
+	require.NoError(t, err)
+
+	w := &testDnsLoopWriter{
+		client:     client.NewRequestHandler(),
+		lighthouse: lighthouse.NewRequestHandler(),
+		clientIp:   netip.MustParseAddr("10.128.0.2"),
+	}
+	client.ifce = w
+
+	client.queryUnsafeRoutes()
+	assert.Equal(t, 1, w.queries)
+	require.Contains(t, client.routeLearner.answers, myVpnNet.Addr())
+	assert.Equal(t, []advertisedRoute{
+		{cidr: netip.MustParsePrefix("192.168.1.0/24"), via: gateway, priority: 200},
+	}, client.routeLearner.answers[myVpnNet.Addr()].routes)
+
+	// The routes go away with the tunnel to the gateway
+	lighthouse.DeleteVpnIp(gateway)
+	assert.Empty(t, lighthouse.unsafeRoutes)
+
+	// An update without routes clears them too
+	lighthouse.setUnsafeRoutes(gateway, update.Details.UnsafeRoutes)
+	assert.Len(t, lighthouse.unsafeRoutes, 1)
+	update.Details.UnsafeRoutes = nil
+	b, err = update.Marshal()
+	require.NoError(t, err)
+	lighthouse.NewRequestHandler().HandleRequest(netip.AddrPort{}, gateway, b, &testEncWriter{})
+	assert.Empty(t, lighthouse.unsafeRoutes)
+}
+
+// testDevice is a device that can not learn routes
+type testDevice struct {
+	overlay.Device
+}
+
+// testRouteDevice records the learned routes it was given
+type testRouteDevice struct {
+	testDevice
+	routes []overlay.Route
+	sets   int
+}
+
+func (d *testRouteDevice) SetLearnedRoutes(routes []overlay.Route) error {
+	d.routes = routes
+	d.sets++
+	return nil
+}
+
+func TestRouteLearner_update(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["tun"] = map[interface{}]interface{}{"learn_unsafe_routes": map[interface{}]interface{}{"enabled": true}}
+	hm := newHostMap(l, netip.MustParsePrefix("10.128.0.2/24"))
+	device := &testRouteDevice{}
+	r, err := newRouteLearnerFromConfig(l, c, hm, device)
+	require.NoError(t, err)
+
+	lighthouse := netip.MustParseAddr("10.128.0.1")
+	primary := netip.MustParseAddr("10.128.0.3")
+	backup := netip.MustParseAddr("10.128.0.4")
+	lan := netip.MustParsePrefix("192.168.1.0/24")
+	window := learnedRouteIntervals * defaultLearnedRouteInterval
+
+	now := time.Now()
+	r.answer(lighthouse, []*UnsafeRoute{
+		{Ip: 0xc0a80100, Bits: 24, Priority: 100, Via: 0x0a800004},
+		{Ip: 0xc0a80100, Bits: 24, Priority: 200, Via: 0x0a800003},
+		{Ip: 0xc0a80101, Bits: 24, Priority: 200, Via: 0x0a800003},
+	}, now)
+
+	// Without tunnels the highest priority wins, the bad network is dropped
+	assert.Empty(t, r.update(now, window))
+	assert.Equal(t, []overlay.Route{{Cidr: lan, Via: primary, Install: true}}, device.routes)
+
+	// Nothing changed, the device is left alone
+	r.update(now, window)
+	assert.Equal(t, 1, device.sets)
+
+	// The primary timed out, traffic moves to the backup
+	r.gatewayFailed(primary)
+	r.update(now, window)
+	assert.Equal(t, []overlay.Route{{Cidr: lan, Via: backup, Install: true}}, device.routes)
+
+	// A tunnel to the backup keeps the traffic there after the primary is no longer held back, the primary is probed
+	backupInfo := addTestGateway(hm, backup, netip.MustParsePrefix("192.168.0.0/16"))
+	now = now.Add(window + time.Second)
+	r.answer(lighthouse, []*UnsafeRoute{
+		{Ip: 0xc0a80100, Bits: 24, Priority: 100, Via: 0x0a800004},
+		{Ip: 0xc0a80100, Bits: 24, Priority: 200, Via: 0x0a800003},
+	}, now)
+	assert.Equal(t, []netip.Addr{primary}, r.update(now, window))
+	assert.Equal(t, backup, device.routes[0].Via)
+
+	// Once the primary is up again traffic goes back to it
+	addTestGateway(hm, primary, netip.MustParsePrefix("192.168.1.0/24"))
+	assert.Empty(t, r.update(now, window))
+	assert.Equal(t, primary, device.routes[0].Via)
+
+	// A gateway whose certificate does not have the network is never used
+	hm.DeleteHostInfo(backupInfo)
+	addTestGateway(hm, backup, netip.MustParsePrefix("172.16.0.0/12"))
+	r.gatewayFailed(primary)
+	hm.DeleteHostInfo(hm.QueryVpnIp(primary))
+	r.update(now, window)
+	assert.Equal(t, primary, device.routes[0].Via)
+
+	// A change to the metric is handed to the device
+	require.NoError(t, c.ReloadConfigString("tun:\n  learn_unsafe_routes:\n    enabled: true\n    metric: 50\n"))
+	r.update(now, window)
+	assert.Equal(t, []overlay.Route{{Cidr: lan, Via: primary, Metric: 50, Install: true}}, device.routes)
+
+	// Networks nobody answers with anymore are removed
+	r.update(now.Add(window+time.Second), window)
+	assert.Empty(t, device.routes)
+	assert.Empty(t, r.answers)
+}
+
+func TestLighthouse_unsafeRoutesReplySize(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"am_lighthouse": true}
+	c.Settings["listen"] = map[interface{}]interface{}{"port": 4242}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, netip.MustParsePrefix("10.128.0.1/24"), nil, nil)
+	require.NoError(t, err)
+
+	// Two gateways advertise far more /32s than fit in one answer
+	for g := uint32(2); g <= 3; g++ {
+		var routes []*UnsafeRoute
+		for i := uint32(300); i > 0; i-- {
+			routes = append(routes, &UnsafeRoute{Ip: 0xc0a80000 + i, Bits: 32, Priority: 100, Via: 0x0a800000 + g})
+		}
+		lh.unsafeRoutes[netip.AddrFrom4([4]byte{10, 128, 0, byte(g)})] = routes
+	}
+
+	lhh := lh.NewRequestHandler()
+	w := &testEncWriter{}
+	lhh.handleHostRoutesQuery(netip.MustParseAddr("10.128.0.4"), w)
+	first := w.lastReply.msg
+	require.NotEmpty(t, first.Details.UnsafeRoutes)
+	assert.LessOrEqual(t, first.Size(), maxUnsafeRoutesReplySize)
+
+	// The lowest networks are kept and both gateways are offered for them
+	assert.Equal(t, &UnsafeRoute{Ip: 0xc0a80001, Bits: 32, Priority: 100, Via: 0x0a800002}, first.Details.UnsafeRoutes[0])
+	assert.Equal(t, &UnsafeRoute{Ip: 0xc0a80001, Bits: 32, Priority: 100, Via: 0x0a800003}, first.Details.UnsafeRoutes[1])
+
+	// Every answer leaves out the same routes no matter how the map is walked
+	for range 10 {
+		lhh.handleHostRoutesQuery(netip.MustParseAddr("10.128.0.4"), w)
+		assert.Equal(t, first.Details.UnsafeRoutes, w.lastReply.msg.Details.UnsafeRoutes)
+	}
+}
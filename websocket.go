@@ -0,0 +1,80 @@
+package nebula
+
+import (
+	"net/http"
+	"net/netip"
+	"net/url"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/udp"
+	"github.com/slackhq/nebula/util"
+)
+
+// NewWebSocketFromConfig builds the websocket transport from listen.transports.websocket, nil is returned when it is
+// disabled. Like the tcp transport, streams are only accepted when listen.transports.websocket.port is set.
+func NewWebSocketFromConfig(l *logrus.Logger, c *config.C, listenHost netip.Addr) (*udp.WebSocketConn, error) {
+	const key = "listen.transports.websocket"
+	if !c.GetBool(key+".enabled", false) {
+		return nil, nil
+	}
+
+	listen, err := streamListenAddr(c, key, listenHost)
+	if err != nil {
+		return nil, err
+	}
+
+	wc := udp.WebSocketConfig{
+		Listen:      listen,
+		Path:        c.GetString(key+".path", udp.DefaultWebSocketPath),
+		TLSClient:   streamTLSClient(c, key),
+		TLS:         c.GetBool(key+".dial_tls", true),
+		DialTimeout: c.GetDuration(key+".dial_timeout", defaultTCPDialTimeout),
+		MaxStreams:  c.GetInt(key+".max_streams", defaultTCPMaxStreams),
+		IdleTimeout: c.GetDuration(key+".idle_timeout", defaultTCPIdleTimeout),
+		Mark:        c.GetInt("listen.so_mark", 0),
+	}
+
+	// Without tls we serve plain http, most likely a reverse proxy in front of us takes care of tls
+	if c.GetBool(key+".tls", false) {
+		wc.TLSServer, err = streamTLSServer(c, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch rawProxy := c.GetString(key+".proxy", ""); rawProxy {
+	case "":
+	case "environment":
+		wc.Proxy = http.ProxyFromEnvironment
+	default:
+		proxy, err := url.Parse(rawProxy)
+		if err != nil || proxy.Scheme != "http" || proxy.Host == "" {
+			return nil, util.NewContextualError("Invalid "+key+".proxy, expected environment or http://host:port", m{"proxy": rawProxy}, err)
+		}
+		wc.Proxy = http.ProxyURL(proxy)
+	}
+
+	// An http proxy wins over listen.proxy, it is more likely to be what the network in front of us expects for http
+	if wc.Proxy == nil {
+		proxy, err := socks5DialerFromConfig(c)
+		if err != nil {
+			return nil, err
+		}
+		if proxy != nil {
+			wc.Dialer = proxy
+		}
+	}
+
+	conn, err := udp.NewWebSocketConn(l, wc)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to open websocket listener", m{"addr": wc.Listen}, err)
+	}
+
+	if wc.Listen.IsValid() {
+		addr, _ := conn.LocalAddr()
+		l.WithField("tls", wc.TLSServer != nil).WithField("path", wc.Path).Infof("listening on websocket %v", addr)
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,172 @@
+package nebula
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func webSocketTestConfig(l *logrus.Logger, ws map[interface{}]interface{}) *config.C {
+	c := config.NewC(l)
+	c.Settings["listen"] = map[interface{}]interface{}{"transports": map[interface{}]interface{}{"websocket": ws}}
+	return c
+}
+
+func TestNewWebSocketFromConfig(t *testing.T) {
+	l := test.NewLogger()
+
+	conn, err := NewWebSocketFromConfig(l, config.NewC(l), netip.MustParseAddr("127.0.0.1"))
+	assert.NoError(t, err)
+	assert.Nil(t, conn, "the websocket transport is disabled by default")
+
+	// Without a port we only dial out
+	conn, err = NewWebSocketFromConfig(l, webSocketTestConfig(l, map[interface{}]interface{}{"enabled": true}), netip.MustParseAddr("127.0.0.1"))
+	require.NoError(t, err)
+	addr, err := conn.LocalAddr()
+	assert.NoError(t, err)
+	assert.False(t, addr.IsValid())
+	conn.Close()
+
+	conn, err = NewWebSocketFromConfig(l, webSocketTestConfig(l, map[interface{}]interface{}{
+		"enabled": true, "port": 0, "tls": true,
+	}), netip.MustParseAddr("127.0.0.1"))
+	require.NoError(t, err)
+	addr, err = conn.LocalAddr()
+	assert.NoError(t, err)
+	assert.Equal(t, netip.MustParseAddr("127.0.0.1"), addr.Addr())
+	assert.NotZero(t, addr.Port())
+	conn.Close()
+
+	for _, proxy := range []string{"socks5://127.0.0.1:1080", "127.0.0.1:3128", "http://"} {
+		_, err = NewWebSocketFromConfig(l, webSocketTestConfig(l, map[interface{}]interface{}{
+			"enabled": true, "proxy": proxy,
+		}), netip.MustParseAddr("127.0.0.1"))
+		assert.ErrorContains(t, err, "Invalid listen.transports.websocket.proxy", proxy)
+	}
+}
+
+func TestWebSocketConn(t *testing.T) {
+	l := test.NewLogger()
+	newServer := func(ws map[interface{}]interface{}) (*udp.WebSocketConn, netip.AddrPort, <-chan tcpTestPacket) {
+		ws["enabled"] = true
+		ws["port"] = 0
+		server, err := NewWebSocketFromConfig(l, webSocketTestConfig(l, ws), netip.MustParseAddr("127.0.0.1"))
+		require.NoError(t, err)
+		t.Cleanup(func() { server.Close() })
+		addr, _ := server.LocalAddr()
+		return server, addr, listenTCPTest(server.TCPConn)
+	}
+
+	proxyAddr, proxied := listenConnectProxyTest(t)
+
+	plain, plainAddr, plainRx := newServer(map[interface{}]interface{}{})
+	tlsServer, tlsAddr, tlsRx := newServer(map[interface{}]interface{}{"tls": true})
+	_, customAddr, customRx := newServer(map[interface{}]interface{}{"path": "/custom"})
+
+	tests := []struct {
+		name   string
+		ws     map[interface{}]interface{}
+		ep     *udp.StreamEndpoint
+		server *udp.WebSocketConn
+		addr   netip.AddrPort
+		rx     <-chan tcpTestPacket
+	}{
+		{name: "plain", ws: map[interface{}]interface{}{"dial_tls": false}, server: plain, addr: plainAddr, rx: plainRx},
+		{name: "tls", ws: map[interface{}]interface{}{}, server: tlsServer, addr: tlsAddr, rx: tlsRx},
+		{name: "proxy", ws: map[interface{}]interface{}{"proxy": "http://user:pass@" + proxyAddr.String()}, server: tlsServer, addr: tlsAddr, rx: tlsRx},
+		{name: "endpoint", ws: map[interface{}]interface{}{}, ep: &udp.StreamEndpoint{Host: "localhost", Path: "/custom"}, addr: customAddr, rx: customRx},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.ws["enabled"] = true
+			client, err := NewWebSocketFromConfig(l, webSocketTestConfig(l, tt.ws), netip.MustParseAddr("127.0.0.1"))
+			require.NoError(t, err)
+			defer client.Close()
+			clientRx := listenTCPTest(client.TCPConn)
+
+			if tt.ep != nil {
+				client.SetEndpoints(func(addr netip.AddrPort) (udp.StreamEndpoint, bool) {
+					return *tt.ep, addr == tt.addr
+				})
+			}
+
+			assert.NoError(t, client.WriteTo(nebulaTestPacket("hello"), tt.addr))
+			assert.NoError(t, client.WriteTo(make([]byte, udp.MTU), tt.addr))
+
+			p := readTCPTest(t, tt.rx)
+			assert.Equal(t, nebulaTestPacket("hello"), p.b)
+			assert.Len(t, readTCPTest(t, tt.rx).b, udp.MTU)
+
+			if tt.server != nil {
+				// Replies go back over the stream the client dialed
+				assert.NoError(t, tt.server.WriteTo([]byte("hi"), p.addr))
+				assert.Equal(t, tcpTestPacket{addr: tt.addr, b: []byte("hi")}, readTCPTest(t, clientRx))
+			}
+		})
+	}
+
+	assert.Equal(t, int32(1), proxied.Load(), "only the proxy test went through the proxy")
+}
+
+// listenConnectProxyTest runs a minimal http proxy that only supports CONNECT with basic auth
+func listenConnectProxyTest(t *testing.T) (netip.AddrPort, *atomic.Int32) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	proxied := &atomic.Int32{}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		user, pass, ok := parseProxyAuthTest(r)
+		if !ok || user != "user" || pass != "pass" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+
+		upstream, err := net.DialTimeout("tcp", r.Host, time.Second)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		proxied.Add(1)
+
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+
+		go func() {
+			_, _ = io.Copy(upstream, buf)
+			upstream.Close()
+		}()
+		_, _ = io.Copy(conn, upstream)
+		conn.Close()
+	})}
+
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+	return ln.Addr().(*net.TCPAddr).AddrPort(), proxied
+}
+
+func parseProxyAuthTest(r *http.Request) (string, string, bool) {
+	// BasicAuth only looks at the Authorization header, borrow it for Proxy-Authorization
+	r.Header.Set("Authorization", r.Header.Get("Proxy-Authorization"))
+	return r.BasicAuth()
+}